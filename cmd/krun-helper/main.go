@@ -1,22 +1,30 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/ftechmax/krun/internal/contracts"
 	"github.com/ftechmax/krun/internal/helperipc"
+	"github.com/ftechmax/krun/internal/intercept"
+	"github.com/ftechmax/krun/internal/krun-helper/dns"
 	"github.com/ftechmax/krun/internal/krun-helper/hostfile"
+	"github.com/ftechmax/krun/internal/krun-helper/loopback"
 	managerclient "github.com/ftechmax/krun/internal/krun-helper/manager-client"
 	helperportforward "github.com/ftechmax/krun/internal/krun-helper/portforward"
+	"github.com/ftechmax/krun/internal/krun-helper/proxy"
 	"github.com/ftechmax/krun/internal/krun-helper/session"
 	helperstream "github.com/ftechmax/krun/internal/krun-helper/stream"
 	"github.com/spf13/cobra"
@@ -27,6 +35,12 @@ const (
 	defaultManagerForwardNamespace   = "krun-system"
 	defaultManagerForwardServiceName = "krun-traffic-manager"
 	defaultManagerForwardRemotePort  = 8080
+
+	resolverDNS   = "dns"
+	resolverHosts = "hosts"
+
+	proxyOff = "off"
+	proxyOn  = "on"
 )
 
 type sessionPortForwardRegistry interface {
@@ -34,12 +48,26 @@ type sessionPortForwardRegistry interface {
 	Remove(sessionKey string) error
 	Clear() error
 	BoundLocalPort(sessionKey string, forward contracts.PortForward) (int, bool)
+	HeadlessMembers(namespace string, service string) ([]helperportforward.Member, error)
 }
 
 type sessionStreamRegistry interface {
-	Upsert(sessionKey string, sessionID string, sessionToken string, interceptPort int) error
+	Upsert(sessionKey string, sessionID string, sessionToken string, ports []contracts.PortMapping, leaseTTL time.Duration, holdTimeout time.Duration) error
 	Remove(sessionKey string) error
 	Clear() error
+	SupersededBy(sessionKey string) (string, bool)
+}
+
+type sessionUDPRegistry interface {
+	Upsert(sessionKey string, sessionID string, sessionToken string, forwards []contracts.PortForward) error
+	Remove(sessionKey string) error
+	Clear() error
+}
+
+// nameResolver publishes the dependency names in place of the hosts file.
+type nameResolver interface {
+	Update(entries []contracts.HostsEntry) error
+	Close() error
 }
 
 type noopPortForwardRegistry struct{}
@@ -50,25 +78,47 @@ func (noopPortForwardRegistry) Clear() error
 func (noopPortForwardRegistry) BoundLocalPort(_ string, _ contracts.PortForward) (int, bool) {
 	return 0, false
 }
+func (noopPortForwardRegistry) HeadlessMembers(_ string, _ string) ([]helperportforward.Member, error) {
+	return nil, nil
+}
 
 type noopStreamRegistry struct{}
 
-func (noopStreamRegistry) Upsert(_ string, _ string, _ string, _ int) error { return nil }
-func (noopStreamRegistry) Remove(_ string) error                            { return nil }
-func (noopStreamRegistry) Clear() error                                     { return nil }
+func (noopStreamRegistry) Upsert(_ string, _ string, _ string, _ []contracts.PortMapping, _ time.Duration, _ time.Duration) error {
+	return nil
+}
+func (noopStreamRegistry) Remove(_ string) error                { return nil }
+func (noopStreamRegistry) Clear() error                         { return nil }
+func (noopStreamRegistry) SupersededBy(_ string) (string, bool) { return "", false }
+
+type noopUDPRegistry struct{}
+
+func (noopUDPRegistry) Upsert(_ string, _ string, _ string, _ []contracts.PortForward) error {
+	return nil
+}
+func (noopUDPRegistry) Remove(_ string) error { return nil }
+func (noopUDPRegistry) Clear() error          { return nil }
 
 var (
+	// hostfileUpdate and hostfileRemove publish the dependency names; they
+	// switch to the DNS resolver when it runs.
 	hostfileUpdate                                     = hostfile.Update
 	hostfileRemove                                     = hostfile.Remove
 	hostsRegistry                                      = hostfile.NewSessionHostsRegistry()
+	loopbackAllocator                                  = loopback.NewAllocator()
 	sessionsRegistry                                   = session.NewDebugSessionRegistry()
 	managerSessionsRegistry                            = session.NewManagerSessionRegistry()
 	portForwardRegistry     sessionPortForwardRegistry = noopPortForwardRegistry{}
 	streamRegistry          sessionStreamRegistry      = noopStreamRegistry{}
+	udpRegistry             sessionUDPRegistry         = noopUDPRegistry{}
 	managerSessionClient    managerclient.SessionAPI   = managerclient.NoopSessionClient{}
 	newPortForwardRegistry                             = newHelperPortForwardRegistry
 	newManagerClient                                   = managerclient.NewSessionClient
 	newStreamRegistry                                  = newHelperStreamRegistry
+	newUDPRegistry                                     = newHelperUDPRegistry
+	startDNSResolver                                   = startHelperDNSResolver
+	// helperProxy is the SOCKS5/HTTP proxy to cluster services, when it runs.
+	helperProxy *proxy.Server
 )
 
 func newHelperPortForwardRegistry(kubeConfigPath string) (sessionPortForwardRegistry, error) {
@@ -79,15 +129,25 @@ func newHelperStreamRegistry(managerAddress string) sessionStreamRegistry {
 	return helperstream.NewSessionRegistry(managerAddress)
 }
 
+func newHelperUDPRegistry(managerAddress string) sessionUDPRegistry {
+	return helperstream.NewUDPRegistry(managerAddress)
+}
+
+func startHelperDNSResolver(address string) (nameResolver, error) {
+	return dns.Start(address)
+}
+
 func main() {
 	var kubeConfigPath string
 	var socketEndpoint string
+	var resolverMode string
+	var proxyAddress string
 
 	rootCmd := &cobra.Command{
 		Use:   "krun-helper",
 		Short: "Elevated daemon helper for krun debug sessions",
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := startHelperDaemon(socketEndpoint, kubeConfigPath); err != nil {
+			if err := startHelperDaemon(socketEndpoint, kubeConfigPath, resolverMode, proxyAddress); err != nil {
 				fmt.Printf("helper daemon failed: %v\n", err)
 				os.Exit(1)
 			}
@@ -96,6 +156,8 @@ func main() {
 
 	rootCmd.Flags().StringVar(&kubeConfigPath, "kubeconfig", "", "Path to kubeconfig file")
 	rootCmd.Flags().StringVar(&socketEndpoint, "socket", "", "IPC endpoint override (unix socket path / named pipe name)")
+	rootCmd.Flags().StringVar(&resolverMode, "resolver", resolverDNS, "How dependency names resolve: dns (embedded DNS server) or hosts (hosts file)")
+	rootCmd.Flags().StringVar(&proxyAddress, "proxy", proxyOff, "Address of the SOCKS5/HTTP proxy to cluster services, on for "+proxy.DefaultAddress+", or off")
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -103,11 +165,15 @@ func main() {
 	}
 }
 
-func startHelperDaemon(socketEndpoint string, kubeConfigPath string) error {
+func startHelperDaemon(socketEndpoint string, kubeConfigPath string, resolverMode string, proxyAddress string) error {
 	endpoint := strings.TrimSpace(socketEndpoint)
 	if endpoint == "" {
 		endpoint = helperipc.DefaultEndpoint
 	}
+	resolverMode = strings.ToLower(strings.TrimSpace(resolverMode))
+	if resolverMode != resolverDNS && resolverMode != resolverHosts {
+		return fmt.Errorf("invalid resolver %q: must be %q or %q", resolverMode, resolverDNS, resolverHosts)
+	}
 
 	registry, err := newPortForwardRegistry(kubeConfigPath)
 	if err != nil {
@@ -135,6 +201,7 @@ func startHelperDaemon(socketEndpoint string, kubeConfigPath string) error {
 	fmt.Printf("manager api forwarded to %s\n", managerForwardAddress)
 
 	streamRegistry = newStreamRegistry("http://" + managerForwardAddress)
+	udpRegistry = newUDPRegistry("http://" + managerForwardAddress)
 
 	managerClient, err := newManagerClient(kubeConfigPath)
 	if err != nil {
@@ -148,6 +215,12 @@ func startHelperDaemon(socketEndpoint string, kubeConfigPath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on helper endpoint: %w", err)
 	}
+	// Only now: a second helper must not take the names over from the
+	// one already listening.
+	if resolverMode == resolverDNS {
+		useDNSResolver()
+	}
+	useProxy(proxyAddress)
 
 	server := &http.Server{
 		Handler: newHandler(shutdownCh),
@@ -192,6 +265,46 @@ func startHelperDaemon(socketEndpoint string, kubeConfigPath string) error {
 	}
 }
 
+// useDNSResolver publishes the dependency names through the embedded DNS
+// resolver. When it cannot start, for example because port 53 is taken,
+// the names stay in the hosts file.
+func useDNSResolver() {
+	resolver, err := startDNSResolver(dns.DefaultAddress)
+	if err != nil {
+		fmt.Printf("dns resolver unavailable, using the hosts file: %v\n", err)
+		return
+	}
+	// A hosts-file helper that crashed left its block behind.
+	if err := hostfileRemove(); err != nil {
+		fmt.Printf("warning: could not remove stale hosts entries: %v\n", err)
+	}
+	hostfileUpdate = resolver.Update
+	hostfileRemove = resolver.Close
+	fmt.Printf("dns resolver listening on %s\n", dns.DefaultAddress)
+}
+
+// useProxy serves the SOCKS5/HTTP proxy on address, "on" standing for
+// proxy.DefaultAddress. It is off unless asked for: it has no
+// authentication, so every local process could reach the cluster with the
+// helper's kubeconfig through it. The proxy is a convenience: when the
+// address is taken the helper runs without it.
+func useProxy(address string) {
+	address = strings.TrimSpace(address)
+	if address == "" || strings.EqualFold(address, proxyOff) {
+		return
+	}
+	if strings.EqualFold(address, proxyOn) {
+		address = proxy.DefaultAddress
+	}
+	server := proxy.NewServer(proxy.NewClusterDialer(portForwardRegistry).Dial)
+	if err := server.Listen(address); err != nil {
+		fmt.Printf("proxy unavailable: %v\n", err)
+		return
+	}
+	helperProxy = server
+	fmt.Printf("proxy listening on %s\n", server.Addr())
+}
+
 func newHandler(shutdownCh chan<- struct{}) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", handleHealthz)
@@ -285,8 +398,28 @@ func handleDebugEnable(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	// 1. update hostfile
-	entries := buildDebugHostEntries(req.Context)
+	if err := validateDependencyProtocols(req.Context); err != nil {
+		writeJSON(w, http.StatusBadRequest, contracts.HelperResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	// 1. give every dependency its own loopback address
+	endpoints := buildDependencyEndpoints(req.Context)
+	addresses, err := assignLoopbackAddresses(sessionKey, endpoints)
+	if err != nil {
+		fail(w, "loopback address assignment failed", err)
+		return
+	}
+	rollbacks = append(rollbacks, func() error {
+		loopbackAllocator.Release(sessionKey)
+		return nil
+	})
+
+	// 2. update hostfile
+	entries := buildDebugHostEntries(endpoints, addresses)
 	mergedEntries := hostsRegistry.Upsert(sessionKey, entries)
 	if err := hostfileUpdate(mergedEntries); err != nil {
 		fail(w, "hostfile update failed", err)
@@ -297,8 +430,8 @@ func handleDebugEnable(w http.ResponseWriter, r *http.Request) {
 		return hostfileUpdate(restored)
 	})
 
-	// 2. set up port-forwards
-	forwards := buildDebugPortForwards(req.Context)
+	// 3. set up port-forwards; UDP ones wait for the manager session
+	forwards, udpForwards := splitUDPForwards(buildDebugPortForwards(endpoints, addresses))
 	if err := portForwardRegistry.Upsert(sessionKey, forwards); err != nil {
 		fail(w, "port-forward update failed", err)
 		return
@@ -307,16 +440,21 @@ func handleDebugEnable(w http.ResponseWriter, r *http.Request) {
 		return portForwardRegistry.Remove(sessionKey)
 	})
 
-	// 3. clean up previous manager session if one exists for this key
+	// 4. clean up previous manager session if one exists for this key
 	if previousManagerSessionID, ok := managerSessionsRegistry.Get(sessionKey); ok {
 		_ = streamRegistry.Remove(sessionKey)
+		_ = udpRegistry.Remove(sessionKey)
 		_ = managerSessionClient.DeleteSession(previousManagerSessionID)
 		managerSessionsRegistry.Remove(sessionKey)
 	}
 
-	// 4. create manager session
-	managerSession, err := managerSessionClient.CreateSession(req.Context)
+	// 5. create manager session
+	managerSession, err := managerSessionClient.CreateSession(req.Context, udpTargets(udpForwards))
 	if err != nil {
+		if errors.Is(err, managerclient.ErrSessionConflict) {
+			fail(w, "manager session create failed (use --force to take it over)", err)
+			return
+		}
 		fail(w, "manager session create failed", err)
 		return
 	}
@@ -324,19 +462,32 @@ func handleDebugEnable(w http.ResponseWriter, r *http.Request) {
 		return managerSessionClient.DeleteSession(managerSession.SessionID)
 	})
 
-	// 5. attach traffic stream
-	if err := streamRegistry.Upsert(sessionKey, managerSession.SessionID, managerSession.SessionToken, req.Context.InterceptPort); err != nil {
+	// 6. attach traffic stream
+	leaseTTL := time.Duration(managerSession.LeaseTTLSeconds) * time.Second
+	holdTimeout := time.Duration(max(req.Context.InterceptHoldSeconds, 0)) * time.Second
+	if err := streamRegistry.Upsert(sessionKey, managerSession.SessionID, managerSession.SessionToken, intercept.ContextPorts(req.Context), leaseTTL, holdTimeout); err != nil {
 		fail(w, "manager stream attach failed", err)
 		return
 	}
+	rollbacks = append(rollbacks, func() error {
+		return streamRegistry.Remove(sessionKey)
+	})
+
+	// 7. relay UDP dependencies through the manager
+	if err := udpRegistry.Upsert(sessionKey, managerSession.SessionID, managerSession.SessionToken, udpForwards); err != nil {
+		fail(w, "udp forward update failed", err)
+		return
+	}
 
 	// register the session.
+	req.Context.InterceptStrategy = managerSession.InterceptStrategy
 	managerSessionsRegistry.Upsert(sessionKey, managerSession.SessionID)
 	sessionsRegistry.Upsert(sessionKey, req.Context)
 
 	writeJSON(w, http.StatusOK, contracts.HelperResponse{
 		Success: true,
 		Message: "debug enable applied",
+		Session: &contracts.HelperDebugSession{SessionKey: sessionKey, Context: req.Context},
 	})
 }
 
@@ -382,7 +533,13 @@ func handleDebugDisable(w http.ResponseWriter, r *http.Request) {
 
 	managerSessionID, ok := managerSessionsRegistry.Get(sessionKey)
 	if !ok {
-		resolvedManagerSessionID, resolveErr := resolveManagerSessionIDForDisable(req.Context)
+		// The enabled context carries the intercept headers that tell this
+		// helper's session apart from teammates sharing the workload.
+		lookupContext := req.Context
+		if enabledContext, found := sessionsRegistry.Get(sessionKey); found {
+			lookupContext = enabledContext
+		}
+		resolvedManagerSessionID, resolveErr := resolveManagerSessionIDForDisable(lookupContext)
 		if resolveErr != nil {
 			failures = append(failures, fmt.Sprintf("manager session lookup failed: %v", resolveErr))
 		} else if strings.TrimSpace(resolvedManagerSessionID) != "" {
@@ -398,6 +555,10 @@ func handleDebugDisable(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if err := udpRegistry.Remove(sessionKey); err != nil {
+		failures = append(failures, fmt.Sprintf("udp forward remove failed: %v", err))
+	}
+
 	if err := portForwardRegistry.Remove(sessionKey); err != nil {
 		failures = append(failures, fmt.Sprintf("port-forward remove failed: %v", err))
 	}
@@ -416,6 +577,7 @@ func handleDebugDisable(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionsRegistry.Remove(sessionKey)
+	loopbackAllocator.Release(sessionKey)
 	if !managerDeleteFailed {
 		managerSessionsRegistry.Remove(sessionKey)
 	}
@@ -435,8 +597,14 @@ func handleDebugSessionsList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sessions := sessionsRegistry.List()
+	for index := range sessions {
+		if newOwner, superseded := streamRegistry.SupersededBy(sessions[index].SessionKey); superseded {
+			sessions[index].SupersededBy = newOwner
+		}
+	}
 	writeJSONAny(w, http.StatusOK, contracts.HelperDebugSessionsResponse{
-		Sessions: sessionsRegistry.List(),
+		Sessions: sessions,
 	})
 }
 
@@ -451,13 +619,23 @@ func writeJSONAny(w http.ResponseWriter, code int, payload any) {
 }
 
 func cleanupHelperState() error {
+	if helperProxy != nil {
+		if err := helperProxy.Close(); err != nil {
+			fmt.Printf("warning: close proxy: %v\n", err)
+		}
+		helperProxy = nil
+	}
 	if err := streamRegistry.Clear(); err != nil {
 		return fmt.Errorf("clear streams: %w", err)
 	}
+	if err := udpRegistry.Clear(); err != nil {
+		return fmt.Errorf("clear udp forwards: %w", err)
+	}
 	if err := portForwardRegistry.Clear(); err != nil {
 		return fmt.Errorf("clear port-forwards: %w", err)
 	}
 	hostsRegistry.Clear()
+	loopbackAllocator.Clear()
 	sessionsRegistry.Clear()
 	managerSessionsRegistry.Clear()
 	if err := hostfileRemove(); err != nil {
@@ -486,7 +664,19 @@ func resolveManagerSessionIDForDisable(ctx contracts.DebugServiceContext) (strin
 		if managerclient.NormalizeNamespace(managerSession.Namespace) != targetNamespace {
 			continue
 		}
-		if strings.TrimSpace(managerSession.ClientID) != managerclient.ManagerClientID {
+		// Sessions from before the helper had its own client id carry the
+		// shared legacy one; the hostname check below still applies.
+		if clientID := strings.TrimSpace(managerSession.ClientID); clientID != managerSessionClient.ClientID() && clientID != managerclient.LegacyClientID {
+			continue
+		}
+		// Never delete a session another machine took over.
+		if hostname := strings.TrimSpace(managerSession.Hostname); hostname != "" && hostname != managerclient.LocalHostname() {
+			continue
+		}
+		if !intercept.EqualHeaders(managerSession.InterceptHeaders, ctx.InterceptHeaders) {
+			continue
+		}
+		if intercept.IsMirror(managerSession.Mode) != intercept.IsMirror(ctx.Mode) {
 			continue
 		}
 		if strings.Compare(strings.TrimSpace(managerSession.CreatedAt), strings.TrimSpace(matched.CreatedAt)) > 0 {
@@ -531,75 +721,224 @@ func resolveDebugSessionKey(sessionKey string, project string, serviceName strin
 	}
 }
 
-func buildDebugHostEntries(ctx contracts.DebugServiceContext) []contracts.HostsEntry {
-	entries := make([]contracts.HostsEntry, 0, len(ctx.ServiceDependencies))
-	indexByHost := map[string]int{}
+// dependencyEndpoint is what one loopback address of a session leads to:
+// a service, or a single pod of it, on a port, and the names resolving to
+// it.
+type dependencyEndpoint struct {
+	namespace string
+	service   string
+	pod       string
+	// protocol is contracts.ProtocolUDP, or empty for TCP.
+	protocol string
+	port     int
+	hosts    []string
+}
+
+// key identifies the service or pod behind the endpoint, so it keeps a
+// single address across hosts and ports.
+func (e dependencyEndpoint) key() string {
+	if e.pod == "" {
+		return e.namespace + "/" + e.service
+	}
+	return e.namespace + "/" + e.service + "/" + e.pod
+}
 
-	addHost := func(host string) {
-		host = strings.TrimSpace(host)
-		if host == "" {
+// buildDependencyEndpoints splits the dependencies into endpoints. A
+// dependency with a pod, a host or alias naming a pod
+// (<pod>.<service>.<namespace>.svc) and each member of a headless service
+// get their own endpoint; everything else shares the service's.
+func buildDependencyEndpoints(ctx contracts.DebugServiceContext) []dependencyEndpoint {
+	var endpoints []dependencyEndpoint
+	indexByTarget := map[string]int{}
+
+	add := func(endpoint dependencyEndpoint, host string) {
+		if endpoint.service == "" && endpoint.pod == "" {
 			return
 		}
-		entry := contracts.HostsEntry{
-			IP:       "127.0.0.1",
-			Hostname: host,
+		target := fmt.Sprintf("%s|%s|%d", endpoint.key(), endpoint.protocol, endpoint.port)
+		index, ok := indexByTarget[target]
+		if !ok {
+			index = len(endpoints)
+			indexByTarget[target] = index
+			endpoints = append(endpoints, endpoint)
 		}
-		if idx, ok := indexByHost[host]; ok {
-			entries[idx] = entry
-			return
+		if host = strings.TrimSpace(host); host != "" && !slices.Contains(endpoints[index].hosts, host) {
+			endpoints[index].hosts = append(endpoints[index].hosts, host)
 		}
-		indexByHost[host] = len(entries)
-		entries = append(entries, entry)
 	}
 
 	for _, dependency := range ctx.ServiceDependencies {
-		addHost(dependency.Host)
+		serviceName, namespace := dependencyServiceTarget(dependency)
+		base := dependencyEndpoint{
+			namespace: namespace,
+			service:   serviceName,
+			pod:       strings.TrimSpace(dependency.Pod),
+			port:      dependency.Port,
+		}
+		if dependencyProtocol(dependency) == contracts.ProtocolUDP {
+			base.protocol = contracts.ProtocolUDP
+		}
+		if pod, memberService, memberNamespace, ok := podHostTarget(dependency.Host); ok && base.pod == "" {
+			base.namespace, base.service, base.pod = memberNamespace, memberService, pod
+		}
+		add(base, dependency.Host)
+
 		for _, alias := range dependency.Aliases {
-			addHost(alias)
+			if pod, memberService, memberNamespace, ok := podHostTarget(alias); ok {
+				add(dependencyEndpoint{namespace: memberNamespace, service: memberService, pod: pod, protocol: base.protocol, port: base.port}, alias)
+				continue
+			}
+			add(base, alias)
+		}
+
+		// The manager sends UDP to the service name, which a headless
+		// service already answers with its members.
+		if base.pod != "" || base.port <= 0 || base.protocol == contracts.ProtocolUDP {
+			continue
+		}
+		members, err := portForwardRegistry.HeadlessMembers(base.namespace, base.service)
+		if err != nil {
+			fmt.Printf("warning: list members of %s/%s: %v\n", base.namespace, base.service, err)
+			continue
+		}
+		for _, member := range members {
+			memberHost := fmt.Sprintf("%s.%s.%s.svc", member.Hostname, base.service, base.namespace)
+			add(dependencyEndpoint{namespace: base.namespace, service: base.service, pod: member.Pod, protocol: base.protocol, port: base.port}, memberHost)
 		}
 	}
-	return entries
+	return endpoints
 }
 
-func buildDebugPortForwards(ctx contracts.DebugServiceContext) []contracts.PortForward {
-	forwards := make([]contracts.PortForward, 0, len(ctx.ServiceDependencies))
-	seen := map[string]bool{}
+// podHostTarget splits a name of the form <pod>.<service>.<namespace>.svc,
+// optionally ending in .cluster.local, as a headless service gives its
+// members. The first label is taken as the pod name, which is what
+// StatefulSet pods use as their hostname.
+func podHostTarget(host string) (string, string, string, bool) {
+	host = strings.TrimSpace(host)
+	if parsedHost, _, err := net.SplitHostPort(host); err == nil {
+		host = parsedHost
+	}
+	host = strings.TrimSuffix(strings.TrimSuffix(host, "."), ".cluster.local")
+	prefix, ok := strings.CutSuffix(host, ".svc")
+	if !ok {
+		return "", "", "", false
+	}
+	labels := strings.Split(prefix, ".")
+	if len(labels) != 3 || slices.Contains(labels, "") {
+		return "", "", "", false
+	}
+	return labels[0], labels[1], labels[2], true
+}
 
-	appendForward := func(forward contracts.PortForward) {
-		namespace := strings.TrimSpace(forward.Namespace)
-		serviceName := strings.TrimSpace(forward.Service)
-		if namespace == "" {
-			namespace = "default"
+// assignLoopbackAddresses reserves a loopback address for every service
+// or pod the session depends on. Dependencies on the same port then bind
+// side by side instead of colliding on 127.0.0.1.
+func assignLoopbackAddresses(sessionKey string, endpoints []dependencyEndpoint) (map[string]string, error) {
+	keys := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if key := endpoint.key(); !slices.Contains(keys, key) {
+			keys = append(keys, key)
 		}
-		if serviceName == "" || forward.LocalPort <= 0 || forward.RemotePort <= 0 {
-			return
+	}
+
+	assigned, err := loopbackAllocator.Assign(sessionKey, keys)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make(map[string]string, len(assigned))
+	for key, address := range assigned {
+		addresses[key] = address.String()
+	}
+	return addresses, nil
+}
+
+func endpointLoopbackAddress(addresses map[string]string, endpoint dependencyEndpoint) string {
+	return cmp.Or(addresses[endpoint.key()], "127.0.0.1")
+}
+
+func buildDebugHostEntries(endpoints []dependencyEndpoint, addresses map[string]string) []contracts.HostsEntry {
+	entries := make([]contracts.HostsEntry, 0, len(endpoints))
+	indexByHost := map[string]int{}
+
+	for _, endpoint := range endpoints {
+		entry := contracts.HostsEntry{IP: endpointLoopbackAddress(addresses, endpoint)}
+		for _, host := range endpoint.hosts {
+			entry.Hostname = host
+			if idx, ok := indexByHost[host]; ok {
+				entries[idx] = entry
+				continue
+			}
+			indexByHost[host] = len(entries)
+			entries = append(entries, entry)
 		}
+	}
+	return entries
+}
 
-		normalized := contracts.PortForward{
-			Namespace:  namespace,
-			Service:    serviceName,
-			LocalPort:  forward.LocalPort,
-			RemotePort: forward.RemotePort,
+func buildDebugPortForwards(endpoints []dependencyEndpoint, addresses map[string]string) []contracts.PortForward {
+	forwards := make([]contracts.PortForward, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if endpoint.port <= 0 {
+			continue
 		}
-		key := fmt.Sprintf("%s|%s|%d|%d", normalized.Namespace, normalized.Service, normalized.LocalPort, normalized.RemotePort)
-		if seen[key] {
-			return
+		forwards = append(forwards, contracts.PortForward{
+			Namespace:    endpoint.namespace,
+			Service:      endpoint.service,
+			Pod:          endpoint.pod,
+			Protocol:     endpoint.protocol,
+			LocalAddress: endpointLoopbackAddress(addresses, endpoint),
+			LocalPort:    endpoint.port,
+			RemotePort:   endpoint.port,
+		})
+	}
+	return forwards
+}
+
+// splitUDPForwards separates the forwards relayed through the manager from
+// the ones port-forwarded directly.
+func splitUDPForwards(forwards []contracts.PortForward) ([]contracts.PortForward, []contracts.PortForward) {
+	var tcpForwards, udpForwards []contracts.PortForward
+	for _, forward := range forwards {
+		if forward.Protocol == contracts.ProtocolUDP {
+			udpForwards = append(udpForwards, forward)
+			continue
 		}
-		seen[key] = true
-		forwards = append(forwards, normalized)
+		tcpForwards = append(tcpForwards, forward)
 	}
+	return tcpForwards, udpForwards
+}
 
-	for _, dependency := range ctx.ServiceDependencies {
-		serviceName, namespace := dependencyServiceTarget(dependency)
-		appendForward(contracts.PortForward{
-			Namespace:  namespace,
-			Service:    serviceName,
-			LocalPort:  dependency.Port,
-			RemotePort: dependency.Port,
-		})
+// udpTargets declares the UDP forwards to the manager, which relays to
+// nothing else for the session.
+func udpTargets(forwards []contracts.PortForward) []contracts.UDPTarget {
+	var targets []contracts.UDPTarget
+	for _, forward := range forwards {
+		target := contracts.UDPTarget{Namespace: forward.Namespace, Service: forward.Service, Pod: forward.Pod, Port: forward.RemotePort}
+		if !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
 	}
+	return targets
+}
 
-	return forwards
+func dependencyProtocol(dependency contracts.DebugServiceDependencyContext) string {
+	return cmp.Or(strings.ToLower(strings.TrimSpace(dependency.Protocol)), contracts.ProtocolTCP)
+}
+
+// validateDependencyProtocols rejects what the UDP relay cannot serve
+// before anything is set up: the manager reaches pods by name only.
+func validateDependencyProtocols(ctx contracts.DebugServiceContext) error {
+	for _, dependency := range ctx.ServiceDependencies {
+		name := cmp.Or(dependency.Host, dependency.Service)
+		protocol := dependencyProtocol(dependency)
+		if protocol != contracts.ProtocolTCP && protocol != contracts.ProtocolUDP {
+			return fmt.Errorf("invalid payload: dependency %q: protocol %q must be %q or %q", name, dependency.Protocol, contracts.ProtocolTCP, contracts.ProtocolUDP)
+		}
+		if _, err := strconv.Atoi(strings.TrimSpace(dependency.Pod)); err == nil && protocol == contracts.ProtocolUDP {
+			return fmt.Errorf("invalid payload: dependency %q: udp dependencies take a pod name, not an ordinal", name)
+		}
+	}
+	return nil
 }
 
 func dependencyServiceTarget(dependency contracts.DebugServiceDependencyContext) (string, string) {
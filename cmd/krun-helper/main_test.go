@@ -4,14 +4,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"slices"
 	"testing"
+	"time"
 
 	"github.com/ftechmax/krun/internal/contracts"
 	"github.com/ftechmax/krun/internal/krun-helper/hostfile"
+	"github.com/ftechmax/krun/internal/krun-helper/loopback"
 	managerclient "github.com/ftechmax/krun/internal/krun-helper/manager-client"
+	helperportforward "github.com/ftechmax/krun/internal/krun-helper/portforward"
 	"github.com/ftechmax/krun/internal/krun-helper/session"
 )
 
@@ -20,7 +24,7 @@ func TestDebugEnableHandlerAppliesHostsAndPortForwards(t *testing.T) {
 
 	fakeRegistry := &fakePortForwardRegistry{}
 	portForwardRegistry = fakeRegistry
-	fakeManager := &fakeManagerSessionClient{createSessionID: "mgr-session-1"}
+	fakeManager := &fakeManagerSessionClient{createSessionID: "mgr-session-1", createStrategy: contracts.InterceptStrategyAfterLinkerdProxy}
 	managerSessionClient = fakeManager
 	fakeStreams := &fakeStreamRegistry{}
 	streamRegistry = fakeStreams
@@ -40,9 +44,15 @@ func TestDebugEnableHandlerAppliesHostsAndPortForwards(t *testing.T) {
 			ServiceName:   "awesome-app3-worker",
 			ContainerPort: 8080,
 			InterceptPort: 5001,
+			Ports: []contracts.DebugServicePortContext{
+				{ContainerPort: 8080, InterceptPort: 5001},
+				{ContainerPort: 9090, InterceptPort: 5002},
+			},
 			ServiceDependencies: []contracts.DebugServiceDependencyContext{
 				{Host: "rabbitmq.default.svc", Port: 5672},
 			},
+			LeaseTTLSeconds:      600,
+			InterceptHoldSeconds: 20,
 		},
 	})
 
@@ -53,6 +63,13 @@ func TestDebugEnableHandlerAppliesHostsAndPortForwards(t *testing.T) {
 	if rec.Code != http.StatusOK {
 		t.Fatalf("expected status 200, got %d", rec.Code)
 	}
+	var response contracts.HelperResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode enable response: %v", err)
+	}
+	if response.Session == nil || response.Session.Context.InterceptStrategy != contracts.InterceptStrategyAfterLinkerdProxy {
+		t.Fatalf("expected the manager's intercept strategy reported, got %+v", response.Session)
+	}
 	if len(updatedEntries) != 1 || updatedEntries[0].Hostname != "rabbitmq.default.svc" {
 		t.Fatalf("unexpected hosts entries: %+v", updatedEntries)
 	}
@@ -74,8 +91,14 @@ func TestDebugEnableHandlerAppliesHostsAndPortForwards(t *testing.T) {
 	if fakeStreams.lastSessionID != "mgr-session-1" {
 		t.Fatalf("unexpected stream session id %q", fakeStreams.lastSessionID)
 	}
-	if fakeStreams.lastInterceptPort != 5001 {
-		t.Fatalf("unexpected stream intercept port %d", fakeStreams.lastInterceptPort)
+	if len(fakeStreams.lastPorts) != 2 || fakeStreams.lastPorts[0].LocalPort != 5001 || fakeStreams.lastPorts[1] != (contracts.PortMapping{ServicePort: 9090, LocalPort: 5002}) {
+		t.Fatalf("unexpected stream intercept ports %v", fakeStreams.lastPorts)
+	}
+	if fakeStreams.lastLeaseTTL != 10*time.Minute {
+		t.Fatalf("unexpected stream lease ttl %s", fakeStreams.lastLeaseTTL)
+	}
+	if fakeStreams.lastHoldTimeout != 20*time.Second {
+		t.Fatalf("unexpected stream hold timeout %s", fakeStreams.lastHoldTimeout)
 	}
 
 	listReq := httptest.NewRequest(http.MethodGet, "/v1/debug/sessions", nil)
@@ -107,6 +130,213 @@ func TestDebugEnableHandlerAppliesHostsAndPortForwards(t *testing.T) {
 	}
 }
 
+func TestDebugEnableHandlerSeparatesSamePortDependencies(t *testing.T) {
+	resetHelperGlobals(t)
+
+	fakeRegistry := &fakePortForwardRegistry{}
+	portForwardRegistry = fakeRegistry
+	managerSessionClient = &fakeManagerSessionClient{createSessionID: "mgr-session-1"}
+	streamRegistry = &fakeStreamRegistry{}
+
+	originalUpdate := hostfileUpdate
+	var updatedEntries []contracts.HostsEntry
+	hostfileUpdate = func(entries []contracts.HostsEntry) error {
+		updatedEntries = append([]contracts.HostsEntry(nil), entries...)
+		return nil
+	}
+	t.Cleanup(func() { hostfileUpdate = originalUpdate })
+
+	handler := newHandler(make(chan struct{}, 1))
+	body, _ := json.Marshal(contracts.DebugSessionCommandRequest{
+		Context: contracts.DebugServiceContext{
+			Project:     "shop",
+			ServiceName: "orders",
+			ServiceDependencies: []contracts.DebugServiceDependencyContext{
+				{Host: "orders-db.default.svc", Port: 5432, Aliases: []string{"orders-db"}},
+				{Host: "billing-db.default.svc", Port: 5432},
+			},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/debug/enable", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	wantEntries := []contracts.HostsEntry{
+		{IP: "127.0.0.3", Hostname: "billing-db.default.svc"},
+		{IP: "127.0.0.2", Hostname: "orders-db"},
+		{IP: "127.0.0.2", Hostname: "orders-db.default.svc"},
+	}
+	if !slices.Equal(updatedEntries, wantEntries) {
+		t.Fatalf("unexpected hosts entries: %+v", updatedEntries)
+	}
+	wantForwards := []contracts.PortForward{
+		{Namespace: "default", Service: "orders-db", LocalAddress: "127.0.0.2", LocalPort: 5432, RemotePort: 5432},
+		{Namespace: "default", Service: "billing-db", LocalAddress: "127.0.0.3", LocalPort: 5432, RemotePort: 5432},
+	}
+	if !slices.Equal(fakeRegistry.lastForwards, wantForwards) {
+		t.Fatalf("unexpected forwards: %+v", fakeRegistry.lastForwards)
+	}
+
+	disableBody, _ := json.Marshal(contracts.DebugSessionCommandRequest{SessionKey: "shop/orders"})
+	disableRec := httptest.NewRecorder()
+	handler.ServeHTTP(disableRec, httptest.NewRequest(http.MethodPost, "/v1/debug/disable", bytes.NewReader(disableBody)))
+	if disableRec.Code != http.StatusOK {
+		t.Fatalf("expected disable status 200, got %d", disableRec.Code)
+	}
+	if addresses, err := loopbackAllocator.Assign("other", []string{"default/redis"}); err != nil || addresses["default/redis"].String() != "127.0.0.2" {
+		t.Fatalf("expected disable to release the addresses, got %v (%v)", addresses, err)
+	}
+}
+
+func TestDebugEnableHandlerTargetsPods(t *testing.T) {
+	resetHelperGlobals(t)
+
+	fakeRegistry := &fakePortForwardRegistry{members: map[string][]helperportforward.Member{
+		"default/mongo": {
+			{Pod: "mongodb-server-0", Hostname: "mongodb-server-0"},
+			{Pod: "mongodb-server-1", Hostname: "mongodb-server-1"},
+		},
+	}}
+	portForwardRegistry = fakeRegistry
+	managerSessionClient = &fakeManagerSessionClient{createSessionID: "mgr-session-1"}
+	streamRegistry = &fakeStreamRegistry{}
+
+	originalUpdate := hostfileUpdate
+	var updatedEntries []contracts.HostsEntry
+	hostfileUpdate = func(entries []contracts.HostsEntry) error {
+		updatedEntries = append([]contracts.HostsEntry(nil), entries...)
+		return nil
+	}
+	t.Cleanup(func() { hostfileUpdate = originalUpdate })
+
+	handler := newHandler(make(chan struct{}, 1))
+	body, _ := json.Marshal(contracts.DebugSessionCommandRequest{
+		Context: contracts.DebugServiceContext{
+			Project:     "shop",
+			ServiceName: "orders",
+			ServiceDependencies: []contracts.DebugServiceDependencyContext{
+				{Host: "mongo.default.svc", Port: 27017, Aliases: []string{"mongodb-server-0.mongo.default.svc.cluster.local"}},
+				{Host: "kafka.default.svc", Port: 9092, Pod: "2"},
+			},
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/debug/enable", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The alias and the member name of mongodb-server-0 share its forward;
+	// the service name keeps the forward to any pod.
+	wantForwards := []contracts.PortForward{
+		{Namespace: "default", Service: "mongo", LocalAddress: "127.0.0.2", LocalPort: 27017, RemotePort: 27017},
+		{Namespace: "default", Service: "mongo", Pod: "mongodb-server-0", LocalAddress: "127.0.0.3", LocalPort: 27017, RemotePort: 27017},
+		{Namespace: "default", Service: "mongo", Pod: "mongodb-server-1", LocalAddress: "127.0.0.4", LocalPort: 27017, RemotePort: 27017},
+		{Namespace: "default", Service: "kafka", Pod: "2", LocalAddress: "127.0.0.5", LocalPort: 9092, RemotePort: 9092},
+	}
+	if !slices.Equal(fakeRegistry.lastForwards, wantForwards) {
+		t.Fatalf("unexpected forwards: %+v", fakeRegistry.lastForwards)
+	}
+	wantEntries := []contracts.HostsEntry{
+		{IP: "127.0.0.5", Hostname: "kafka.default.svc"},
+		{IP: "127.0.0.2", Hostname: "mongo.default.svc"},
+		{IP: "127.0.0.3", Hostname: "mongodb-server-0.mongo.default.svc"},
+		{IP: "127.0.0.3", Hostname: "mongodb-server-0.mongo.default.svc.cluster.local"},
+		{IP: "127.0.0.4", Hostname: "mongodb-server-1.mongo.default.svc"},
+	}
+	if !slices.Equal(updatedEntries, wantEntries) {
+		t.Fatalf("unexpected hosts entries: %+v", updatedEntries)
+	}
+}
+
+func TestDebugEnableHandlerRelaysUDPDependencies(t *testing.T) {
+	resetHelperGlobals(t)
+
+	fakeRegistry := &fakePortForwardRegistry{members: map[string][]helperportforward.Member{
+		"monitoring/statsd": {{Pod: "statsd-0", Hostname: "statsd-0"}},
+	}}
+	portForwardRegistry = fakeRegistry
+	fakeManager := &fakeManagerSessionClient{createSessionID: "mgr-session-1"}
+	managerSessionClient = fakeManager
+	streamRegistry = &fakeStreamRegistry{}
+	fakeUDP := &fakeUDPRegistry{}
+	udpRegistry = fakeUDP
+
+	originalUpdate := hostfileUpdate
+	hostfileUpdate = func(_ []contracts.HostsEntry) error { return nil }
+	t.Cleanup(func() { hostfileUpdate = originalUpdate })
+
+	handler := newHandler(make(chan struct{}, 1))
+	enable := func(dependencies ...contracts.DebugServiceDependencyContext) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(contracts.DebugSessionCommandRequest{
+			Context: contracts.DebugServiceContext{Project: "shop", ServiceName: "orders", ServiceDependencies: dependencies},
+		})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/debug/enable", bytes.NewReader(body)))
+		return rec
+	}
+
+	// A service serving the same port over TCP and UDP keeps one address.
+	rec := enable(
+		contracts.DebugServiceDependencyContext{Host: "statsd.monitoring.svc", Port: 8125, Protocol: "UDP"},
+		contracts.DebugServiceDependencyContext{Host: "statsd.monitoring.svc", Port: 8125},
+	)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	wantUDP := []contracts.PortForward{
+		{Namespace: "monitoring", Service: "statsd", Protocol: contracts.ProtocolUDP, LocalAddress: "127.0.0.2", LocalPort: 8125, RemotePort: 8125},
+	}
+	if fakeUDP.upsertCalls != 1 || fakeUDP.lastSessionKey != "shop/orders" || fakeUDP.lastSessionID != "mgr-session-1" || !slices.Equal(fakeUDP.lastForwards, wantUDP) {
+		t.Fatalf("unexpected udp forwards for session %q (%q): %+v", fakeUDP.lastSessionKey, fakeUDP.lastSessionID, fakeUDP.lastForwards)
+	}
+	// The manager relays only to what the session declared.
+	if want := []contracts.UDPTarget{{Namespace: "monitoring", Service: "statsd", Port: 8125}}; !slices.Equal(fakeManager.lastUDPTargets, want) {
+		t.Fatalf("unexpected udp targets declared to the manager: %+v", fakeManager.lastUDPTargets)
+	}
+	// Headless members are expanded for the TCP dependency only.
+	wantTCP := []contracts.PortForward{
+		{Namespace: "monitoring", Service: "statsd", LocalAddress: "127.0.0.2", LocalPort: 8125, RemotePort: 8125},
+		{Namespace: "monitoring", Service: "statsd", Pod: "statsd-0", LocalAddress: "127.0.0.3", LocalPort: 8125, RemotePort: 8125},
+	}
+	if !slices.Equal(fakeRegistry.lastForwards, wantTCP) {
+		t.Fatalf("unexpected tcp forwards: %+v", fakeRegistry.lastForwards)
+	}
+
+	disableBody, _ := json.Marshal(contracts.DebugSessionCommandRequest{SessionKey: "shop/orders"})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/debug/disable", bytes.NewReader(disableBody)))
+	if rec.Code != http.StatusOK || fakeUDP.removeCalls != 1 {
+		t.Fatalf("expected disable to remove the udp forwards, got %d (%d removes)", rec.Code, fakeUDP.removeCalls)
+	}
+
+	for _, dependency := range []contracts.DebugServiceDependencyContext{
+		{Host: "statsd.monitoring.svc", Port: 8125, Protocol: "sctp"},
+		{Host: "statsd.monitoring.svc", Port: 8125, Protocol: "udp", Pod: "0"},
+	} {
+		if rec := enable(dependency); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %+v, got %d: %s", dependency, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestPodHostTarget(t *testing.T) {
+	pod, service, namespace, ok := podHostTarget("mongodb-server-0.mongo.data.svc.cluster.local")
+	if !ok || pod != "mongodb-server-0" || service != "mongo" || namespace != "data" {
+		t.Fatalf("unexpected target %q %q %q %v", pod, service, namespace, ok)
+	}
+	for _, host := range []string{"mongo.data.svc", "mongodb-server-0.mongo.data", "a.b.c.d.svc"} {
+		if _, _, _, ok := podHostTarget(host); ok {
+			t.Fatalf("expected %s not to name a pod", host)
+		}
+	}
+}
+
 func TestDebugDisableHandlerRemovesScopedState(t *testing.T) {
 	resetHelperGlobals(t)
 
@@ -199,9 +429,11 @@ func TestDebugDisableHandlerFallsBackToManagerLookup(t *testing.T) {
 	portForwardRegistry = fakeRegistry
 	fakeManager := &fakeManagerSessionClient{
 		listSessions: []contracts.DebugSession{
-			{SessionID: "other", Namespace: "default", ServiceName: "other-svc", ClientID: managerclient.ManagerClientID, CreatedAt: "2026-01-01T00:00:00Z"},
-			{SessionID: "target-1", Namespace: "default", ServiceName: "svc-a", ClientID: managerclient.ManagerClientID, CreatedAt: "2026-01-01T00:00:01Z"},
-			{SessionID: "target-2", Namespace: "default", ServiceName: "svc-a", ClientID: managerclient.ManagerClientID, CreatedAt: "2026-01-01T00:00:02Z"},
+			{SessionID: "other", Namespace: "default", ServiceName: "other-svc", ClientID: fakeClientID, CreatedAt: "2026-01-01T00:00:00Z"},
+			{SessionID: "target-1", Namespace: "default", ServiceName: "svc-a", ClientID: fakeClientID, CreatedAt: "2026-01-01T00:00:01Z"},
+			{SessionID: "target-2", Namespace: "default", ServiceName: "svc-a", ClientID: fakeClientID, CreatedAt: "2026-01-01T00:00:02Z"},
+			// Another installation on the same host, with the same user.
+			{SessionID: "colleague", Namespace: "default", ServiceName: "svc-a", ClientID: "krun-helper-other", CreatedAt: "2026-01-01T00:00:03Z"},
 		},
 	}
 	managerSessionClient = fakeManager
@@ -245,6 +477,47 @@ func TestDebugDisableHandlerFallsBackToManagerLookup(t *testing.T) {
 	}
 }
 
+func TestResolveManagerSessionIDForDisableMatchesInterceptHeaders(t *testing.T) {
+	resetHelperGlobals(t)
+
+	managerSessionClient = &fakeManagerSessionClient{
+		listSessions: []contracts.DebugSession{
+			{SessionID: "alice", Namespace: "default", ServiceName: "svc-a", ClientID: fakeClientID, CreatedAt: "2026-01-01T00:00:01Z", InterceptHeaders: map[string]string{"X-Krun-Intercept": "alice"}},
+			{SessionID: "bob", Namespace: "default", ServiceName: "svc-a", ClientID: fakeClientID, CreatedAt: "2026-01-01T00:00:02Z", InterceptHeaders: map[string]string{"X-Krun-Intercept": "bob"}},
+		},
+	}
+
+	got, err := resolveManagerSessionIDForDisable(contracts.DebugServiceContext{
+		ServiceName:      "svc-a",
+		InterceptHeaders: map[string]string{"x-krun-intercept": "alice"},
+	})
+	if err != nil {
+		t.Fatalf("resolve manager session: %v", err)
+	}
+	if got != "alice" {
+		t.Fatalf("expected the session with matching headers, got %q", got)
+	}
+}
+
+func TestResolveManagerSessionIDForDisableSkipsOtherHosts(t *testing.T) {
+	resetHelperGlobals(t)
+
+	managerSessionClient = &fakeManagerSessionClient{
+		listSessions: []contracts.DebugSession{
+			{SessionID: "mine", Namespace: "default", ServiceName: "svc-a", ClientID: fakeClientID, CreatedAt: "2026-01-01T00:00:01Z", Hostname: managerclient.LocalHostname()},
+			{SessionID: "taken-over", Namespace: "default", ServiceName: "svc-a", ClientID: fakeClientID, CreatedAt: "2026-01-01T00:00:02Z", Hostname: "someone-elses-laptop"},
+		},
+	}
+
+	got, err := resolveManagerSessionIDForDisable(contracts.DebugServiceContext{ServiceName: "svc-a"})
+	if err != nil {
+		t.Fatalf("resolve manager session: %v", err)
+	}
+	if got != "mine" {
+		t.Fatalf("expected this host's session, got %q", got)
+	}
+}
+
 func TestDebugEnableHandlerRollsBackWhenManagerCreateFails(t *testing.T) {
 	resetHelperGlobals(t)
 
@@ -377,14 +650,140 @@ func TestDebugSessionsListMethodNotAllowed(t *testing.T) {
 	}
 }
 
+func TestDebugSessionsListReportsSupersededSessions(t *testing.T) {
+	resetHelperGlobals(t)
+	sessionsRegistry.Upsert("proj-a/svc-a", contracts.DebugServiceContext{Project: "proj-a", ServiceName: "svc-a"})
+	sessionsRegistry.Upsert("proj-a/svc-b", contracts.DebugServiceContext{Project: "proj-a", ServiceName: "svc-b"})
+	streamRegistry = &fakeStreamRegistry{superseded: map[string]string{"proj-a/svc-a": "bob@bob-laptop"}}
+	handler := newHandler(make(chan struct{}, 1))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/debug/sessions", nil))
+	var response contracts.HelperDebugSessionsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode list response: %v", err)
+	}
+	if len(response.Sessions) != 2 {
+		t.Fatalf("expected two sessions, got %+v", response.Sessions)
+	}
+	for _, listed := range response.Sessions {
+		want := ""
+		if listed.SessionKey == "proj-a/svc-a" {
+			want = "bob@bob-laptop"
+		}
+		if listed.SupersededBy != want {
+			t.Fatalf("unexpected superseded_by for %s: %q", listed.SessionKey, listed.SupersededBy)
+		}
+	}
+}
+
+func TestUseDNSResolverTakesOverNames(t *testing.T) {
+	resetHelperGlobals(t)
+	t.Cleanup(func() {
+		hostfileUpdate = hostfile.Update
+		hostfileRemove = hostfile.Remove
+		startDNSResolver = startHelperDNSResolver
+	})
+
+	hostsRemoved := false
+	hostfileRemove = func() error {
+		hostsRemoved = true
+		return nil
+	}
+	resolver := &fakeNameResolver{}
+	startDNSResolver = func(string) (nameResolver, error) { return resolver, nil }
+
+	useDNSResolver()
+	if !hostsRemoved {
+		t.Fatalf("expected stale hosts entries to be removed")
+	}
+	if err := hostfileUpdate([]contracts.HostsEntry{{IP: "127.0.0.1", Hostname: "rabbitmq.default.svc"}}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if len(resolver.entries) != 1 {
+		t.Fatalf("expected the names published through the resolver, got %+v", resolver.entries)
+	}
+	if err := hostfileRemove(); err != nil || !resolver.closed {
+		t.Fatalf("expected cleanup to close the resolver, got %v", err)
+	}
+}
+
+func TestUseDNSResolverFallsBackToHostsFile(t *testing.T) {
+	resetHelperGlobals(t)
+	t.Cleanup(func() {
+		hostfileUpdate = hostfile.Update
+		startDNSResolver = startHelperDNSResolver
+	})
+	hostsUpdated := false
+	hostfileUpdate = func([]contracts.HostsEntry) error {
+		hostsUpdated = true
+		return nil
+	}
+	startDNSResolver = func(string) (nameResolver, error) { return nil, errors.New("address already in use") }
+
+	useDNSResolver()
+	if err := hostfileUpdate(nil); err != nil || !hostsUpdated {
+		t.Fatalf("expected the hosts file to stay in use, got %v", err)
+	}
+}
+
 func resetHelperGlobals(t *testing.T) {
 	t.Helper()
 	hostsRegistry = hostfile.NewSessionHostsRegistry()
+	loopbackAllocator = loopback.NewAllocator()
 	sessionsRegistry = session.NewDebugSessionRegistry()
 	managerSessionsRegistry = session.NewManagerSessionRegistry()
 	portForwardRegistry = noopPortForwardRegistry{}
 	streamRegistry = noopStreamRegistry{}
+	udpRegistry = noopUDPRegistry{}
 	managerSessionClient = managerclient.NoopSessionClient{}
+	helperProxy = nil
+}
+
+func TestUseProxyStartsOnlyWhenAsked(t *testing.T) {
+	resetHelperGlobals(t)
+	originalRemove := hostfileRemove
+	hostfileRemove = func() error { return nil }
+	t.Cleanup(func() { hostfileRemove = originalRemove })
+
+	for _, address := range []string{"", "off", "OFF"} {
+		useProxy(address)
+		if helperProxy != nil {
+			t.Fatalf("expected no proxy for %q", address)
+		}
+	}
+
+	useProxy("127.0.0.1:0")
+	if helperProxy == nil || helperProxy.Addr() == "" {
+		t.Fatalf("expected the proxy to listen")
+	}
+	address := helperProxy.Addr()
+
+	if err := cleanupHelperState(); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if helperProxy != nil {
+		t.Fatalf("expected cleanup to stop the proxy")
+	}
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Fatalf("expected the proxy port closed after cleanup")
+	}
+}
+
+type fakeNameResolver struct {
+	entries []contracts.HostsEntry
+	closed  bool
+}
+
+func (f *fakeNameResolver) Update(entries []contracts.HostsEntry) error {
+	f.entries = entries
+	return nil
+}
+
+func (f *fakeNameResolver) Close() error {
+	f.closed = true
+	return nil
 }
 
 type fakePortForwardRegistry struct {
@@ -393,6 +792,7 @@ type fakePortForwardRegistry struct {
 	clearCalls     int
 	lastSessionKey string
 	lastForwards   []contracts.PortForward
+	members        map[string][]helperportforward.Member
 }
 
 func (f *fakePortForwardRegistry) Upsert(sessionKey string, forwards []contracts.PortForward) error {
@@ -417,12 +817,18 @@ func (f *fakePortForwardRegistry) BoundLocalPort(_ string, forward contracts.Por
 	return forward.LocalPort, true
 }
 
+func (f *fakePortForwardRegistry) HeadlessMembers(namespace string, service string) ([]helperportforward.Member, error) {
+	return f.members[namespace+"/"+service], nil
+}
+
 type fakeManagerSessionClient struct {
 	createCalls          int
 	listCalls            int
 	deleteCalls          int
 	createSessionID      string
 	createSessionIDs     []string
+	createStrategy       string
+	lastUDPTargets       []contracts.UDPTarget
 	lastDeletedSessionID string
 	createErr            error
 	listErr              error
@@ -430,8 +836,9 @@ type fakeManagerSessionClient struct {
 	listSessions         []contracts.DebugSession
 }
 
-func (f *fakeManagerSessionClient) CreateSession(ctx contracts.DebugServiceContext) (contracts.DebugSession, error) {
+func (f *fakeManagerSessionClient) CreateSession(ctx contracts.DebugServiceContext, udpTargets []contracts.UDPTarget) (contracts.DebugSession, error) {
 	f.createCalls++
+	f.lastUDPTargets = udpTargets
 	if f.createErr != nil {
 		return contracts.DebugSession{}, f.createErr
 	}
@@ -446,11 +853,20 @@ func (f *fakeManagerSessionClient) CreateSession(ctx contracts.DebugServiceConte
 		sessionID = "mgr-default"
 	}
 	return contracts.DebugSession{
-		SessionID:   sessionID,
-		ServiceName: ctx.ServiceName,
+		SessionID:         sessionID,
+		ServiceName:       ctx.ServiceName,
+		LeaseTTLSeconds:   ctx.LeaseTTLSeconds,
+		InterceptStrategy: f.createStrategy,
 	}, nil
 }
 
+// fakeClientID is the helper installation's client id in tests.
+const fakeClientID = "krun-helper-test"
+
+func (f *fakeManagerSessionClient) ClientID() string {
+	return fakeClientID
+}
+
 func (f *fakeManagerSessionClient) DeleteSession(sessionID string) error {
 	f.deleteCalls++
 	f.lastDeletedSessionID = sessionID
@@ -465,22 +881,55 @@ func (f *fakeManagerSessionClient) ListSessions() ([]contracts.DebugSession, err
 	return append([]contracts.DebugSession(nil), f.listSessions...), nil
 }
 
+type fakeUDPRegistry struct {
+	upsertCalls    int
+	removeCalls    int
+	lastSessionKey string
+	lastSessionID  string
+	lastForwards   []contracts.PortForward
+}
+
+func (f *fakeUDPRegistry) Upsert(sessionKey string, sessionID string, _ string, forwards []contracts.PortForward) error {
+	f.upsertCalls++
+	f.lastSessionKey = sessionKey
+	f.lastSessionID = sessionID
+	f.lastForwards = append([]contracts.PortForward(nil), forwards...)
+	return nil
+}
+
+func (f *fakeUDPRegistry) Remove(_ string) error {
+	f.removeCalls++
+	return nil
+}
+
+func (f *fakeUDPRegistry) Clear() error { return nil }
+
 type fakeStreamRegistry struct {
-	upsertCalls       int
-	removeCalls       int
-	clearCalls        int
-	lastSessionKey    string
-	lastSessionID     string
-	lastSessionToken  string
-	lastInterceptPort int
+	upsertCalls      int
+	removeCalls      int
+	clearCalls       int
+	lastSessionKey   string
+	lastSessionID    string
+	lastSessionToken string
+	lastPorts        []contracts.PortMapping
+	lastLeaseTTL     time.Duration
+	lastHoldTimeout  time.Duration
+	superseded       map[string]string
+}
+
+func (f *fakeStreamRegistry) SupersededBy(sessionKey string) (string, bool) {
+	newOwner, ok := f.superseded[sessionKey]
+	return newOwner, ok
 }
 
-func (f *fakeStreamRegistry) Upsert(sessionKey string, sessionID string, sessionToken string, interceptPort int) error {
+func (f *fakeStreamRegistry) Upsert(sessionKey string, sessionID string, sessionToken string, ports []contracts.PortMapping, leaseTTL time.Duration, holdTimeout time.Duration) error {
 	f.upsertCalls++
 	f.lastSessionKey = sessionKey
 	f.lastSessionID = sessionID
 	f.lastSessionToken = sessionToken
-	f.lastInterceptPort = interceptPort
+	f.lastPorts = ports
+	f.lastLeaseTTL = leaseTTL
+	f.lastHoldTimeout = holdTimeout
 	return nil
 }
 
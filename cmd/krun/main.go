@@ -5,8 +5,10 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"time"
 
 	cfg "github.com/ftechmax/krun/internal/config"
+	"github.com/ftechmax/krun/internal/intercept"
 	"github.com/ftechmax/krun/internal/krun/build"
 	"github.com/ftechmax/krun/internal/krun/debug"
 	"github.com/ftechmax/krun/internal/krun/deploy"
@@ -97,6 +99,12 @@ func main() {
 		Run:   handleDebugEnable,
 	}
 	debugEnableCmd.Flags().String("container", "", "Name of the target container in the workload")
+	debugEnableCmd.Flags().Bool("mirror", false, "Copy traffic to the local app while the workload keeps serving callers")
+	debugEnableCmd.Flags().Bool("single-replica", false, "Intercept one cloned pod instead of every replica of the workload")
+	debugEnableCmd.Flags().Bool("ephemeral", false, "Attach the traffic-agent to the running pods instead of restarting them with a sidecar")
+	debugEnableCmd.Flags().StringArray("intercept-header", nil, "Only intercept HTTP requests carrying this header (name=value, repeatable)")
+	debugEnableCmd.Flags().Bool("force", false, "Take over the session if someone else is debugging the service")
+	debugEnableCmd.Flags().Duration("session-ttl", 0, "Remove the session after this long without a connected helper (default: manager setting)")
 	debugDisableCmd := &cobra.Command{
 		Use:   "disable <service>",
 		Short: "Disable debug mode for a service",
@@ -282,6 +290,25 @@ func handleDebugList(cmd *cobra.Command, args []string) {
 
 func handleDebugEnable(cmd *cobra.Command, args []string) {
 	containerName, _ := cmd.Flags().GetString("container")
+	mirror, _ := cmd.Flags().GetBool("mirror")
+	singleReplica, _ := cmd.Flags().GetBool("single-replica")
+	ephemeral, _ := cmd.Flags().GetBool("ephemeral")
+	if singleReplica && ephemeral {
+		fmt.Println(utils.Colorize("--single-replica and --ephemeral cannot be combined", utils.Red))
+		return
+	}
+	rawHeaders, _ := cmd.Flags().GetStringArray("intercept-header")
+	interceptHeaders, err := intercept.ParseHeaders(rawHeaders)
+	if err != nil {
+		fmt.Println(utils.Colorize(err.Error(), utils.Red))
+		return
+	}
+	force, _ := cmd.Flags().GetBool("force")
+	sessionTTL, _ := cmd.Flags().GetDuration("session-ttl")
+	if sessionTTL < 0 || (sessionTTL > 0 && sessionTTL < time.Second) {
+		fmt.Println(utils.Colorize("--session-ttl must be at least 1s", utils.Red))
+		return
+	}
 
 	argServiceName := args[0]
 	service := cfg.Service{}
@@ -296,7 +323,15 @@ func handleDebugEnable(cmd *cobra.Command, args []string) {
 		return
 	}
 	fmt.Printf("Enabling debug mode for service %s\n", argServiceName)
-	debug.Enable(service, config, containerName)
+	debug.Enable(service, config, debug.EnableOptions{
+		ContainerName:    containerName,
+		InterceptHeaders: interceptHeaders,
+		Mirror:           mirror,
+		SingleReplica:    singleReplica,
+		Ephemeral:        ephemeral,
+		SessionTTL:       sessionTTL,
+		Force:            force,
+	})
 }
 
 func handleDebugDisable(cmd *cobra.Command, args []string) {
@@ -10,8 +10,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/streamcodec"
 	"github.com/ftechmax/krun/internal/streamconn"
 	"github.com/ftechmax/krun/internal/wskeepalive"
 	"github.com/google/uuid"
@@ -29,32 +30,71 @@ import (
 var (
 	version = "debug" // will be set by the build system
 	agentID = uuid.NewString()
+	// connectionCounter numbers intercepted connections across all ports.
+	connectionCounter atomic.Uint64
 )
 
 const (
 	managerAddressEnv      = "KRUN_MANAGER_ADDRESS"
 	sessionIDEnv           = "KRUN_SESSION_ID"
 	sessionTokenEnv        = "KRUN_SESSION_TOKEN"
+	interceptRoutesEnv     = "KRUN_INTERCEPT_ROUTES"
 	targetPortEnv          = "KRUN_TARGET_PORT"
 	agentListenPortEnv     = "KRUN_AGENT_LISTEN_PORT"
 	agentProbePortEnv      = "KRUN_AGENT_PROBE_PORT"
+	agentEphemeralEnv      = "KRUN_AGENT_EPHEMERAL"
+	agentRedirectEnv       = "KRUN_AGENT_REDIRECT"
+	agentDiagnosticsEnv    = "KRUN_AGENT_DIAGNOSTICS"
+	agentStrategyEnv       = "KRUN_AGENT_INTERCEPT_STRATEGY"
 	defaultAgentListenPort = 8081
 	defaultAgentProbePort  = 8082
 	defaultStreamPath      = "/v1/stream/agent"
 	maxBackoff             = 10 * time.Second
 	initialBackoff         = time.Second
 	streamQueueSize        = 2048
-	connWriteTimeout       = 10 * time.Second
+	// With diagnostics on, the installed rules and their counters are
+	// logged this often.
+	diagnosticsInterval = time.Minute
+
+	// KRUN_AGENT_REDIRECT says who owns the redirect rules. By default the
+	// agent installs them on start and removes them on exit. An init
+	// container run with "init" installs them and exits; the agent next to
+	// it, run with "external", then needs no privileges. Rules installed
+	// by an init container go with the pod.
+	redirectSelf     = "self"
+	redirectInit     = "init"
+	redirectExternal = "external"
 )
 
 type runtimeConfig struct {
-	SessionID       string
-	SessionToken    string
-	ManagerAddress  string
+	ManagerAddress string
+	// TargetPort serves routes that do not list their ports; TargetPorts
+	// are all ports any route intercepts.
 	TargetPort      int
+	TargetPorts     []int
 	AgentListenPort int
 	ProbePort       int
-	StreamURL       string
+	Routes          []routeConfig
+	// Ephemeral agents run as ephemeral containers, possibly next to other
+	// agents in the pod: they listen on kernel-picked ports, put their
+	// redirect rules first, serve no probes (the injector cannot rewrite
+	// them) and exit once the manager releases their sessions.
+	Ephemeral bool
+	// Redirect is one of redirectSelf, redirectInit and redirectExternal.
+	Redirect string
+	// Diagnostics logs the redirect backend's rules and counters.
+	Diagnostics bool
+	// Strategy is the intercept strategy the manager picked, then the one
+	// the agent settled on. ProxyUID is the mesh proxy's UID behind a mesh.
+	Strategy string
+	ProxyUID int
+}
+
+// routeConfig is one session served by this agent, with the manager
+// stream it attaches to.
+type routeConfig struct {
+	contracts.InterceptRoute
+	StreamURL string
 }
 
 type reconnectingStreamClient struct {
@@ -63,16 +103,17 @@ type reconnectingStreamClient struct {
 	sendCh       chan contracts.StreamEnvelope
 	onReceive    func(contracts.StreamEnvelope)
 	onDisconnect func()
-	runCtx       context.Context
-	cancel       context.CancelFunc
-	doneCh       chan struct{}
-	once         sync.Once
-}
-
-type redirectRule struct {
-	TargetPort  int
-	ListenPort  int
-	RunIptables func(ctx context.Context, args ...string) error
+	// onConnect runs on a goroutine of its own once the stream is up, so
+	// it may queue envelopes.
+	onConnect func()
+	// onGone, when set, runs instead of a reconnect once the manager
+	// refuses the stream because the session no longer exists.
+	onGone    func()
+	runCtx    context.Context
+	cancel    context.CancelFunc
+	doneCh    chan struct{}
+	once      sync.Once
+	connected atomic.Bool
 }
 
 func main() {
@@ -87,83 +128,101 @@ func run() error {
 	if err != nil {
 		return err
 	}
+	var backend redirectBackend
+	if cfg.Redirect != redirectExternal {
+		backend, err = selectRedirectBackend(&cfg)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Redirect == redirectInit {
+		return installRedirectRules(cfg, backend)
+	}
 
 	log.Printf(
-		"krun traffic-agent %s starting (session_id=%q target_port=%d listen_port=%d manager=%q)",
+		"krun traffic-agent %s starting (routes=%s target_ports=%v listen_port=%d manager=%q ephemeral=%t strategy=%s)",
 		version,
-		cfg.SessionID,
-		cfg.TargetPort,
+		describeRoutes(cfg.Routes),
+		cfg.TargetPorts,
 		cfg.AgentListenPort,
 		cfg.ManagerAddress,
+		cfg.Ephemeral,
+		cfg.Strategy,
 	)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	connections := streamconn.NewRegistry()
-	defer connections.CloseAll()
-
-	// The manager drops connection routing for this session when the agent
-	// stream detaches (and tells the helper to close its side), so every
-	// intercepted conn from the previous epoch is dead: close them instead
-	// of streaming into the void after reconnect.
-	streamClient := newReconnectingStreamClient(ctx, cfg, nil, connections.CloseAll)
-	streamClient.onReceive = func(envelope contracts.StreamEnvelope) {
-		handleInboundEnvelope(connections, envelope, func(connectionID string) {
-			_ = streamClient.Send(ctx, cfg.newStreamEnvelope(connectionID, contracts.StreamTypeClose))
-		})
-	}
-	streamClient.start()
-	defer streamClient.Close()
-
-	rule := redirectRule{
-		TargetPort: cfg.TargetPort,
-		ListenPort: cfg.AgentListenPort,
-	}
-	if err := rule.Install(ctx); err != nil {
-		return fmt.Errorf("install redirect rule: %w", err)
-	}
-	defer func() {
-		cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cleanupCancel()
-		if err := rule.Remove(cleanupCtx); err != nil {
-			log.Printf("cleanup redirect rule failed: %v", err)
-		}
-	}()
-
-	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(cfg.AgentListenPort)))
-	if err != nil {
-		return fmt.Errorf("listen on intercept port %d: %w", cfg.AgentListenPort, err)
+	streams := make([]*routeStream, 0, len(cfg.Routes))
+	for _, route := range cfg.Routes {
+		stream := startRouteStream(ctx, route, cfg.Ephemeral)
+		defer stream.Close()
+		streams = append(streams, stream)
 	}
-	defer listener.Close()
 
-	// Kubelet probes that originally targeted the intercepted port are
+	// Kubelet probes that originally targeted an intercepted port are
 	// rewritten by the injector to point here; answering them keeps the pod
 	// Ready while the developer's local app is stopped or on a breakpoint.
-	probeServer, err := startProbeServer(cfg.ProbePort)
-	if err != nil {
-		return err
+	if !cfg.Ephemeral {
+		probeServer, err := startProbeServer(cfg.ProbePort)
+		if err != nil {
+			return err
+		}
+		defer probeServer.Close()
 	}
-	defer probeServer.Close()
 
-	var connIDCounter atomic.Uint64
-	go acceptInterceptedConnections(ctx, listener, cfg, streamClient, connections, &connIDCounter)
+	for index, targetPort := range cfg.TargetPorts {
+		listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(cfg.listenPort(index))))
+		if err != nil {
+			return fmt.Errorf("listen for target port %d: %w", targetPort, err)
+		}
+		defer listener.Close()
+
+		if cfg.Redirect == redirectSelf {
+			rule := redirectRule{
+				TargetPort: targetPort,
+				ListenPort: listener.Addr().(*net.TCPAddr).Port,
+				First:      cfg.Ephemeral,
+				ProxyUID:   cfg.ProxyUID,
+				Backend:    backend,
+			}
+			if err := rule.Install(ctx); err != nil {
+				return fmt.Errorf("install redirect rule: %w", err)
+			}
+			defer func() {
+				cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cleanupCancel()
+				if err := rule.Remove(cleanupCtx); err != nil {
+					log.Printf("cleanup redirect rule failed: %v", err)
+				}
+			}()
+		}
+
+		router := newConnectionRouter(targetPort, streamsForPort(streams, targetPort, cfg.TargetPort))
+		go acceptInterceptedConnections(ctx, listener, router)
+	}
+	if cfg.Diagnostics && cfg.Redirect == redirectSelf {
+		go reportRedirectRules(ctx, backend)
+	}
 
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
 	defer signal.Stop(signalCh)
 
-	sig := <-signalCh
-	log.Printf("received %s, shutting down traffic-agent", sig)
+	select {
+	case sig := <-signalCh:
+		log.Printf("received %s, shutting down traffic-agent", sig)
+	case <-allReleased(streams):
+		log.Printf("all sessions released, shutting down traffic-agent")
+	}
 	cancel()
-	_ = listener.Close()
 	return nil
 }
 
 func loadRuntimeConfig() (runtimeConfig, error) {
-	sessionID := strings.TrimSpace(os.Getenv(sessionIDEnv))
-	if sessionID == "" {
-		return runtimeConfig{}, fmt.Errorf("%s is required", sessionIDEnv)
+	interceptRoutes, err := loadInterceptRoutes()
+	if err != nil {
+		return runtimeConfig{}, err
 	}
 
 	managerAddress := resolveManagerAddress()
@@ -186,23 +245,169 @@ func loadRuntimeConfig() (runtimeConfig, error) {
 		return runtimeConfig{}, err
 	}
 
-	streamURL, err := buildStreamURL(managerAddress, sessionID)
-	if err != nil {
-		return runtimeConfig{}, err
+	redirect := strings.ToLower(strings.TrimSpace(os.Getenv(agentRedirectEnv)))
+	switch redirect {
+	case "":
+		redirect = redirectSelf
+	case redirectSelf, redirectInit, redirectExternal:
+	default:
+		return runtimeConfig{}, fmt.Errorf("%s must be %q, %q or %q", agentRedirectEnv, redirectSelf, redirectInit, redirectExternal)
+	}
+
+	ephemeral, _ := strconv.ParseBool(strings.TrimSpace(os.Getenv(agentEphemeralEnv)))
+	diagnostics, _ := strconv.ParseBool(strings.TrimSpace(os.Getenv(agentDiagnosticsEnv)))
+
+	strategy := strings.ToLower(strings.TrimSpace(os.Getenv(agentStrategyEnv)))
+	switch strategy {
+	case "", contracts.InterceptStrategyInbound, contracts.InterceptStrategyAfterIstioProxy, contracts.InterceptStrategyAfterLinkerdProxy:
+	default:
+		return runtimeConfig{}, fmt.Errorf("%s must be %q, %q or %q", agentStrategyEnv,
+			contracts.InterceptStrategyInbound, contracts.InterceptStrategyAfterIstioProxy, contracts.InterceptStrategyAfterLinkerdProxy)
+	}
+	if ephemeral {
+		if redirect != redirectSelf {
+			return runtimeConfig{}, fmt.Errorf("ephemeral agents install their own redirect rules (%s)", agentRedirectEnv)
+		}
+		// Other agents may share the pod's network namespace.
+		agentListenPort = 0
+	}
+
+	routes := make([]routeConfig, 0, len(interceptRoutes))
+	for _, interceptRoute := range interceptRoutes {
+		streamURL, err := buildStreamURL(managerAddress, interceptRoute.SessionID)
+		if err != nil {
+			return runtimeConfig{}, err
+		}
+		routes = append(routes, routeConfig{InterceptRoute: interceptRoute, StreamURL: streamURL})
 	}
 
 	return runtimeConfig{
-		SessionID:       sessionID,
-		SessionToken:    strings.TrimSpace(os.Getenv(sessionTokenEnv)),
 		ManagerAddress:  managerAddress,
 		TargetPort:      targetPort,
+		TargetPorts:     interceptedPorts(targetPort, routes),
 		AgentListenPort: agentListenPort,
 		ProbePort:       probePort,
-		StreamURL:       streamURL,
+		Routes:          routes,
+		Ephemeral:       ephemeral,
+		Redirect:        redirect,
+		Diagnostics:     diagnostics,
+		Strategy:        strategy,
 	}, nil
 }
 
-func (cfg runtimeConfig) newStreamEnvelope(connectionID string, envelopeType string) contracts.StreamEnvelope {
+// listenPort is where the agent listens for the index-th target port; 0
+// lets the kernel pick. An agent that installs its own rules fixes only
+// the first one. Rules of an init container are installed before the
+// agent runs, so then every port is fixed: counting up from the listen
+// port, skipping the probe port.
+func (cfg runtimeConfig) listenPort(index int) int {
+	if cfg.Redirect == redirectSelf {
+		if index == 0 {
+			return cfg.AgentListenPort
+		}
+		return 0
+	}
+	port := cfg.AgentListenPort
+	for {
+		if port != cfg.ProbePort {
+			if index == 0 {
+				return port
+			}
+			index--
+		}
+		port++
+	}
+}
+
+// selectRedirectBackend detects what the redirect rules are installed
+// with in this pod, and settles the intercept strategy of cfg.
+func selectRedirectBackend(cfg *runtimeConfig) (redirectBackend, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	backend, err := detectRedirectBackend(ctx, runCommand, hasIPv6Address())
+	if err != nil {
+		return redirectBackend{}, err
+	}
+	cfg.Strategy, cfg.ProxyUID = selectInterceptStrategy(ctx, backend, cfg.Strategy)
+	log.Printf("redirect backend %s strategy %s", backend, cfg.Strategy)
+	return backend, nil
+}
+
+// installRedirectRules is all an init container does: the agent started
+// after it listens where the rules point.
+func installRedirectRules(cfg runtimeConfig, backend redirectBackend) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for index, targetPort := range cfg.TargetPorts {
+		rule := redirectRule{
+			TargetPort: targetPort,
+			ListenPort: cfg.listenPort(index),
+			ProxyUID:   cfg.ProxyUID,
+			Backend:    backend,
+		}
+		if err := validatePort(rule.ListenPort); err != nil {
+			return fmt.Errorf("listen port for target port %d %w", targetPort, err)
+		}
+		if err := rule.Install(ctx); err != nil {
+			return fmt.Errorf("install redirect rule: %w", err)
+		}
+	}
+	log.Printf("krun traffic-agent %s installed redirect rules for target_ports=%v", version, cfg.TargetPorts)
+	if cfg.Diagnostics {
+		logRedirectRules(ctx, backend)
+	}
+	return nil
+}
+
+// reportRedirectRules logs the installed rules, then again every
+// diagnosticsInterval, for their counters.
+func reportRedirectRules(ctx context.Context, backend redirectBackend) {
+	ticker := time.NewTicker(diagnosticsInterval)
+	defer ticker.Stop()
+	for {
+		logRedirectRules(ctx, backend)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func logRedirectRules(ctx context.Context, backend redirectBackend) {
+	dump, err := backend.Dump(ctx)
+	if err != nil {
+		log.Printf("diagnostics: list %s redirect rules: %v", backend, err)
+		return
+	}
+	log.Printf("diagnostics: %s redirect rules:\n%s", backend, dump)
+}
+
+// interceptedPorts lists the container ports the routes intercept, the
+// primary port first when a route serves it.
+func interceptedPorts(primary int, routes []routeConfig) []int {
+	var ports []int
+	for _, route := range routes {
+		ports = append(ports, route.targetPorts(primary)...)
+	}
+	slices.Sort(ports)
+	ports = slices.Compact(ports)
+	if index := slices.Index(ports, primary); index > 0 {
+		ports = slices.Insert(slices.Delete(ports, index, index+1), 0, primary)
+	}
+	return ports
+}
+
+// targetPorts lists the container ports the route intercepts; routes
+// without ports serve the primary one.
+func (cfg routeConfig) targetPorts(primary int) []int {
+	if len(cfg.Ports) == 0 {
+		return []int{primary}
+	}
+	return cfg.Ports
+}
+
+func (cfg routeConfig) newStreamEnvelope(connectionID string, envelopeType string) contracts.StreamEnvelope {
 	return contracts.StreamEnvelope{
 		Type:         envelopeType,
 		SessionID:    cfg.SessionID,
@@ -287,14 +492,7 @@ func buildStreamURL(managerAddress string, sessionID string) (string, error) {
 	return parsed.String(), nil
 }
 
-func acceptInterceptedConnections(
-	ctx context.Context,
-	listener net.Listener,
-	cfg runtimeConfig,
-	streamClient *reconnectingStreamClient,
-	connections *streamconn.Registry,
-	connIDCounter *atomic.Uint64,
-) {
+func acceptInterceptedConnections(ctx context.Context, listener net.Listener, router *connectionRouter) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -305,48 +503,57 @@ func acceptInterceptedConnections(
 			continue
 		}
 
-		go captureConnection(ctx, conn, cfg, streamClient, connections, connIDCounter)
+		go router.handle(ctx, conn)
 	}
 }
 
+// captureConnection streams an intercepted connection, already opened and
+// acknowledged on the session's client, to the stream. prefix holds bytes
+// read while routing the connection. window is the send credit the helper
+// granted, or nil when it does not do flow control.
 func captureConnection(
 	ctx context.Context,
 	conn net.Conn,
-	cfg runtimeConfig,
+	connectionID string,
+	prefix []byte,
+	window *streamconn.Window,
+	cfg routeConfig,
 	streamClient *reconnectingStreamClient,
 	connections *streamconn.Registry,
-	connIDCounter *atomic.Uint64,
 ) {
 	go func() {
 		<-ctx.Done()
 		_ = conn.Close()
 	}()
 
-	connectionID := fmt.Sprintf("%s-%d", agentID, connIDCounter.Add(1))
-	connections.Set(connectionID, conn)
+	connections.Set(connectionID, conn, window)
 
-	openEnvelope := cfg.newStreamEnvelope(connectionID, contracts.StreamTypeOpen)
-	openEnvelope.Metadata = map[string]string{
-		"remote_addr": conn.RemoteAddr().String(),
-		"local_addr":  conn.LocalAddr().String(),
+	sendData := func(chunk []byte) bool {
+		window.Consume(len(chunk))
+		if err := connections.SendData(connectionID, chunk); err != nil {
+			log.Printf("send data envelope failed (connection_id=%s): %v", connectionID, err)
+			connections.CloseAndDelete(connectionID)
+			return false
+		}
+		return true
 	}
-	if err := streamClient.Send(ctx, openEnvelope); err != nil {
-		log.Printf("send open envelope failed (connection_id=%s): %v", connectionID, err)
-		connections.CloseAndDelete(connectionID)
+	if len(prefix) > 0 && !sendData(prefix) {
 		return
 	}
 
 	buffer := make([]byte, 32*1024)
 	for {
-		readBytes, readErr := conn.Read(buffer)
+		// Stop reading the caller while the helper's window is exhausted,
+		// e.g. the local app sits on a breakpoint.
+		available, err := window.Acquire(ctx, len(buffer))
+		if err != nil {
+			return
+		}
+		readBytes, readErr := conn.Read(buffer[:available])
 		if readBytes > 0 {
 			chunk := make([]byte, readBytes)
 			copy(chunk, buffer[:readBytes])
-			dataEnvelope := cfg.newStreamEnvelope(connectionID, contracts.StreamTypeData)
-			dataEnvelope.Data = chunk
-			if err := streamClient.Send(ctx, dataEnvelope); err != nil {
-				log.Printf("send data envelope failed (connection_id=%s): %v", connectionID, err)
-				connections.CloseAndDelete(connectionID)
+			if !sendData(chunk) {
 				return
 			}
 		}
@@ -357,7 +564,7 @@ func captureConnection(
 		if errors.Is(readErr, io.EOF) {
 			// Half-close: the caller finished sending but may still expect
 			// response data, so keep the conn registered for writes.
-			_ = streamClient.Send(ctx, cfg.newStreamEnvelope(connectionID, contracts.StreamTypeCloseWrite))
+			_ = connections.SendCloseWrite(connectionID)
 			if connections.MarkReadClosed(connectionID) {
 				_ = streamClient.Send(ctx, cfg.newStreamEnvelope(connectionID, contracts.StreamTypeClose))
 			}
@@ -375,7 +582,7 @@ func captureConnection(
 
 func newReconnectingStreamClient(
 	parent context.Context,
-	cfg runtimeConfig,
+	cfg routeConfig,
 	onReceive func(contracts.StreamEnvelope),
 	onDisconnect func(),
 ) *reconnectingStreamClient {
@@ -416,6 +623,24 @@ func (c *reconnectingStreamClient) Send(ctx context.Context, envelope contracts.
 	}
 }
 
+// TrySend queues an envelope without waiting; false means the stream is
+// closed or its queue is full.
+func (c *reconnectingStreamClient) TrySend(envelope contracts.StreamEnvelope) bool {
+	select {
+	case <-c.doneCh:
+		return false
+	case c.sendCh <- envelope:
+		return true
+	default:
+		return false
+	}
+}
+
+// Connected reports whether the manager stream is currently attached.
+func (c *reconnectingStreamClient) Connected() bool {
+	return c.connected.Load()
+}
+
 func (c *reconnectingStreamClient) Close() {
 	c.once.Do(func() {
 		c.cancel()
@@ -434,8 +659,13 @@ func (c *reconnectingStreamClient) run(ctx context.Context) {
 		default:
 		}
 
-		conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.streamURL, c.headers)
+		conn, response, err := streamcodec.Dial(ctx, c.streamURL, c.headers)
 		if err != nil {
+			if c.onGone != nil && response != nil && response.StatusCode == http.StatusNotFound {
+				log.Printf("manager stream refused: session no longer exists")
+				c.onGone()
+				return
+			}
 			log.Printf("manager stream connect failed: %v", err)
 			if !sleepWithContext(ctx, backoff) {
 				return
@@ -446,7 +676,12 @@ func (c *reconnectingStreamClient) run(ctx context.Context) {
 
 		backoff = initialBackoff
 		log.Printf("manager stream connected")
+		c.connected.Store(true)
+		if c.onConnect != nil {
+			go c.onConnect()
+		}
 		err = c.pumpConnection(ctx, conn)
+		c.connected.Store(false)
 		if err != nil && !errors.Is(err, context.Canceled) {
 			log.Printf("manager stream disconnected: %v", err)
 		}
@@ -468,8 +703,8 @@ func (c *reconnectingStreamClient) pumpConnection(ctx context.Context, conn *web
 	inboundCh := make(chan contracts.StreamEnvelope, 128)
 	go func() {
 		for {
-			var envelope contracts.StreamEnvelope
-			if err := conn.ReadJSON(&envelope); err != nil {
+			envelope, err := streamcodec.Read(conn)
+			if err != nil {
 				readerErrCh <- err
 				return
 			}
@@ -500,7 +735,7 @@ func (c *reconnectingStreamClient) pumpConnection(ctx context.Context, conn *web
 		if err := conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
 			return err
 		}
-		if err := conn.WriteJSON(*pending); err != nil {
+		if err := streamcodec.Write(conn, *pending); err != nil {
 			return err
 		}
 		pending = nil
@@ -549,75 +784,10 @@ func nextBackoff(current time.Duration) time.Duration {
 	return next
 }
 
-func runIptablesCommand(ctx context.Context, args ...string) error {
-	cmd := exec.CommandContext(ctx, "iptables", args...)
-	output, err := cmd.CombinedOutput()
-	if err == nil {
-		return nil
-	}
-	message := strings.TrimSpace(string(output))
-	if message == "" {
-		return fmt.Errorf("iptables %s: %w", strings.Join(args, " "), err)
-	}
-	return fmt.Errorf("iptables %s: %w: %s", strings.Join(args, " "), err, message)
-}
-
-func (r redirectRule) Install(ctx context.Context) error {
-	runIptables := r.RunIptables
-	if runIptables == nil {
-		runIptables = runIptablesCommand
-	}
-
-	redirectArgs := buildRedirectArgs(r.TargetPort, r.ListenPort)
-	checkArgs := append([]string{"-t", "nat", "-C", "PREROUTING"}, redirectArgs...)
-	if err := runIptables(ctx, checkArgs...); err == nil {
-		return nil
-	}
-
-	addArgs := append([]string{"-t", "nat", "-A", "PREROUTING"}, redirectArgs...)
-	if err := runIptables(ctx, addArgs...); err != nil {
-		return err
-	}
-	log.Printf("installed iptables redirect target_port=%d listen_port=%d", r.TargetPort, r.ListenPort)
-	return nil
-}
-
-func (r redirectRule) Remove(ctx context.Context) error {
-	runIptables := r.RunIptables
-	if runIptables == nil {
-		runIptables = runIptablesCommand
-	}
-
-	removeArgs := append([]string{"-t", "nat", "-D", "PREROUTING"}, buildRedirectArgs(r.TargetPort, r.ListenPort)...)
-	if err := runIptables(ctx, removeArgs...); err != nil {
-		if isMissingIptablesRuleError(err) {
-			return nil
-		}
-		return err
-	}
-	log.Printf("removed iptables redirect target_port=%d listen_port=%d", r.TargetPort, r.ListenPort)
-	return nil
-}
-
-func buildRedirectArgs(targetPort int, listenPort int) []string {
-	return []string{
-		"-p", "tcp",
-		"--dport", strconv.Itoa(targetPort),
-		"-j", "REDIRECT",
-		"--to-ports", strconv.Itoa(listenPort),
-	}
-}
-
-func isMissingIptablesRuleError(err error) bool {
-	if err == nil {
-		return false
-	}
-	message := strings.ToLower(err.Error())
-	return strings.Contains(message, "bad rule") ||
-		strings.Contains(message, "no chain/target/match by that name")
-}
-
-func handleInboundEnvelope(connections *streamconn.Registry, envelope contracts.StreamEnvelope, sendClose func(connectionID string)) {
+// handleInboundEnvelope applies an envelope from the helper to its
+// intercepted connection. Writes are queued per connection, so a caller
+// that stops reading never stalls the stream for the others.
+func handleInboundEnvelope(connections *streamconn.Registry, envelope contracts.StreamEnvelope) {
 	connectionID := strings.TrimSpace(envelope.ConnectionID)
 	if connectionID == "" {
 		return
@@ -625,23 +795,11 @@ func handleInboundEnvelope(connections *streamconn.Registry, envelope contracts.
 
 	switch envelope.Type {
 	case contracts.StreamTypeData:
-		if len(envelope.Data) == 0 {
-			return
-		}
-		conn := connections.Get(connectionID)
-		if conn == nil {
-			return
-		}
-		// Bound the write so a caller that stopped reading cannot stall the
-		// stream pump for every other intercepted connection.
-		_ = conn.SetWriteDeadline(time.Now().Add(connWriteTimeout))
-		if _, err := conn.Write(envelope.Data); err != nil {
-			connections.CloseAndDelete(connectionID)
-		}
+		connections.Write(connectionID, envelope.Seq, envelope.Data)
+	case contracts.StreamTypeWindow:
+		connections.Grant(connectionID, envelope.Window, envelope.Seq)
 	case contracts.StreamTypeCloseWrite:
-		if connections.CloseWriteHalf(connectionID) && sendClose != nil {
-			sendClose(connectionID)
-		}
+		connections.CloseWriteHalf(connectionID, envelope.Seq)
 	case contracts.StreamTypeClose, contracts.StreamTypeError:
 		connections.CloseAndDelete(connectionID)
 	}
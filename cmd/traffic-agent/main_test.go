@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/streamconn"
 	"github.com/gorilla/websocket"
 )
 
@@ -42,11 +43,18 @@ func TestLoadRuntimeConfig(t *testing.T) {
 	if err != nil {
 		t.Fatalf("loadRuntimeConfig returned error: %v", err)
 	}
-	if cfg.SessionID != "session-1" {
-		t.Fatalf("expected session id, got %q", cfg.SessionID)
+	if len(cfg.Routes) != 1 {
+		t.Fatalf("expected a single route, got %d", len(cfg.Routes))
 	}
-	if cfg.SessionToken != "token-1" {
-		t.Fatalf("expected session token, got %q", cfg.SessionToken)
+	route := cfg.Routes[0]
+	if route.SessionID != "session-1" {
+		t.Fatalf("expected session id, got %q", route.SessionID)
+	}
+	if route.SessionToken != "token-1" {
+		t.Fatalf("expected session token, got %q", route.SessionToken)
+	}
+	if len(route.Headers) != 0 {
+		t.Fatalf("expected catch-all route, got headers %v", route.Headers)
 	}
 	if cfg.TargetPort != 8080 {
 		t.Fatalf("expected target port 8080, got %d", cfg.TargetPort)
@@ -54,8 +62,73 @@ func TestLoadRuntimeConfig(t *testing.T) {
 	if cfg.AgentListenPort != defaultAgentListenPort {
 		t.Fatalf("expected default listen port %d, got %d", defaultAgentListenPort, cfg.AgentListenPort)
 	}
-	if cfg.StreamURL != "ws://manager.default.svc:8080/v1/stream/agent?session_id=session-1" {
-		t.Fatalf("unexpected stream url %q", cfg.StreamURL)
+	if route.StreamURL != "ws://manager.default.svc:8080/v1/stream/agent?session_id=session-1" {
+		t.Fatalf("unexpected stream url %q", route.StreamURL)
+	}
+}
+
+func TestLoadRuntimeConfigEphemeralPicksListenPorts(t *testing.T) {
+	t.Setenv(managerAddressEnv, "http://manager.default.svc:8080")
+	t.Setenv(sessionIDEnv, "session-1")
+	t.Setenv(targetPortEnv, "8080")
+	t.Setenv(agentEphemeralEnv, "true")
+
+	cfg, err := loadRuntimeConfig()
+	if err != nil {
+		t.Fatalf("loadRuntimeConfig returned error: %v", err)
+	}
+	if !cfg.Ephemeral {
+		t.Fatal("expected an ephemeral agent")
+	}
+	if cfg.AgentListenPort != 0 {
+		t.Fatalf("expected the kernel to pick the listen port, got %d", cfg.AgentListenPort)
+	}
+}
+
+func TestLoadRuntimeConfigRedirect(t *testing.T) {
+	t.Setenv(managerAddressEnv, "http://manager.default.svc:8080")
+	t.Setenv(sessionIDEnv, "session-1")
+	t.Setenv(targetPortEnv, "8080")
+
+	cfg, err := loadRuntimeConfig()
+	if err != nil {
+		t.Fatalf("loadRuntimeConfig returned error: %v", err)
+	}
+	if cfg.Redirect != redirectSelf {
+		t.Fatalf("expected the agent to own its rules by default, got %q", cfg.Redirect)
+	}
+
+	t.Setenv(agentRedirectEnv, "External")
+	cfg, err = loadRuntimeConfig()
+	if err != nil {
+		t.Fatalf("loadRuntimeConfig returned error: %v", err)
+	}
+	if cfg.Redirect != redirectExternal {
+		t.Fatalf("expected external rules, got %q", cfg.Redirect)
+	}
+
+	t.Setenv(agentEphemeralEnv, "true")
+	if _, err := loadRuntimeConfig(); err == nil {
+		t.Fatal("expected ephemeral agents to refuse rules installed elsewhere")
+	}
+
+	t.Setenv(agentEphemeralEnv, "")
+	t.Setenv(agentRedirectEnv, "sometimes")
+	if _, err := loadRuntimeConfig(); err == nil || !strings.Contains(err.Error(), agentRedirectEnv) {
+		t.Fatalf("expected an invalid redirect mode to be refused, got %v", err)
+	}
+}
+
+func TestListenPortsAreFixedWhenRulesAreExternal(t *testing.T) {
+	cfg := runtimeConfig{AgentListenPort: 8081, ProbePort: 8082, Redirect: redirectSelf}
+	if got := []int{cfg.listenPort(0), cfg.listenPort(1)}; !reflect.DeepEqual(got, []int{8081, 0}) {
+		t.Fatalf("expected only the first listen port fixed, got %v", got)
+	}
+
+	cfg.Redirect = redirectInit
+	got := []int{cfg.listenPort(0), cfg.listenPort(1), cfg.listenPort(2)}
+	if !reflect.DeepEqual(got, []int{8081, 8083, 8084}) {
+		t.Fatalf("expected fixed listen ports around the probe port, got %v", got)
 	}
 }
 
@@ -94,56 +167,6 @@ func TestBuildStreamURLConvertsHTTPS(t *testing.T) {
 	}
 }
 
-func TestBuildRedirectArgs(t *testing.T) {
-	got := buildRedirectArgs(8080, 18081)
-	want := []string{"-p", "tcp", "--dport", "8080", "-j", "REDIRECT", "--to-ports", "18081"}
-	if !reflect.DeepEqual(got, want) {
-		t.Fatalf("unexpected redirect args: want=%v got=%v", want, got)
-	}
-}
-
-func TestRedirectRuleInstallAddsRuleWhenMissing(t *testing.T) {
-	fake := &fakeRunner{
-		responses: map[string]error{
-			"-t nat -C PREROUTING -p tcp --dport 8080 -j REDIRECT --to-ports 18081": errors.New("not found"),
-		},
-	}
-	rule := redirectRule{
-		TargetPort:  8080,
-		ListenPort:  18081,
-		RunIptables: fake.Run,
-	}
-
-	if err := rule.Install(context.Background()); err != nil {
-		t.Fatalf("install returned error: %v", err)
-	}
-
-	expectedCalls := [][]string{
-		{"-t", "nat", "-C", "PREROUTING", "-p", "tcp", "--dport", "8080", "-j", "REDIRECT", "--to-ports", "18081"},
-		{"-t", "nat", "-A", "PREROUTING", "-p", "tcp", "--dport", "8080", "-j", "REDIRECT", "--to-ports", "18081"},
-	}
-	if !reflect.DeepEqual(fake.calls, expectedCalls) {
-		t.Fatalf("unexpected iptables calls: want=%v got=%v", expectedCalls, fake.calls)
-	}
-}
-
-func TestRedirectRuleRemoveIgnoresMissingRule(t *testing.T) {
-	fake := &fakeRunner{
-		responses: map[string]error{
-			"-t nat -D PREROUTING -p tcp --dport 8080 -j REDIRECT --to-ports 18081": errors.New("Bad rule (does a matching rule exist in that chain?)"),
-		},
-	}
-	rule := redirectRule{
-		TargetPort:  8080,
-		ListenPort:  18081,
-		RunIptables: fake.Run,
-	}
-
-	if err := rule.Remove(context.Background()); err != nil {
-		t.Fatalf("remove returned error for missing rule: %v", err)
-	}
-}
-
 func TestPumpConnectionHandlesInboundWithoutPendingWrite(t *testing.T) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(*http.Request) bool { return true },
@@ -229,21 +252,41 @@ func TestPumpConnectionHandlesInboundWithoutPendingWrite(t *testing.T) {
 	}
 }
 
-type fakeRunner struct {
-	calls     [][]string
-	responses map[string]error
-}
+func TestCaptureConnectionWaitsForHelperWindow(t *testing.T) {
+	client := &reconnectingStreamClient{
+		sendCh: make(chan contracts.StreamEnvelope, 8),
+		doneCh: make(chan struct{}),
+	}
+	caller, agentSide := net.Pipe()
+	defer caller.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connections := newConnectionRegistry(ctx, routeConfig{}, client)
 
-func (f *fakeRunner) Run(_ context.Context, args ...string) error {
-	copied := make([]string, len(args))
-	copy(copied, args)
-	f.calls = append(f.calls, copied)
+	go captureConnection(ctx, agentSide, "conn-1", nil, streamconn.NewWindow(4), routeConfig{}, client, connections)
+	go func() { _, _ = caller.Write([]byte("abcdefgh")) }()
 
-	if f.responses == nil {
-		return nil
+	nextData := func() string {
+		t.Helper()
+		select {
+		case envelope := <-client.sendCh:
+			return string(envelope.Data)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for a data envelope")
+			return ""
+		}
 	}
-	if err, ok := f.responses[strings.Join(args, " ")]; ok {
-		return err
+	if data := nextData(); data != "abcd" {
+		t.Fatalf("expected reads bounded by the window, got %q", data)
+	}
+	select {
+	case envelope := <-client.sendCh:
+		t.Fatalf("expected the caller to be paused without credit, got %+v", envelope)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	handleInboundEnvelope(connections, contracts.StreamEnvelope{Type: contracts.StreamTypeWindow, ConnectionID: "conn-1", Window: 4})
+	if data := nextData(); data != "efgh" {
+		t.Fatalf("expected the caller to resume after a window update, got %q", data)
 	}
-	return nil
 }
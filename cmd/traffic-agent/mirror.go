@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+// mirrorTap copies the inbound bytes of one connection to a mirror
+// session. It never blocks the caller: when the session stream cannot keep
+// up, the tap gives up on the connection instead of slowing it down.
+type mirrorTap struct {
+	stream       *routeStream
+	connectionID string
+	active       atomic.Bool
+}
+
+// mirroredConn tees every byte read from the caller to its mirror taps,
+// whoever ends up serving the connection.
+type mirroredConn struct {
+	net.Conn
+	taps      []*mirrorTap
+	closeOnce sync.Once
+}
+
+// startMirrors opens the connection on every attached mirror session and
+// wraps conn so later reads are copied too. prefix holds bytes already read
+// while routing the connection.
+func startMirrors(conn net.Conn, connectionID string, targetPort int, mirrors []*routeStream, prefix []byte) net.Conn {
+	taps := make([]*mirrorTap, 0, len(mirrors))
+	for _, stream := range mirrors {
+		tap := stream.openMirror(conn, connectionID, targetPort, prefix)
+		if tap != nil {
+			taps = append(taps, tap)
+		}
+	}
+	if len(taps) == 0 {
+		return conn
+	}
+	return &mirroredConn{Conn: conn, taps: taps}
+}
+
+func (s *routeStream) openMirror(conn net.Conn, connectionID string, targetPort int, prefix []byte) *mirrorTap {
+	if !s.client.Connected() {
+		return nil
+	}
+
+	tap := &mirrorTap{stream: s, connectionID: connectionID}
+	openEnvelope := s.route.newStreamEnvelope(connectionID, contracts.StreamTypeOpen)
+	openEnvelope.Metadata = openMetadata(conn, targetPort)
+	openEnvelope.Metadata[contracts.StreamMetadataMode] = contracts.SessionModeMirror
+	if !s.client.TrySend(openEnvelope) {
+		return nil
+	}
+	tap.active.Store(true)
+	s.mirrorTaps.Store(connectionID, tap)
+	if len(prefix) > 0 {
+		tap.send(prefix)
+	}
+	return tap
+}
+
+// stopMirror deactivates a tap the helper refused or closed and reports
+// whether the envelope belonged to one.
+func (s *routeStream) stopMirror(envelope contracts.StreamEnvelope) bool {
+	connectionID := strings.TrimSpace(envelope.ConnectionID)
+	value, ok := s.mirrorTaps.Load(connectionID)
+	if !ok {
+		return false
+	}
+	switch envelope.Type {
+	case contracts.StreamTypeError, contracts.StreamTypeClose:
+		value.(*mirrorTap).active.Store(false)
+		s.mirrorTaps.Delete(connectionID)
+	}
+	// Everything else the helper sends about a mirrored connection (acks,
+	// half-closes) has nothing to act on.
+	return true
+}
+
+func (s *routeStream) stopAllMirrors() {
+	s.mirrorTaps.Range(func(key, value any) bool {
+		value.(*mirrorTap).active.Store(false)
+		s.mirrorTaps.Delete(key)
+		return true
+	})
+}
+
+func (t *mirrorTap) send(chunk []byte) {
+	if !t.active.Load() {
+		return
+	}
+	dataEnvelope := t.stream.route.newStreamEnvelope(t.connectionID, contracts.StreamTypeData)
+	dataEnvelope.Data = append([]byte(nil), chunk...)
+	if t.stream.client.TrySend(dataEnvelope) {
+		return
+	}
+	log.Printf("mirror session %s is falling behind, dropping connection %s", t.stream.route.SessionID, t.connectionID)
+	t.close()
+}
+
+func (t *mirrorTap) closeWrite() {
+	if !t.active.Load() {
+		return
+	}
+	t.stream.client.TrySend(t.stream.route.newStreamEnvelope(t.connectionID, contracts.StreamTypeCloseWrite))
+}
+
+func (t *mirrorTap) close() {
+	if !t.active.Swap(false) {
+		return
+	}
+	t.stream.mirrorTaps.Delete(t.connectionID)
+	t.stream.client.TrySend(t.stream.route.newStreamEnvelope(t.connectionID, contracts.StreamTypeClose))
+}
+
+func (c *mirroredConn) Read(p []byte) (int, error) {
+	readBytes, err := c.Conn.Read(p)
+	if readBytes > 0 {
+		for _, tap := range c.taps {
+			tap.send(p[:readBytes])
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		for _, tap := range c.taps {
+			tap.closeWrite()
+		}
+	}
+	return readBytes, err
+}
+
+func (c *mirroredConn) CloseWrite() error {
+	if halfCloser, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+	return c.Close()
+}
+
+func (c *mirroredConn) Close() error {
+	c.closeOnce.Do(func() {
+		for _, tap := range c.taps {
+			tap.close()
+		}
+	})
+	return c.Conn.Close()
+}
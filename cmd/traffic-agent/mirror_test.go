@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+func drainEnvelopes(client *reconnectingStreamClient) []contracts.StreamEnvelope {
+	var envelopes []contracts.StreamEnvelope
+	for {
+		select {
+		case envelope := <-client.sendCh:
+			envelopes = append(envelopes, envelope)
+		default:
+			return envelopes
+		}
+	}
+}
+
+func TestMirroredConnCopiesInboundBytes(t *testing.T) {
+	stream := newTestRouteStream(true)
+	stream.client.sendCh = make(chan contracts.StreamEnvelope, 16)
+	caller, agentSide := net.Pipe()
+
+	conn := startMirrors(agentSide, "conn-1", 8080, []*routeStream{stream}, []byte("head|"))
+	go func() {
+		_, _ = caller.Write([]byte("body"))
+		_ = caller.Close()
+	}()
+
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read mirrored conn: %v", err)
+	}
+	if string(received) != "body" {
+		t.Fatalf("mirroring must not change what the server reads, got %q", received)
+	}
+	_ = conn.Close()
+
+	envelopes := drainEnvelopes(stream.client)
+	var mirrored string
+	var types []string
+	for _, envelope := range envelopes {
+		types = append(types, envelope.Type)
+		if envelope.Type == contracts.StreamTypeData {
+			mirrored += string(envelope.Data)
+		}
+	}
+	if envelopes[0].Type != contracts.StreamTypeOpen || envelopes[0].Metadata[contracts.StreamMetadataMode] != contracts.SessionModeMirror {
+		t.Fatalf("expected mirror open first, got %+v", envelopes[0])
+	}
+	if mirrored != "head|body" {
+		t.Fatalf("expected prefix and body to be mirrored, got %q", mirrored)
+	}
+	last := types[len(types)-2:]
+	if last[0] != contracts.StreamTypeCloseWrite || last[1] != contracts.StreamTypeClose {
+		t.Fatalf("expected close-write then close, got %v", types)
+	}
+}
+
+func TestMirrorTapStopsWhenHelperRefuses(t *testing.T) {
+	stream := newTestRouteStream(true)
+	caller, agentSide := net.Pipe()
+	defer caller.Close()
+
+	conn := startMirrors(agentSide, "conn-1", 8080, []*routeStream{stream}, nil)
+	mirrored, ok := conn.(*mirroredConn)
+	if !ok {
+		t.Fatal("expected connection to be wrapped for mirroring")
+	}
+	drainEnvelopes(stream.client)
+
+	if !stream.stopMirror(contracts.StreamEnvelope{Type: contracts.StreamTypeError, ConnectionID: "conn-1"}) {
+		t.Fatal("expected helper error to be consumed by the mirror tap")
+	}
+	mirrored.taps[0].send([]byte("ignored"))
+	if got := drainEnvelopes(stream.client); len(got) != 0 {
+		t.Fatalf("expected no envelopes after refusal, got %+v", got)
+	}
+}
+
+func TestStartMirrorsSkipsDetachedSessions(t *testing.T) {
+	stream := newTestRouteStream(false)
+	caller, agentSide := net.Pipe()
+	defer caller.Close()
+	defer agentSide.Close()
+
+	if conn := startMirrors(agentSide, "conn-1", 8080, []*routeStream{stream}, nil); conn != agentSide {
+		t.Fatal("expected the plain connection when no mirror session is attached")
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+// Backends the redirect rules can be installed with. The iptables ones
+// install the same rules through the legacy or the nf_tables kernel
+// interface; nft keeps them in a table of its own.
+const (
+	backendIptablesNFT    = "iptables-nft"
+	backendIptablesLegacy = "iptables-legacy"
+	backendIptables       = "iptables"
+	backendNFT            = "nft"
+
+	nftTable = "krun"
+	// nftInboundChain redirects connections as they reach the pod;
+	// nftProxyChain the connections a mesh proxy opens, ahead of the
+	// mesh's own nat rules.
+	nftInboundChain = "prerouting"
+	nftProxyChain   = "output"
+)
+
+// meshProxy is a service mesh proxy the agent can sit behind: the nat
+// chain its init container sends the pod's outbound traffic through, and
+// the UID the proxy runs as unless that chain says otherwise.
+type meshProxy struct {
+	strategy    string
+	outputChain string
+	uid         int
+}
+
+var meshProxies = []meshProxy{
+	{strategy: contracts.InterceptStrategyAfterIstioProxy, outputChain: "ISTIO_OUTPUT", uid: 1337},
+	{strategy: contracts.InterceptStrategyAfterLinkerdProxy, outputChain: "PROXY_INIT_OUTPUT", uid: 2102},
+}
+
+// commandRunner runs a command and returns its combined output.
+type commandRunner func(ctx context.Context, name string, args ...string) (string, error)
+
+// redirectBackend installs redirect rules for IPv4 and, when the pod has
+// an IPv6 address the backend can redirect, for IPv6.
+type redirectBackend struct {
+	Name string
+	IPv6 bool
+	Run  commandRunner
+}
+
+type redirectRule struct {
+	TargetPort int
+	ListenPort int
+	// First inserts the rule ahead of the chain's other rules, so it wins
+	// over the redirect of an older agent for the same port.
+	First bool
+	// ProxyUID, when set, redirects the connections a mesh proxy running
+	// as this UID opens to the target port, instead of the inbound ones.
+	// Those rules always go first, ahead of the mesh's.
+	ProxyUID int
+	Backend  redirectBackend
+}
+
+// detectRedirectBackend picks the first backend that works in the pod's
+// network namespace. Among the iptables ones, the one that already holds
+// rules (from the CNI, or a service mesh) is the one the node uses, so
+// ours go next to them.
+func detectRedirectBackend(ctx context.Context, run commandRunner, ipv6 bool) (redirectBackend, error) {
+	var usable []string
+	for _, name := range []string{backendIptablesNFT, backendIptablesLegacy} {
+		output, err := run(ctx, name, "-t", "nat", "-S", "PREROUTING")
+		if err != nil {
+			continue
+		}
+		if hasIptablesRules(output) {
+			return newIptablesBackend(ctx, run, name, ipv6), nil
+		}
+		usable = append(usable, name)
+	}
+	if len(usable) > 0 {
+		return newIptablesBackend(ctx, run, usable[0], ipv6), nil
+	}
+	if _, err := run(ctx, backendNFT, "list", "tables"); err == nil {
+		return redirectBackend{Name: backendNFT, IPv6: ipv6, Run: run}, nil
+	}
+	// Images that only ship the unsuffixed iptables.
+	if _, err := run(ctx, backendIptables, "-t", "nat", "-S", "PREROUTING"); err == nil {
+		return newIptablesBackend(ctx, run, backendIptables, ipv6), nil
+	}
+	return redirectBackend{}, fmt.Errorf("no redirect backend available (tried %s, %s, %s and %s)",
+		backendIptablesNFT, backendIptablesLegacy, backendNFT, backendIptables)
+}
+
+// newIptablesBackend redirects IPv6 too when the matching ip6tables can
+// reach the IPv6 nat table. Without it only IPv4 traffic is intercepted.
+func newIptablesBackend(ctx context.Context, run commandRunner, name string, ipv6 bool) redirectBackend {
+	backend := redirectBackend{Name: name, Run: run}
+	if !ipv6 {
+		return backend
+	}
+	if _, err := run(ctx, ip6tablesCommand(name), "-t", "nat", "-S", "PREROUTING"); err != nil {
+		log.Printf("IPv6 traffic is not intercepted: %v", err)
+		return backend
+	}
+	backend.IPv6 = true
+	return backend
+}
+
+func (b redirectBackend) String() string {
+	if b.IPv6 {
+		return b.Name + " (ipv4, ipv6)"
+	}
+	return b.Name + " (ipv4)"
+}
+
+// Dump lists the installed redirect rules with their packet counters.
+func (b redirectBackend) Dump(ctx context.Context) (string, error) {
+	var dump strings.Builder
+	if b.Name == backendNFT {
+		for _, family := range b.nftFamilies() {
+			output, err := b.Run(ctx, backendNFT, "list", "table", family, nftTable)
+			if err != nil {
+				return "", err
+			}
+			dump.WriteString(output)
+		}
+		return dump.String(), nil
+	}
+	for _, command := range b.iptablesCommands() {
+		output, err := b.Run(ctx, command, "-t", "nat", "-L", "-n", "-v")
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&dump, "%s:\n%s", command, output)
+	}
+	return dump.String(), nil
+}
+
+func (b redirectBackend) iptablesCommands() []string {
+	if b.IPv6 {
+		return []string{b.Name, ip6tablesCommand(b.Name)}
+	}
+	return []string{b.Name}
+}
+
+func (b redirectBackend) nftFamilies() []string {
+	if b.IPv6 {
+		return []string{"ip", "ip6"}
+	}
+	return []string{"ip"}
+}
+
+func (r redirectRule) Install(ctx context.Context) error {
+	var err error
+	if r.Backend.Name == backendNFT {
+		err = r.installNFT(ctx)
+	} else {
+		err = r.installIptables(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("installed redirect backend=%s target_port=%d listen_port=%d", r.Backend, r.TargetPort, r.ListenPort)
+	return nil
+}
+
+func (r redirectRule) Remove(ctx context.Context) error {
+	var err error
+	if r.Backend.Name == backendNFT {
+		err = r.removeNFT(ctx)
+	} else {
+		err = r.removeIptables(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("removed redirect backend=%s target_port=%d listen_port=%d", r.Backend, r.TargetPort, r.ListenPort)
+	return nil
+}
+
+func (r redirectRule) installIptables(ctx context.Context) error {
+	chain, redirectArgs := r.iptablesRule()
+	for _, command := range r.Backend.iptablesCommands() {
+		checkArgs := append([]string{"-t", "nat", "-C", chain}, redirectArgs...)
+		if _, err := r.Backend.Run(ctx, command, checkArgs...); err == nil {
+			continue
+		}
+
+		addArgs := append([]string{"-t", "nat", "-A", chain}, redirectArgs...)
+		if r.First || r.ProxyUID > 0 {
+			addArgs = append([]string{"-t", "nat", "-I", chain, "1"}, redirectArgs...)
+		}
+		if _, err := r.Backend.Run(ctx, command, addArgs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r redirectRule) removeIptables(ctx context.Context) error {
+	chain, redirectArgs := r.iptablesRule()
+	removeArgs := append([]string{"-t", "nat", "-D", chain}, redirectArgs...)
+	for _, command := range r.Backend.iptablesCommands() {
+		if _, err := r.Backend.Run(ctx, command, removeArgs...); err != nil && !isMissingIptablesRuleError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// iptablesRule returns the nat chain and the rule redirecting the target
+// port.
+func (r redirectRule) iptablesRule() (string, []string) {
+	if r.ProxyUID > 0 {
+		return "OUTPUT", buildProxyRedirectArgs(r.TargetPort, r.ListenPort, r.ProxyUID)
+	}
+	return "PREROUTING", buildRedirectArgs(r.TargetPort, r.ListenPort)
+}
+
+// nftChain returns the krun chain the rule goes into, with the hook that
+// chain is created with.
+func (r redirectRule) nftChain() (string, []string) {
+	if r.ProxyUID > 0 {
+		return nftProxyChain, []string{"{", "type", "nat", "hook", "output", "priority", "-101", ";", "}"}
+	}
+	return nftInboundChain, []string{"{", "type", "nat", "hook", "prerouting", "priority", "dstnat", ";", "}"}
+}
+
+// installNFT adds the rule to a nat chain of the krun table, creating
+// both when missing. The rule is found again by its comment.
+func (r redirectRule) installNFT(ctx context.Context) error {
+	chain, hook := r.nftChain()
+	for _, family := range r.Backend.nftFamilies() {
+		if _, err := r.Backend.Run(ctx, backendNFT, "add", "table", family, nftTable); err != nil {
+			return err
+		}
+		_, err := r.Backend.Run(ctx, backendNFT, append([]string{"add", "chain", family, nftTable, chain}, hook...)...)
+		if err != nil {
+			return err
+		}
+		handle, err := r.nftHandle(ctx, family)
+		if err != nil {
+			return err
+		}
+		if handle != "" {
+			continue
+		}
+
+		verb := "add"
+		if r.First || r.ProxyUID > 0 {
+			verb = "insert"
+		}
+		args := append([]string{verb, "rule", family, nftTable, chain}, buildNFTRedirectArgs(r.TargetPort, r.ListenPort, r.ProxyUID)...)
+		if _, err := r.Backend.Run(ctx, backendNFT, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r redirectRule) removeNFT(ctx context.Context) error {
+	chain, _ := r.nftChain()
+	for _, family := range r.Backend.nftFamilies() {
+		handle, err := r.nftHandle(ctx, family)
+		if err != nil {
+			return err
+		}
+		if handle == "" {
+			continue
+		}
+		_, err = r.Backend.Run(ctx, backendNFT, "delete", "rule", family, nftTable, chain, "handle", handle)
+		if err != nil && !isMissingNFTObjectError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// nftHandle returns the handle of the rule in the family's chain, or ""
+// when the rule, or the chain, is not there.
+func (r redirectRule) nftHandle(ctx context.Context, family string) (string, error) {
+	chain, _ := r.nftChain()
+	output, err := r.Backend.Run(ctx, backendNFT, "-a", "list", "chain", family, nftTable, chain)
+	if err != nil {
+		if isMissingNFTObjectError(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	comment := "comment " + strconv.Quote(nftRuleComment(r.TargetPort, r.ListenPort))
+	for line := range strings.Lines(output) {
+		if !strings.Contains(line, comment) {
+			continue
+		}
+		if _, handle, found := strings.Cut(line, "# handle "); found {
+			return strings.TrimSpace(handle), nil
+		}
+	}
+	return "", nil
+}
+
+func buildRedirectArgs(targetPort int, listenPort int) []string {
+	return []string{
+		"-p", "tcp",
+		"--dport", strconv.Itoa(targetPort),
+		"-j", "REDIRECT",
+		"--to-ports", strconv.Itoa(listenPort),
+	}
+}
+
+// buildProxyRedirectArgs matches only what the proxy delivers into the
+// pod: its connections out of the pod to the same port are the app's
+// outbound calls and must leave untouched.
+func buildProxyRedirectArgs(targetPort int, listenPort int, proxyUID int) []string {
+	return []string{
+		"-o", "lo",
+		"-p", "tcp",
+		"--dport", strconv.Itoa(targetPort),
+		"-m", "owner", "--uid-owner", strconv.Itoa(proxyUID),
+		"-j", "REDIRECT",
+		"--to-ports", strconv.Itoa(listenPort),
+	}
+}
+
+func buildNFTRedirectArgs(targetPort int, listenPort int, proxyUID int) []string {
+	var args []string
+	if proxyUID > 0 {
+		args = []string{"meta", "skuid", strconv.Itoa(proxyUID), "oifname", strconv.Quote("lo")}
+	}
+	return append(args,
+		"tcp", "dport", strconv.Itoa(targetPort),
+		"counter",
+		"redirect", "to", ":"+strconv.Itoa(listenPort),
+		"comment", strconv.Quote(nftRuleComment(targetPort, listenPort)),
+	)
+}
+
+func nftRuleComment(targetPort int, listenPort int) string {
+	return fmt.Sprintf("krun %d to %d", targetPort, listenPort)
+}
+
+// selectInterceptStrategy decides where the agent takes connections
+// over. The mesh chains in the pod's nat table win over the configured
+// strategy: the manager may not have seen the mesh, e.g. for a session
+// declared as a resource. A configured mesh whose chains are not there
+// yet (its init container runs after ours) is trusted. It returns the
+// strategy and, behind a mesh, the proxy's UID.
+func selectInterceptStrategy(ctx context.Context, backend redirectBackend, configured string) (string, int) {
+	if backend.Name != backendNFT {
+		if output, err := backend.Run(ctx, backend.Name, "-t", "nat", "-S"); err == nil {
+			if proxy, uid, found := findMeshProxy(output); found {
+				if configured != "" && configured != proxy.strategy {
+					log.Printf("found %s chains in the pod; intercepting %s instead of %s", proxy.outputChain, proxy.strategy, configured)
+				}
+				return proxy.strategy, uid
+			}
+		}
+	}
+	for _, proxy := range meshProxies {
+		if proxy.strategy == configured {
+			return proxy.strategy, proxy.uid
+		}
+	}
+	return contracts.InterceptStrategyInbound, 0
+}
+
+// findMeshProxy looks for a mesh's output chain in `iptables -t nat -S`
+// output, and for the proxy UID its rules exempt.
+func findMeshProxy(output string) (meshProxy, int, bool) {
+	for _, proxy := range meshProxies {
+		found, parsed := false, false
+		uid := proxy.uid
+		for line := range strings.Lines(output) {
+			line = strings.TrimSpace(line)
+			if line == "-N "+proxy.outputChain {
+				found = true
+			}
+			if parsed || !strings.HasPrefix(line, "-A "+proxy.outputChain+" ") {
+				continue
+			}
+			if _, rest, ok := strings.Cut(line, "--uid-owner "); ok {
+				if value, err := strconv.Atoi(strings.Fields(rest)[0]); err == nil {
+					uid, parsed = value, true
+				}
+			}
+		}
+		if found {
+			return proxy, uid, true
+		}
+	}
+	return meshProxy{}, 0, false
+}
+
+// hasIptablesRules reports whether `iptables -S` output lists rules
+// besides the chain policies.
+func hasIptablesRules(output string) bool {
+	for line := range strings.Lines(output) {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "-P ") {
+			return true
+		}
+	}
+	return false
+}
+
+// ip6tablesCommand is the IPv6 counterpart of an iptables command.
+func ip6tablesCommand(name string) string {
+	return "ip6" + strings.TrimPrefix(name, "ip")
+}
+
+// hasIPv6Address reports whether the pod can be reached over IPv6.
+func hasIPv6Address() bool {
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if ok && ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+func runCommand(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err == nil {
+		return string(output), nil
+	}
+	message := strings.TrimSpace(string(output))
+	if message == "" {
+		return "", fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return "", fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, message)
+}
+
+func isMissingIptablesRuleError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "bad rule") ||
+		strings.Contains(message, "no chain/target/match by that name")
+}
+
+func isMissingNFTObjectError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "no such file or directory")
+}
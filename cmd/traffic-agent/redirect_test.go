@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBuildRedirectArgs(t *testing.T) {
+	got := buildRedirectArgs(8080, 18081)
+	want := []string{"-p", "tcp", "--dport", "8080", "-j", "REDIRECT", "--to-ports", "18081"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected redirect args: want=%v got=%v", want, got)
+	}
+}
+
+func TestRedirectRuleInstallAddsRuleWhenMissing(t *testing.T) {
+	fake := &fakeRunner{
+		responses: map[string]error{
+			"iptables-nft -t nat -C PREROUTING -p tcp --dport 8080 -j REDIRECT --to-ports 18081": errors.New("not found"),
+		},
+	}
+	rule := redirectRule{
+		TargetPort: 8080,
+		ListenPort: 18081,
+		Backend:    redirectBackend{Name: backendIptablesNFT, Run: fake.Run},
+	}
+
+	if err := rule.Install(context.Background()); err != nil {
+		t.Fatalf("install returned error: %v", err)
+	}
+
+	expectedCalls := [][]string{
+		{"iptables-nft", "-t", "nat", "-C", "PREROUTING", "-p", "tcp", "--dport", "8080", "-j", "REDIRECT", "--to-ports", "18081"},
+		{"iptables-nft", "-t", "nat", "-A", "PREROUTING", "-p", "tcp", "--dport", "8080", "-j", "REDIRECT", "--to-ports", "18081"},
+	}
+	if !reflect.DeepEqual(fake.calls, expectedCalls) {
+		t.Fatalf("unexpected iptables calls: want=%v got=%v", expectedCalls, fake.calls)
+	}
+}
+
+func TestRedirectRuleInstallInsertsFirstRule(t *testing.T) {
+	fake := &fakeRunner{
+		responses: map[string]error{
+			"iptables-nft -t nat -C PREROUTING -p tcp --dport 8080 -j REDIRECT --to-ports 18081": errors.New("not found"),
+		},
+	}
+	rule := redirectRule{
+		TargetPort: 8080,
+		ListenPort: 18081,
+		First:      true,
+		Backend:    redirectBackend{Name: backendIptablesNFT, Run: fake.Run},
+	}
+
+	if err := rule.Install(context.Background()); err != nil {
+		t.Fatalf("install returned error: %v", err)
+	}
+
+	want := []string{"iptables-nft", "-t", "nat", "-I", "PREROUTING", "1", "-p", "tcp", "--dport", "8080", "-j", "REDIRECT", "--to-ports", "18081"}
+	if len(fake.calls) != 2 || !reflect.DeepEqual(fake.calls[1], want) {
+		t.Fatalf("expected the rule inserted first, got %v", fake.calls)
+	}
+}
+
+func TestRedirectRuleInstallsIPv6Rule(t *testing.T) {
+	fake := &fakeRunner{
+		responses: map[string]error{
+			"iptables-legacy -t nat -C PREROUTING -p tcp --dport 8080 -j REDIRECT --to-ports 18081":  errors.New("not found"),
+			"ip6tables-legacy -t nat -C PREROUTING -p tcp --dport 8080 -j REDIRECT --to-ports 18081": errors.New("not found"),
+		},
+	}
+	rule := redirectRule{
+		TargetPort: 8080,
+		ListenPort: 18081,
+		Backend:    redirectBackend{Name: backendIptablesLegacy, IPv6: true, Run: fake.Run},
+	}
+
+	if err := rule.Install(context.Background()); err != nil {
+		t.Fatalf("install returned error: %v", err)
+	}
+	if len(fake.calls) != 4 || fake.calls[3][0] != "ip6tables-legacy" || fake.calls[3][3] != "-A" {
+		t.Fatalf("expected the rule added for both families, got %v", fake.calls)
+	}
+}
+
+func TestRedirectRuleRemoveIgnoresMissingRule(t *testing.T) {
+	fake := &fakeRunner{
+		responses: map[string]error{
+			"iptables-nft -t nat -D PREROUTING -p tcp --dport 8080 -j REDIRECT --to-ports 18081": errors.New("Bad rule (does a matching rule exist in that chain?)"),
+		},
+	}
+	rule := redirectRule{
+		TargetPort: 8080,
+		ListenPort: 18081,
+		Backend:    redirectBackend{Name: backendIptablesNFT, Run: fake.Run},
+	}
+
+	if err := rule.Remove(context.Background()); err != nil {
+		t.Fatalf("remove returned error for missing rule: %v", err)
+	}
+}
+
+func TestRedirectRuleInstallsAndRemovesNFTRule(t *testing.T) {
+	fake := &fakeRunner{
+		outputs: map[string]string{},
+	}
+	rule := redirectRule{
+		TargetPort: 8080,
+		ListenPort: 18081,
+		First:      true,
+		Backend:    redirectBackend{Name: backendNFT, Run: fake.Run},
+	}
+
+	if err := rule.Install(context.Background()); err != nil {
+		t.Fatalf("install returned error: %v", err)
+	}
+	want := []string{"nft", "insert", "rule", "ip", "krun", "prerouting", "tcp", "dport", "8080", "counter", "redirect", "to", ":18081", "comment", `"krun 8080 to 18081"`}
+	if last := fake.calls[len(fake.calls)-1]; !reflect.DeepEqual(last, want) {
+		t.Fatalf("unexpected nft rule: want=%v got=%v", want, last)
+	}
+
+	// Installed once, the rule is found by its comment.
+	fake.outputs["nft -a list chain ip krun prerouting"] = "table ip krun {\n" +
+		"\tchain prerouting {\n" +
+		"\t\ttype nat hook prerouting priority dstnat; policy accept;\n" +
+		"\t\ttcp dport 8080 counter packets 0 bytes 0 redirect to :18081 comment \"krun 8080 to 18081\" # handle 4\n" +
+		"\t}\n}\n"
+	fake.calls = nil
+	if err := rule.Install(context.Background()); err != nil {
+		t.Fatalf("reinstall returned error: %v", err)
+	}
+	for _, call := range fake.calls {
+		if call[1] == "insert" {
+			t.Fatalf("expected an installed rule not to be added again, got %v", fake.calls)
+		}
+	}
+
+	fake.calls = nil
+	if err := rule.Remove(context.Background()); err != nil {
+		t.Fatalf("remove returned error: %v", err)
+	}
+	want = []string{"nft", "delete", "rule", "ip", "krun", "prerouting", "handle", "4"}
+	if last := fake.calls[len(fake.calls)-1]; !reflect.DeepEqual(last, want) {
+		t.Fatalf("unexpected nft removal: want=%v got=%v", want, last)
+	}
+}
+
+func TestDetectRedirectBackend(t *testing.T) {
+	unavailable := errors.New("executable file not found in $PATH")
+	policies := "-P PREROUTING ACCEPT\n"
+	tests := []struct {
+		name      string
+		responses map[string]error
+		outputs   map[string]string
+		ipv6      bool
+		want      string
+		wantIPv6  bool
+	}{
+		{
+			name:     "prefers iptables-nft",
+			outputs:  map[string]string{"iptables-nft -t nat -S PREROUTING": policies},
+			ipv6:     true,
+			want:     "iptables-nft (ipv4, ipv6)",
+			wantIPv6: true,
+		},
+		{
+			name: "follows existing legacy rules",
+			outputs: map[string]string{
+				"iptables-nft -t nat -S PREROUTING":    policies,
+				"iptables-legacy -t nat -S PREROUTING": policies + "-A PREROUTING -p tcp -j ISTIO_INBOUND\n",
+			},
+			want: "iptables-legacy (ipv4)",
+		},
+		{
+			name: "skips IPv6 without ip6tables",
+			responses: map[string]error{
+				"ip6tables-nft -t nat -S PREROUTING": errors.New("can't initialize ip6tables table `nat'"),
+			},
+			ipv6: true,
+			want: "iptables-nft (ipv4)",
+		},
+		{
+			name: "falls back to nft",
+			responses: map[string]error{
+				"iptables-nft -t nat -S PREROUTING":    unavailable,
+				"iptables-legacy -t nat -S PREROUTING": unavailable,
+			},
+			ipv6:     true,
+			want:     "nft (ipv4, ipv6)",
+			wantIPv6: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeRunner{responses: test.responses, outputs: test.outputs}
+			backend, err := detectRedirectBackend(context.Background(), fake.Run, test.ipv6)
+			if err != nil {
+				t.Fatalf("detect returned error: %v", err)
+			}
+			if backend.String() != test.want || backend.IPv6 != test.wantIPv6 {
+				t.Fatalf("expected %s, got %s", test.want, backend)
+			}
+		})
+	}
+
+	fake := &fakeRunner{responses: map[string]error{
+		"iptables-nft -t nat -S PREROUTING":    unavailable,
+		"iptables-legacy -t nat -S PREROUTING": unavailable,
+		"nft list tables":                      unavailable,
+		"iptables -t nat -S PREROUTING":        unavailable,
+	}}
+	if _, err := detectRedirectBackend(context.Background(), fake.Run, false); err == nil {
+		t.Fatal("expected an error without any backend")
+	}
+}
+
+func TestRedirectRuleInstallsAfterMeshProxy(t *testing.T) {
+	fake := &fakeRunner{
+		responses: map[string]error{
+			"iptables-nft -t nat -C OUTPUT -o lo -p tcp --dport 8080 -m owner --uid-owner 1337 -j REDIRECT --to-ports 18081": errors.New("not found"),
+		},
+	}
+	rule := redirectRule{
+		TargetPort: 8080,
+		ListenPort: 18081,
+		ProxyUID:   1337,
+		Backend:    redirectBackend{Name: backendIptablesNFT, Run: fake.Run},
+	}
+
+	if err := rule.Install(context.Background()); err != nil {
+		t.Fatalf("install returned error: %v", err)
+	}
+	want := []string{"iptables-nft", "-t", "nat", "-I", "OUTPUT", "1", "-o", "lo", "-p", "tcp", "--dport", "8080", "-m", "owner", "--uid-owner", "1337", "-j", "REDIRECT", "--to-ports", "18081"}
+	if len(fake.calls) != 2 || !reflect.DeepEqual(fake.calls[1], want) {
+		t.Fatalf("expected the proxy's connections redirected ahead of the mesh, got %v", fake.calls)
+	}
+
+	fake = &fakeRunner{}
+	rule.Backend = redirectBackend{Name: backendNFT, Run: fake.Run}
+	if err := rule.Install(context.Background()); err != nil {
+		t.Fatalf("install with nft returned error: %v", err)
+	}
+	want = []string{"nft", "insert", "rule", "ip", "krun", "output", "meta", "skuid", "1337", "oifname", `"lo"`, "tcp", "dport", "8080", "counter", "redirect", "to", ":18081", "comment", `"krun 8080 to 18081"`}
+	if last := fake.calls[len(fake.calls)-1]; !reflect.DeepEqual(last, want) {
+		t.Fatalf("unexpected nft rule: want=%v got=%v", want, last)
+	}
+}
+
+func TestProxyRedirectSkipsOutboundFlows(t *testing.T) {
+	type flow struct {
+		uid       int
+		outIface  string
+		dport     int
+		redirects bool
+	}
+	flows := []flow{
+		// The proxy hands an inbound request to the app over loopback.
+		{uid: 1337, outIface: "lo", dport: 8080, redirects: true},
+		// The app's outbound call, sent on by the proxy, to another
+		// service on the same port.
+		{uid: 1337, outIface: "eth0", dport: 8080},
+		{uid: 1000, outIface: "lo", dport: 8080},
+		{uid: 1337, outIface: "lo", dport: 9090},
+	}
+
+	iptablesArgs := buildProxyRedirectArgs(8080, 18081, 1337)
+	nftArgs := buildNFTRedirectArgs(8080, 18081, 1337)
+	for _, f := range flows {
+		iptablesMatch := ruleMatches(iptablesArgs, map[string]string{
+			"-o": f.outIface, "--dport": strconv.Itoa(f.dport), "--uid-owner": strconv.Itoa(f.uid),
+		})
+		nftMatch := ruleMatches(nftArgs, map[string]string{
+			"oifname": strconv.Quote(f.outIface), "dport": strconv.Itoa(f.dport), "skuid": strconv.Itoa(f.uid),
+		})
+		if iptablesMatch != f.redirects || nftMatch != f.redirects {
+			t.Fatalf("flow %+v: expected redirect=%v, got iptables=%v nft=%v", f, f.redirects, iptablesMatch, nftMatch)
+		}
+	}
+}
+
+// ruleMatches reports whether every matcher of a rule that the flow
+// describes holds for it.
+func ruleMatches(args []string, flow map[string]string) bool {
+	for i := 0; i+1 < len(args); i++ {
+		if value, ok := flow[args[i]]; ok && args[i+1] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSelectInterceptStrategy(t *testing.T) {
+	istio := "-P PREROUTING ACCEPT\n" +
+		"-N ISTIO_INBOUND\n" +
+		"-N ISTIO_OUTPUT\n" +
+		"-A OUTPUT -p tcp -j ISTIO_OUTPUT\n" +
+		"-A ISTIO_OUTPUT -s 127.0.0.6/32 -o lo -j RETURN\n" +
+		"-A ISTIO_OUTPUT -m owner --uid-owner 1500 -j RETURN\n" +
+		"-A ISTIO_OUTPUT -m owner --uid-owner 1337 -j RETURN\n"
+	tests := []struct {
+		name       string
+		output     string
+		backend    string
+		configured string
+		want       string
+		wantUID    int
+	}{
+		{name: "no mesh", output: "-P PREROUTING ACCEPT\n", backend: backendIptablesNFT, want: "inbound"},
+		{name: "istio chains win", output: istio, backend: backendIptablesNFT, configured: "inbound", want: "after-istio-proxy", wantUID: 1500},
+		{name: "configured mesh without chains yet", backend: backendIptablesLegacy, configured: "after-linkerd-proxy", want: "after-linkerd-proxy", wantUID: 2102},
+		{name: "configured mesh with nft", backend: backendNFT, configured: "after-istio-proxy", want: "after-istio-proxy", wantUID: 1337},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeRunner{outputs: map[string]string{test.backend + " -t nat -S": test.output}}
+			backend := redirectBackend{Name: test.backend, Run: fake.Run}
+			strategy, uid := selectInterceptStrategy(context.Background(), backend, test.configured)
+			if strategy != test.want || uid != test.wantUID {
+				t.Fatalf("expected %s with uid %d, got %s with uid %d", test.want, test.wantUID, strategy, uid)
+			}
+		})
+	}
+}
+
+type fakeRunner struct {
+	calls     [][]string
+	responses map[string]error
+	outputs   map[string]string
+}
+
+func (f *fakeRunner) Run(_ context.Context, name string, args ...string) (string, error) {
+	call := append([]string{name}, args...)
+	f.calls = append(f.calls, call)
+
+	key := strings.Join(call, " ")
+	if err, ok := f.responses[key]; ok {
+		return "", err
+	}
+	return f.outputs[key], nil
+}
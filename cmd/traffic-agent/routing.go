@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/intercept"
+	"github.com/ftechmax/krun/internal/streamconn"
+)
+
+const (
+	// maxRequestHeadBytes bounds how much of a connection is buffered while
+	// looking for the end of the HTTP request head.
+	maxRequestHeadBytes = 16 * 1024
+	requestHeadTimeout  = 5 * time.Second
+	targetDialTimeout   = 5 * time.Second
+	// openAckTimeout bounds how long a caller is held while the helper
+	// dials the local app (its own dial timeout is 2s). A helper holding
+	// the open for a restarting app renews it with hold envelopes; the
+	// manager acks at once for helpers that never send open-ack.
+	openAckTimeout = 5 * time.Second
+)
+
+var requestHeadTerminator = []byte("\r\n\r\n")
+
+// routeStream is the manager stream and connection table of one session.
+type routeStream struct {
+	route       routeConfig
+	client      *reconnectingStreamClient
+	connections *streamconn.Registry
+	opens       *openWaiters
+	mirrorTaps  sync.Map
+	// released is closed once the manager released the session.
+	released    chan struct{}
+	releaseOnce sync.Once
+}
+
+// openWaiters hands the helper's reply to an open back to the goroutine
+// holding the caller's connection.
+type openWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]chan contracts.StreamEnvelope
+}
+
+// connectionRouter hands each connection intercepted on one target port to
+// the first intercept session whose headers match, or to the application
+// container when no session claims it. Matching mirror sessions get a copy
+// either way.
+type connectionRouter struct {
+	targetPort    int
+	streams       []*routeStream
+	headerRouting bool
+}
+
+func loadInterceptRoutes() ([]contracts.InterceptRoute, error) {
+	if raw := strings.TrimSpace(os.Getenv(interceptRoutesEnv)); raw != "" {
+		var routes []contracts.InterceptRoute
+		if err := json.Unmarshal([]byte(raw), &routes); err != nil {
+			return nil, fmt.Errorf("%s must be a JSON route list: %w", interceptRoutesEnv, err)
+		}
+		if len(routes) == 0 {
+			return nil, fmt.Errorf("%s must contain at least one route", interceptRoutesEnv)
+		}
+		for idx := range routes {
+			routes[idx].SessionID = strings.TrimSpace(routes[idx].SessionID)
+			if routes[idx].SessionID == "" {
+				return nil, fmt.Errorf("%s: route %d is missing session_id", interceptRoutesEnv, idx)
+			}
+			routes[idx].SessionToken = strings.TrimSpace(routes[idx].SessionToken)
+			routes[idx].Headers = intercept.NormalizeHeaders(routes[idx].Headers)
+			for _, port := range routes[idx].Ports {
+				if err := validatePort(port); err != nil {
+					return nil, fmt.Errorf("%s: route %d port %d %w", interceptRoutesEnv, idx, port, err)
+				}
+			}
+		}
+		intercept.SortRoutes(routes)
+		return routes, nil
+	}
+
+	sessionID := strings.TrimSpace(os.Getenv(sessionIDEnv))
+	if sessionID == "" {
+		return nil, fmt.Errorf("%s or %s is required", sessionIDEnv, interceptRoutesEnv)
+	}
+	return []contracts.InterceptRoute{{
+		SessionID:    sessionID,
+		SessionToken: strings.TrimSpace(os.Getenv(sessionTokenEnv)),
+	}}, nil
+}
+
+func describeRoutes(routes []routeConfig) string {
+	parts := make([]string, 0, len(routes))
+	for _, route := range routes {
+		if len(route.Headers) == 0 {
+			parts = append(parts, route.SessionID+"[*]")
+			continue
+		}
+		parts = append(parts, route.SessionID+"["+intercept.FormatHeaders(route.Headers)+"]")
+	}
+	return strings.Join(parts, " ")
+}
+
+// startRouteStream connects the route to its session. An ephemeral agent
+// also takes a refused reconnect as the release of its session.
+func startRouteStream(ctx context.Context, route routeConfig, ephemeral bool) *routeStream {
+	client := newReconnectingStreamClient(ctx, route, nil, nil)
+	connections := newConnectionRegistry(ctx, route, client)
+	opens := newOpenWaiters()
+
+	// While the stream is down the manager holds flow-controlled
+	// connections for a while, so they are suspended and resumed after
+	// reconnect; the rest cannot be resumed and are closed instead of
+	// streaming into the void. Callers still waiting on an open fall back
+	// to the application container; mirrored connections just stop being
+	// copied.
+	var stream *routeStream
+	client.onConnect = connections.Reattach
+	client.onDisconnect = func() {
+		connections.Suspend()
+		opens.failAll()
+		stream.stopAllMirrors()
+	}
+	client.onReceive = func(envelope contracts.StreamEnvelope) {
+		if envelope.Type == contracts.StreamTypeRelease {
+			stream.release()
+			return
+		}
+		if opens.resolve(envelope) || stream.stopMirror(envelope) {
+			return
+		}
+		if envelope.Type == contracts.StreamTypeResume || envelope.Type == contracts.StreamTypeResumed {
+			// Replays wait for the send queue this goroutine drains.
+			go stream.resumeConnection(ctx, envelope)
+			return
+		}
+		handleInboundEnvelope(connections, envelope)
+	}
+	stream = &routeStream{
+		route:       route,
+		client:      client,
+		connections: connections,
+		opens:       opens,
+		released:    make(chan struct{}),
+	}
+	if ephemeral {
+		client.onGone = stream.release
+	}
+	client.start()
+	return stream
+}
+
+func (s *routeStream) release() {
+	s.releaseOnce.Do(func() {
+		log.Printf("session released (session_id=%s)", s.route.SessionID)
+		close(s.released)
+	})
+}
+
+// isReleased reports whether the manager released the session. An
+// ephemeral agent can outlive some of its sessions; their routes no longer
+// claim connections.
+func (s *routeStream) isReleased() bool {
+	select {
+	case <-s.released:
+		return true
+	default:
+		return false
+	}
+}
+
+// allReleased is closed once every stream's session was released.
+func allReleased(streams []*routeStream) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for _, stream := range streams {
+			<-stream.released
+		}
+		close(done)
+	}()
+	return done
+}
+
+// newConnectionRegistry tracks the route's intercepted connections and
+// sends what they report to the helper over client.
+func newConnectionRegistry(ctx context.Context, route routeConfig, client *reconnectingStreamClient) *streamconn.Registry {
+	return streamconn.NewRegistry(streamconn.Hooks{
+		Send: func(connectionID string, chunk streamconn.Chunk) error {
+			envelope := route.newStreamEnvelope(connectionID, contracts.StreamTypeData)
+			if chunk.CloseWrite {
+				envelope.Type = contracts.StreamTypeCloseWrite
+			}
+			envelope.Data = chunk.Data
+			envelope.Seq = chunk.Seq
+			return client.Send(ctx, envelope)
+		},
+		Resume: func(connectionID string, reply bool, received uint64, credited int) {
+			envelope := route.newStreamEnvelope(connectionID, contracts.StreamTypeResume)
+			if reply {
+				envelope.Type = contracts.StreamTypeResumed
+			}
+			envelope.Seq = received
+			envelope.Window = credited
+			_ = client.Send(ctx, envelope)
+		},
+		Credit: func(connectionID string, bytes int, received uint64) {
+			envelope := route.newStreamEnvelope(connectionID, contracts.StreamTypeWindow)
+			envelope.Window = bytes
+			envelope.Seq = received
+			_ = client.Send(ctx, envelope)
+		},
+		Closed: func(connectionID string) {
+			_ = client.Send(ctx, route.newStreamEnvelope(connectionID, contracts.StreamTypeClose))
+		},
+		Failed: func(connectionID string, err error) {
+			errorEnvelope := route.newStreamEnvelope(connectionID, contracts.StreamTypeError)
+			errorEnvelope.Message = fmt.Sprintf("write to caller: %v", err)
+			_ = client.Send(ctx, errorEnvelope)
+			_ = client.Send(ctx, route.newStreamEnvelope(connectionID, contracts.StreamTypeClose))
+		},
+	})
+}
+
+// resumeConnection answers the helper's resume of an intercepted
+// connection, or completes the agent's own. A connection the agent no
+// longer has is closed on the helper's side too.
+func (s *routeStream) resumeConnection(ctx context.Context, envelope contracts.StreamEnvelope) {
+	connectionID := strings.TrimSpace(envelope.ConnectionID)
+	reply := envelope.Type == contracts.StreamTypeResume
+	err := s.connections.Resume(connectionID, envelope.Seq, envelope.Window, reply)
+	if !errors.Is(err, streamconn.ErrUnknownConnection) {
+		return
+	}
+	errorEnvelope := s.route.newStreamEnvelope(connectionID, contracts.StreamTypeError)
+	errorEnvelope.Message = err.Error()
+	_ = s.client.Send(ctx, errorEnvelope)
+	_ = s.client.Send(ctx, s.route.newStreamEnvelope(connectionID, contracts.StreamTypeClose))
+}
+
+func (s *routeStream) Close() {
+	s.client.Close()
+	s.connections.CloseAll()
+}
+
+// streamsForPort picks the streams of the routes that intercept port.
+func streamsForPort(streams []*routeStream, port int, primary int) []*routeStream {
+	var selected []*routeStream
+	for _, stream := range streams {
+		if slices.Contains(stream.route.targetPorts(primary), port) {
+			selected = append(selected, stream)
+		}
+	}
+	return selected
+}
+
+func newConnectionRouter(targetPort int, streams []*routeStream) *connectionRouter {
+	headerRouting := false
+	for _, stream := range streams {
+		if stream.route.matchesHeadersOn(targetPort) {
+			headerRouting = true
+			break
+		}
+	}
+	return &connectionRouter{
+		targetPort:    targetPort,
+		streams:       streams,
+		headerRouting: headerRouting,
+	}
+}
+
+// openConnection announces a connection to the session's client and waits
+// for the helper to confirm it reached the local app. Nothing is read from
+// the caller meanwhile, so a refused open loses no bytes. It returns the
+// send credit the helper granted, nil for helpers without flow control.
+func (s *routeStream) openConnection(ctx context.Context, conn net.Conn, connectionID string, targetPort int) (*streamconn.Window, error) {
+	if !s.client.Connected() {
+		return nil, errors.New("manager stream is not attached")
+	}
+
+	reply := s.opens.register(connectionID)
+	defer s.opens.cancel(connectionID)
+
+	openEnvelope := s.route.newStreamEnvelope(connectionID, contracts.StreamTypeOpen)
+	openEnvelope.Metadata = openMetadata(conn, targetPort)
+	openEnvelope.Window = streamconn.DefaultWindow
+	if err := s.client.Send(ctx, openEnvelope); err != nil {
+		return nil, fmt.Errorf("send open envelope: %w", err)
+	}
+
+	timer := time.NewTimer(openAckTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case envelope := <-reply:
+			if envelope.Type == contracts.StreamTypeHold {
+				// The helper waits for the local app to come back; keep the
+				// caller a while longer.
+				timer.Reset(openAckTimeout)
+				continue
+			}
+			if envelope.Type == contracts.StreamTypeOpenAck {
+				if envelope.Window > 0 {
+					return streamconn.NewWindow(envelope.Window), nil
+				}
+				return nil, nil
+			}
+			if envelope.Message != "" {
+				return nil, errors.New(envelope.Message)
+			}
+			return nil, fmt.Errorf("open refused (%s)", envelope.Type)
+		case <-timer.C:
+			// A late ack would leave the helper holding a local conn nobody
+			// feeds; tell it to drop the connection.
+			_ = s.client.Send(ctx, s.route.newStreamEnvelope(connectionID, contracts.StreamTypeClose))
+			return nil, errors.New("timed out waiting for the local client")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// openMetadata describes an intercepted connection to the helper. The
+// target port tells it which local port serves the connection.
+func openMetadata(conn net.Conn, targetPort int) map[string]string {
+	return map[string]string{
+		"remote_addr":                      conn.RemoteAddr().String(),
+		"local_addr":                       conn.LocalAddr().String(),
+		contracts.StreamMetadataTargetPort: strconv.Itoa(targetPort),
+	}
+}
+
+func newOpenWaiters() *openWaiters {
+	return &openWaiters{waiters: map[string]chan contracts.StreamEnvelope{}}
+}
+
+func (w *openWaiters) register(connectionID string) <-chan contracts.StreamEnvelope {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Room for a pending hold and the final reply, so resolve never
+	// blocks on an open that gave up.
+	reply := make(chan contracts.StreamEnvelope, 2)
+	w.waiters[connectionID] = reply
+	return reply
+}
+
+func (w *openWaiters) cancel(connectionID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.waiters, connectionID)
+}
+
+// resolve delivers the first reply to a pending open and reports whether
+// the envelope was consumed. Hold envelopes keep the open pending.
+func (w *openWaiters) resolve(envelope contracts.StreamEnvelope) bool {
+	switch envelope.Type {
+	case contracts.StreamTypeOpenAck, contracts.StreamTypeError, contracts.StreamTypeClose, contracts.StreamTypeHold:
+	default:
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	reply, ok := w.waiters[strings.TrimSpace(envelope.ConnectionID)]
+	if !ok {
+		return envelope.Type == contracts.StreamTypeHold
+	}
+	if envelope.Type == contracts.StreamTypeHold {
+		// One pending hold renews the open as well as several.
+		if len(reply) == 0 {
+			reply <- envelope
+		}
+		return true
+	}
+	delete(w.waiters, strings.TrimSpace(envelope.ConnectionID))
+	reply <- envelope
+	return true
+}
+
+func (w *openWaiters) failAll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for connectionID, reply := range w.waiters {
+		reply <- contracts.StreamEnvelope{
+			Type:         contracts.StreamTypeError,
+			ConnectionID: connectionID,
+			Message:      "manager stream disconnected",
+		}
+		delete(w.waiters, connectionID)
+	}
+}
+
+// handle routes one intercepted connection. Connections no session claims,
+// or whose session cannot take them right now (no attached client, local
+// app not listening), go to the application container, so a debug session
+// never takes the service down for everyone else.
+func (r *connectionRouter) handle(ctx context.Context, conn net.Conn) {
+	stream, mirrors, prefix := r.selectStreams(conn)
+	connectionID := fmt.Sprintf("%s-%d", agentID, connectionCounter.Add(1))
+	conn = startMirrors(conn, connectionID, r.targetPort, mirrors, prefix)
+	if stream == nil {
+		proxyToTarget(ctx, conn, r.targetPort, prefix)
+		return
+	}
+
+	window, err := stream.openConnection(ctx, conn, connectionID, r.targetPort)
+	if err != nil {
+		log.Printf(
+			"session %s cannot take connection %s, passing it through: %v",
+			stream.route.SessionID,
+			connectionID,
+			err,
+		)
+		proxyToTarget(ctx, conn, r.targetPort, prefix)
+		return
+	}
+	captureConnection(ctx, conn, connectionID, prefix, window, stream.route, stream.client, stream.connections)
+}
+
+// selectStreams picks the intercept session that owns a connection and
+// the mirror sessions that watch it. Without header routes nothing is read
+// up front; otherwise the request head is buffered and returned so it can
+// be replayed to whichever side gets the connection. Routing is per
+// connection: only the first request head is read, and later requests on
+// a keep-alive connection follow it. Ports the Service marks as not HTTP
+// are never read, so server-first protocols are not held for the head
+// timeout.
+func (r *connectionRouter) selectStreams(conn net.Conn) (*routeStream, []*routeStream, []byte) {
+	var prefix []byte
+	var header http.Header
+	if r.headerRouting {
+		prefix, header = readRequestHead(conn, requestHeadTimeout)
+	}
+
+	var owner *routeStream
+	var mirrors []*routeStream
+	for _, stream := range r.streams {
+		if stream.isReleased() || (len(stream.route.Headers) > 0 && !stream.route.matchesHeadersOn(r.targetPort)) {
+			continue
+		}
+		if !intercept.Matches(stream.route.Headers, header) {
+			continue
+		}
+		if stream.route.Mirror {
+			mirrors = append(mirrors, stream)
+			continue
+		}
+		if owner == nil {
+			owner = stream
+		}
+	}
+	return owner, mirrors, prefix
+}
+
+// matchesHeadersOn reports whether the route picks connections on port by
+// their request headers.
+func (cfg routeConfig) matchesHeadersOn(port int) bool {
+	return len(cfg.Headers) > 0 && !slices.Contains(cfg.OpaquePorts, port)
+}
+
+// readRequestHead reads until the end of the HTTP request head, the size
+// limit, or the timeout, and parses the headers it got. A nil header means
+// the bytes were not a complete HTTP request head; such connections only
+// match the catch-all route.
+func readRequestHead(conn net.Conn, timeout time.Duration) ([]byte, http.Header) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, 0, 4096)
+	chunk := make([]byte, 4096)
+	for len(buffer) < maxRequestHeadBytes && !bytes.Contains(buffer, requestHeadTerminator) {
+		readBytes, err := conn.Read(chunk)
+		buffer = append(buffer, chunk[:readBytes]...)
+		if err != nil {
+			break
+		}
+	}
+	if !bytes.Contains(buffer, requestHeadTerminator) {
+		return buffer, nil
+	}
+
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buffer)))
+	if err != nil {
+		return buffer, nil
+	}
+	header := request.Header
+	// net/http lifts Host out of the header map; put it back so sessions
+	// can route on it like any other header.
+	if request.Host != "" {
+		header.Set("Host", request.Host)
+	}
+	return buffer, header
+}
+
+// proxyToTarget hands a connection no session claimed to the application
+// container. The redirect rule only applies to PREROUTING, so dialing the
+// target port from inside the pod reaches the app directly.
+func proxyToTarget(ctx context.Context, conn net.Conn, targetPort int, prefix []byte) {
+	defer conn.Close()
+
+	host := "127.0.0.1"
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP != nil && !local.IP.IsUnspecified() {
+		host = local.IP.String()
+	}
+	dialer := net.Dialer{Timeout: targetDialTimeout}
+	upstream, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(targetPort)))
+	if err != nil {
+		log.Printf("pass-through dial to target port %d failed: %v", targetPort, err)
+		return
+	}
+	defer upstream.Close()
+
+	if len(prefix) > 0 {
+		if _, err := upstream.Write(prefix); err != nil {
+			return
+		}
+	}
+	pipeConnections(ctx, conn, upstream)
+}
+
+// pipeConnections copies both directions until each side is done,
+// forwarding half-closes so request/response protocols finish cleanly.
+func pipeConnections(ctx context.Context, a net.Conn, b net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = a.Close()
+			_ = b.Close()
+		case <-done:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	copyHalf := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil && !errors.Is(err, net.ErrClosed) {
+			_ = a.Close()
+			_ = b.Close()
+			return
+		}
+		closeWrite(dst)
+	}
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = halfCloser.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
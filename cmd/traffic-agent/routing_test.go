@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/streamcodec"
+	"github.com/ftechmax/krun/internal/streamconn"
+	"github.com/gorilla/websocket"
+)
+
+func TestLoadRuntimeConfigWithInterceptRoutes(t *testing.T) {
+	t.Setenv(managerAddressEnv, "http://manager.default.svc:8080")
+	t.Setenv(targetPortEnv, "8080")
+	t.Setenv(interceptRoutesEnv, `[
+		{"session_id":"catch-all","session_token":"t0"},
+		{"session_id":"alice","session_token":"t1","headers":{"x-krun-intercept":"alice"}}
+	]`)
+
+	cfg, err := loadRuntimeConfig()
+	if err != nil {
+		t.Fatalf("loadRuntimeConfig returned error: %v", err)
+	}
+	if len(cfg.Routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(cfg.Routes))
+	}
+	if cfg.Routes[0].SessionID != "alice" || cfg.Routes[0].Headers["X-Krun-Intercept"] != "alice" {
+		t.Fatalf("expected header route first, got %+v", cfg.Routes[0])
+	}
+	if cfg.Routes[1].StreamURL != "ws://manager.default.svc:8080/v1/stream/agent?session_id=catch-all" {
+		t.Fatalf("unexpected stream url %q", cfg.Routes[1].StreamURL)
+	}
+}
+
+func TestLoadRuntimeConfigCollectsInterceptedPorts(t *testing.T) {
+	t.Setenv(managerAddressEnv, "http://manager.default.svc:8080")
+	t.Setenv(targetPortEnv, "8080")
+	t.Setenv(interceptRoutesEnv, `[
+		{"session_id":"grpc","ports":[9090,8080]},
+		{"session_id":"metrics","headers":{"x-krun-intercept":"alice"},"ports":[9100,7000]},
+		{"session_id":"catch-all"}
+	]`)
+
+	cfg, err := loadRuntimeConfig()
+	if err != nil {
+		t.Fatalf("loadRuntimeConfig returned error: %v", err)
+	}
+	if !slices.Equal(cfg.TargetPorts, []int{8080, 7000, 9090, 9100}) {
+		t.Fatalf("expected every port once with the primary first, got %v", cfg.TargetPorts)
+	}
+
+	streams := make([]*routeStream, 0, len(cfg.Routes))
+	for _, route := range cfg.Routes {
+		streams = append(streams, &routeStream{route: route})
+	}
+	served := streamsForPort(streams, 8080, cfg.TargetPort)
+	if len(served) != 2 || served[0].route.SessionID != "catch-all" || served[1].route.SessionID != "grpc" {
+		t.Fatalf("expected the catch-all and grpc routes on the primary port, got %d streams", len(served))
+	}
+	if served := streamsForPort(streams, 9100, cfg.TargetPort); len(served) != 1 || served[0].route.SessionID != "metrics" {
+		t.Fatalf("expected only the metrics route on 9100, got %d streams", len(served))
+	}
+}
+
+func TestLoadInterceptRoutesRejectsMissingSessionID(t *testing.T) {
+	t.Setenv(interceptRoutesEnv, `[{"headers":{"x-krun-intercept":"alice"}}]`)
+
+	if _, err := loadInterceptRoutes(); err == nil {
+		t.Fatal("expected error for route without session id")
+	}
+}
+
+func TestReadRequestHeadParsesHeaders(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	request := "GET /orders HTTP/1.1\r\nHost: orders-api\r\nX-Krun-Intercept: alice\r\n\r\nbody"
+	go func() {
+		_, _ = client.Write([]byte(request))
+	}()
+
+	prefix, header := readRequestHead(server, time.Second)
+	if !strings.HasPrefix(request, string(prefix)) || !strings.Contains(string(prefix), "\r\n\r\n") {
+		t.Fatalf("expected buffered request head, got %q", prefix)
+	}
+	if header.Get("X-Krun-Intercept") != "alice" {
+		t.Fatalf("expected intercept header, got %v", header)
+	}
+	if header.Get("Host") != "orders-api" {
+		t.Fatalf("expected host header, got %v", header)
+	}
+}
+
+func TestReadRequestHeadReturnsNilHeaderForNonHTTP(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("\x16\x03\x01binary"))
+		_ = client.Close()
+	}()
+
+	prefix, header := readRequestHead(server, time.Second)
+	if header != nil {
+		t.Fatalf("expected nil header, got %v", header)
+	}
+	if string(prefix) != "\x16\x03\x01binary" {
+		t.Fatalf("expected raw bytes to be kept, got %q", prefix)
+	}
+}
+
+func TestConnectionRouterSelectsMatchingRoute(t *testing.T) {
+	alice := &routeStream{route: routeConfig{InterceptRoute: contracts.InterceptRoute{
+		SessionID: "alice",
+		Headers:   map[string]string{"X-Krun-Intercept": "alice"},
+	}}}
+	catchAll := &routeStream{route: routeConfig{InterceptRoute: contracts.InterceptRoute{SessionID: "catch-all"}}}
+	releasedAlice := &routeStream{route: alice.route, released: make(chan struct{})}
+	releasedAlice.release()
+
+	cases := []struct {
+		name    string
+		streams []*routeStream
+		request string
+		want    *routeStream
+	}{
+		{"header match", []*routeStream{alice, catchAll}, "GET / HTTP/1.1\r\nX-Krun-Intercept: alice\r\n\r\n", alice},
+		{"falls to catch-all", []*routeStream{alice, catchAll}, "GET / HTTP/1.1\r\nX-Krun-Intercept: bob\r\n\r\n", catchAll},
+		{"no match passes through", []*routeStream{alice}, "GET / HTTP/1.1\r\n\r\n", nil},
+		{"released route skipped", []*routeStream{releasedAlice, catchAll}, "GET / HTTP/1.1\r\nX-Krun-Intercept: alice\r\n\r\n", catchAll},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				_, _ = client.Write([]byte(tc.request))
+			}()
+
+			router := newConnectionRouter(8080, tc.streams)
+			got, _, prefix := router.selectStreams(server)
+			if got != tc.want {
+				t.Fatalf("unexpected route selected: %+v", got)
+			}
+			if string(prefix) != tc.request {
+				t.Fatalf("expected request head to be kept for replay, got %q", prefix)
+			}
+		})
+	}
+}
+
+func TestConnectionRouterSkipsHeadersOnOpaquePorts(t *testing.T) {
+	alice := &routeStream{route: routeConfig{InterceptRoute: contracts.InterceptRoute{
+		SessionID:   "alice",
+		Headers:     map[string]string{"X-Krun-Intercept": "alice"},
+		Ports:       []int{8080, 3306},
+		OpaquePorts: []int{3306},
+	}}}
+	catchAll := &routeStream{route: routeConfig{InterceptRoute: contracts.InterceptRoute{SessionID: "catch-all", Ports: []int{3306}}}}
+
+	router := newConnectionRouter(3306, []*routeStream{alice, catchAll})
+	if router.headerRouting {
+		t.Fatal("expected no header routing on an opaque port")
+	}
+	// The client of a server-first protocol sends nothing; the connection
+	// is handed on at once.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	start := time.Now()
+	got, _, prefix := router.selectStreams(server)
+	if got != catchAll || len(prefix) != 0 {
+		t.Fatalf("expected the catch-all route without reading, got %+v %q", got, prefix)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected no wait for a request head, took %v", elapsed)
+	}
+
+	if !newConnectionRouter(8080, []*routeStream{alice, catchAll}).headerRouting {
+		t.Fatal("expected header routing on the route's HTTP port")
+	}
+}
+
+func TestProxyToTargetReplaysPrefix(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		received, _ := io.ReadAll(conn)
+		_, _ = conn.Write([]byte("echo:" + string(received)))
+	}()
+	targetPort := upstream.Addr().(*net.TCPAddr).Port
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen front: %v", err)
+	}
+	defer front.Close()
+	go func() {
+		conn, err := front.Accept()
+		if err != nil {
+			return
+		}
+		proxyToTarget(context.Background(), conn, targetPort, []byte("head|"))
+	}()
+
+	caller, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatalf("dial front: %v", err)
+	}
+	defer caller.Close()
+	if _, err := caller.Write([]byte("body")); err != nil {
+		t.Fatalf("write body: %v", err)
+	}
+	_ = caller.(*net.TCPConn).CloseWrite()
+	_ = caller.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	response, err := io.ReadAll(caller)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if string(response) != "echo:head|body" {
+		t.Fatalf("unexpected response %q", response)
+	}
+}
+
+func newTestRouteStream(connected bool) *routeStream {
+	client := &reconnectingStreamClient{
+		sendCh: make(chan contracts.StreamEnvelope, 4),
+		doneCh: make(chan struct{}),
+	}
+	client.connected.Store(connected)
+	return &routeStream{
+		route:  routeConfig{InterceptRoute: contracts.InterceptRoute{SessionID: "session-1"}},
+		client: client,
+		opens:  newOpenWaiters(),
+	}
+}
+
+func TestOpenConnectionWaitsForAck(t *testing.T) {
+	stream := newTestRouteStream(true)
+	caller, agentSide := net.Pipe()
+	defer caller.Close()
+	defer agentSide.Close()
+
+	opened := make(chan contracts.StreamEnvelope, 1)
+	go func() {
+		open := <-stream.client.sendCh
+		opened <- open
+		stream.opens.resolve(contracts.StreamEnvelope{Type: contracts.StreamTypeOpenAck, ConnectionID: open.ConnectionID})
+	}()
+
+	window, err := stream.openConnection(context.Background(), agentSide, "conn-1", 8080)
+	if err != nil {
+		t.Fatalf("expected acknowledged open, got %v", err)
+	}
+	if window != nil {
+		t.Fatal("an ack without a window must leave the connection without flow control")
+	}
+	if open := <-opened; open.Metadata[contracts.StreamMetadataTargetPort] != "8080" {
+		t.Fatalf("expected the open to name its target port, got %v", open.Metadata)
+	}
+}
+
+func TestOpenConnectionNegotiatesWindow(t *testing.T) {
+	stream := newTestRouteStream(true)
+	caller, agentSide := net.Pipe()
+	defer caller.Close()
+	defer agentSide.Close()
+
+	advertised := make(chan int, 1)
+	go func() {
+		open := <-stream.client.sendCh
+		advertised <- open.Window
+		stream.opens.resolve(contracts.StreamEnvelope{Type: contracts.StreamTypeOpenAck, ConnectionID: open.ConnectionID, Window: 10})
+	}()
+
+	window, err := stream.openConnection(context.Background(), agentSide, "conn-1", 8080)
+	if err != nil {
+		t.Fatalf("expected acknowledged open, got %v", err)
+	}
+	if got := <-advertised; got != streamconn.DefaultWindow {
+		t.Fatalf("expected the open to advertise the receive window, got %d", got)
+	}
+	if available, err := window.Acquire(context.Background(), 64); err != nil || available != 10 {
+		t.Fatalf("expected the helper's window as send credit, got %d err=%v", available, err)
+	}
+}
+
+func TestOpenConnectionFailsWhenRefused(t *testing.T) {
+	stream := newTestRouteStream(true)
+	caller, agentSide := net.Pipe()
+	defer caller.Close()
+	defer agentSide.Close()
+
+	go func() {
+		open := <-stream.client.sendCh
+		stream.opens.resolve(contracts.StreamEnvelope{
+			Type:         contracts.StreamTypeError,
+			ConnectionID: open.ConnectionID,
+			Message:      "no helper client stream attached",
+		})
+	}()
+
+	_, err := stream.openConnection(context.Background(), agentSide, "conn-1", 8080)
+	if err == nil || !strings.Contains(err.Error(), "no helper client") {
+		t.Fatalf("expected refusal error, got %v", err)
+	}
+}
+
+func TestOpenConnectionFailsFastWithoutStream(t *testing.T) {
+	stream := newTestRouteStream(false)
+	caller, agentSide := net.Pipe()
+	defer caller.Close()
+	defer agentSide.Close()
+
+	if _, err := stream.openConnection(context.Background(), agentSide, "conn-1", 8080); err == nil {
+		t.Fatal("expected error while the manager stream is detached")
+	}
+	if len(stream.client.sendCh) != 0 {
+		t.Fatal("no open must be sent while the manager stream is detached")
+	}
+}
+
+func TestOpenWaitersFailAllReleasesPendingOpens(t *testing.T) {
+	waiters := newOpenWaiters()
+	reply := waiters.register("conn-1")
+
+	waiters.failAll()
+
+	select {
+	case envelope := <-reply:
+		if envelope.Type != contracts.StreamTypeError {
+			t.Fatalf("expected error reply, got %q", envelope.Type)
+		}
+	default:
+		t.Fatal("expected pending open to be released")
+	}
+	if waiters.resolve(contracts.StreamEnvelope{Type: contracts.StreamTypeOpenAck, ConnectionID: "conn-1"}) {
+		t.Fatal("late ack must not be consumed after failAll")
+	}
+}
+
+func TestResumeConnectionReplaysWhatTheHelperMissed(t *testing.T) {
+	stream := newTestRouteStream(true)
+	stream.connections = newConnectionRegistry(context.Background(), stream.route, stream.client)
+	caller, agentSide := net.Pipe()
+	defer caller.Close()
+	stream.connections.Set("conn-1", agentSide, streamconn.NewWindow(streamconn.DefaultWindow))
+	defer stream.connections.CloseAll()
+
+	if err := stream.connections.SendData("conn-1", []byte("lost")); err != nil {
+		t.Fatalf("send data: %v", err)
+	}
+	<-stream.client.sendCh
+
+	stream.resumeConnection(context.Background(), contracts.StreamEnvelope{Type: contracts.StreamTypeResume, ConnectionID: "conn-1"})
+	if envelope := <-stream.client.sendCh; envelope.Type != contracts.StreamTypeResumed {
+		t.Fatalf("expected the agent's resume state first, got %+v", envelope)
+	}
+	if envelope := <-stream.client.sendCh; envelope.Type != contracts.StreamTypeData || envelope.Seq != 1 || string(envelope.Data) != "lost" {
+		t.Fatalf("expected the unacknowledged data replayed, got %+v", envelope)
+	}
+
+	stream.resumeConnection(context.Background(), contracts.StreamEnvelope{Type: contracts.StreamTypeResume, ConnectionID: "conn-2"})
+	if envelope := <-stream.client.sendCh; envelope.Type != contracts.StreamTypeError {
+		t.Fatalf("expected an unknown connection to be refused, got %+v", envelope)
+	}
+	if envelope := <-stream.client.sendCh; envelope.Type != contracts.StreamTypeClose {
+		t.Fatalf("expected the refused connection closed, got %+v", envelope)
+	}
+}
+
+func TestOpenConnectionWaitsWhileHelperHolds(t *testing.T) {
+	stream := newTestRouteStream(true)
+	caller, agentSide := net.Pipe()
+	defer caller.Close()
+	defer agentSide.Close()
+
+	go func() {
+		open := <-stream.client.sendCh
+		for range 3 {
+			if !stream.opens.resolve(contracts.StreamEnvelope{Type: contracts.StreamTypeHold, ConnectionID: open.ConnectionID}) {
+				return
+			}
+		}
+		stream.opens.resolve(contracts.StreamEnvelope{Type: contracts.StreamTypeOpenAck, ConnectionID: open.ConnectionID})
+	}()
+
+	if _, err := stream.openConnection(context.Background(), agentSide, "conn-1", 8080); err != nil {
+		t.Fatalf("expected the open to outlast the holds, got %v", err)
+	}
+}
+
+func TestRouteStreamReleasedByManager(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: streamcodec.Subprotocols}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = streamcodec.Write(conn, contracts.StreamEnvelope{Type: contracts.StreamTypeRelease, SessionID: "session-1"})
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := startRouteStream(ctx, testRouteConfig(t, server.URL), false)
+	defer stream.Close()
+
+	select {
+	case <-allReleased([]*routeStream{stream}):
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the release envelope to release the session")
+	}
+}
+
+func TestEphemeralRouteStreamReleasedWhenSessionIsGone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "session not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := startRouteStream(ctx, testRouteConfig(t, server.URL), true)
+	defer stream.Close()
+
+	select {
+	case <-stream.released:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a refused reconnect to release an ephemeral agent's session")
+	}
+}
+
+func testRouteConfig(t *testing.T, serverURL string) routeConfig {
+	t.Helper()
+	streamURL, err := buildStreamURL(serverURL, "session-1")
+	if err != nil {
+		t.Fatalf("build stream url: %v", err)
+	}
+	return routeConfig{
+		InterceptRoute: contracts.InterceptRoute{SessionID: "session-1"},
+		StreamURL:      streamURL,
+	}
+}
@@ -3,16 +3,19 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -20,9 +23,12 @@ import (
 
 	"github.com/ftechmax/krun/internal/contracts"
 	"github.com/ftechmax/krun/internal/kube"
+	"github.com/ftechmax/krun/internal/streamcodec"
 	"github.com/ftechmax/krun/internal/traffic-manager/agent"
+	"github.com/ftechmax/krun/internal/traffic-manager/controller"
 	sessionregistry "github.com/ftechmax/krun/internal/traffic-manager/session"
 	streamrelay "github.com/ftechmax/krun/internal/traffic-manager/stream"
+	"github.com/ftechmax/krun/internal/traffic-manager/webhook"
 	"github.com/gorilla/websocket"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -31,34 +37,73 @@ import (
 )
 
 var (
-	version                        = "debug" // will be set by the build system
-	sessionRegistry                = sessionregistry.NewDebugSessionRegistry()
-	sidecarBridge   agent.Injector = agent.NoopInjector{}
-	relayRegistry                  = streamrelay.NewSessionRelayRegistry()
-	streamUpgrader                 = websocket.Upgrader{
+	version                               = "debug" // will be set by the build system
+	sessionRegistry                       = sessionregistry.NewDebugSessionRegistry()
+	sidecarBridge   agent.Injector        = agent.NoopInjector{}
+	sessionStore    sessionregistry.Store = sessionregistry.NoopStore{}
+	relayRegistry                         = streamrelay.NewSessionRelayRegistry()
+	meshDetector    strategyDetector
+	streamUpgrader  = websocket.Upgrader{
+		CheckOrigin: func(_ *http.Request) bool { return true },
+		// Peers that offer no subprotocol (older agents and helpers) get
+		// none back and stay on JSON envelopes.
+		Subprotocols: streamcodec.Subprotocols,
+	}
+	// udpUpgrader serves the UDP relay, whose messages are raw datagrams
+	// rather than stream envelopes.
+	udpUpgrader = websocket.Upgrader{
 		CheckOrigin: func(_ *http.Request) bool { return true },
 	}
 	errStreamSessionNotFound = errors.New("session not found")
 	errStreamUnauthorized    = errors.New("invalid session token")
 	managerAuthToken         string
+	sessionLeaseTTL          = defaultSessionLeaseTTL
 )
 
 const (
 	defaultListenAddress = ":8080"
+	webhookListenAddress = ":8443"
 
 	envAgentContainerName    = "KRUN_AGENT_CONTAINER_NAME"
+	envAgentDiagnostics      = "KRUN_AGENT_DIAGNOSTICS"
 	envAgentImage            = "KRUN_AGENT_IMAGE"
 	envAgentImagePullPolicy  = "KRUN_AGENT_IMAGE_PULL_POLICY"
+	envAgentInitRedirect     = "KRUN_AGENT_INIT_REDIRECT"
 	envAgentProbePort        = "KRUN_AGENT_PROBE_PORT"
 	envManagerAddress        = "KRUN_MANAGER_ADDRESS"
+	envSessionLeaseTTL       = "KRUN_SESSION_LEASE_TTL"
+	envSessionStore          = "KRUN_SESSION_STORE"
+	envSidecarInjection      = "KRUN_SIDECAR_INJECTION"
 	streamSessionIDQuery     = "session_id"
 	streamSessionTokenQuery  = "session_token"
 	streamSessionIDHeader    = "X-Krun-Session-ID"
 	streamSessionTokenHeader = "X-Krun-Session-Token"
 
-	managerNamespace = "krun-system"
-	authSecretName   = "krun-manager-auth"
-	authSecretKey    = "token"
+	managerNamespace   = "krun-system"
+	managerServiceName = "krun-traffic-manager"
+	authSecretName     = "krun-manager-auth"
+	authSecretKey      = "token"
+	// Debug sessions are persisted here so a restarted manager can keep
+	// the sidecars that still serve them.
+	sessionsSecretName  = "krun-sessions"
+	sessionStoreTimeout = 10 * time.Second
+	// KRUN_SESSION_STORE selects where sessions live: the Secret above,
+	// or DebugSession resources reconciled by the session controller.
+	// "configmap", the store's name before it moved to a Secret, still
+	// selects it.
+	sessionStoreSecret          = "secret"
+	sessionStoreLegacyConfigMap = "configmap"
+	sessionStoreCRD             = "crd"
+	// KRUN_SIDECAR_INJECTION selects how sidecars get into pods: patched
+	// into the workload's pod template, or added to each pod at admission
+	// by the manager's own webhook, served on the Service's webhook port.
+	sidecarInjectionTemplate = "template"
+	sidecarInjectionWebhook  = "webhook"
+	webhookServicePort       = 443
+	// A session whose helper has not renewed its lease for its TTL is
+	// considered abandoned (laptop asleep, helper crashed) and reaped.
+	defaultSessionLeaseTTL = 15 * time.Minute
+	sessionReapInterval    = 30 * time.Second
 	// Session CRUD requires this shared-token header. A custom header is
 	// used because the API server consumes Authorization for its own
 	// authentication and does not forward it through the service proxy.
@@ -77,7 +122,17 @@ func run() error {
 	if err != nil {
 		return fmt.Errorf("initialize kubernetes client: %w", err)
 	}
-	initializeInjector(client.Clientset)
+	admission, err := initializeInjector(client)
+	if err != nil {
+		return err
+	}
+	if err := initializeSessionLeaseTTL(); err != nil {
+		return err
+	}
+	storeKind, err := initializeSessionStore(client)
+	if err != nil {
+		return err
+	}
 
 	startupCtx, cancelStartup := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancelStartup()
@@ -86,8 +141,8 @@ func run() error {
 		return err
 	}
 
-	log.Printf("cleaning up dangling traffic-agent sidecars")
-	if err := cleanupDanglingAgents(startupCtx); err != nil {
+	log.Printf("restoring debug sessions and reconciling traffic-agent sidecars")
+	if err := restoreSessions(startupCtx); err != nil {
 		return err
 	}
 
@@ -98,14 +153,27 @@ func run() error {
 	log.Printf("krun traffic-manager listening on %s", defaultListenAddress)
 	log.Printf("version: %s", version)
 
-	serverErrCh := make(chan error, 1)
+	servers := []*http.Server{server}
+	serverErrCh := make(chan error, 2)
 	go func() {
 		serverErrCh <- server.ListenAndServe()
 	}()
+	if admission != nil {
+		webhookServer, err := startAdmissionWebhook(startupCtx, client.Clientset, admission, serverErrCh)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, webhookServer)
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	go runSessionReaper(ctx)
+	if storeKind == sessionStoreCRD {
+		go controller.New(client.DynamicClient, sessionRegistry, sidecarBridge, relayRegistry, sessionStore).Run(ctx)
+	}
+
 	select {
 	case err := <-serverErrCh:
 		if err == http.ErrServerClosed {
@@ -116,11 +184,22 @@ func run() error {
 		log.Printf("received shutdown signal, shutting down traffic-manager")
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		if err := server.Shutdown(shutdownCtx); err != nil {
-			return fmt.Errorf("shutdown server: %w", err)
+		if admission != nil {
+			// Pods admitted while no manager runs start without the agent
+			// either way; the API server need not wait for one.
+			if err := webhook.Deregister(shutdownCtx, client.Clientset); err != nil {
+				log.Printf("deregister admission webhook: %v", err)
+			}
 		}
-		if err := <-serverErrCh; err != nil && err != http.ErrServerClosed {
-			return err
+		for _, server := range servers {
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				return fmt.Errorf("shutdown server: %w", err)
+			}
+		}
+		for range servers {
+			if err := <-serverErrCh; err != nil && err != http.ErrServerClosed {
+				return err
+			}
 		}
 		return nil
 	}
@@ -137,6 +216,8 @@ func newHandler() http.Handler {
 	mux.HandleFunc("/v1/stream/client", func(w http.ResponseWriter, r *http.Request) {
 		handleStreamAttach(w, r, contracts.StreamRoleClient)
 	})
+	mux.HandleFunc("/v1/stream/mux", handleStreamMux)
+	mux.HandleFunc("/v1/stream/udp", handleStreamUDP)
 	return mux
 }
 
@@ -154,7 +235,7 @@ func handleSessions(w http.ResponseWriter, r *http.Request) {
 		handleCreateSession(w, r)
 	case http.MethodGet:
 		writeJSON(w, http.StatusOK, contracts.ListDebugSessionsResponse{
-			Sessions: sessionRegistry.List(),
+			Sessions: listSessions(),
 		})
 	default:
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -178,6 +259,10 @@ func handleSessionByID(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotFound, "session not found")
 		return
 	}
+	if debugSession.Origin == contracts.SessionOriginResource {
+		writeError(w, http.StatusConflict, "session is declared by a DebugSession resource; delete the resource instead")
+		return
+	}
 
 	if err := sidecarBridge.Remove(r.Context(), debugSession); err != nil && !errors.Is(err, agent.ErrWorkloadNotFound) {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to remove traffic-agent sidecar: %v", err))
@@ -185,9 +270,28 @@ func handleSessionByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionRegistry.Delete(id)
+	relayRegistry.ForgetLease(id)
+	forgetStoredSession(r.Context(), debugSession)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// listSessions returns the registered sessions with their live client
+// state filled in.
+func listSessions() []contracts.DebugSession {
+	sessions := sessionRegistry.List()
+	for index := range sessions {
+		sessions[index].ClientConnected = relayRegistry.ClientConnected(sessions[index].SessionID)
+	}
+	return sessions
+}
+
+// strategyDetector tells how a session's traffic can be intercepted,
+// given the service mesh its workload runs in. Without one (meshDetector
+// is nil) the traffic-agents pick the strategy themselves.
+type strategyDetector interface {
+	InterceptStrategy(ctx context.Context, session contracts.DebugSession) (string, error)
+}
+
 func handleCreateSession(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -203,14 +307,39 @@ func handleCreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := sessionRegistry.Create(request)
+	if request.LeaseTTLSeconds == 0 {
+		request.LeaseTTLSeconds = int(sessionLeaseTTL / time.Second)
+	}
+	session, superseded, err := sessionRegistry.Create(request)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, err.Error())
+		statusCode := http.StatusBadRequest
+		if errors.Is(err, sessionregistry.ErrSessionConflict) {
+			statusCode = http.StatusConflict
+		}
+		writeError(w, statusCode, err.Error())
 		return
 	}
+	// The helper attaches only after this response; start the lease now so
+	// the reaper gives it a full TTL to do so.
+	relayRegistry.RenewLease(session.SessionID)
+
+	if meshDetector != nil {
+		strategy, err := meshDetector.InterceptStrategy(r.Context(), session)
+		if err != nil {
+			// The agent still finds a mesh by its redirect chains.
+			log.Printf("detect intercept strategy for session %s: %v", session.SessionID, err)
+		} else {
+			session.InterceptStrategy = strategy
+			sessionRegistry.Update(session)
+		}
+	}
 
 	if err := sidecarBridge.Inject(r.Context(), session); err != nil {
 		sessionRegistry.Delete(session.SessionID)
+		relayRegistry.ForgetLease(session.SessionID)
+		// The sidecar still routes to the sessions this one would have
+		// replaced.
+		sessionRegistry.Restore(superseded)
 		statusCode := http.StatusInternalServerError
 		if errors.Is(err, agent.ErrWorkloadNotFound) {
 			statusCode = http.StatusNotFound
@@ -218,6 +347,14 @@ func handleCreateSession(w http.ResponseWriter, r *http.Request) {
 		writeError(w, statusCode, fmt.Sprintf("failed to inject traffic-agent sidecar: %v", err))
 		return
 	}
+	for _, previous := range superseded {
+		log.Printf("debug session %s superseded by %s (owner %s)",
+			previous.SessionID, session.SessionID, sessionregistry.DescribeOwner(session))
+		relayRegistry.ForgetLease(previous.SessionID)
+		relayRegistry.NotifySuperseded(previous.SessionID, sessionregistry.DescribeOwner(session))
+		forgetStoredSession(r.Context(), previous)
+	}
+	storeSession(r.Context(), session)
 
 	writeJSON(w, http.StatusCreated, session)
 }
@@ -230,14 +367,7 @@ func handleStreamAttach(w http.ResponseWriter, r *http.Request, role string) {
 
 	debugSession, err := resolveStreamSession(r)
 	if err != nil {
-		statusCode := http.StatusBadRequest
-		if errors.Is(err, errStreamSessionNotFound) {
-			statusCode = http.StatusNotFound
-		}
-		if errors.Is(err, errStreamUnauthorized) {
-			statusCode = http.StatusUnauthorized
-		}
-		writeError(w, statusCode, err.Error())
+		writeStreamSessionError(w, err)
 		return
 	}
 
@@ -248,7 +378,111 @@ func handleStreamAttach(w http.ResponseWriter, r *http.Request, role string) {
 	}
 
 	log.Printf("stream attached (role=%s session_id=%s)", role, debugSession.SessionID)
-	relayRegistry.ServePeer(role, debugSession.SessionID, conn)
+	relayRegistry.ServePeer(role, debugSession.SessionID, r.URL.Query().Get(contracts.StreamMetadataFeatures), conn)
+}
+
+// handleStreamUDP relays one local UDP flow of a helper to a cluster
+// service, or to one member of a headless service, for as long as the
+// websocket stays open. The session authorizing it must have declared the
+// target as a UDP dependency; the manager's network position is not
+// lent out for anything else.
+func handleStreamUDP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	debugSession, err := resolveStreamSession(r)
+	if err != nil {
+		writeStreamSessionError(w, err)
+		return
+	}
+	udpTarget, err := udpRelayTarget(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !slices.Contains(debugSession.UDPTargets, udpTarget) {
+		writeError(w, http.StatusForbidden, "udp target is not a dependency of the session")
+		return
+	}
+	target := udpTargetAddress(udpTarget)
+	udp, err := net.Dial("udp", target)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("dial %s: %v", target, err))
+		return
+	}
+
+	conn, err := udpUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		udp.Close()
+		log.Printf("udp relay upgrade failed (session_id=%s target=%s): %v", debugSession.SessionID, target, err)
+		return
+	}
+	log.Printf("udp relay attached (session_id=%s target=%s)", debugSession.SessionID, target)
+	streamrelay.RelayUDP(conn, udp)
+}
+
+// udpRelayTarget reads the target of a UDP relay from its query. Only
+// cluster names are accepted, so the relay cannot be pointed elsewhere.
+func udpRelayTarget(query url.Values) (contracts.UDPTarget, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(query.Get("port")))
+	if err != nil {
+		return contracts.UDPTarget{}, fmt.Errorf("invalid port %q", query.Get("port"))
+	}
+	return sessionregistry.NormalizeUDPTarget(contracts.UDPTarget{
+		Namespace: query.Get("namespace"),
+		Service:   query.Get("service"),
+		Pod:       query.Get("pod"),
+		Port:      port,
+	})
+}
+
+// udpTargetAddress is <service>.<namespace>.svc, or
+// <pod>.<service>.<namespace>.svc, and the port.
+func udpTargetAddress(target contracts.UDPTarget) string {
+	host := target.Service + "." + target.Namespace + ".svc"
+	if target.Pod != "" {
+		host = target.Pod + "." + host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(target.Port))
+}
+
+func writeStreamSessionError(w http.ResponseWriter, err error) {
+	statusCode := http.StatusBadRequest
+	if errors.Is(err, errStreamSessionNotFound) {
+		statusCode = http.StatusNotFound
+	}
+	if errors.Is(err, errStreamUnauthorized) {
+		statusCode = http.StatusUnauthorized
+	}
+	writeError(w, statusCode, err.Error())
+}
+
+// handleStreamMux serves a helper stream that carries the client side of
+// many sessions. Each session authenticates with its own token when the
+// helper attaches it, so the upgrade itself needs none.
+func handleStreamMux(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("stream upgrade failed (role=%s mux): %v", contracts.StreamRoleClient, err)
+		return
+	}
+
+	log.Printf("stream attached (role=%s mux)", contracts.StreamRoleClient)
+	relayRegistry.ServeClientMux(conn, func(sessionID string, sessionToken string) (string, error) {
+		debugSession, err := authorizeStreamSession(sessionID, sessionToken)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("stream session attached (role=%s mux session_id=%s)", contracts.StreamRoleClient, debugSession.SessionID)
+		return debugSession.SessionID, nil
+	})
 }
 
 func parseSessionID(path string) (string, error) {
@@ -272,6 +506,15 @@ func resolveStreamSession(r *http.Request) (contracts.DebugSession, error) {
 	if sessionID == "" {
 		sessionID = strings.TrimSpace(r.Header.Get(streamSessionIDHeader))
 	}
+	sessionToken := strings.TrimSpace(r.URL.Query().Get(streamSessionTokenQuery))
+	if sessionToken == "" {
+		sessionToken = strings.TrimSpace(r.Header.Get(streamSessionTokenHeader))
+	}
+	return authorizeStreamSession(sessionID, sessionToken)
+}
+
+func authorizeStreamSession(sessionID string, sessionToken string) (contracts.DebugSession, error) {
+	sessionID = strings.TrimSpace(sessionID)
 	if sessionID == "" {
 		return contracts.DebugSession{}, errors.New("session id is required")
 	}
@@ -280,12 +523,7 @@ func resolveStreamSession(r *http.Request) (contracts.DebugSession, error) {
 	if !ok {
 		return contracts.DebugSession{}, errStreamSessionNotFound
 	}
-
-	sessionToken := strings.TrimSpace(r.URL.Query().Get(streamSessionTokenQuery))
-	if sessionToken == "" {
-		sessionToken = strings.TrimSpace(r.Header.Get(streamSessionTokenHeader))
-	}
-	if strings.TrimSpace(debugSession.SessionToken) != "" && sessionToken != debugSession.SessionToken {
+	if strings.TrimSpace(debugSession.SessionToken) != "" && strings.TrimSpace(sessionToken) != debugSession.SessionToken {
 		return contracts.DebugSession{}, errStreamUnauthorized
 	}
 
@@ -305,16 +543,91 @@ func writeJSON(w http.ResponseWriter, code int, payload any) {
 	_ = json.NewEncoder(w).Encode(payload)
 }
 
-func initializeInjector(clientset kubernetes.Interface) {
+// initializeInjector sets up the sidecar injection KRUN_SIDECAR_INJECTION
+// asks for. In webhook mode it returns the injector that serves the
+// admission webhook.
+func initializeInjector(client *kube.Client) (*agent.WebhookInjector, error) {
+	clientset := client.Clientset
 	probePort, _ := strconv.Atoi(strings.TrimSpace(os.Getenv(envAgentProbePort)))
+	// With KRUN_AGENT_INIT_REDIRECT an init container installs the redirect
+	// rules, and the agent sidecar runs unprivileged.
+	initRedirect := false
+	if raw := strings.TrimSpace(os.Getenv(envAgentInitRedirect)); raw != "" {
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: must be a boolean", envAgentInitRedirect, raw)
+		}
+		initRedirect = parsed
+	}
+	diagnostics, _ := strconv.ParseBool(strings.TrimSpace(os.Getenv(envAgentDiagnostics)))
 
-	sidecarBridge = agent.NewWorkloadInjector(clientset, agent.Options{
+	options := agent.Options{
 		ContainerName:   strings.TrimSpace(os.Getenv(envAgentContainerName)),
 		Image:           strings.TrimSpace(os.Getenv(envAgentImage)),
 		ImagePullPolicy: strings.TrimSpace(os.Getenv(envAgentImagePullPolicy)),
 		ManagerAddress:  strings.TrimSpace(os.Getenv(envManagerAddress)),
 		ProbePort:       probePort,
-	})
+		InitRedirect:    initRedirect,
+		Diagnostics:     diagnostics,
+		Dynamic:         client.DynamicClient,
+	}
+	injection := strings.ToLower(strings.TrimSpace(os.Getenv(envSidecarInjection)))
+	var sidecar agent.Injector
+	var admission *agent.WebhookInjector
+	switch injection {
+	case "", sidecarInjectionTemplate:
+		sidecar = agent.NewWorkloadInjector(clientset, options)
+	case sidecarInjectionWebhook:
+		admission = agent.NewWebhookInjector(clientset, options)
+		sidecar = admission
+	default:
+		return nil, fmt.Errorf("invalid %s %q: must be %q or %q", envSidecarInjection, injection, sidecarInjectionTemplate, sidecarInjectionWebhook)
+	}
+	meshDetector = agent.NewWorkloadInjector(clientset, options)
+	sidecarBridge = agent.SessionInjector{
+		Sidecar:   sidecar,
+		Ephemeral: agent.NewEphemeralInjector(clientset, options, relayRegistry.ReleaseAgents),
+	}
+	return admission, nil
+}
+
+// startAdmissionWebhook serves the admission webhook with a freshly
+// generated certificate and registers it, with that certificate, with the
+// API server. Pods admitted while the manager is down start without the
+// agent.
+func startAdmissionWebhook(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	admission *agent.WebhookInjector,
+	serverErrCh chan<- error,
+) (*http.Server, error) {
+	certificate, caBundle, err := webhook.GenerateCertificate(webhook.DNSNames(managerNamespace, managerServiceName), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(webhook.Path, admission)
+	server := &http.Server{
+		Addr:      webhookListenAddress,
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12},
+	}
+	go func() {
+		serverErrCh <- server.ListenAndServeTLS("", "")
+	}()
+	log.Printf("krun traffic-manager admission webhook listening on %s", webhookListenAddress)
+
+	err = webhook.Register(ctx, clientset, webhook.Config{
+		ServiceNamespace:  managerNamespace,
+		ServiceName:       managerServiceName,
+		ServicePort:       webhookServicePort,
+		IgnoredNamespaces: []string{managerNamespace, metav1.NamespaceSystem},
+		TargetLabelKey:    agent.TargetLabelKey,
+	}, caBundle)
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
 }
 
 // initializeAuthToken loads the shared session-API token from its Secret,
@@ -384,9 +697,136 @@ func requireAuthToken(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func cleanupDanglingAgents(ctx context.Context) error {
-	if err := sidecarBridge.Cleanup(ctx); err != nil {
-		return fmt.Errorf("cleanup dangling traffic-agent sidecars: %w", err)
+// restoreSessions reloads the persisted sessions and reconciles injected
+// sidecars against them: routes of stored sessions survive the restart,
+// anything else is stripped. Stored API sessions no sidecar serves anymore
+// are dropped from the store; declared ones are set up again by the
+// session controller.
+func restoreSessions(ctx context.Context) error {
+	stored, err := sessionStore.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("load stored debug sessions: %w", err)
+	}
+
+	kept, err := sidecarBridge.Reconcile(ctx, stored)
+	if err != nil {
+		return fmt.Errorf("reconcile traffic-agent sidecars: %w", err)
 	}
+
+	sessionRegistry.Restore(kept)
+	for _, debugSession := range kept {
+		// Helpers need time to reattach to the new manager process.
+		relayRegistry.RenewLease(debugSession.SessionID)
+	}
+	for _, debugSession := range stored {
+		if debugSession.Origin == contracts.SessionOriginResource {
+			continue
+		}
+		if _, ok := sessionRegistry.Get(debugSession.SessionID); !ok {
+			forgetStoredSession(ctx, debugSession)
+		}
+	}
+	log.Printf("restored %d of %d stored debug session(s)", len(kept), len(stored))
 	return nil
 }
+
+// storeSession writes a session to the session store. A failed write is
+// logged rather than surfaced: the session keeps working, it just would not
+// survive a manager restart.
+func storeSession(ctx context.Context, debugSession contracts.DebugSession) {
+	storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sessionStoreTimeout)
+	defer cancel()
+	if err := sessionStore.Put(storeCtx, debugSession); err != nil {
+		log.Printf("persist debug session %s: %v", debugSession.SessionID, err)
+	}
+}
+
+func forgetStoredSession(ctx context.Context, debugSession contracts.DebugSession) {
+	storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sessionStoreTimeout)
+	defer cancel()
+	if err := sessionStore.Delete(storeCtx, debugSession); err != nil {
+		log.Printf("forget stored debug session %s: %v", debugSession.SessionID, err)
+	}
+}
+
+func initializeSessionStore(client *kube.Client) (string, error) {
+	storeKind := strings.ToLower(strings.TrimSpace(os.Getenv(envSessionStore)))
+	switch storeKind {
+	case "", sessionStoreSecret, sessionStoreLegacyConfigMap:
+		sessionStore = sessionregistry.NewSecretStore(client.Clientset, managerNamespace, sessionsSecretName)
+		return sessionStoreSecret, nil
+	case sessionStoreCRD:
+		sessionStore = sessionregistry.NewCRDStore(client.DynamicClient)
+		return sessionStoreCRD, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q: must be %q or %q", envSessionStore, storeKind, sessionStoreSecret, sessionStoreCRD)
+	}
+}
+
+func initializeSessionLeaseTTL() error {
+	raw := strings.TrimSpace(os.Getenv(envSessionLeaseTTL))
+	if raw == "" {
+		return nil
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl < time.Second {
+		return fmt.Errorf("invalid %s %q: must be a duration of at least 1s", envSessionLeaseTTL, raw)
+	}
+	sessionLeaseTTL = ttl
+	return nil
+}
+
+func runSessionReaper(ctx context.Context) {
+	ticker := time.NewTicker(sessionReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			reapExpiredSessions(ctx, now)
+		}
+	}
+}
+
+// reapExpiredSessions removes the sidecar route and the session for every
+// API session whose lease ran out. A failed removal is retried on the next
+// tick.
+func reapExpiredSessions(ctx context.Context, now time.Time) int {
+	reaped := 0
+	for _, debugSession := range sessionRegistry.List() {
+		// Declared sessions live as long as their resource.
+		if debugSession.Origin == contracts.SessionOriginResource || !leaseExpired(debugSession, now) {
+			continue
+		}
+
+		log.Printf("reaping idle debug session %s (%s/%s): no client lease for %s",
+			debugSession.SessionID, debugSession.Namespace, debugSession.Workload, leaseTTL(debugSession))
+		if err := sidecarBridge.Remove(ctx, debugSession); err != nil && !errors.Is(err, agent.ErrWorkloadNotFound) {
+			log.Printf("reap debug session %s: remove traffic-agent sidecar: %v", debugSession.SessionID, err)
+			continue
+		}
+		sessionRegistry.Delete(debugSession.SessionID)
+		relayRegistry.ForgetLease(debugSession.SessionID)
+		forgetStoredSession(ctx, debugSession)
+		reaped++
+	}
+	return reaped
+}
+
+func leaseExpired(debugSession contracts.DebugSession, now time.Time) bool {
+	renewedAt, ok := relayRegistry.LeaseRenewedAt(debugSession.SessionID)
+	if !ok {
+		// Never renewed in this process; start the countdown now.
+		relayRegistry.RenewLease(debugSession.SessionID)
+		return false
+	}
+	return now.Sub(renewedAt) > leaseTTL(debugSession)
+}
+
+func leaseTTL(debugSession contracts.DebugSession) time.Duration {
+	if debugSession.LeaseTTLSeconds > 0 {
+		return time.Duration(debugSession.LeaseTTLSeconds) * time.Second
+	}
+	return sessionLeaseTTL
+}
@@ -8,9 +8,14 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/streamcodec"
 	"github.com/ftechmax/krun/internal/traffic-manager/agent"
 	sessionregistry "github.com/ftechmax/krun/internal/traffic-manager/session"
 	streamrelay "github.com/ftechmax/krun/internal/traffic-manager/stream"
@@ -253,7 +258,7 @@ func TestStreamAttachMethodNotAllowed(t *testing.T) {
 func TestStreamAttachRequiresValidSessionAndToken(t *testing.T) {
 	resetSessionState(t)
 
-	created, err := sessionRegistry.Create(contracts.CreateDebugSessionRequest{
+	created, _, err := sessionRegistry.Create(contracts.CreateDebugSessionRequest{
 		ServiceName: "orders-api",
 		ServicePort: 8080,
 		LocalPort:   5000,
@@ -278,30 +283,435 @@ func TestStreamAttachRequiresValidSessionAndToken(t *testing.T) {
 	}
 }
 
-func TestCleanupDanglingAgents(t *testing.T) {
+func TestStreamUDPRequiresSessionAndClusterTarget(t *testing.T) {
+	resetSessionState(t)
+	handler := newHandler()
+
+	created, _, err := sessionRegistry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+		ClientID:    "dev-1",
+		UDPTargets:  []contracts.UDPTarget{{Namespace: "monitoring", Service: "statsd", Port: 8125}},
+	})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	credentials := "session_id=" + created.SessionID + "&session_token=" + created.SessionToken
+
+	cases := map[string]int{
+		"/v1/stream/udp?session_id=" + created.SessionID + "&service=statsd&port=8125":   http.StatusUnauthorized,
+		"/v1/stream/udp?" + credentials + "&service=statsd.example.com&port=8125":        http.StatusBadRequest,
+		"/v1/stream/udp?" + credentials + "&service=statsd&namespace=monitoring&port=0":  http.StatusBadRequest,
+		"/v1/stream/udp?" + credentials + "&service=statsd&namespace=monitoring&pod=a.b": http.StatusBadRequest,
+		"/v1/stream/udp?session_id=unknown&session_token=abc&service=statsd&port=8125":   http.StatusNotFound,
+		// Only the session's declared dependencies are relayed to.
+		"/v1/stream/udp?" + credentials + "&service=statsd&port=8125":                            http.StatusForbidden,
+		"/v1/stream/udp?" + credentials + "&service=statsd&namespace=kube-system&port=8125":      http.StatusForbidden,
+		"/v1/stream/udp?" + credentials + "&service=statsd&namespace=monitoring&port=8126":       http.StatusForbidden,
+		"/v1/stream/udp?" + credentials + "&service=kube-dns&namespace=kube-system&port=53":      http.StatusForbidden,
+		"/v1/stream/udp?" + credentials + "&service=statsd&namespace=monitoring&pod=x&port=8125": http.StatusForbidden,
+	}
+	for target, want := range cases {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, newAuthedRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Fatalf("%s: expected status %d, got %d", target, want, rec.Code)
+		}
+	}
+}
+
+func TestUDPRelayTarget(t *testing.T) {
+	cases := map[string]string{
+		"service=statsd&port=8125":                                  "statsd.default.svc:8125",
+		"service=kafka&namespace=data&pod=kafka-broker-1&port=9093": "kafka-broker-1.kafka.data.svc:9093",
+	}
+	for query, want := range cases {
+		values, _ := url.ParseQuery(query)
+		target, err := udpRelayTarget(values)
+		if got := udpTargetAddress(target); err != nil || got != want {
+			t.Fatalf("%s: expected %s, got %q (%v)", query, want, got, err)
+		}
+	}
+}
+
+func TestStreamMuxAuthorizesEachSession(t *testing.T) {
+	resetSessionState(t)
+	created, _, err := sessionRegistry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+		ClientID:    "dev-1",
+	})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	server := httptest.NewServer(newHandler())
+	defer server.Close()
+
+	conn, _, err := streamcodec.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/v1/stream/mux", nil)
+	if err != nil {
+		t.Fatalf("dial mux stream: %v", err)
+	}
+	defer conn.Close()
+
+	attach := func(sessionID string, sessionToken string) contracts.StreamEnvelope {
+		t.Helper()
+		if err := streamcodec.Write(conn, contracts.StreamEnvelope{
+			Type:         contracts.StreamTypeAttach,
+			SessionID:    sessionID,
+			SessionToken: sessionToken,
+		}); err != nil {
+			t.Fatalf("write attach: %v", err)
+		}
+		reply, err := streamcodec.Read(conn)
+		if err != nil {
+			t.Fatalf("read attach reply: %v", err)
+		}
+		return reply
+	}
+	if reply := attach(created.SessionID, "wrong"); reply.Type != contracts.StreamTypeError || reply.Message != errStreamUnauthorized.Error() {
+		t.Fatalf("expected unauthorized attach to be refused, got %+v", reply)
+	}
+	if reply := attach("unknown", "abc"); reply.Type != contracts.StreamTypeError || reply.Message != errStreamSessionNotFound.Error() {
+		t.Fatalf("expected unknown session to be refused, got %+v", reply)
+	}
+	if reply := attach(created.SessionID, created.SessionToken); reply.Type != contracts.StreamTypeAttached || reply.SessionID != created.SessionID {
+		t.Fatalf("expected session to attach, got %+v", reply)
+	}
+	if !relayRegistry.ClientConnected(created.SessionID) {
+		t.Fatal("expected the session to report an attached client")
+	}
+}
+
+func TestRestoreSessionsKeepsReconciledSessions(t *testing.T) {
+	resetSessionState(t)
+	stored := []contracts.DebugSession{
+		{SessionID: "sess_kept", SessionToken: "token-a", Namespace: "default", Workload: "orders-api"},
+		{SessionID: "sess_gone", SessionToken: "token-b", Namespace: "default", Workload: "billing-api"},
+		// Declared sessions are set up again by the controller, not dropped.
+		{SessionID: "shop.debug", Namespace: "shop", Workload: "cart-api", Origin: contracts.SessionOriginResource},
+	}
+	store := &fakeSessionStore{sessions: stored}
+	sessionStore = store
+	fake := &fakeInjector{reconcileKeep: []string{"sess_kept"}}
+	sidecarBridge = fake
+
+	if err := restoreSessions(context.Background()); err != nil {
+		t.Fatalf("restore sessions: %v", err)
+	}
+	if len(fake.reconcileCalls) != 1 || len(fake.reconcileCalls[0]) != 3 {
+		t.Fatalf("expected reconcile with all stored sessions, got %+v", fake.reconcileCalls)
+	}
+	if _, ok := sessionRegistry.Get("sess_kept"); !ok {
+		t.Fatalf("expected reconciled session to be restored")
+	}
+	if _, ok := sessionRegistry.Get("sess_gone"); ok {
+		t.Fatalf("expected session without a sidecar route to be dropped")
+	}
+	if len(store.deletes) != 1 || store.deletes[0] != "sess_gone" || len(store.puts) != 0 {
+		t.Fatalf("expected only the dropped session to be removed from the store, got puts=%v deletes=%v", store.puts, store.deletes)
+	}
+}
+
+func TestRestoreSessionsReturnsError(t *testing.T) {
+	resetSessionState(t)
+	reconcileErr := errors.New("reconcile failed")
+	sidecarBridge = &fakeInjector{
+		reconcileErr: reconcileErr,
+	}
+
+	err := restoreSessions(context.Background())
+	if !errors.Is(err, reconcileErr) {
+		t.Fatalf("expected reconcile error %v, got %v", reconcileErr, err)
+	}
+
+	loadErr := errors.New("load failed")
+	sessionStore = &fakeSessionStore{loadErr: loadErr}
+	err = restoreSessions(context.Background())
+	if !errors.Is(err, loadErr) {
+		t.Fatalf("expected load error %v, got %v", loadErr, err)
+	}
+}
+
+func TestSessionChangesArePersisted(t *testing.T) {
+	resetSessionState(t)
+	store := &fakeSessionStore{}
+	sessionStore = store
+	sidecarBridge = &fakeInjector{}
+	handler := newHandler()
+
+	createPayload, _ := json.Marshal(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+	})
+	createRec := httptest.NewRecorder()
+	handler.ServeHTTP(createRec, newAuthedRequest(http.MethodPost, "/v1/sessions", bytes.NewReader(createPayload)))
+	if createRec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", createRec.Code)
+	}
+	var created contracts.DebugSession
+	if err := json.Unmarshal(createRec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+	if len(store.puts) != 1 || store.puts[0] != created.SessionID {
+		t.Fatalf("expected created session to be persisted, got %v", store.puts)
+	}
+
+	deleteRec := httptest.NewRecorder()
+	handler.ServeHTTP(deleteRec, newAuthedRequest(http.MethodDelete, "/v1/sessions/"+created.SessionID, nil))
+	if deleteRec.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", deleteRec.Code)
+	}
+	if len(store.deletes) != 1 || store.deletes[0] != created.SessionID {
+		t.Fatalf("expected deleted session to be removed from the store, got %v", store.deletes)
+	}
+}
+
+func TestReapExpiredSessions(t *testing.T) {
 	resetSessionState(t)
 	fake := &fakeInjector{}
 	sidecarBridge = fake
+	handler := newHandler()
+
+	createPayload, _ := json.Marshal(contracts.CreateDebugSessionRequest{
+		ServiceName:     "orders-api",
+		ServicePort:     8080,
+		LocalPort:       5000,
+		LeaseTTLSeconds: 60,
+	})
+	createRec := httptest.NewRecorder()
+	handler.ServeHTTP(createRec, newAuthedRequest(http.MethodPost, "/v1/sessions", bytes.NewReader(createPayload)))
+	if createRec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", createRec.Code)
+	}
+	var created contracts.DebugSession
+	if err := json.Unmarshal(createRec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+	if created.LeaseTTLSeconds != 60 {
+		t.Fatalf("expected requested lease ttl, got %d", created.LeaseTTLSeconds)
+	}
 
-	if err := cleanupDanglingAgents(context.Background()); err != nil {
-		t.Fatalf("cleanup dangling agents: %v", err)
+	if reaped := reapExpiredSessions(context.Background(), time.Now().Add(30*time.Second)); reaped != 0 {
+		t.Fatalf("expected no session to be reaped within its ttl, got %d", reaped)
 	}
-	if fake.cleanupCalls != 1 {
-		t.Fatalf("expected cleanup to be called once, got %d", fake.cleanupCalls)
+	if reaped := reapExpiredSessions(context.Background(), time.Now().Add(2*time.Minute)); reaped != 1 {
+		t.Fatalf("expected the idle session to be reaped, got %d", reaped)
+	}
+	if _, ok := sessionRegistry.Get(created.SessionID); ok {
+		t.Fatalf("expected reaped session to be deleted")
+	}
+	if len(fake.removeCalls) != 1 || fake.removeCalls[0].SessionID != created.SessionID {
+		t.Fatalf("expected the sidecar route to be removed, got %+v", fake.removeCalls)
 	}
 }
 
-func TestCleanupDanglingAgentsReturnsError(t *testing.T) {
+func TestDeclaredSessionsOutliveLeaseAndAPIDelete(t *testing.T) {
 	resetSessionState(t)
-	cleanupErr := errors.New("cleanup failed")
-	fake := &fakeInjector{
-		cleanupErr: cleanupErr,
+	fake := &fakeInjector{}
+	sidecarBridge = fake
+	declared, _, err := sessionRegistry.Adopt(contracts.DebugSession{
+		SessionID:       "shop.orders-debug",
+		Namespace:       "shop",
+		ServiceName:     "orders-api",
+		ServicePort:     8080,
+		LocalPort:       5000,
+		LeaseTTLSeconds: 60,
+		Origin:          contracts.SessionOriginResource,
+	})
+	if err != nil {
+		t.Fatalf("adopt session: %v", err)
+	}
+
+	if reaped := reapExpiredSessions(context.Background(), time.Now().Add(time.Hour)); reaped != 0 {
+		t.Fatalf("expected declared session not to be reaped, got %d", reaped)
+	}
+
+	rec := httptest.NewRecorder()
+	newHandler().ServeHTTP(rec, newAuthedRequest(http.MethodDelete, "/v1/sessions/"+declared.SessionID, nil))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected status 409, got %d", rec.Code)
+	}
+	if _, ok := sessionRegistry.Get(declared.SessionID); !ok || len(fake.removeCalls) != 0 {
+		t.Fatal("expected declared session to survive an API delete")
+	}
+}
+
+func TestReapKeepsSessionWhenRemoveFails(t *testing.T) {
+	resetSessionState(t)
+	sidecarBridge = &fakeInjector{removeErr: errors.New("remove failed")}
+
+	created, _, err := sessionRegistry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+	})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
 	}
+	relayRegistry.RenewLease(created.SessionID)
+
+	if reaped := reapExpiredSessions(context.Background(), time.Now().Add(sessionLeaseTTL+time.Minute)); reaped != 0 {
+		t.Fatalf("expected nothing reaped while removal fails, got %d", reaped)
+	}
+	if _, ok := sessionRegistry.Get(created.SessionID); !ok {
+		t.Fatalf("expected session to stay for the next reap attempt")
+	}
+}
+
+func TestCreateSessionDefaultsLeaseTTL(t *testing.T) {
+	resetSessionState(t)
+	handler := newHandler()
+
+	createPayload, _ := json.Marshal(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+	})
+	createRec := httptest.NewRecorder()
+	handler.ServeHTTP(createRec, newAuthedRequest(http.MethodPost, "/v1/sessions", bytes.NewReader(createPayload)))
+	var created contracts.DebugSession
+	if err := json.Unmarshal(createRec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+	if created.LeaseTTLSeconds != int(defaultSessionLeaseTTL/time.Second) {
+		t.Fatalf("expected default lease ttl, got %d", created.LeaseTTLSeconds)
+	}
+
+	listRec := httptest.NewRecorder()
+	handler.ServeHTTP(listRec, newAuthedRequest(http.MethodGet, "/v1/sessions", nil))
+	var listed contracts.ListDebugSessionsResponse
+	if err := json.Unmarshal(listRec.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("decode list response: %v", err)
+	}
+	if len(listed.Sessions) != 1 || listed.Sessions[0].ClientConnected {
+		t.Fatalf("expected one session without a client, got %+v", listed.Sessions)
+	}
+}
+
+func TestCreateSessionRecordsInterceptStrategy(t *testing.T) {
+	resetSessionState(t)
+	fake := &fakeInjector{}
 	sidecarBridge = fake
+	meshDetector = fakeStrategyDetector{strategy: contracts.InterceptStrategyAfterIstioProxy}
+	handler := newHandler()
+
+	createPayload, _ := json.Marshal(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+	})
+	createRec := httptest.NewRecorder()
+	handler.ServeHTTP(createRec, newAuthedRequest(http.MethodPost, "/v1/sessions", bytes.NewReader(createPayload)))
+	var created contracts.DebugSession
+	if err := json.Unmarshal(createRec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+	if created.InterceptStrategy != contracts.InterceptStrategyAfterIstioProxy {
+		t.Fatalf("expected the strategy in the response, got %q", created.InterceptStrategy)
+	}
+	if len(fake.injectCalls) != 1 || fake.injectCalls[0].InterceptStrategy != contracts.InterceptStrategyAfterIstioProxy {
+		t.Fatalf("expected the strategy passed to the injector, got %+v", fake.injectCalls)
+	}
+	if stored, ok := sessionRegistry.Get(created.SessionID); !ok || stored.InterceptStrategy != created.InterceptStrategy {
+		t.Fatalf("expected the strategy registered, got %+v", stored)
+	}
 
-	err := cleanupDanglingAgents(context.Background())
-	if !errors.Is(err, cleanupErr) {
-		t.Fatalf("expected cleanup error %v, got %v", cleanupErr, err)
+	// A failed detection leaves the choice to the agent.
+	resetSessionState(t)
+	meshDetector = fakeStrategyDetector{err: errors.New("forbidden")}
+	createRec = httptest.NewRecorder()
+	newHandler().ServeHTTP(createRec, newAuthedRequest(http.MethodPost, "/v1/sessions", bytes.NewReader(createPayload)))
+	if createRec.Code != http.StatusCreated {
+		t.Fatalf("expected the session created anyway, got status %d", createRec.Code)
+	}
+	created = contracts.DebugSession{}
+	if err := json.Unmarshal(createRec.Body.Bytes(), &created); err != nil || created.InterceptStrategy != "" {
+		t.Fatalf("expected no strategy, got %+v (%v)", created, err)
+	}
+}
+
+func TestCreateSessionConflictRequiresForce(t *testing.T) {
+	resetSessionState(t)
+	fake := &fakeInjector{}
+	sidecarBridge = fake
+	handler := newHandler()
+
+	create := func(request contracts.CreateDebugSessionRequest) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(request)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, newAuthedRequest(http.MethodPost, "/v1/sessions", bytes.NewReader(payload)))
+		return rec
+	}
+
+	aliceRec := create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+		KubeUser:    "alice",
+		Hostname:    "alice-laptop",
+	})
+	if aliceRec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", aliceRec.Code)
+	}
+	var alice contracts.DebugSession
+	if err := json.Unmarshal(aliceRec.Body.Bytes(), &alice); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+
+	bobRequest := contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+		KubeUser:    "bob",
+		Hostname:    "bob-laptop",
+	}
+	if rec := create(bobRequest); rec.Code != http.StatusConflict {
+		t.Fatalf("expected status 409, got %d", rec.Code)
+	}
+	if len(fake.injectCalls) != 1 {
+		t.Fatalf("a conflicting create must not touch the sidecar, got %d inject calls", len(fake.injectCalls))
+	}
+
+	bobRequest.Force = true
+	if rec := create(bobRequest); rec.Code != http.StatusCreated {
+		t.Fatalf("expected forced create to succeed, got %d", rec.Code)
+	}
+	if _, ok := sessionRegistry.Get(alice.SessionID); ok {
+		t.Fatalf("expected alice's session to be taken over")
+	}
+	if _, ok := relayRegistry.LeaseRenewedAt(alice.SessionID); ok {
+		t.Fatalf("expected the superseded session's lease to be dropped")
+	}
+}
+
+func TestCreateSessionRestoresSupersededWhenInjectFails(t *testing.T) {
+	resetSessionState(t)
+	previous, _, err := sessionRegistry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+	})
+	if err != nil {
+		t.Fatalf("create previous session: %v", err)
+	}
+	sidecarBridge = &fakeInjector{injectErr: errors.New("inject failed")}
+	handler := newHandler()
+
+	payload, _ := json.Marshal(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+	})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, newAuthedRequest(http.MethodPost, "/v1/sessions", bytes.NewReader(payload)))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", rec.Code)
+	}
+	if _, ok := sessionRegistry.Get(previous.SessionID); !ok {
+		t.Fatalf("expected the previous session to be restored after the failed inject")
 	}
 }
 
@@ -309,16 +719,28 @@ func resetSessionState(t *testing.T) {
 	t.Helper()
 	sessionRegistry = sessionregistry.NewDebugSessionRegistry()
 	sidecarBridge = agent.NoopInjector{}
+	sessionStore = sessionregistry.NoopStore{}
 	relayRegistry = streamrelay.NewSessionRelayRegistry()
+	meshDetector = nil
+}
+
+type fakeStrategyDetector struct {
+	strategy string
+	err      error
+}
+
+func (f fakeStrategyDetector) InterceptStrategy(context.Context, contracts.DebugSession) (string, error) {
+	return f.strategy, f.err
 }
 
 type fakeInjector struct {
-	injectErr    error
-	removeErr    error
-	cleanupErr   error
-	injectCalls  []contracts.DebugSession
-	removeCalls  []contracts.DebugSession
-	cleanupCalls int
+	injectErr      error
+	removeErr      error
+	reconcileErr   error
+	reconcileKeep  []string
+	injectCalls    []contracts.DebugSession
+	removeCalls    []contracts.DebugSession
+	reconcileCalls [][]contracts.DebugSession
 }
 
 func (f *fakeInjector) Inject(_ context.Context, session contracts.DebugSession) error {
@@ -331,9 +753,39 @@ func (f *fakeInjector) Remove(_ context.Context, session contracts.DebugSession)
 	return f.removeErr
 }
 
-func (f *fakeInjector) Cleanup(_ context.Context) error {
-	f.cleanupCalls++
-	return f.cleanupErr
+func (f *fakeInjector) Reconcile(_ context.Context, sessions []contracts.DebugSession) ([]contracts.DebugSession, error) {
+	f.reconcileCalls = append(f.reconcileCalls, sessions)
+	if f.reconcileErr != nil {
+		return nil, f.reconcileErr
+	}
+	var kept []contracts.DebugSession
+	for _, debugSession := range sessions {
+		if slices.Contains(f.reconcileKeep, debugSession.SessionID) {
+			kept = append(kept, debugSession)
+		}
+	}
+	return kept, nil
+}
+
+type fakeSessionStore struct {
+	sessions []contracts.DebugSession
+	loadErr  error
+	puts     []string
+	deletes  []string
+}
+
+func (f *fakeSessionStore) Load(_ context.Context) ([]contracts.DebugSession, error) {
+	return f.sessions, f.loadErr
+}
+
+func (f *fakeSessionStore) Put(_ context.Context, session contracts.DebugSession) error {
+	f.puts = append(f.puts, session.SessionID)
+	return nil
+}
+
+func (f *fakeSessionStore) Delete(_ context.Context, session contracts.DebugSession) error {
+	f.deletes = append(f.deletes, session.SessionID)
+	return nil
 }
 
 const testAuthToken = "test-auth-token"
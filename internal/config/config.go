@@ -12,15 +12,22 @@ import (
 )
 
 type Service struct {
-	Name                string              `json:"name"`
-	Project             string              `json:"project"`   // This will be set based on the directory structure
-	Namespace           string              `json:"namespace"` // Kubernetes namespace (default: "default")
-	Path                string              `json:"path"`
-	Dockerfile          string              `json:"dockerfile"`
-	Context             string              `json:"context"`
-	ContainerPort       int                 `json:"container_port"` // Default is "8080"
-	InterceptPort       int                 `json:"intercept_port"` // Default is "5000"
-	ServiceDependencies []ServiceDependency `json:"service_dependencies"`
+	Name                 string              `json:"name"`
+	Project              string              `json:"project"`   // This will be set based on the directory structure
+	Namespace            string              `json:"namespace"` // Kubernetes namespace (default: "default")
+	Path                 string              `json:"path"`
+	Dockerfile           string              `json:"dockerfile"`
+	Context              string              `json:"context"`
+	ContainerPort        int                 `json:"container_port"`         // Default is "8080"
+	InterceptPort        int                 `json:"intercept_port"`         // Default is "5000"
+	InterceptHoldSeconds int                 `json:"intercept_hold_seconds"` // Default is 0 (no hold)
+	Ports                []ServicePort       `json:"ports"`                  // Overrides container_port/intercept_port
+	ServiceDependencies  []ServiceDependency `json:"service_dependencies"`
+}
+
+type ServicePort struct {
+	ContainerPort int `json:"container_port"`
+	InterceptPort int `json:"intercept_port"`
 }
 
 type ServiceDependency struct {
@@ -29,6 +36,10 @@ type ServiceDependency struct {
 	Service   string   `json:"service"`
 	Port      int      `json:"port"`
 	Aliases   []string `json:"aliases"`
+	// Pod targets one pod of the service, by name or ordinal.
+	Pod string `json:"pod"`
+	// Protocol is "tcp" (the default) or "udp".
+	Protocol string `json:"protocol"`
 }
 
 type KrunSourceConfig struct {
@@ -40,6 +51,12 @@ type KrunConfig struct {
 	KrunSourceConfig `json:"source"`
 	LocalRegistry    string `json:"local_registry"`
 	RemoteRegistry   string `json:"remote_registry"`
+	// Resolver is how krun-helper publishes dependency names: "dns" (the
+	// default) or "hosts".
+	Resolver string `json:"resolver"`
+	// Proxy is where krun-helper serves its SOCKS5/HTTP proxy to cluster
+	// services, "on" for 127.0.0.1:1080; unset or "off" it does not run.
+	Proxy string `json:"proxy"`
 }
 
 type Config struct {
@@ -164,6 +181,12 @@ func DiscoverServices(sourceDir string, searchDepth int) ([]Service, map[string]
 				svc[i].Project = project
 				projectPaths[project] = projectRelPath
 
+				// The first of several ports is the primary one
+				if len(svc[i].Ports) > 0 {
+					svc[i].ContainerPort = svc[i].Ports[0].ContainerPort
+					svc[i].InterceptPort = svc[i].Ports[0].InterceptPort
+				}
+
 				// Set the container port to a default value if not specified
 				if svc[i].ContainerPort == 0 {
 					svc[i].ContainerPort = 8080 // Default port if not specified
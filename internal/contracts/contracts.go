@@ -12,8 +12,102 @@ type DebugSession struct {
 	ClientID        string `json:"client_id"`
 	CreatedAt       string `json:"created_at"`
 	ClientConnected bool   `json:"client_connected,omitempty"`
+	// Ports lists every intercepted port, ServicePort/LocalPort first, for
+	// sessions that intercept more than one.
+	Ports []PortMapping `json:"ports,omitempty"`
+	// KubeUser and Hostname identify the developer owning the session,
+	// together with the helper's ClientID, which is random per helper
+	// installation. KubeUser is what the helper reads from its kubeconfig;
+	// the manager does not verify it.
+	KubeUser string `json:"kube_user,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	// InterceptHeaders narrows the session to HTTP requests carrying every
+	// listed header; empty intercepts all traffic on the service port.
+	InterceptHeaders map[string]string `json:"intercept_headers,omitempty"`
+	// Mode is SessionModeIntercept or SessionModeMirror.
+	Mode string `json:"mode,omitempty"`
+	// SingleReplica intercepts a single-replica clone of the workload that
+	// shares its Service, instead of every replica.
+	SingleReplica bool `json:"single_replica,omitempty"`
+	// Injection is SessionInjectionSidecar or SessionInjectionEphemeral.
+	Injection string `json:"injection,omitempty"`
+	// LeaseTTLSeconds is how long the session survives without its helper
+	// renewing the lease over the client stream.
+	LeaseTTLSeconds int `json:"lease_ttl_seconds,omitempty"`
+	// Origin is SessionOriginAPI or SessionOriginResource.
+	Origin string `json:"origin,omitempty"`
+	// InterceptStrategy is how the traffic-agent takes connections over,
+	// one of the InterceptStrategy constants. The manager picks it when it
+	// creates the session; empty leaves it to the agent.
+	InterceptStrategy string `json:"intercept_strategy,omitempty"`
+	// UDPTargets are the only addresses the session's helper may relay
+	// UDP to through the manager.
+	UDPTargets []UDPTarget `json:"udp_targets,omitempty"`
 }
 
+// UDPTarget is a service, or one named pod of it, and port a session
+// declared as a UDP dependency.
+type UDPTarget struct {
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	Pod       string `json:"pod,omitempty"`
+	Port      int    `json:"port"`
+}
+
+// PortMapping pairs an intercepted container port with the local port the
+// developer's app serves it on.
+type PortMapping struct {
+	ServicePort int `json:"service_port"`
+	LocalPort   int `json:"local_port"`
+}
+
+const (
+	// SessionOriginAPI marks sessions created through POST /v1/sessions;
+	// they live as long as their helper keeps renewing the lease.
+	SessionOriginAPI = "api"
+	// SessionOriginResource marks sessions declared as DebugSession
+	// resources; they live as long as the resource does.
+	SessionOriginResource = "resource"
+)
+
+const (
+	// SessionModeIntercept routes matching connections to the developer's
+	// machine; the local app answers the caller.
+	SessionModeIntercept = "intercept"
+	// SessionModeMirror keeps the in-pod container serving callers and
+	// sends a copy of the inbound bytes to the local app, whose responses
+	// are discarded.
+	SessionModeMirror = "mirror"
+)
+
+const (
+	// SessionInjectionSidecar adds the traffic-agent to the workload's pod
+	// template, which rolls its pods in and out of the session.
+	SessionInjectionSidecar = "sidecar"
+	// SessionInjectionEphemeral attaches the traffic-agent to the running
+	// pods as an ephemeral container; nothing restarts. Pods started later
+	// are not intercepted.
+	SessionInjectionEphemeral = "ephemeral"
+)
+
+const (
+	// InterceptStrategyInbound redirects connections as they reach the pod.
+	InterceptStrategyInbound = "inbound"
+	// InterceptStrategyAfterIstioProxy and InterceptStrategyAfterLinkerdProxy
+	// leave inbound traffic to the service mesh proxy and redirect the
+	// connections it opens to the application, once mTLS is terminated.
+	InterceptStrategyAfterIstioProxy   = "after-istio-proxy"
+	InterceptStrategyAfterLinkerdProxy = "after-linkerd-proxy"
+)
+
+const (
+	// ProtocolTCP is the default protocol of a dependency. ProtocolUDP
+	// dependencies are relayed through the traffic-manager, one websocket
+	// per local client address.
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
 type CreateDebugSessionRequest struct {
 	Namespace   string `json:"namespace,omitempty"`
 	ServiceName string `json:"service_name"`
@@ -21,6 +115,20 @@ type CreateDebugSessionRequest struct {
 	ServicePort int    `json:"service_port"`
 	LocalPort   int    `json:"local_port"`
 	ClientID    string `json:"client_id,omitempty"`
+	KubeUser    string `json:"kube_user,omitempty"`
+	Hostname    string `json:"hostname,omitempty"`
+
+	InterceptHeaders map[string]string `json:"intercept_headers,omitempty"`
+	Mode             string            `json:"mode,omitempty"`
+	LeaseTTLSeconds  int               `json:"lease_ttl_seconds,omitempty"`
+	// Ports adds more intercepted ports to ServicePort/LocalPort.
+	Ports         []PortMapping `json:"ports,omitempty"`
+	SingleReplica bool          `json:"single_replica,omitempty"`
+	Injection     string        `json:"injection,omitempty"`
+	UDPTargets    []UDPTarget   `json:"udp_targets,omitempty"`
+	// Force takes over a conflicting session owned by someone else instead
+	// of failing with 409 Conflict.
+	Force bool `json:"force,omitempty"`
 }
 
 type ListDebugSessionsResponse struct {
@@ -33,10 +141,18 @@ type HostsEntry struct {
 }
 
 type PortForward struct {
-	Namespace  string `json:"namespace,omitempty"`
-	Service    string `json:"service"`
-	LocalPort  int    `json:"local_port"`
-	RemotePort int    `json:"remote_port"`
+	Namespace string `json:"namespace,omitempty"`
+	Service   string `json:"service"`
+	// Pod sends the forward to one pod instead of any pod of Service: a
+	// pod name, or an ordinal among the Service's pods.
+	Pod string `json:"pod,omitempty"`
+	// Protocol is ProtocolTCP when empty.
+	Protocol string `json:"protocol,omitempty"`
+	// LocalAddress is the loopback address the forward listens on,
+	// 127.0.0.1 when empty.
+	LocalAddress string `json:"local_address,omitempty"`
+	LocalPort    int    `json:"local_port"`
+	RemotePort   int    `json:"remote_port"`
 }
 
 type DebugServiceDependencyContext struct {
@@ -45,15 +161,34 @@ type DebugServiceDependencyContext struct {
 	Service   string   `json:"service,omitempty"`
 	Port      int      `json:"port"`
 	Aliases   []string `json:"aliases,omitempty"`
+	// Pod targets one pod of the service, by name or ordinal.
+	Pod string `json:"pod,omitempty"`
+	// Protocol is ProtocolTCP when empty.
+	Protocol string `json:"protocol,omitempty"`
+}
+
+type DebugServicePortContext struct {
+	ContainerPort int `json:"container_port"`
+	InterceptPort int `json:"intercept_port"`
 }
 
 type DebugServiceContext struct {
-	Project             string                          `json:"project,omitempty"`
-	ServiceName         string                          `json:"service_name"`
-	Namespace           string                          `json:"namespace,omitempty"`
-	ContainerPort       int                             `json:"container_port"`
-	InterceptPort       int                             `json:"intercept_port"`
-	ServiceDependencies []DebugServiceDependencyContext `json:"service_dependencies,omitempty"`
+	Project              string                          `json:"project,omitempty"`
+	ServiceName          string                          `json:"service_name"`
+	Namespace            string                          `json:"namespace,omitempty"`
+	ContainerPort        int                             `json:"container_port"`
+	InterceptPort        int                             `json:"intercept_port"`
+	Ports                []DebugServicePortContext       `json:"ports,omitempty"`
+	InterceptHoldSeconds int                             `json:"intercept_hold_seconds,omitempty"`
+	ServiceDependencies  []DebugServiceDependencyContext `json:"service_dependencies,omitempty"`
+	InterceptHeaders     map[string]string               `json:"intercept_headers,omitempty"`
+	Mode                 string                          `json:"mode,omitempty"`
+	SingleReplica        bool                            `json:"single_replica,omitempty"`
+	Injection            string                          `json:"injection,omitempty"`
+	LeaseTTLSeconds      int                             `json:"lease_ttl_seconds,omitempty"`
+	Force                bool                            `json:"force,omitempty"`
+	// InterceptStrategy is what the manager picked for the session.
+	InterceptStrategy string `json:"intercept_strategy,omitempty"`
 }
 
 type DebugSessionCommandRequest struct {
@@ -64,6 +199,9 @@ type DebugSessionCommandRequest struct {
 type HelperDebugSession struct {
 	SessionKey string              `json:"session_key"`
 	Context    DebugServiceContext `json:"context"`
+	// SupersededBy names the owner who took the session over; the local
+	// session no longer receives traffic.
+	SupersededBy string `json:"superseded_by,omitempty"`
 }
 
 type HelperDebugSessionsResponse struct {
@@ -73,11 +211,39 @@ type HelperDebugSessionsResponse struct {
 type HelperResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
+	// Session is the session a debug enable set up.
+	Session *HelperDebugSession `json:"session,omitempty"`
+}
+
+// traffic-agent contracts
+
+// InterceptRoute is one debug session served by a shared traffic-agent.
+// Routes with headers only receive HTTP requests carrying all of them; a
+// route without headers takes every connection no other route claims.
+type InterceptRoute struct {
+	SessionID    string            `json:"session_id"`
+	SessionToken string            `json:"session_token,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	// Mirror routes never own a connection: they get a copy of the inbound
+	// bytes of every matching connection, whoever serves it.
+	Mirror bool `json:"mirror,omitempty"`
+	// Ports are the container ports the route intercepts; empty means the
+	// agent's KRUN_TARGET_PORT only.
+	Ports []int `json:"ports,omitempty"`
+	// OpaquePorts are the ports the Service declares as not HTTP. Headers
+	// are not read there, so a route with headers takes no connections on
+	// them.
+	OpaquePorts []int `json:"opaque_ports,omitempty"`
 }
 
 const (
 	StreamTypeOpen = "open"
-	StreamTypeData = "data"
+	// StreamTypeOpenAck is the helper's reply once an opened connection
+	// reached the local app. Until it arrives the agent holds the caller;
+	// an error/close reply (or none in time) sends the connection to the
+	// application container instead.
+	StreamTypeOpenAck = "open-ack"
+	StreamTypeData    = "data"
 	// StreamTypeCloseWrite half-closes a connection: the sender saw EOF on
 	// its read side but the reverse direction may still carry data. The
 	// relay routes it like data; only close/error tear the connection down.
@@ -85,6 +251,38 @@ const (
 	StreamTypeClose      = "close"
 	StreamTypeError      = "error"
 	StreamTypePing       = "ping"
+	// StreamTypeLease is sent by the helper on its client stream to renew
+	// the session lease. The relay consumes it; agents never see it.
+	StreamTypeLease = "lease"
+	// StreamTypeSuperseded tells a helper its session was taken over by
+	// another owner; Message names the new owner.
+	StreamTypeSuperseded = "superseded"
+	// StreamTypeWindow grants the receiver Window more bytes of send credit
+	// on a flow-controlled connection, once the sender of the envelope has
+	// written that much to its local side.
+	StreamTypeWindow = "window"
+	// StreamTypeAttach asks a multiplexed client stream to carry SessionID,
+	// authenticated by SessionToken. The manager answers StreamTypeAttached,
+	// or an error envelope without a connection id when it refuses.
+	StreamTypeAttach   = "attach"
+	StreamTypeAttached = "attached"
+	// StreamTypeDetach stops relaying SessionID on a multiplexed client
+	// stream. The manager sends it when another client took the session.
+	StreamTypeDetach = "detach"
+	// StreamTypeResume re-establishes a flow-controlled connection after
+	// the sender's stream reconnected: Seq is the last data sequence number
+	// it received and Window the credit it granted in total. The peer
+	// replays what follows Seq and answers StreamTypeResumed with its own.
+	StreamTypeResume  = "resume"
+	StreamTypeResumed = "resumed"
+	// StreamTypeHold tells the agent the helper is still waiting for the
+	// local app to accept an opened connection; the agent keeps holding
+	// the caller instead of giving up on the open.
+	StreamTypeHold = "hold"
+	// StreamTypeRelease tells the agents of an ephemeral session that it
+	// ended. Such an agent cannot be taken out of its pod, so it removes its
+	// redirect rules and exits instead.
+	StreamTypeRelease = "release"
 )
 
 const (
@@ -92,6 +290,24 @@ const (
 	StreamRoleClient = "client"
 )
 
+const (
+	// StreamMetadataMode marks an open as SessionModeMirror, telling the
+	// helper to discard the local app's response bytes.
+	StreamMetadataMode = "mode"
+	// StreamMetadataTargetPort is the container port an opened connection
+	// was sent to, telling the helper which local port to dial.
+	StreamMetadataTargetPort = "target_port"
+	// StreamMetadataFeatures lists the stream features a helper supports,
+	// comma separated, in the metadata of its attach envelope or the query
+	// of its session stream.
+	StreamMetadataFeatures = "features"
+)
+
+// StreamFeatureOpenAck marks a helper that answers every open with
+// StreamTypeOpenAck or an error/close. The manager acks the opens for
+// helpers without it, so their agents do not hold callers waiting.
+const StreamFeatureOpenAck = "open-ack"
+
 type StreamEnvelope struct {
 	Type         string            `json:"type"`
 	SessionID    string            `json:"session_id"`
@@ -100,4 +316,12 @@ type StreamEnvelope struct {
 	Data         []byte            `json:"data,omitempty"`
 	Message      string            `json:"message,omitempty"`
 	Metadata     map[string]string `json:"metadata,omitempty"`
+	// Window is the initial receive window on open and open-ack, and the
+	// credit increment on window envelopes. A connection is flow controlled
+	// only when both its open and open-ack advertise a window.
+	Window int `json:"window,omitempty"`
+	// Seq numbers the data and close-write envelopes of each direction of
+	// a flow-controlled connection, starting at 1. On window envelopes it
+	// acknowledges everything received up to it.
+	Seq uint64 `json:"seq,omitempty"`
 }
@@ -0,0 +1,169 @@
+// Package intercept holds the routing rules shared by the manager, the
+// injector and the traffic-agent: how intercept headers are normalized and
+// compared, how a request head picks the session that owns it, which ports
+// a session intercepts and how its agent gets into the pod.
+package intercept
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+// NormalizeHeaders canonicalizes header names and trims values. Empty names
+// are dropped; the result is nil when nothing is left, so "no headers" has
+// a single representation on the wire.
+func NormalizeHeaders(headers map[string]string) map[string]string {
+	normalized := map[string]string{}
+	for name, value := range headers {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		normalized[http.CanonicalHeaderKey(name)] = strings.TrimSpace(value)
+	}
+	if len(normalized) == 0 {
+		return nil
+	}
+	return normalized
+}
+
+// EqualHeaders reports whether two header sets select the same traffic.
+func EqualHeaders(a map[string]string, b map[string]string) bool {
+	return maps.Equal(NormalizeHeaders(a), NormalizeHeaders(b))
+}
+
+// Matches reports whether a request head carries every required header with
+// the exact value. An empty requirement matches anything, including
+// connections that are not HTTP at all (nil header).
+func Matches(required map[string]string, header http.Header) bool {
+	for name, value := range NormalizeHeaders(required) {
+		if !slices.Contains(header.Values(name), value) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseHeader splits a "name=value" or "name: value" flag argument.
+func ParseHeader(raw string) (string, string, error) {
+	separator := strings.IndexAny(raw, "=:")
+	if separator < 0 {
+		return "", "", fmt.Errorf("invalid intercept header %q: expected name=value", raw)
+	}
+	name := strings.TrimSpace(raw[:separator])
+	value := strings.TrimSpace(raw[separator+1:])
+	if name == "" {
+		return "", "", fmt.Errorf("invalid intercept header %q: name is required", raw)
+	}
+	if value == "" {
+		return "", "", fmt.Errorf("invalid intercept header %q: value is required", raw)
+	}
+	return http.CanonicalHeaderKey(name), value, nil
+}
+
+// ParseHeaders turns repeated flag arguments into a header set.
+func ParseHeaders(values []string) (map[string]string, error) {
+	headers := map[string]string{}
+	var errs []error
+	for _, raw := range values {
+		name, value, err := ParseHeader(raw)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		headers[name] = value
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return NormalizeHeaders(headers), nil
+}
+
+// FormatHeaders renders a header set as "Name=value, ..." in stable order.
+func FormatHeaders(headers map[string]string) string {
+	normalized := NormalizeHeaders(headers)
+	parts := make([]string, 0, len(normalized))
+	for _, name := range slices.Sorted(maps.Keys(normalized)) {
+		parts = append(parts, name+"="+normalized[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// SortRoutes orders routes so the first match wins correctly: the most
+// specific header sets come first and the catch-all route (no headers)
+// last. Ties are broken by session id to keep the order deterministic.
+func SortRoutes(routes []contracts.InterceptRoute) {
+	slices.SortStableFunc(routes, func(a, b contracts.InterceptRoute) int {
+		if len(a.Headers) != len(b.Headers) {
+			return len(b.Headers) - len(a.Headers)
+		}
+		return strings.Compare(a.SessionID, b.SessionID)
+	})
+}
+
+// HasHeaderRoutes reports whether any route needs the request head parsed.
+func HasHeaderRoutes(routes []contracts.InterceptRoute) bool {
+	return slices.ContainsFunc(routes, func(route contracts.InterceptRoute) bool {
+		return len(route.Headers) > 0
+	})
+}
+
+// NormalizeMode validates a session mode, defaulting to intercept.
+func NormalizeMode(mode string) (string, error) {
+	switch normalized := strings.ToLower(strings.TrimSpace(mode)); normalized {
+	case "", contracts.SessionModeIntercept:
+		return contracts.SessionModeIntercept, nil
+	case contracts.SessionModeMirror:
+		return normalized, nil
+	default:
+		return "", fmt.Errorf("mode must be %q or %q", contracts.SessionModeIntercept, contracts.SessionModeMirror)
+	}
+}
+
+// IsMirror reports whether a (possibly unnormalized) mode is mirror.
+func IsMirror(mode string) bool {
+	normalized, err := NormalizeMode(mode)
+	return err == nil && normalized == contracts.SessionModeMirror
+}
+
+// NormalizeInjection validates how a session's agent is injected,
+// defaulting to a sidecar.
+func NormalizeInjection(injection string) (string, error) {
+	switch normalized := strings.ToLower(strings.TrimSpace(injection)); normalized {
+	case "", contracts.SessionInjectionSidecar:
+		return contracts.SessionInjectionSidecar, nil
+	case contracts.SessionInjectionEphemeral:
+		return normalized, nil
+	default:
+		return "", fmt.Errorf("injection must be %q or %q", contracts.SessionInjectionSidecar, contracts.SessionInjectionEphemeral)
+	}
+}
+
+// IsEphemeral reports whether a (possibly unnormalized) injection is
+// ephemeral.
+func IsEphemeral(injection string) bool {
+	normalized, err := NormalizeInjection(injection)
+	return err == nil && normalized == contracts.SessionInjectionEphemeral
+}
+
+// DescribeStrategy renders an intercept strategy for the developer.
+func DescribeStrategy(strategy string) string {
+	switch strategy {
+	case contracts.InterceptStrategyInbound:
+		return "inbound (connections are redirected as they reach the pod)"
+	case contracts.InterceptStrategyAfterIstioProxy:
+		return "after the Istio proxy (mTLS and mesh policies still apply)"
+	case contracts.InterceptStrategyAfterLinkerdProxy:
+		return "after the Linkerd proxy (mTLS and mesh policies still apply)"
+	case "":
+		return "picked by the traffic-agent"
+	default:
+		return strategy
+	}
+}
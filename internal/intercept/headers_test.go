@@ -0,0 +1,134 @@
+package intercept
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+func TestNormalizeHeaders(t *testing.T) {
+	got := NormalizeHeaders(map[string]string{" x-krun-intercept ": " alice ", "": "ignored"})
+	if len(got) != 1 || got["X-Krun-Intercept"] != "alice" {
+		t.Fatalf("unexpected normalized headers: %v", got)
+	}
+	if NormalizeHeaders(map[string]string{" ": "x"}) != nil {
+		t.Fatal("expected nil for an empty header set")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	header := http.Header{}
+	header.Add("X-Krun-Intercept", "alice")
+	header.Add("X-Tenant", "shop")
+
+	if !Matches(map[string]string{"x-krun-intercept": "alice"}, header) {
+		t.Fatal("expected matching header to match")
+	}
+	if Matches(map[string]string{"x-krun-intercept": "bob"}, header) {
+		t.Fatal("expected different value not to match")
+	}
+	if Matches(map[string]string{"x-krun-intercept": "alice", "x-other": "1"}, header) {
+		t.Fatal("expected missing header not to match")
+	}
+	if !Matches(nil, nil) {
+		t.Fatal("expected empty requirement to match non-HTTP traffic")
+	}
+	if Matches(map[string]string{"x-krun-intercept": "alice"}, nil) {
+		t.Fatal("expected header requirement not to match non-HTTP traffic")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	got, err := ParseHeaders([]string{"x-krun-intercept=alice", "X-Tenant: shop"})
+	if err != nil {
+		t.Fatalf("parse headers: %v", err)
+	}
+	if got["X-Krun-Intercept"] != "alice" || got["X-Tenant"] != "shop" {
+		t.Fatalf("unexpected headers: %v", got)
+	}
+
+	if _, err := ParseHeaders([]string{"no-separator"}); err == nil {
+		t.Fatal("expected error for missing separator")
+	}
+	if _, err := ParseHeaders([]string{"x-krun-intercept="}); err == nil {
+		t.Fatal("expected error for empty value")
+	}
+}
+
+func TestSortRoutesPutsCatchAllLast(t *testing.T) {
+	routes := []contracts.InterceptRoute{
+		{SessionID: "catch-all"},
+		{SessionID: "b", Headers: map[string]string{"X-A": "1"}},
+		{SessionID: "a", Headers: map[string]string{"X-A": "1", "X-B": "2"}},
+	}
+
+	SortRoutes(routes)
+
+	want := []string{"a", "b", "catch-all"}
+	for idx, route := range routes {
+		if route.SessionID != want[idx] {
+			t.Fatalf("unexpected order at %d: %+v", idx, routes)
+		}
+	}
+}
+
+func TestFormatHeaders(t *testing.T) {
+	got := FormatHeaders(map[string]string{"x-tenant": "shop", "x-krun-intercept": "alice"})
+	if got != "X-Krun-Intercept=alice, X-Tenant=shop" {
+		t.Fatalf("unexpected formatted headers: %q", got)
+	}
+}
+
+func TestNormalizeMode(t *testing.T) {
+	cases := map[string]string{
+		"":          contracts.SessionModeIntercept,
+		"intercept": contracts.SessionModeIntercept,
+		" Mirror ":  contracts.SessionModeMirror,
+	}
+	for input, want := range cases {
+		got, err := NormalizeMode(input)
+		if err != nil {
+			t.Fatalf("normalize %q: %v", input, err)
+		}
+		if got != want {
+			t.Fatalf("normalize %q: expected %q, got %q", input, want, got)
+		}
+	}
+	if _, err := NormalizeMode("tee"); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+func TestNormalizeInjection(t *testing.T) {
+	cases := map[string]string{
+		"":            contracts.SessionInjectionSidecar,
+		"sidecar":     contracts.SessionInjectionSidecar,
+		" Ephemeral ": contracts.SessionInjectionEphemeral,
+	}
+	for input, want := range cases {
+		got, err := NormalizeInjection(input)
+		if err != nil {
+			t.Fatalf("normalize %q: %v", input, err)
+		}
+		if got != want {
+			t.Fatalf("normalize %q: expected %q, got %q", input, want, got)
+		}
+	}
+	if _, err := NormalizeInjection("initcontainer"); err == nil {
+		t.Fatal("expected error for unknown injection")
+	}
+}
+
+func TestDescribeStrategy(t *testing.T) {
+	if got := DescribeStrategy(contracts.InterceptStrategyAfterIstioProxy); !strings.Contains(got, "Istio proxy") {
+		t.Fatalf("unexpected istio description: %q", got)
+	}
+	if got := DescribeStrategy(""); got != "picked by the traffic-agent" {
+		t.Fatalf("unexpected description of an unset strategy: %q", got)
+	}
+	if got := DescribeStrategy("sideways"); got != "sideways" {
+		t.Fatalf("expected unknown strategies shown as-is, got %q", got)
+	}
+}
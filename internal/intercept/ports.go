@@ -0,0 +1,60 @@
+package intercept
+
+import (
+	"fmt"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+// NormalizePorts validates the intercepted ports of a session: its primary
+// servicePort/localPort pair plus any extra mappings. The result lists
+// every mapping once, primary first. Without a primary pair the first
+// mapping becomes the primary.
+func NormalizePorts(servicePort int, localPort int, ports []contracts.PortMapping) ([]contracts.PortMapping, error) {
+	if servicePort == 0 && localPort == 0 && len(ports) > 0 {
+		servicePort, localPort = ports[0].ServicePort, ports[0].LocalPort
+	}
+	primary := contracts.PortMapping{ServicePort: servicePort, LocalPort: localPort}
+	normalized := []contracts.PortMapping{primary}
+	for _, port := range ports {
+		if port != primary {
+			normalized = append(normalized, port)
+		}
+	}
+
+	seen := make(map[int]bool, len(normalized))
+	for _, port := range normalized {
+		if port.ServicePort < 1 || port.ServicePort > 65535 {
+			return nil, fmt.Errorf("service_port %d must be in range 1-65535", port.ServicePort)
+		}
+		if port.LocalPort < 1 || port.LocalPort > 65535 {
+			return nil, fmt.Errorf("local_port %d must be in range 1-65535", port.LocalPort)
+		}
+		if seen[port.ServicePort] {
+			return nil, fmt.Errorf("service_port %d is mapped more than once", port.ServicePort)
+		}
+		seen[port.ServicePort] = true
+	}
+	return normalized, nil
+}
+
+// SessionPorts lists the port mappings a session intercepts, primary
+// first.
+func SessionPorts(session contracts.DebugSession) []contracts.PortMapping {
+	if len(session.Ports) > 0 {
+		return session.Ports
+	}
+	return []contracts.PortMapping{{ServicePort: session.ServicePort, LocalPort: session.LocalPort}}
+}
+
+// ContextPorts lists the port mappings of a debug context, primary first.
+func ContextPorts(ctx contracts.DebugServiceContext) []contracts.PortMapping {
+	if len(ctx.Ports) == 0 {
+		return []contracts.PortMapping{{ServicePort: ctx.ContainerPort, LocalPort: ctx.InterceptPort}}
+	}
+	ports := make([]contracts.PortMapping, 0, len(ctx.Ports))
+	for _, port := range ctx.Ports {
+		ports = append(ports, contracts.PortMapping{ServicePort: port.ContainerPort, LocalPort: port.InterceptPort})
+	}
+	return ports
+}
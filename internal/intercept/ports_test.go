@@ -0,0 +1,49 @@
+package intercept
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+func TestNormalizePorts(t *testing.T) {
+	got, err := NormalizePorts(8080, 5000, []contracts.PortMapping{
+		{ServicePort: 8080, LocalPort: 5000},
+		{ServicePort: 9090, LocalPort: 5001},
+	})
+	want := []contracts.PortMapping{{ServicePort: 8080, LocalPort: 5000}, {ServicePort: 9090, LocalPort: 5001}}
+	if err != nil || !slices.Equal(got, want) {
+		t.Fatalf("expected primary first and listed once, got %v err=%v", got, err)
+	}
+
+	got, err = NormalizePorts(0, 0, []contracts.PortMapping{{ServicePort: 9090, LocalPort: 5001}})
+	if err != nil || !slices.Equal(got, []contracts.PortMapping{{ServicePort: 9090, LocalPort: 5001}}) {
+		t.Fatalf("expected the first mapping to become the primary, got %v err=%v", got, err)
+	}
+
+	if _, err := NormalizePorts(8080, 5000, []contracts.PortMapping{{ServicePort: 8080, LocalPort: 5001}}); err == nil {
+		t.Fatal("expected a port mapped twice to be rejected")
+	}
+	if _, err := NormalizePorts(8080, 5000, []contracts.PortMapping{{ServicePort: 9090, LocalPort: 0}}); err == nil {
+		t.Fatal("expected a missing local port to be rejected")
+	}
+}
+
+func TestContextPorts(t *testing.T) {
+	single := ContextPorts(contracts.DebugServiceContext{ContainerPort: 8080, InterceptPort: 5000})
+	if !slices.Equal(single, []contracts.PortMapping{{ServicePort: 8080, LocalPort: 5000}}) {
+		t.Fatalf("expected the primary pair, got %v", single)
+	}
+	multi := ContextPorts(contracts.DebugServiceContext{
+		ContainerPort: 8080,
+		InterceptPort: 5000,
+		Ports: []contracts.DebugServicePortContext{
+			{ContainerPort: 8080, InterceptPort: 5000},
+			{ContainerPort: 9090, InterceptPort: 5001},
+		},
+	})
+	if len(multi) != 2 || multi[1] != (contracts.PortMapping{ServicePort: 9090, LocalPort: 5001}) {
+		t.Fatalf("expected every listed port, got %v", multi)
+	}
+}
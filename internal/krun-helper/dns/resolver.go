@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+// DefaultAddress is where the helper serves DNS. System resolvers only
+// reach servers on port 53.
+const DefaultAddress = "127.0.0.1:53"
+
+// systemResolver points the operating system's resolver at the server.
+type systemResolver interface {
+	// Apply routes names to the server. Domains starting with "." stand
+	// for every name below them.
+	Apply(server netip.AddrPort, domains []string) error
+	// Restore undoes Apply, including an Apply of a helper that crashed.
+	Restore() error
+}
+
+// Resolver publishes the names of the debug sessions' dependencies through
+// an embedded DNS server the operating system's resolver is pointed at.
+type Resolver struct {
+	server  *Server
+	system  systemResolver
+	address netip.AddrPort
+
+	mu sync.Mutex
+}
+
+// Start serves DNS on address and points the system's resolver at it.
+func Start(address string) (*Resolver, error) {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns address %q: %w", address, err)
+	}
+	system, err := newSystemResolver()
+	if err != nil {
+		return nil, err
+	}
+	if err := system.Restore(); err != nil {
+		return nil, fmt.Errorf("restore system resolver: %w", err)
+	}
+
+	server := NewServer()
+	if err := server.Listen(address); err != nil {
+		return nil, err
+	}
+	resolver := &Resolver{server: server, system: system, address: addrPort}
+	if err := resolver.Update(nil); err != nil {
+		server.Close()
+		return nil, err
+	}
+	return resolver, nil
+}
+
+// Update replaces the names the resolver answers.
+func (r *Resolver) Update(entries []contracts.HostsEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.server.SetEntries(entries)
+	if err := r.system.Apply(r.address, routedDomains(entries)); err != nil {
+		return fmt.Errorf("point system resolver at %s: %w", r.address, err)
+	}
+	return nil
+}
+
+// Close points the system's resolver back where it was and stops the
+// server.
+func (r *Resolver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return errors.Join(r.system.Restore(), r.server.Close())
+}
+
+// routedDomains lists the names to route to the server: the cluster's
+// domains and every entry's hostname.
+func routedDomains(entries []contracts.HostsEntry) []string {
+	domains := make([]string, 0, len(clusterSuffixes)+len(entries))
+	for _, suffix := range clusterSuffixes {
+		domains = append(domains, "."+strings.TrimSuffix(suffix, "."))
+	}
+	for _, entry := range entries {
+		hostname := strings.ToLower(strings.TrimSpace(entry.Hostname))
+		if suffix, ok := strings.CutPrefix(hostname, "*"); ok {
+			hostname = suffix
+		}
+		hostname = strings.TrimSuffix(hostname, ".")
+		if hostname != "" && hostname != "." && !slices.Contains(domains, hostname) {
+			domains = append(domains, hostname)
+		}
+	}
+	return domains
+}
@@ -0,0 +1,278 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// answerTTL is kept short: the names come and go with debug sessions.
+	answerTTL      = 5
+	tcpIdleTimeout = 10 * time.Second
+	maxMessageSize = 65535
+)
+
+// clusterSuffixes are routed to the server as a whole: the cluster's DNS
+// is out of reach, so other resolvers should not see these names.
+var clusterSuffixes = []string{"svc.", "cluster.local."}
+
+// Server answers the names of the debug sessions' dependencies; the
+// system resolver only sends it those and the cluster's domains, and any
+// other name does not exist. A name ending in .svc also answers as
+// .svc.cluster.local and the other way round; hostnames starting with
+// "*." match any name below them.
+type Server struct {
+	mu        sync.RWMutex
+	records   map[string][]netip.Addr
+	wildcards map[string][]netip.Addr
+
+	udp net.PacketConn
+	tcp net.Listener
+	wg  sync.WaitGroup
+}
+
+// NewServer returns a server without names.
+func NewServer() *Server {
+	return &Server{
+		records:   map[string][]netip.Addr{},
+		wildcards: map[string][]netip.Addr{},
+	}
+}
+
+// Listen binds address over UDP and TCP and serves queries until Close.
+func (s *Server) Listen(address string) error {
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return fmt.Errorf("listen on udp %s: %w", address, err)
+	}
+	// TCP takes the port UDP was given, for address ":0".
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("listen on tcp %s: %w", address, err)
+	}
+	s.udp, s.tcp = udp, tcp
+
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	if s.udp == nil {
+		return ""
+	}
+	return s.udp.LocalAddr().String()
+}
+
+func (s *Server) Close() error {
+	if s.udp == nil {
+		return nil
+	}
+	err := errors.Join(s.udp.Close(), s.tcp.Close())
+	s.wg.Wait()
+	return err
+}
+
+// SetEntries replaces the names the server answers.
+func (s *Server) SetEntries(entries []contracts.HostsEntry) {
+	records := map[string][]netip.Addr{}
+	wildcards := map[string][]netip.Addr{}
+	for _, entry := range entries {
+		addr, err := netip.ParseAddr(strings.TrimSpace(entry.IP))
+		if err != nil {
+			continue
+		}
+		hostname := strings.TrimSpace(entry.Hostname)
+		if suffix, ok := strings.CutPrefix(hostname, "*."); ok {
+			name := canonicalName(suffix)
+			wildcards[name] = append(wildcards[name], addr)
+			continue
+		}
+		name := canonicalName(hostname)
+		records[name] = append(records[name], addr)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records, s.wildcards = records, wildcards
+}
+
+// lookup returns the addresses of a name, nil when it does not exist.
+func (s *Server) lookup(name string) []netip.Addr {
+	name = canonicalName(name)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if addrs, ok := s.records[name]; ok {
+		return addrs
+	}
+	for parent := name; ; {
+		_, rest, found := strings.Cut(parent, ".")
+		if !found || rest == "" {
+			break
+		}
+		if addrs, ok := s.wildcards[rest]; ok {
+			return addrs
+		}
+		parent = rest
+	}
+	return nil
+}
+
+// canonicalName lowercases a name, makes it fully qualified and shortens
+// .svc.cluster.local to .svc.
+func canonicalName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	if trimmed, ok := strings.CutSuffix(name, ".svc.cluster.local."); ok {
+		name = trimmed + ".svc."
+	}
+	return name
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := s.udp.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buffer[:n]...)
+		go func() {
+			if response := s.handle(query); response != nil {
+				_, _ = s.udp.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers the length-prefixed queries of one TCP connection.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readFramed(conn)
+		if err != nil {
+			return
+		}
+		response := s.handle(query)
+		if response == nil {
+			return
+		}
+		if err := writeFramed(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response to a query, or nil when the query cannot be
+// parsed.
+func (s *Server) handle(query []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return reply(header, nil, dnsmessage.RCodeFormatError, nil)
+	}
+
+	addrs := s.lookup(question.Name.String())
+	if addrs == nil {
+		return reply(header, &question, dnsmessage.RCodeNameError, nil)
+	}
+	return reply(header, &question, dnsmessage.RCodeSuccess, addrs)
+}
+
+// reply builds an authoritative response carrying the addresses that
+// match the question's type.
+func reply(query dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode, addrs []netip.Addr) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		Authoritative:      rcode != dnsmessage.RCodeServerFailure,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil
+	}
+	if question != nil {
+		if err := builder.Question(*question); err != nil {
+			return nil
+		}
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if question == nil {
+			break
+		}
+		resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: answerTTL}
+		var err error
+		switch {
+		case question.Type == dnsmessage.TypeA && addr.Is4():
+			err = builder.AResource(resource, dnsmessage.AResource{A: addr.As4()})
+		case question.Type == dnsmessage.TypeAAAA && addr.Is6() && !addr.Is4In6():
+			err = builder.AAAAResource(resource, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func readFramed(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func writeFramed(w io.Writer, message []byte) error {
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, len(message)+2), uint16(len(message)))
+	_, err := w.Write(append(framed, message...))
+	return err
+}
@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+func TestServerAnswersSessionNames(t *testing.T) {
+	server := startTestServer(t, []contracts.HostsEntry{
+		{IP: "127.0.0.1", Hostname: "rabbitmq.default.svc"},
+		{IP: "127.0.0.2", Hostname: "postgres.data.svc.cluster.local"},
+		{IP: "127.0.0.3", Hostname: "*.cache.internal"},
+		{IP: "127.0.0.4", Hostname: "Queue.Local"},
+	})
+
+	for _, network := range []string{"udp", "tcp"} {
+		resolver := testResolver(server.Addr(), network)
+		cases := map[string]string{
+			"rabbitmq.default.svc":               "127.0.0.1",
+			"rabbitmq.default.svc.cluster.local": "127.0.0.1",
+			"postgres.data.svc":                  "127.0.0.2",
+			"redis.eu.cache.internal":            "127.0.0.3",
+			"queue.local":                        "127.0.0.4",
+		}
+		for name, want := range cases {
+			addrs, err := resolver.LookupHost(context.Background(), name)
+			if err != nil {
+				t.Fatalf("%s lookup %s: %v", network, name, err)
+			}
+			if !slices.Equal(addrs, []string{want}) {
+				t.Fatalf("%s lookup %s: expected %s, got %v", network, name, want, addrs)
+			}
+		}
+	}
+}
+
+func TestServerRejectsUnknownNames(t *testing.T) {
+	server := startTestServer(t, []contracts.HostsEntry{{IP: "127.0.0.1", Hostname: "queue.local"}})
+
+	for _, network := range []string{"udp", "tcp"} {
+		for _, name := range []string{"orders.default.svc.cluster.local", "other.queue.local", "example.com"} {
+			_, err := testResolver(server.Addr(), network).LookupHost(context.Background(), name)
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Fatalf("%s lookup %s: expected the name not to exist, got %v", network, name, err)
+			}
+		}
+	}
+}
+
+func TestServerUpdatesEntries(t *testing.T) {
+	server := startTestServer(t, []contracts.HostsEntry{{IP: "127.0.0.1", Hostname: "rabbitmq.default.svc"}})
+	server.SetEntries(nil)
+
+	if _, err := testResolver(server.Addr(), "udp").LookupHost(context.Background(), "rabbitmq.default.svc"); err == nil {
+		t.Fatalf("expected a removed name not to resolve")
+	}
+}
+
+func TestRoutedDomains(t *testing.T) {
+	got := routedDomains([]contracts.HostsEntry{
+		{IP: "127.0.0.1", Hostname: "rabbitmq.default.svc"},
+		{IP: "127.0.0.1", Hostname: "*.cache.internal"},
+		{IP: "127.0.0.1", Hostname: "Queue.Local"},
+		{IP: "127.0.0.1", Hostname: "queue.local"},
+	})
+	want := []string{".svc", ".cluster.local", "rabbitmq.default.svc", ".cache.internal", "queue.local"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected routed domains %v, got %v", want, got)
+	}
+}
+
+func startTestServer(t *testing.T, entries []contracts.HostsEntry) *Server {
+	t.Helper()
+	server := NewServer()
+	server.SetEntries(entries)
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func testResolver(address string, network string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: time.Second}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
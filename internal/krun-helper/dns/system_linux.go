@@ -0,0 +1,180 @@
+//go:build linux
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	resolvConfBlockStart = "##### KRUN #####"
+	resolvConfBlockEnd   = "##### END KRUN #####"
+	// resolvedStub is the address of systemd-resolved's stub resolver,
+	// the nameserver /etc/resolv.conf lists when systemd-resolved owns it.
+	resolvedStub = "127.0.0.53"
+	// linkName is the dummy link that carries the server and its routing
+	// domains: systemd-resolved takes no DNS settings for the loopback
+	// link.
+	linkName = "krun-dns"
+)
+
+var (
+	resolvConfPath = "/etc/resolv.conf"
+	lookPath       = exec.LookPath
+	runCommand     = func(name string, args ...string) error {
+		output, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+)
+
+// resolved routes the sessions' names to the server with routing-only
+// domains on a link of systemd-resolved; every other name keeps resolving
+// as before. If the helper dies
+// without restoring, only those names fail, and the next start removes
+// the link.
+type resolved struct {
+	mu      sync.Mutex
+	linked  bool
+	applied []string
+}
+
+// newSystemResolver needs systemd-resolved: the resolver library reading
+// /etc/resolv.conf cannot route by name, and a nameserver put first there
+// would see every lookup and be dropped by whatever rewrites the file.
+// Without it the helper falls back to the hosts file. Either way the
+// block an older helper left in /etc/resolv.conf goes first.
+func newSystemResolver() (systemResolver, error) {
+	if err := stripResolvConf(resolvConfPath); err != nil {
+		return nil, err
+	}
+	usesStub, err := usesResolvedStub(resolvConfPath)
+	if err != nil {
+		return nil, err
+	}
+	if !usesStub {
+		return nil, fmt.Errorf("%s does not point at systemd-resolved, which routing names by domain needs", resolvConfPath)
+	}
+	for _, tool := range []string{"ip", "resolvectl"} {
+		if _, err := lookPath(tool); err != nil {
+			return nil, fmt.Errorf("find %s: %w", tool, err)
+		}
+	}
+	return &resolved{}, nil
+}
+
+func (r *resolved) Apply(server netip.AddrPort, domains []string) error {
+	if server.Port() != 53 {
+		return fmt.Errorf("systemd-resolved link settings cannot name port %d", server.Port())
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.linked && slices.Equal(r.applied, domains) {
+		return nil
+	}
+
+	if !r.linked {
+		if err := runCommand("ip", "link", "add", linkName, "type", "dummy"); err != nil {
+			return err
+		}
+		r.linked = true
+		if err := runCommand("ip", "link", "set", linkName, "up"); err != nil {
+			return err
+		}
+		if err := runCommand("resolvectl", "dns", linkName, server.Addr().String()); err != nil {
+			return err
+		}
+	}
+	routing := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		routing = append(routing, "~"+strings.TrimPrefix(domain, "."))
+	}
+	if err := runCommand("resolvectl", append([]string{"domain", linkName}, routing...)...); err != nil {
+		return err
+	}
+	if err := runCommand("resolvectl", "flush-caches"); err != nil {
+		return err
+	}
+	r.applied = slices.Clone(domains)
+	return nil
+}
+
+// Restore deletes the link; systemd-resolved drops its settings with it.
+func (r *resolved) Restore() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.linked {
+		if _, err := net.InterfaceByName(linkName); err != nil {
+			return nil
+		}
+	}
+	if err := runCommand("ip", "link", "delete", linkName); err != nil {
+		return err
+	}
+	r.linked = false
+	r.applied = nil
+	return nil
+}
+
+// usesResolvedStub reports whether the resolver library sends its queries
+// to systemd-resolved.
+func usesResolvedStub(path string) (bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("read %s: %w", path, err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" && fields[1] == resolvedStub {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// stripResolvConf removes the block older helpers put at the top of the
+// file. It is written in place: the file is often a symlink into a
+// resolver daemon's runtime directory, which has to stay.
+func stripResolvConf(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	stripped := stripResolvConfBlock(string(content))
+	if stripped == string(content) {
+		return nil
+	}
+	perm := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := os.WriteFile(path, []byte(stripped), perm); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
+
+func stripResolvConfBlock(content string) string {
+	start := strings.Index(content, resolvConfBlockStart)
+	if start == -1 {
+		return content
+	}
+	end := strings.Index(content[start:], resolvConfBlockEnd)
+	if end == -1 {
+		return content[:start]
+	}
+	end += start + len(resolvConfBlockEnd)
+	return content[:start] + strings.TrimLeft(content[end:], "\n")
+}
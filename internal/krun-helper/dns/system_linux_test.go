@@ -0,0 +1,112 @@
+//go:build linux
+
+package dns
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNewSystemResolverStripsStaleBlock(t *testing.T) {
+	stubbed := "nameserver 127.0.0.53\noptions edns0 trust-ad\nsearch corp.example\n"
+	plain := "search corp.example\nnameserver 10.0.0.2\n"
+	stale := "##### KRUN #####\nnameserver 127.0.0.1\n##### END KRUN #####\n"
+	withResolvConf(t, stale+stubbed)
+	lookPath = func(file string) (string, error) { return "/usr/bin/" + file, nil }
+	t.Cleanup(func() { lookPath = defaultLookPath })
+
+	system, err := newSystemResolver()
+	if err != nil {
+		t.Fatalf("new system resolver: %v", err)
+	}
+	if _, ok := system.(*resolved); !ok {
+		t.Fatalf("expected systemd-resolved to route the names, got %T", system)
+	}
+	if got := readFile(t, resolvConfPath); got != stubbed {
+		t.Fatalf("expected the stale block removed, got %q", got)
+	}
+
+	// Without systemd-resolved nothing is written; the helper falls back
+	// to the hosts file.
+	withResolvConf(t, stale+plain)
+	if _, err := newSystemResolver(); err == nil {
+		t.Fatalf("expected an error without systemd-resolved")
+	}
+	if got := readFile(t, resolvConfPath); got != plain {
+		t.Fatalf("expected the stale block removed, got %q", got)
+	}
+}
+
+func TestResolvedRoutesDomainsOnLink(t *testing.T) {
+	var commands []string
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+	t.Cleanup(func() { runCommand = defaultRunCommand })
+	system := &resolved{}
+	server := netip.MustParseAddrPort("127.0.0.1:53")
+
+	if err := system.Apply(server, []string{".svc", ".cluster.local"}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := system.Apply(server, []string{".svc", ".cluster.local", "kafka.example.com"}); err != nil {
+		t.Fatalf("apply again: %v", err)
+	}
+	// Applying the same domains changes nothing.
+	if err := system.Apply(server, []string{".svc", ".cluster.local", "kafka.example.com"}); err != nil {
+		t.Fatalf("apply unchanged: %v", err)
+	}
+	if err := system.Restore(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	want := []string{
+		"ip link add krun-dns type dummy",
+		"ip link set krun-dns up",
+		"resolvectl dns krun-dns 127.0.0.1",
+		"resolvectl domain krun-dns ~svc ~cluster.local",
+		"resolvectl flush-caches",
+		"resolvectl domain krun-dns ~svc ~cluster.local ~kafka.example.com",
+		"resolvectl flush-caches",
+		"ip link delete krun-dns",
+	}
+	if !slices.Equal(commands, want) {
+		t.Fatalf("unexpected commands\nwant: %q\ngot:  %q", want, commands)
+	}
+}
+
+func TestResolvedRejectsOtherPorts(t *testing.T) {
+	if err := (&resolved{}).Apply(netip.MustParseAddrPort("127.0.0.1:5353"), nil); err == nil {
+		t.Fatalf("expected a port other than 53 to be rejected")
+	}
+}
+
+var (
+	defaultLookPath   = lookPath
+	defaultRunCommand = runCommand
+)
+
+func withResolvConf(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write resolv.conf: %v", err)
+	}
+	previous := resolvConfPath
+	resolvConfPath = path
+	t.Cleanup(func() { resolvConfPath = previous })
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return string(content)
+}
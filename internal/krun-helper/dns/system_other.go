@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+
+package dns
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func newSystemResolver() (systemResolver, error) {
+	return nil, fmt.Errorf("the DNS resolver is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,76 @@
+//go:build windows
+
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// nrptComment marks the Name Resolution Policy Table rules krun owns.
+const nrptComment = "krun"
+
+// nrpt routes the sessions' names to the server with Name Resolution
+// Policy Table rules; every other name keeps resolving as before.
+type nrpt struct {
+	mu      sync.Mutex
+	applied []string
+}
+
+func newSystemResolver() (systemResolver, error) {
+	return &nrpt{}, nil
+}
+
+func (n *nrpt) Apply(server netip.AddrPort, domains []string) error {
+	if server.Port() != 53 {
+		return fmt.Errorf("name resolution policy rules cannot name port %d", server.Port())
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if slices.Equal(n.applied, domains) {
+		return nil
+	}
+
+	quoted := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		quoted = append(quoted, powershellQuote(domain))
+	}
+	script := removeNRPTRulesScript
+	if len(quoted) > 0 {
+		script += fmt.Sprintf("; Add-DnsClientNrptRule -Namespace %s -NameServers %s -Comment %s | Out-Null",
+			strings.Join(quoted, ","), powershellQuote(server.Addr().String()), powershellQuote(nrptComment))
+	}
+	if err := runPowershell(script + "; Clear-DnsClientCache"); err != nil {
+		return err
+	}
+	n.applied = slices.Clone(domains)
+	return nil
+}
+
+func (n *nrpt) Restore() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := runPowershell(removeNRPTRulesScript + "; Clear-DnsClientCache"); err != nil {
+		return err
+	}
+	n.applied = nil
+	return nil
+}
+
+var removeNRPTRulesScript = "Get-DnsClientNrptRule | Where-Object Comment -eq " + powershellQuote(nrptComment) + " | Remove-DnsClientNrptRule -Force"
+
+func runPowershell(script string) error {
+	output, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", "$ErrorActionPreference = 'Stop'; "+script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func powershellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
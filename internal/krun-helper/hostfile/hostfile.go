@@ -156,7 +156,8 @@ func buildKrunBlock(entries []contracts.HostsEntry, newline string) string {
 	for _, entry := range entries {
 		hostname := strings.TrimSpace(entry.Hostname)
 		ip := strings.TrimSpace(entry.IP)
-		if hostname == "" || ip == "" {
+		// The hosts file has no wildcards; only the DNS resolver serves them.
+		if hostname == "" || ip == "" || strings.Contains(hostname, "*") {
 			continue
 		}
 		builder.WriteString(ip)
@@ -194,6 +194,33 @@ func TestUpdateMalformedExistingBlock(t *testing.T) {
 	}
 }
 
+func TestUpdateSkipsWildcards(t *testing.T) {
+	tmpDir := t.TempDir()
+	hostsPath := filepath.Join(tmpDir, "hosts")
+	if err := os.WriteFile(hostsPath, []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+		t.Fatalf("write initial hosts: %v", err)
+	}
+
+	overrideHostsPath(t, hostsPath)
+
+	err := Update([]contracts.HostsEntry{
+		{IP: "127.0.0.1", Hostname: "*.cache.internal"},
+		{IP: "127.0.0.1", Hostname: "rabbitmq.local"},
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	got := mustRead(t, hostsPath)
+	want := "127.0.0.1 localhost\n" +
+		"##### KRUN #####\n" +
+		"127.0.0.1\trabbitmq.local\n" +
+		"##### END KRUN #####\n"
+	if got != want {
+		t.Fatalf("unexpected hosts file\nwant:\n%q\ngot:\n%q", want, got)
+	}
+}
+
 func overrideHostsPath(t *testing.T, hostsPath string) {
 	t.Helper()
 	original := hostsFilePathResolver
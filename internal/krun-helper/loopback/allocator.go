@@ -0,0 +1,132 @@
+package loopback
+
+import (
+	"errors"
+	"net/netip"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/ftechmax/krun/internal/sessionkey"
+)
+
+// The whole of 127.0.0.0/8 reaches the loopback interface on Linux and
+// Windows, so any address in it can be bound without setup. 127.0.0.1 is
+// left to local services. Elsewhere, as on macOS, lo0 only carries
+// 127.0.0.1 and every dependency shares it.
+var (
+	firstAddress  = netip.MustParseAddr("127.0.0.2")
+	lastAddress   = netip.MustParseAddr("127.0.0.254")
+	sharedAddress = netip.MustParseAddr("127.0.0.1")
+)
+
+var ErrExhausted = errors.New("no free loopback address")
+
+// Allocator gives every dependency its own loopback address, so
+// dependencies on the same port can be forwarded side by side. A
+// dependency keeps its address while any session uses it.
+type Allocator struct {
+	// shared hands every dependency sharedAddress.
+	shared bool
+
+	mu        sync.Mutex
+	addresses map[string]netip.Addr
+	sessions  map[string][]string
+}
+
+func NewAllocator() *Allocator {
+	return newAllocator(runtime.GOOS != "linux" && runtime.GOOS != "windows")
+}
+
+func newAllocator(shared bool) *Allocator {
+	return &Allocator{
+		shared:    shared,
+		addresses: map[string]netip.Addr{},
+		sessions:  map[string][]string{},
+	}
+}
+
+// Assign replaces the dependencies of a session and returns their
+// addresses. Dependencies are opaque keys; the session's previous ones
+// that no other session uses are released.
+func (a *Allocator) Assign(sessionKey string, dependencies []string) (map[string]netip.Addr, error) {
+	if a.shared {
+		assigned := make(map[string]netip.Addr, len(dependencies))
+		for _, dependency := range dependencies {
+			assigned[dependency] = sharedAddress
+		}
+		return assigned, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := sessionkey.Normalize(sessionKey)
+	previous, existed := a.sessions[key]
+	a.sessions[key] = dependencies
+
+	assigned := make(map[string]netip.Addr, len(dependencies))
+	for _, dependency := range dependencies {
+		address, ok := a.addresses[dependency]
+		if !ok {
+			address, ok = a.freeLocked()
+			if !ok {
+				if existed {
+					a.sessions[key] = previous
+				} else {
+					delete(a.sessions, key)
+				}
+				a.releaseUnusedLocked()
+				return nil, ErrExhausted
+			}
+			a.addresses[dependency] = address
+		}
+		assigned[dependency] = address
+	}
+	a.releaseUnusedLocked()
+	return assigned, nil
+}
+
+// Release drops a session's dependencies.
+func (a *Allocator) Release(sessionKey string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, sessionkey.Normalize(sessionKey))
+	a.releaseUnusedLocked()
+}
+
+func (a *Allocator) Clear() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.addresses = map[string]netip.Addr{}
+	a.sessions = map[string][]string{}
+}
+
+// freeLocked returns the lowest address no dependency holds.
+func (a *Allocator) freeLocked() (netip.Addr, bool) {
+	taken := make(map[netip.Addr]bool, len(a.addresses))
+	for _, address := range a.addresses {
+		taken[address] = true
+	}
+	for address := firstAddress; address.Compare(lastAddress) <= 0; address = address.Next() {
+		if !taken[address] {
+			return address, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+func (a *Allocator) releaseUnusedLocked() {
+	for dependency := range a.addresses {
+		used := false
+		for _, dependencies := range a.sessions {
+			if slices.Contains(dependencies, dependency) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			delete(a.addresses, dependency)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package loopback
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestAssignGivesEachDependencyItsOwnAddress(t *testing.T) {
+	allocator := newAllocator(false)
+
+	assigned, err := allocator.Assign("shop/orders", []string{"default/orders-db", "default/billing-db"})
+	if err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	if assigned["default/orders-db"] != netip.MustParseAddr("127.0.0.2") || assigned["default/billing-db"] != netip.MustParseAddr("127.0.0.3") {
+		t.Fatalf("unexpected addresses %v", assigned)
+	}
+
+	// Another session sharing a dependency gets the same address for it.
+	shared, err := allocator.Assign("shop/billing", []string{"default/billing-db", "default/redis"})
+	if err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	if shared["default/billing-db"] != assigned["default/billing-db"] || shared["default/redis"] != netip.MustParseAddr("127.0.0.4") {
+		t.Fatalf("unexpected shared addresses %v", shared)
+	}
+
+	// Released addresses are handed out again; shared ones stay.
+	allocator.Release("shop/orders")
+	again, err := allocator.Assign("shop/catalog", []string{"default/catalog-db"})
+	if err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	if again["default/catalog-db"] != netip.MustParseAddr("127.0.0.2") {
+		t.Fatalf("expected the released address reused, got %v", again)
+	}
+	if kept, _ := allocator.Assign("shop/billing", []string{"default/billing-db"}); kept["default/billing-db"] != assigned["default/billing-db"] {
+		t.Fatalf("expected the shared dependency to keep its address, got %v", kept)
+	}
+}
+
+func TestAssignFailsWhenAddressesRunOut(t *testing.T) {
+	allocator := newAllocator(false)
+	dependencies := make([]string, 0, 253)
+	for index := range 253 {
+		dependencies = append(dependencies, fmt.Sprintf("default/db-%d", index))
+	}
+	if _, err := allocator.Assign("a", dependencies); err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+
+	if _, err := allocator.Assign("b", []string{"default/one-too-many"}); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("expected ErrExhausted, got %v", err)
+	}
+	// The failed session holds nothing.
+	allocator.Release("a")
+	assigned, err := allocator.Assign("c", []string{"default/db"})
+	if err != nil || assigned["default/db"] != netip.MustParseAddr("127.0.0.2") {
+		t.Fatalf("expected the addresses free again, got %v (%v)", assigned, err)
+	}
+}
+
+func TestAssignSharesOneAddressWithoutLoopbackRange(t *testing.T) {
+	allocator := newAllocator(true)
+
+	assigned, err := allocator.Assign("shop/orders", []string{"default/orders-db", "default/billing-db"})
+	if err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	for dependency, address := range assigned {
+		if address != netip.MustParseAddr("127.0.0.1") {
+			t.Fatalf("expected %s on 127.0.0.1, got %v", dependency, address)
+		}
+	}
+}
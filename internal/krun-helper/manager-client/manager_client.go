@@ -2,24 +2,37 @@ package managerclient
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/intercept"
 	"github.com/ftechmax/krun/internal/kube"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	defaultManagerNamespace   = "krun-system"
 	defaultManagerServiceName = "krun-traffic-manager"
 	defaultManagerServicePort = 8080
-	ManagerClientID           = "krun-helper"
-	managerRequestTimeout     = 10 * time.Second
+	// LegacyClientID is the client id every helper sent before each
+	// installation got its own.
+	LegacyClientID        = "krun-helper"
+	managerRequestTimeout = 10 * time.Second
+	// clientIDFile keeps the installation's client id, below the user
+	// config directory.
+	clientIDFile = "krun/helper-client-id"
 
 	authSecretName = "krun-manager-auth"
 	authSecretKey  = "token"
@@ -31,14 +44,18 @@ const (
 )
 
 type SessionAPI interface {
-	CreateSession(ctx contracts.DebugServiceContext) (contracts.DebugSession, error)
+	// CreateSession registers a session for ctx. udpTargets are the UDP
+	// dependencies the manager will relay to for it, and nothing else.
+	CreateSession(ctx contracts.DebugServiceContext, udpTargets []contracts.UDPTarget) (contracts.DebugSession, error)
 	ListSessions() ([]contracts.DebugSession, error)
 	DeleteSession(sessionID string) error
+	// ClientID identifies this helper installation as a session owner.
+	ClientID() string
 }
 
 type NoopSessionClient struct{}
 
-func (NoopSessionClient) CreateSession(ctx contracts.DebugServiceContext) (contracts.DebugSession, error) {
+func (NoopSessionClient) CreateSession(ctx contracts.DebugServiceContext, _ []contracts.UDPTarget) (contracts.DebugSession, error) {
 	serviceName := strings.TrimSpace(ctx.ServiceName)
 	return contracts.DebugSession{
 		SessionID:   "noop/" + serviceName,
@@ -54,8 +71,23 @@ func (NoopSessionClient) ListSessions() ([]contracts.DebugSession, error) {
 	return nil, nil
 }
 
+func (NoopSessionClient) ClientID() string {
+	return LegacyClientID
+}
+
+// ErrSessionConflict means the manager refused to replace a session owned
+// by someone else; retry with DebugServiceContext.Force to take it over.
+var ErrSessionConflict = errors.New("debug session is owned by someone else")
+
 type kubeManagerSessionClient struct {
 	client *kube.Client
+	// clientID, kubeUser and hostname identify this developer as the
+	// session owner. kubeUser is read from the local kubeconfig and the
+	// manager cannot verify it; the random clientID is what tells two
+	// developers with the same user and hostname apart.
+	clientID string
+	kubeUser string
+	hostname string
 }
 
 func NewSessionClient(kubeConfigPath string) (SessionAPI, error) {
@@ -64,11 +96,84 @@ func NewSessionClient(kubeConfigPath string) (SessionAPI, error) {
 		return nil, err
 	}
 	return &kubeManagerSessionClient{
-		client: client,
+		client:   client,
+		clientID: installationClientID(),
+		kubeUser: resolveKubeUser(kubeConfigPath),
+		hostname: LocalHostname(),
 	}, nil
 }
 
-func (c *kubeManagerSessionClient) CreateSession(ctx contracts.DebugServiceContext) (contracts.DebugSession, error) {
+func (c *kubeManagerSessionClient) ClientID() string {
+	return c.clientID
+}
+
+// installationClientID returns the client id of this helper installation.
+// An id that cannot be stored lasts until the helper restarts; sessions it
+// created then look like someone else's.
+func installationClientID() string {
+	configDir, err := os.UserConfigDir()
+	if err == nil {
+		var clientID string
+		if clientID, err = loadClientID(filepath.Join(configDir, clientIDFile)); err == nil {
+			return clientID
+		}
+	}
+	log.Printf("helper client id is not persisted: %v", err)
+	return newClientID()
+}
+
+// loadClientID reads the client id stored at path, generating and storing
+// one on first use.
+func loadClientID(path string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		if clientID := strings.TrimSpace(string(raw)); clientID != "" {
+			return clientID, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("read helper client id: %w", err)
+	}
+	clientID := newClientID()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", fmt.Errorf("create helper client id directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(clientID+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("write helper client id: %w", err)
+	}
+	return clientID, nil
+}
+
+func newClientID() string {
+	buffer := make([]byte, 16)
+	_, _ = rand.Read(buffer)
+	return "krun-helper-" + hex.EncodeToString(buffer)
+}
+
+// LocalHostname is the hostname recorded as part of session ownership.
+func LocalHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(hostname)
+}
+
+// resolveKubeUser returns the kubeconfig user of the current context.
+func resolveKubeUser(kubeConfigPath string) string {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeConfigPath
+	rawConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).RawConfig()
+	if err != nil {
+		return ""
+	}
+	kubeContext, ok := rawConfig.Contexts[rawConfig.CurrentContext]
+	if !ok || kubeContext == nil {
+		return ""
+	}
+	return strings.TrimSpace(kubeContext.AuthInfo)
+}
+
+func (c *kubeManagerSessionClient) CreateSession(ctx contracts.DebugServiceContext, udpTargets []contracts.UDPTarget) (contracts.DebugSession, error) {
 	serviceName := strings.TrimSpace(ctx.ServiceName)
 	if serviceName == "" {
 		return contracts.DebugSession{}, errors.New("create manager session: service_name is required")
@@ -86,7 +191,20 @@ func (c *kubeManagerSessionClient) CreateSession(ctx contracts.DebugServiceConte
 		Workload:    serviceName,
 		ServicePort: ctx.ContainerPort,
 		LocalPort:   ctx.InterceptPort,
-		ClientID:    ManagerClientID,
+		ClientID:    c.clientID,
+		KubeUser:    c.kubeUser,
+		Hostname:    c.hostname,
+
+		InterceptHeaders: ctx.InterceptHeaders,
+		Mode:             ctx.Mode,
+		SingleReplica:    ctx.SingleReplica,
+		Injection:        ctx.Injection,
+		LeaseTTLSeconds:  ctx.LeaseTTLSeconds,
+		UDPTargets:       udpTargets,
+		Force:            ctx.Force,
+	}
+	if len(ctx.Ports) > 0 {
+		request.Ports = intercept.ContextPorts(ctx)
 	}
 
 	body, err := json.Marshal(request)
@@ -102,6 +220,7 @@ func (c *kubeManagerSessionClient) CreateSession(ctx contracts.DebugServiceConte
 		return contracts.DebugSession{}, err
 	}
 
+	var statusCode int
 	responseBody, err := c.client.Clientset.CoreV1().RESTClient().Post().
 		Namespace(defaultManagerNamespace).
 		Resource("services").
@@ -111,7 +230,11 @@ func (c *kubeManagerSessionClient) CreateSession(ctx contracts.DebugServiceConte
 		SetHeader(authTokenHeader, authToken).
 		Body(body).
 		Do(requestCtx).
+		StatusCode(&statusCode).
 		Raw()
+	if statusCode == http.StatusConflict {
+		return contracts.DebugSession{}, fmt.Errorf("%w: %s", ErrSessionConflict, managerErrorMessage(responseBody))
+	}
 	if err != nil {
 		return contracts.DebugSession{}, fmt.Errorf("create manager session: %w", err)
 	}
@@ -200,6 +323,17 @@ func (c *kubeManagerSessionClient) fetchAuthToken(ctx context.Context) (string,
 	return token, nil
 }
 
+// managerErrorMessage extracts the message of a manager error response.
+func managerErrorMessage(body []byte) string {
+	var response struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || strings.TrimSpace(response.Message) == "" {
+		return strings.TrimSpace(string(body))
+	}
+	return strings.TrimSpace(response.Message)
+}
+
 func (c *kubeManagerSessionClient) serviceProxyName() string {
 	return fmt.Sprintf("http:%s:%d", defaultManagerServiceName, defaultManagerServicePort)
 }
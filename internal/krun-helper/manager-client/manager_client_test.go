@@ -3,8 +3,10 @@ package managerclient
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -41,10 +43,13 @@ func TestManagerClientCreateSession(t *testing.T) {
 		ServiceName:   " orders-api ",
 		ContainerPort: 8080,
 		InterceptPort: 5000,
-	})
+	}, []contracts.UDPTarget{{Namespace: "monitoring", Service: "statsd", Port: 8125}})
 	if err != nil {
 		t.Fatalf("create session failed: %v", err)
 	}
+	if len(createReq.UDPTargets) != 1 || createReq.UDPTargets[0].Service != "statsd" {
+		t.Fatalf("expected the udp targets sent along, got %+v", createReq.UDPTargets)
+	}
 	if created.SessionID != "mgr-session-1" {
 		t.Fatalf("expected created session id, got %q", created.SessionID)
 	}
@@ -60,8 +65,62 @@ func TestManagerClientCreateSession(t *testing.T) {
 	if createReq.ServicePort != 8080 || createReq.LocalPort != 5000 {
 		t.Fatalf("unexpected ports in create request: %+v", createReq)
 	}
-	if createReq.ClientID != ManagerClientID {
-		t.Fatalf("expected client_id %q, got %q", ManagerClientID, createReq.ClientID)
+	if createReq.ClientID != client.ClientID() {
+		t.Fatalf("expected client_id %q, got %q", client.ClientID(), createReq.ClientID)
+	}
+}
+
+func TestLoadClientIDPersistsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "krun", "helper-client-id")
+	first, err := loadClientID(path)
+	if err != nil {
+		t.Fatalf("load client id: %v", err)
+	}
+	if first == "" || first == LegacyClientID {
+		t.Fatalf("expected a generated client id, got %q", first)
+	}
+	second, err := loadClientID(path)
+	if err != nil {
+		t.Fatalf("reload client id: %v", err)
+	}
+	if second != first {
+		t.Fatalf("expected the stored client id %q, got %q", first, second)
+	}
+	if other, _ := loadClientID(filepath.Join(t.TempDir(), "helper-client-id")); other == first {
+		t.Fatal("expected another installation to get its own client id")
+	}
+}
+
+func TestManagerClientCreateSessionConflict(t *testing.T) {
+	var createReq contracts.CreateDebugSessionRequest
+	client, closeFn := newTestManagerClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&createReq); err != nil {
+			t.Fatalf("decode create request: %v", err)
+		}
+		writeJSONResponse(t, w, http.StatusConflict, map[string]string{
+			"message": "session conflict: default/orders-api is already debugged by alice@alice-laptop",
+		})
+	})
+	defer closeFn()
+	client.kubeUser = "bob"
+	client.hostname = "bob-laptop"
+
+	_, err := client.CreateSession(contracts.DebugServiceContext{
+		ServiceName:   "orders-api",
+		ContainerPort: 8080,
+		InterceptPort: 5000,
+	}, nil)
+	if !errors.Is(err, ErrSessionConflict) {
+		t.Fatalf("expected session conflict, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "alice@alice-laptop") {
+		t.Fatalf("expected the manager message in the error, got %v", err)
+	}
+	if createReq.KubeUser != "bob" || createReq.Hostname != "bob-laptop" {
+		t.Fatalf("expected owner identity in the create request, got %+v", createReq)
+	}
+	if createReq.Force {
+		t.Fatalf("expected force to be off by default")
 	}
 }
 
@@ -74,21 +133,21 @@ func TestManagerClientCreateSessionValidation(t *testing.T) {
 	if _, err := client.CreateSession(contracts.DebugServiceContext{
 		ContainerPort: 8080,
 		InterceptPort: 5000,
-	}); err == nil {
+	}, nil); err == nil {
 		t.Fatalf("expected error for empty service_name")
 	}
 	if _, err := client.CreateSession(contracts.DebugServiceContext{
 		ServiceName:   "orders-api",
 		ContainerPort: 0,
 		InterceptPort: 5000,
-	}); err == nil {
+	}, nil); err == nil {
 		t.Fatalf("expected error for invalid service_port")
 	}
 	if _, err := client.CreateSession(contracts.DebugServiceContext{
 		ServiceName:   "orders-api",
 		ContainerPort: 8080,
 		InterceptPort: 0,
-	}); err == nil {
+	}, nil); err == nil {
 		t.Fatalf("expected error for invalid local_port")
 	}
 }
@@ -217,6 +276,7 @@ func newTestManagerClient(t *testing.T, handler http.HandlerFunc) (*kubeManagerS
 			RestConfig: restConfig,
 			Clientset:  clientset,
 		},
+		clientID: "krun-helper-test",
 	}, server.Close
 }
 
@@ -2,12 +2,15 @@ package portforward
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,10 +28,14 @@ import (
 
 const (
 	defaultNamespace       = "default"
+	defaultLocalAddress    = "127.0.0.1"
 	readyTimeout           = 10 * time.Second
 	forwardShutdownTimeout = 2 * time.Second
 	reconnectInitialDelay  = 1 * time.Second
 	reconnectMaxDelay      = 30 * time.Second
+
+	// podIndexLabel carries a StatefulSet pod's ordinal.
+	podIndexLabel = "apps.kubernetes.io/pod-index"
 )
 
 type SessionRegistry struct {
@@ -67,16 +74,30 @@ func NewSessionRegistry(kubeConfigPath string) (*SessionRegistry, error) {
 	return registry, nil
 }
 
+// Upsert replaces the forwards of a session. New forwards are dialed
+// without holding the registry: a slow one would otherwise keep every
+// other session waiting until its dial times out.
 func (r *SessionRegistry) Upsert(sessionKey string, forwards []contracts.PortForward) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
 	key := sessionkey.Normalize(sessionKey)
 	normalized := normalizePortForwards(forwards)
 	if len(normalized) == 0 {
-		return r.removeLocked(key)
+		return r.Remove(key)
+	}
+
+	started, err := r.startMissing(key, normalized)
+	// A forward another session started meanwhile is shared instead.
+	defer func() {
+		for _, handle := range started {
+			handle.stop()
+		}
+	}()
+	if err != nil {
+		return err
 	}
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	existing := r.sessions[key]
 	if existing == nil {
 		existing = map[string]*forwardHandle{}
@@ -99,7 +120,13 @@ func (r *SessionRegistry) Upsert(sessionKey string, forwards []contracts.PortFor
 			continue
 		}
 
-		handle, err := r.startForwardFn(forward)
+		handle, ok := started[forwardKey]
+		delete(started, forwardKey)
+		var err error
+		if !ok {
+			// Stopped by another session while this one was dialing.
+			handle, err = r.startForwardFn(forward)
+		}
 		if err != nil {
 			for _, acquiredKey := range acquiredKeys {
 				r.releaseSharedLocked(acquiredKey)
@@ -108,7 +135,7 @@ func (r *SessionRegistry) Upsert(sessionKey string, forwards []contracts.PortFor
 			return err
 		}
 
-		fmt.Printf("Started port-forward %s/%s:%d -> 127.0.0.1:%d\n", handle.spec.Namespace, handle.spec.Service, handle.spec.RemotePort, handle.spec.LocalPort)
+		fmt.Printf("Started port-forward %s:%d -> %s\n", forwardTarget(handle.spec), handle.spec.RemotePort, localEndpoint(handle.spec))
 		r.shared[forwardKey] = &sharedForward{handle: handle, refCount: 1}
 		next[forwardKey] = handle
 		acquiredKeys = append(acquiredKeys, forwardKey)
@@ -118,7 +145,7 @@ func (r *SessionRegistry) Upsert(sessionKey string, forwards []contracts.PortFor
 		if _, ok := next[existingKey]; ok {
 			continue
 		}
-		fmt.Printf("Stopping port-forward %s/%s:%d -> 127.0.0.1:%d\n", existingHandle.spec.Namespace, existingHandle.spec.Service, existingHandle.spec.RemotePort, existingHandle.spec.LocalPort)
+		fmt.Printf("Stopping port-forward %s:%d -> %s\n", forwardTarget(existingHandle.spec), existingHandle.spec.RemotePort, localEndpoint(existingHandle.spec))
 		r.releaseSharedLocked(existingKey)
 	}
 
@@ -126,6 +153,37 @@ func (r *SessionRegistry) Upsert(sessionKey string, forwards []contracts.PortFor
 	return nil
 }
 
+// startMissing dials the forwards neither the session nor any other one
+// runs yet.
+func (r *SessionRegistry) startMissing(key string, forwards []contracts.PortForward) (map[string]*forwardHandle, error) {
+	r.mu.Lock()
+	var missing []contracts.PortForward
+	for _, forward := range forwards {
+		forwardKey := portForwardKey(forward)
+		if _, ok := r.sessions[key][forwardKey]; ok {
+			continue
+		}
+		if _, ok := r.shared[forwardKey]; ok {
+			continue
+		}
+		missing = append(missing, forward)
+	}
+	r.mu.Unlock()
+
+	started := make(map[string]*forwardHandle, len(missing))
+	for _, forward := range missing {
+		handle, err := r.startForwardFn(forward)
+		if err != nil {
+			for _, handle := range started {
+				handle.stop()
+			}
+			return nil, err
+		}
+		started[portForwardKey(forward)] = handle
+	}
+	return started, nil
+}
+
 // BoundLocalPort reports the actual local port of a forward previously
 // requested via Upsert. For requests with LocalPort 0 this is the
 // OS-allocated port; the lookup key is the forward spec as requested.
@@ -168,7 +226,7 @@ func (r *SessionRegistry) removeLocked(sessionKey string) error {
 	if sessionkey.IsBlank(sessionKey) {
 		for _, handles := range r.sessions {
 			for forwardKey, handle := range handles {
-				fmt.Printf("Stopping port-forward %s/%s:%d -> 127.0.0.1:%d\n", handle.spec.Namespace, handle.spec.Service, handle.spec.RemotePort, handle.spec.LocalPort)
+				fmt.Printf("Stopping port-forward %s:%d -> %s\n", forwardTarget(handle.spec), handle.spec.RemotePort, localEndpoint(handle.spec))
 				r.releaseSharedLocked(forwardKey)
 			}
 		}
@@ -182,7 +240,7 @@ func (r *SessionRegistry) removeLocked(sessionKey string) error {
 		return nil
 	}
 	for forwardKey, handle := range handles {
-		fmt.Printf("Stopping port-forward %s/%s:%d -> 127.0.0.1:%d\n", handle.spec.Namespace, handle.spec.Service, handle.spec.RemotePort, handle.spec.LocalPort)
+		fmt.Printf("Stopping port-forward %s:%d -> %s\n", forwardTarget(handle.spec), handle.spec.RemotePort, localEndpoint(handle.spec))
 		r.releaseSharedLocked(forwardKey)
 	}
 	delete(r.sessions, key)
@@ -240,8 +298,8 @@ func (r *SessionRegistry) startForward(forward contracts.PortForward) (*forwardH
 				return
 			case <-currentDone:
 				// Port-forward died, reconnect with backoff.
-				log.Printf("port-forward lost %s/%s %d -> 127.0.0.1:%d, reconnecting",
-					forward.Namespace, forward.Service, forward.RemotePort, forward.LocalPort)
+				log.Printf("port-forward lost %s %d -> %s, reconnecting",
+					forwardTarget(forward), forward.RemotePort, localEndpoint(forward))
 			}
 
 			delay := reconnectInitialDelay
@@ -254,7 +312,7 @@ func (r *SessionRegistry) startForward(forward contracts.PortForward) (*forwardH
 
 				newStop, newDone, _, dialErr := r.dialForward(forward)
 				if dialErr != nil {
-					log.Printf("port-forward reconnect failed %s/%s: %v", forward.Namespace, forward.Service, dialErr)
+					log.Printf("port-forward reconnect failed %s: %v", forwardTarget(forward), dialErr)
 					delay *= 2
 					if delay > reconnectMaxDelay {
 						delay = reconnectMaxDelay
@@ -262,8 +320,8 @@ func (r *SessionRegistry) startForward(forward contracts.PortForward) (*forwardH
 					continue
 				}
 
-				log.Printf("port-forward reconnected %s/%s %d -> 127.0.0.1:%d",
-					forward.Namespace, forward.Service, forward.RemotePort, forward.LocalPort)
+				log.Printf("port-forward reconnected %s %d -> %s",
+					forwardTarget(forward), forward.RemotePort, localEndpoint(forward))
 				currentStop = newStop
 				currentDone = newDone
 				break
@@ -277,7 +335,7 @@ func (r *SessionRegistry) startForward(forward contracts.PortForward) (*forwardH
 func (r *SessionRegistry) dialForward(forward contracts.PortForward) (stopChan chan struct{}, doneChan chan struct{}, boundLocalPort int, err error) {
 	targetPod, targetPort, err := r.resolvePodForwardTarget(forward)
 	if err != nil {
-		return nil, nil, 0, fmt.Errorf("resolve target for %s/%s: %w", forward.Namespace, forward.Service, err)
+		return nil, nil, 0, fmt.Errorf("resolve target for %s: %w", forwardTarget(forward), err)
 	}
 
 	request := r.client.Clientset.CoreV1().RESTClient().Post().
@@ -297,7 +355,7 @@ func (r *SessionRegistry) dialForward(forward contracts.PortForward) (stopChan c
 	readyChan := make(chan struct{})
 	errOut := bytes.NewBuffer(nil)
 
-	pf, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, ports, stop, readyChan, io.Discard, errOut)
+	pf, err := portforward.NewOnAddresses(dialer, []string{cmp.Or(forward.LocalAddress, defaultLocalAddress)}, ports, stop, readyChan, io.Discard, errOut)
 	if err != nil {
 		return nil, nil, 0, fmt.Errorf("create port-forwarder: %w", err)
 	}
@@ -320,7 +378,7 @@ func (r *SessionRegistry) dialForward(forward contracts.PortForward) (stopChan c
 				case <-done:
 				case <-time.After(forwardShutdownTimeout):
 				}
-				return nil, nil, 0, fmt.Errorf("resolve bound local port for %s/%s: %v", forward.Namespace, forward.Service, portsErr)
+				return nil, nil, 0, fmt.Errorf("resolve bound local port for %s: %v", forwardTarget(forward), portsErr)
 			}
 			boundLocalPort = int(forwardedPorts[0].Local)
 		}
@@ -333,18 +391,22 @@ func (r *SessionRegistry) dialForward(forward contracts.PortForward) (stopChan c
 		if msg != "" {
 			err = fmt.Errorf("%w: %s", err, msg)
 		}
-		return nil, nil, 0, fmt.Errorf("start %s/%s (pod %s) %d -> 127.0.0.1:%d: %w", forward.Namespace, forward.Service, targetPod, targetPort, forward.LocalPort, err)
+		return nil, nil, 0, fmt.Errorf("start %s (pod %s) %d -> %s: %w", forwardTarget(forward), targetPod, targetPort, localEndpoint(forward), err)
 	case <-time.After(readyTimeout):
 		close(stop)
 		select {
 		case <-done:
 		case <-time.After(forwardShutdownTimeout):
 		}
-		return nil, nil, 0, fmt.Errorf("timed out waiting for %s/%s (pod %s) %d -> 127.0.0.1:%d", forward.Namespace, forward.Service, targetPod, targetPort, forward.LocalPort)
+		return nil, nil, 0, fmt.Errorf("timed out waiting for %s (pod %s) %d -> %s", forwardTarget(forward), targetPod, targetPort, localEndpoint(forward))
 	}
 }
 
 func (r *SessionRegistry) resolvePodForwardTarget(forward contracts.PortForward) (string, int, error) {
+	if forward.Pod != "" && !isOrdinal(forward.Pod) {
+		return r.resolveNamedPodTarget(forward)
+	}
+
 	service, err := r.client.Clientset.CoreV1().Services(forward.Namespace).Get(context.Background(), forward.Service, metav1.GetOptions{})
 	if err != nil {
 		return "", 0, fmt.Errorf("get service: %w", err)
@@ -360,7 +422,12 @@ func (r *SessionRegistry) resolvePodForwardTarget(forward contracts.PortForward)
 		return "", 0, fmt.Errorf("list pods: %w", err)
 	}
 
-	pod, err := selectPodForPortForward(podList.Items)
+	var pod corev1.Pod
+	if forward.Pod != "" {
+		pod, err = selectPodByOrdinal(podList.Items, forward.Pod)
+	} else {
+		pod, err = selectPodForPortForward(podList.Items)
+	}
 	if err != nil {
 		return "", 0, err
 	}
@@ -373,6 +440,97 @@ func (r *SessionRegistry) resolvePodForwardTarget(forward contracts.PortForward)
 	return pod.Name, targetPort, nil
 }
 
+// resolveNamedPodTarget forwards to a pod by name. The service, when
+// given, still maps the requested port to the pod's.
+func (r *SessionRegistry) resolveNamedPodTarget(forward contracts.PortForward) (string, int, error) {
+	pod, err := r.client.Clientset.CoreV1().Pods(forward.Namespace).Get(context.Background(), forward.Pod, metav1.GetOptions{})
+	if err != nil {
+		return "", 0, fmt.Errorf("get pod: %w", err)
+	}
+	if forward.Service == "" {
+		return pod.Name, forward.RemotePort, nil
+	}
+
+	service, err := r.client.Clientset.CoreV1().Services(forward.Namespace).Get(context.Background(), forward.Service, metav1.GetOptions{})
+	if err != nil {
+		return "", 0, fmt.Errorf("get service: %w", err)
+	}
+	targetPort, err := resolveServiceTargetPort(*service, *pod, forward.RemotePort)
+	if err != nil {
+		return "", 0, err
+	}
+	return pod.Name, targetPort, nil
+}
+
+// Member is a pod of a headless service with its own DNS name,
+// <hostname>.<service>.<namespace>.svc.
+type Member struct {
+	Pod      string
+	Hostname string
+}
+
+// HeadlessMembers lists the members of a headless service. Other
+// services have none.
+func (r *SessionRegistry) HeadlessMembers(namespace string, serviceName string) ([]Member, error) {
+	namespace = cmp.Or(strings.TrimSpace(namespace), defaultNamespace)
+	service, err := r.client.Clientset.CoreV1().Services(namespace).Get(context.Background(), strings.TrimSpace(serviceName), metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get service: %w", err)
+	}
+	if service.Spec.ClusterIP != corev1.ClusterIPNone || len(service.Spec.Selector) == 0 {
+		return nil, nil
+	}
+
+	podList, err := r.client.Clientset.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: labels.Set(service.Spec.Selector).AsSelector().String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list pods: %w", err)
+	}
+	return headlessMembers(service.Name, podList.Items), nil
+}
+
+// headlessMembers keeps the pods that publish a name under the service:
+// a hostname with the service as subdomain, as StatefulSet pods have.
+func headlessMembers(serviceName string, pods []corev1.Pod) []Member {
+	var members []Member
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || pod.Spec.Hostname == "" || pod.Spec.Subdomain != serviceName {
+			continue
+		}
+		members = append(members, Member{Pod: pod.Name, Hostname: pod.Spec.Hostname})
+	}
+	slices.SortFunc(members, func(a, b Member) int {
+		return strings.Compare(a.Hostname, b.Hostname)
+	})
+	return members
+}
+
+// selectPodByOrdinal picks the pod with the given StatefulSet ordinal,
+// from its pod-index label or the "-<ordinal>" suffix of its name.
+func selectPodByOrdinal(pods []corev1.Pod, ordinal string) (corev1.Pod, error) {
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		if index, ok := pod.Labels[podIndexLabel]; ok {
+			if index == ordinal {
+				return pod, nil
+			}
+			continue
+		}
+		if strings.HasSuffix(pod.Name, "-"+ordinal) {
+			return pod, nil
+		}
+	}
+	return corev1.Pod{}, fmt.Errorf("no pod with ordinal %s found for service selector", ordinal)
+}
+
+func isOrdinal(pod string) bool {
+	_, err := strconv.ParseUint(pod, 10, 32)
+	return err == nil
+}
+
 func selectPodForPortForward(pods []corev1.Pod) (corev1.Pod, error) {
 	if len(pods) == 0 {
 		return corev1.Pod{}, fmt.Errorf("no pods found for service selector")
@@ -479,19 +637,33 @@ func normalizePortForwards(forwards []contracts.PortForward) []contracts.PortFor
 	for _, forward := range forwards {
 		namespace := strings.TrimSpace(forward.Namespace)
 		service := strings.TrimSpace(forward.Service)
+		pod := strings.TrimSpace(forward.Pod)
 		if namespace == "" {
 			namespace = defaultNamespace
 		}
+		// A pod name alone is enough; an ordinal needs the service.
+		if service == "" && (pod == "" || isOrdinal(pod)) {
+			continue
+		}
 		// LocalPort 0 is allowed: the OS allocates a free port at dial time.
-		if service == "" || forward.LocalPort < 0 || forward.RemotePort <= 0 {
+		if forward.LocalPort < 0 || forward.RemotePort <= 0 {
 			continue
 		}
 
+		// The default address stays implicit, so both spellings share a
+		// forward.
+		localAddress := strings.TrimSpace(forward.LocalAddress)
+		if localAddress == defaultLocalAddress {
+			localAddress = ""
+		}
+
 		normalizedForward := contracts.PortForward{
-			Namespace:  namespace,
-			Service:    service,
-			LocalPort:  forward.LocalPort,
-			RemotePort: forward.RemotePort,
+			Namespace:    namespace,
+			Service:      service,
+			Pod:          pod,
+			LocalAddress: localAddress,
+			LocalPort:    forward.LocalPort,
+			RemotePort:   forward.RemotePort,
 		}
 		key := portForwardKey(normalizedForward)
 		if seen[key] {
@@ -502,35 +674,38 @@ func normalizePortForwards(forwards []contracts.PortForward) []contracts.PortFor
 	}
 
 	slices.SortFunc(normalized, func(a, b contracts.PortForward) int {
-		if a.Namespace == b.Namespace {
-			if a.Service == b.Service {
-				if a.LocalPort == b.LocalPort {
-					switch {
-					case a.RemotePort < b.RemotePort:
-						return -1
-					case a.RemotePort > b.RemotePort:
-						return 1
-					default:
-						return 0
-					}
-				}
-				switch {
-				case a.LocalPort < b.LocalPort:
-					return -1
-				case a.LocalPort > b.LocalPort:
-					return 1
-				default:
-					return 0
-				}
-			}
-			return strings.Compare(a.Service, b.Service)
-		}
-		return strings.Compare(a.Namespace, b.Namespace)
+		return cmp.Or(
+			strings.Compare(a.Namespace, b.Namespace),
+			strings.Compare(a.Service, b.Service),
+			strings.Compare(a.Pod, b.Pod),
+			strings.Compare(a.LocalAddress, b.LocalAddress),
+			cmp.Compare(a.LocalPort, b.LocalPort),
+			cmp.Compare(a.RemotePort, b.RemotePort),
+		)
 	})
 
 	return normalized
 }
 
 func portForwardKey(forward contracts.PortForward) string {
-	return fmt.Sprintf("%s|%s|%d|%d", forward.Namespace, forward.Service, forward.LocalPort, forward.RemotePort)
+	return fmt.Sprintf("%s|%s|%s|%s|%d|%d", forward.Namespace, forward.Service, forward.Pod, forward.LocalAddress, forward.LocalPort, forward.RemotePort)
+}
+
+// forwardTarget renders what a forward reaches, e.g. "default/mongo",
+// "default/mongo/mongodb-server-0" or, without a service,
+// "default/pod/mongodb-server-0".
+func forwardTarget(forward contracts.PortForward) string {
+	switch {
+	case forward.Pod == "":
+		return forward.Namespace + "/" + forward.Service
+	case forward.Service == "":
+		return forward.Namespace + "/pod/" + forward.Pod
+	default:
+		return forward.Namespace + "/" + forward.Service + "/" + forward.Pod
+	}
+}
+
+// localEndpoint renders where a forward listens, e.g. "127.0.0.2:5432".
+func localEndpoint(forward contracts.PortForward) string {
+	return net.JoinHostPort(cmp.Or(forward.LocalAddress, defaultLocalAddress), strconv.Itoa(forward.LocalPort))
 }
@@ -3,6 +3,7 @@ package portforward
 import (
 	"context"
 	"fmt"
+	"slices"
 	"sync"
 	"testing"
 
@@ -246,6 +247,36 @@ func TestUpsertRollsBackSharedRefsOnStartFailure(t *testing.T) {
 	}
 }
 
+func TestUpsertDoesNotHoldOtherSessionsWhileDialing(t *testing.T) {
+	r, tracker := newTestRegistry()
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	r.startForwardFn = func(fwd contracts.PortForward) (*forwardHandle, error) {
+		if fwd.Service == "slow" {
+			close(dialing)
+			<-release
+		}
+		return tracker.start(fwd)
+	}
+
+	slowDone := make(chan error, 1)
+	go func() {
+		slowDone <- r.Upsert("session-a", []contracts.PortForward{makeForward("default", "slow", 8080)})
+	}()
+	<-dialing
+	if err := r.Upsert("session-b", []contracts.PortForward{makeForward("default", "redis", 6379)}); err != nil {
+		t.Fatalf("upsert while another session dials: %v", err)
+	}
+
+	close(release)
+	if err := <-slowDone; err != nil {
+		t.Fatalf("slow upsert: %v", err)
+	}
+	if len(r.sessions) != 2 || len(r.shared) != 2 {
+		t.Fatalf("expected both sessions with their forwards, got %d sessions and %d forwards", len(r.sessions), len(r.shared))
+	}
+}
+
 func TestUpsertReplacingForwardsReleasesOldShared(t *testing.T) {
 	r, _ := newTestRegistry()
 	redis := []contracts.PortForward{makeForward("default", "redis", 6379)}
@@ -266,6 +297,99 @@ func TestUpsertReplacingForwardsReleasesOldShared(t *testing.T) {
 	}
 }
 
+func TestUpsertForwardsSamePortOnSeparateAddresses(t *testing.T) {
+	r, tracker := newTestRegistry()
+	orders := makeForward("default", "orders-db", 5432)
+	orders.LocalAddress = "127.0.0.2"
+	billing := makeForward("default", "billing-db", 5432)
+	billing.LocalAddress = "127.0.0.3"
+
+	if err := r.Upsert("session-a", []contracts.PortForward{orders, billing}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if tracker.count() != 2 {
+		t.Fatalf("expected both forwards started, got %d", tracker.count())
+	}
+	if port, ok := r.BoundLocalPort("session-a", billing); !ok || port != 5432 {
+		t.Fatalf("expected the billing forward on port 5432, got %d (%v)", port, ok)
+	}
+
+	// The default address, spelled out or not, is the same forward.
+	explicit := makeForward("default", "redis", 6379)
+	explicit.LocalAddress = "127.0.0.1"
+	if err := r.Upsert("session-b", []contracts.PortForward{makeForward("default", "redis", 6379), explicit}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if tracker.count() != 3 {
+		t.Fatalf("expected one redis forward, got %d starts", tracker.count())
+	}
+	if got := localEndpoint(tracker.calls[0]); got != "127.0.0.3:5432" && got != "127.0.0.2:5432" {
+		t.Fatalf("unexpected local endpoint %q", got)
+	}
+}
+
+func TestSelectPodByOrdinal(t *testing.T) {
+	indexed := makePod("kafka-broker-1", corev1.PodRunning, true)
+	indexed.Labels = map[string]string{podIndexLabel: "1"}
+	pods := []corev1.Pod{
+		makePod("mongodb-server-0", corev1.PodRunning, true),
+		makePod("mongodb-server-10", corev1.PodRunning, true),
+		indexed,
+	}
+
+	for ordinal, want := range map[string]string{"0": "mongodb-server-0", "10": "mongodb-server-10", "1": "kafka-broker-1"} {
+		pod, err := selectPodByOrdinal(pods, ordinal)
+		if err != nil || pod.Name != want {
+			t.Fatalf("ordinal %s: expected %s, got %q (%v)", ordinal, want, pod.Name, err)
+		}
+	}
+	if _, err := selectPodByOrdinal(pods, "2"); err == nil {
+		t.Fatalf("expected a missing ordinal to fail")
+	}
+}
+
+func TestHeadlessMembersKeepsNamedPods(t *testing.T) {
+	member := func(name string, hostname string, subdomain string) corev1.Pod {
+		pod := makePod(name, corev1.PodRunning, true)
+		pod.Spec.Hostname = hostname
+		pod.Spec.Subdomain = subdomain
+		return pod
+	}
+	pods := []corev1.Pod{
+		member("mongodb-server-1", "mongodb-server-1", "mongo"),
+		member("mongodb-server-0", "mongodb-server-0", "mongo"),
+		member("other-0", "other-0", "other"),
+		makePod("mongo-7d9f", corev1.PodRunning, true),
+	}
+
+	want := []Member{
+		{Pod: "mongodb-server-0", Hostname: "mongodb-server-0"},
+		{Pod: "mongodb-server-1", Hostname: "mongodb-server-1"},
+	}
+	if got := headlessMembers("mongo", pods); !slices.Equal(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestNormalizePortForwardsKeepsPodTargets(t *testing.T) {
+	byName := contracts.PortForward{Namespace: "default", Pod: " mongodb-server-0 ", LocalPort: 27017, RemotePort: 27017}
+	byOrdinal := contracts.PortForward{Namespace: "default", Service: "mongo", Pod: "1", LocalPort: 27017, RemotePort: 27017}
+	ordinalOnly := contracts.PortForward{Namespace: "default", Pod: "1", LocalPort: 27017, RemotePort: 27017}
+
+	got := normalizePortForwards([]contracts.PortForward{byOrdinal, byName, ordinalOnly, makeForward("default", "mongo", 27017)})
+	want := []contracts.PortForward{
+		{Namespace: "default", Pod: "mongodb-server-0", LocalPort: 27017, RemotePort: 27017},
+		{Namespace: "default", Service: "mongo", LocalPort: 27017, RemotePort: 27017},
+		byOrdinal,
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if forwardTarget(got[0]) != "default/pod/mongodb-server-0" || forwardTarget(got[2]) != "default/mongo/1" {
+		t.Fatalf("unexpected targets %q %q", forwardTarget(got[0]), forwardTarget(got[2]))
+	}
+}
+
 func makePod(name string, phase corev1.PodPhase, ready bool) corev1.Pod {
 	conditionStatus := corev1.ConditionFalse
 	if ready {
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+// ForwardSessionKey prefixes the sessions of the port-forwards the proxy
+// opens, one per forward.
+const ForwardSessionKey = "__proxy__"
+
+// forwardIdleTimeout is how long a forward stays open after its last
+// connection closed.
+const forwardIdleTimeout = 5 * time.Minute
+
+// ForwardRegistry is the part of the helper's port-forward registry the
+// proxy uses.
+type ForwardRegistry interface {
+	Upsert(sessionKey string, forwards []contracts.PortForward) error
+	BoundLocalPort(sessionKey string, forward contracts.PortForward) (int, bool)
+	Remove(sessionKey string) error
+}
+
+// ClusterDialer reaches <service>.<namespace>.svc names, and the pods of
+// headless services as <pod>.<service>.<namespace>.svc, optionally ending
+// in .cluster.local, through a port-forward opened on first use and
+// closed once it has been idle for a while. Other names are dialed
+// directly.
+type ClusterDialer struct {
+	registry    ForwardRegistry
+	direct      net.Dialer
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	forwards map[contracts.PortForward]*clusterForward
+	next     int
+}
+
+// clusterForward is a port-forward of the proxy. Dials of the same target
+// wait for the first one to start it; ready closes once it has.
+type clusterForward struct {
+	sessionKey string
+	ready      chan struct{}
+	localPort  int
+	err        error
+
+	// conns counts the dials and connections using the forward; idle
+	// closes it when none are left.
+	conns int
+	idle  *time.Timer
+}
+
+func NewClusterDialer(registry ForwardRegistry) *ClusterDialer {
+	return &ClusterDialer{
+		registry:    registry,
+		idleTimeout: forwardIdleTimeout,
+		forwards:    map[contracts.PortForward]*clusterForward{},
+	}
+}
+
+func (d *ClusterDialer) Dial(ctx context.Context, address string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	service, namespace, pod, cluster, err := clusterService(host)
+	if err != nil {
+		return nil, err
+	}
+	if !cluster {
+		return d.direct.DialContext(ctx, "tcp", address)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port <= 0 {
+		return nil, fmt.Errorf("invalid port %q", portText)
+	}
+
+	forward := contracts.PortForward{
+		Namespace:  namespace,
+		Service:    service,
+		Pod:        pod,
+		LocalPort:  0,
+		RemotePort: port,
+	}
+	entry, err := d.acquire(ctx, forward)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.direct.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(entry.localPort)))
+	if err != nil {
+		d.release(forward, entry)
+		return nil, err
+	}
+	return &forwardConn{Conn: conn, release: func() { d.release(forward, entry) }}, nil
+}
+
+// acquire returns the forward to a target, started by the first dial that
+// needs it. Starting happens outside the lock, so a slow target only
+// holds up the dials to it.
+func (d *ClusterDialer) acquire(ctx context.Context, forward contracts.PortForward) (*clusterForward, error) {
+	d.mu.Lock()
+	entry, ok := d.forwards[forward]
+	if !ok {
+		d.next++
+		entry = &clusterForward{
+			sessionKey: fmt.Sprintf("%s/%d", ForwardSessionKey, d.next),
+			ready:      make(chan struct{}),
+		}
+		d.forwards[forward] = entry
+	}
+	entry.conns++
+	if entry.idle != nil {
+		entry.idle.Stop()
+		entry.idle = nil
+	}
+	d.mu.Unlock()
+
+	if !ok {
+		entry.localPort, entry.err = d.start(entry.sessionKey, forward)
+		if entry.err != nil {
+			// The next dial tries again.
+			d.mu.Lock()
+			if d.forwards[forward] == entry {
+				delete(d.forwards, forward)
+			}
+			d.mu.Unlock()
+		}
+		close(entry.ready)
+	}
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		d.release(forward, entry)
+		return nil, ctx.Err()
+	}
+	if entry.err != nil {
+		d.release(forward, entry)
+		return nil, entry.err
+	}
+	return entry, nil
+}
+
+func (d *ClusterDialer) start(sessionKey string, forward contracts.PortForward) (int, error) {
+	if err := d.registry.Upsert(sessionKey, []contracts.PortForward{forward}); err != nil {
+		return 0, err
+	}
+	localPort, ok := d.registry.BoundLocalPort(sessionKey, forward)
+	if !ok || localPort <= 0 {
+		_ = d.registry.Remove(sessionKey)
+		return 0, fmt.Errorf("port-forward to %s/%s:%d reported no bound local port", forward.Namespace, forward.Service, forward.RemotePort)
+	}
+	return localPort, nil
+}
+
+// release gives back a use of a forward; the last one leaves it to close
+// once it has been idle for idleTimeout.
+func (d *ClusterDialer) release(forward contracts.PortForward, entry *clusterForward) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry.conns--
+	if entry.conns > 0 {
+		return
+	}
+	entry.idle = time.AfterFunc(d.idleTimeout, func() {
+		d.mu.Lock()
+		if entry.conns > 0 || d.forwards[forward] != entry {
+			d.mu.Unlock()
+			return
+		}
+		delete(d.forwards, forward)
+		d.mu.Unlock()
+		// Each forward has its own session, so a newer one to the same
+		// target keeps running.
+		if err := d.registry.Remove(entry.sessionKey); err != nil {
+			log.Printf("close idle port-forward to %s/%s:%d: %v", forward.Namespace, forward.Service, forward.RemotePort, err)
+		}
+	})
+}
+
+// forwardConn gives back its use of the forward when it is closed.
+type forwardConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *forwardConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// clusterService splits a cluster name into service, namespace and, for
+// <pod>.<service>.<namespace>.svc, the pod. Names outside the cluster
+// report false; other names under .svc are an error.
+func clusterService(host string) (string, string, string, bool, error) {
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	name = strings.TrimSuffix(name, ".cluster.local")
+	prefix, ok := strings.CutSuffix(name, ".svc")
+	if !ok {
+		return "", "", "", false, nil
+	}
+	labels := strings.Split(prefix, ".")
+	if slices.Contains(labels, "") {
+		return "", "", "", true, fmt.Errorf("%s is not a cluster service name", host)
+	}
+	switch len(labels) {
+	case 2:
+		return labels[0], labels[1], "", true, nil
+	case 3:
+		return labels[1], labels[2], labels[0], true, nil
+	default:
+		return "", "", "", true, fmt.Errorf("%s is not a cluster service name", host)
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+)
+
+func TestClusterService(t *testing.T) {
+	cases := []struct {
+		host      string
+		service   string
+		namespace string
+		pod       string
+		cluster   bool
+		wantErr   bool
+	}{
+		{host: "orders.default.svc", service: "orders", namespace: "default", cluster: true},
+		{host: "Orders.Shop.svc.cluster.local.", service: "orders", namespace: "shop", cluster: true},
+		{host: "example.com"},
+		{host: "10.0.0.1"},
+		{host: "mongo-0.mongo.default.svc.cluster.local", service: "mongo", namespace: "default", pod: "mongo-0", cluster: true},
+		{host: "a.mongo-0.mongo.default.svc", cluster: true, wantErr: true},
+		{host: "default.svc", cluster: true, wantErr: true},
+		{host: ".default.svc", cluster: true, wantErr: true},
+	}
+	for _, tc := range cases {
+		service, namespace, pod, cluster, err := clusterService(tc.host)
+		if (err != nil) != tc.wantErr || cluster != tc.cluster || service != tc.service || namespace != tc.namespace || pod != tc.pod {
+			t.Fatalf("%s: got %q %q %q %v (%v)", tc.host, service, namespace, pod, cluster, err)
+		}
+	}
+}
+
+func TestClusterDialerForwardsOnFirstUse(t *testing.T) {
+	backend := startEchoServer(t)
+	_, portText, _ := net.SplitHostPort(backend)
+	port, _ := strconv.Atoi(portText)
+	registry := newFakeForwardRegistry(port)
+	dialer := NewClusterDialer(registry)
+
+	for _, address := range []string{"orders.default.svc:5432", "orders.default.svc.cluster.local:5432", "billing.shop.svc:5432", "postgres-1.postgres.shop.svc:5432"} {
+		conn, err := dialer.Dial(context.Background(), address)
+		if err != nil {
+			t.Fatalf("dial %s: %v", address, err)
+		}
+		assertEcho(t, conn)
+		conn.Close()
+	}
+
+	want := []contracts.PortForward{
+		{Namespace: "default", Service: "orders", RemotePort: 5432},
+		{Namespace: "shop", Service: "billing", RemotePort: 5432},
+		{Namespace: "shop", Service: "postgres", Pod: "postgres-1", RemotePort: 5432},
+	}
+	if got := registry.started(); !slices.Equal(got, want) {
+		t.Fatalf("expected one forward per service, got %+v", got)
+	}
+
+	// Names outside the cluster are dialed as they are.
+	conn, err := dialer.Dial(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("dial direct: %v", err)
+	}
+	conn.Close()
+	if got := registry.started(); len(got) != 3 {
+		t.Fatalf("expected no forward for a direct dial, got %+v", got)
+	}
+}
+
+func TestClusterDialerDoesNotWaitForOtherForwards(t *testing.T) {
+	backend := startEchoServer(t)
+	_, portText, _ := net.SplitHostPort(backend)
+	port, _ := strconv.Atoi(portText)
+	registry := newFakeForwardRegistry(port)
+	registry.block = map[string]chan struct{}{"slow": make(chan struct{})}
+	dialer := NewClusterDialer(registry)
+
+	slowDone := make(chan error, 1)
+	go func() {
+		conn, err := dialer.Dial(context.Background(), "slow.default.svc:80")
+		if err == nil {
+			conn.Close()
+		}
+		slowDone <- err
+	}()
+
+	// Another dial to the slow target waits for the same start.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for registry.upserts() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := dialer.Dial(ctx, "slow.default.svc:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the second dial to wait for the slow forward, got %v", err)
+	}
+
+	conn, err := dialer.Dial(context.Background(), "orders.default.svc:5432")
+	if err != nil {
+		t.Fatalf("dial while another forward starts: %v", err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	close(registry.block["slow"])
+	if err := <-slowDone; err != nil {
+		t.Fatalf("dial slow: %v", err)
+	}
+	if upserts := registry.upserts(); upserts != 2 {
+		t.Fatalf("expected each forward started once, got %d upserts", upserts)
+	}
+}
+
+func TestClusterDialerClosesIdleForwards(t *testing.T) {
+	backend := startEchoServer(t)
+	_, portText, _ := net.SplitHostPort(backend)
+	port, _ := strconv.Atoi(portText)
+	registry := newFakeForwardRegistry(port)
+	dialer := NewClusterDialer(registry)
+	dialer.idleTimeout = 20 * time.Millisecond
+
+	first, err := dialer.Dial(context.Background(), "orders.default.svc:5432")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	second, err := dialer.Dial(context.Background(), "orders.default.svc:5432")
+	if err != nil {
+		t.Fatalf("dial again: %v", err)
+	}
+	first.Close()
+	time.Sleep(60 * time.Millisecond)
+	if removed := registry.removedKeys(); len(removed) != 0 {
+		t.Fatalf("expected the forward kept while a connection uses it, got %v removed", removed)
+	}
+
+	second.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(registry.removedKeys()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the idle forward closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The next dial opens it again.
+	conn, err := dialer.Dial(context.Background(), "orders.default.svc:5432")
+	if err != nil {
+		t.Fatalf("dial after close: %v", err)
+	}
+	conn.Close()
+	if upserts := registry.upserts(); upserts != 2 {
+		t.Fatalf("expected the forward started again, got %d upserts", upserts)
+	}
+}
+
+type fakeForwardRegistry struct {
+	localPort int
+	// block holds the start of a service's forward until closed.
+	block map[string]chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string][]contracts.PortForward
+	order    []contracts.PortForward
+	calls    int
+	removed  []string
+}
+
+func newFakeForwardRegistry(localPort int) *fakeForwardRegistry {
+	return &fakeForwardRegistry{localPort: localPort, sessions: map[string][]contracts.PortForward{}}
+}
+
+func (f *fakeForwardRegistry) Upsert(sessionKey string, forwards []contracts.PortForward) error {
+	f.mu.Lock()
+	f.calls++
+	f.mu.Unlock()
+	for _, forward := range forwards {
+		if block, ok := f.block[forward.Service]; ok {
+			<-block
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions[sessionKey] = append([]contracts.PortForward(nil), forwards...)
+	f.order = append(f.order, forwards...)
+	return nil
+}
+
+func (f *fakeForwardRegistry) BoundLocalPort(sessionKey string, forward contracts.PortForward) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !slices.Contains(f.sessions[sessionKey], forward) {
+		return 0, false
+	}
+	return f.localPort, true
+}
+
+func (f *fakeForwardRegistry) Remove(sessionKey string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sessions, sessionKey)
+	f.removed = append(f.removed, sessionKey)
+	return nil
+}
+
+func (f *fakeForwardRegistry) started() []contracts.PortForward {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.order)
+}
+
+func (f *fakeForwardRegistry) upserts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func (f *fakeForwardRegistry) removedKeys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.removed)
+}
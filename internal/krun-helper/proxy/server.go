@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAddress is where the helper serves the proxy when it is
+	// turned on without an address.
+	DefaultAddress = "127.0.0.1:1080"
+
+	handshakeTimeout = 10 * time.Second
+	dialTimeout      = 15 * time.Second
+
+	socksVersion          = 0x05
+	socksNoAuth           = 0x00
+	socksNoAcceptable     = 0xff
+	socksConnect          = 0x01
+	socksAddrIPv4         = 0x01
+	socksAddrDomain       = 0x03
+	socksAddrIPv6         = 0x04
+	socksSucceeded        = 0x00
+	socksGeneralFailure   = 0x01
+	socksCommandRejected  = 0x07
+	socksAddressRejected  = 0x08
+	socksReplyHeaderBytes = 4
+)
+
+// DialFunc opens a connection to host:port for a proxy client.
+type DialFunc func(ctx context.Context, address string) (net.Conn, error)
+
+// Server is a SOCKS5 and HTTP proxy on a single port. The first byte of a
+// connection tells the two apart: SOCKS5 starts with its version, HTTP
+// with a method. HTTP clients may CONNECT, or send plain requests in
+// absolute form, which are passed on one per connection.
+type Server struct {
+	dial DialFunc
+
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+func NewServer(dial DialFunc) *Server {
+	return &Server{
+		dial:  dial,
+		conns: map[net.Conn]struct{}{},
+	}
+}
+
+// Listen binds address and serves clients until Close.
+func (s *Server) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", address, err)
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting clients and drops the open connections.
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.track(conn, true)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.track(conn, false)
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) track(conn net.Conn, open bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if open {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == socksVersion {
+		s.handleSOCKS(conn, reader)
+		return
+	}
+	s.handleHTTP(conn, reader)
+}
+
+func (s *Server) handleSOCKS(conn net.Conn, reader *bufio.Reader) {
+	// Greeting: version, method count, methods. Only "no authentication"
+	// is offered; the proxy listens on loopback.
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	if !slices.Contains(methods, socksNoAuth) {
+		_, _ = conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return
+	}
+
+	// Request: version, command, reserved, address type, address, port.
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return
+	}
+	if request[1] != socksConnect {
+		writeSOCKSReply(conn, socksCommandRejected)
+		return
+	}
+	host, err := readSOCKSHost(reader, request[3])
+	if err != nil {
+		writeSOCKSReply(conn, socksAddressRejected)
+		return
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(reader, portBytes); err != nil {
+		return
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+
+	target, err := s.dialTarget(address)
+	if err != nil {
+		log.Printf("proxy: dial %s: %v", address, err)
+		writeSOCKSReply(conn, socksGeneralFailure)
+		return
+	}
+	defer target.Close()
+	writeSOCKSReply(conn, socksSucceeded)
+
+	_ = conn.SetDeadline(time.Time{})
+	pipe(conn, reader, target)
+}
+
+func readSOCKSHost(reader *bufio.Reader, addressType byte) (string, error) {
+	switch addressType {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := 4
+		if addressType == socksAddrIPv6 {
+			size = 16
+		}
+		raw := make([]byte, size)
+		if _, err := io.ReadFull(reader, raw); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(raw)
+		return addr.String(), nil
+	case socksAddrDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		raw := make([]byte, length)
+		if _, err := io.ReadFull(reader, raw); err != nil {
+			return "", err
+		}
+		return string(raw), nil
+	default:
+		return "", fmt.Errorf("unsupported address type %d", addressType)
+	}
+}
+
+// writeSOCKSReply answers a request. The bound address is left zero:
+// clients of a CONNECT do not use it.
+func writeSOCKSReply(conn net.Conn, reply byte) {
+	response := make([]byte, socksReplyHeaderBytes+net.IPv4len+2)
+	response[0] = socksVersion
+	response[1] = reply
+	response[3] = socksAddrIPv4
+	_, _ = conn.Write(response)
+}
+
+func (s *Server) handleHTTP(conn net.Conn, reader *bufio.Reader) {
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+
+	if request.Method == http.MethodConnect {
+		target, err := s.dialTarget(request.Host)
+		if err != nil {
+			log.Printf("proxy: dial %s: %v", request.Host, err)
+			writeHTTPStatus(conn, http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+		pipe(conn, reader, target)
+		return
+	}
+
+	if request.URL.Scheme != "http" || request.URL.Host == "" {
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return
+	}
+	address := request.URL.Host
+	if request.URL.Port() == "" {
+		address = net.JoinHostPort(request.URL.Hostname(), "80")
+	}
+	target, err := s.dialTarget(address)
+	if err != nil {
+		log.Printf("proxy: dial %s: %v", address, err)
+		writeHTTPStatus(conn, http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	// One request per connection: the next one may be for another host.
+	request.Header.Del("Proxy-Connection")
+	request.Header.Del("Proxy-Authorization")
+	request.Close = true
+	_ = conn.SetDeadline(time.Time{})
+	if err := request.Write(target); err != nil {
+		writeHTTPStatus(conn, http.StatusBadGateway)
+		return
+	}
+	_, _ = io.Copy(conn, target)
+}
+
+func (s *Server) dialTarget(address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return s.dial(ctx, address)
+}
+
+func writeHTTPStatus(conn net.Conn, status int) {
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
+
+// pipe copies both ways until each side finished sending. The client is
+// read through reader, which may hold bytes sent ahead of the reply.
+func pipe(client net.Conn, reader io.Reader, target net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(target, reader)
+		closeWrite(target)
+	}()
+	_, _ = io.Copy(client, target)
+	closeWrite(client)
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if closeWriter, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = closeWriter.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+func TestServerConnectsSOCKSClients(t *testing.T) {
+	backend := startEchoServer(t)
+	server := startTestServer(t, map[string]string{"orders.default.svc:80": backend})
+
+	dialer, err := xproxy.SOCKS5("tcp", server.Addr(), nil, xproxy.Direct)
+	if err != nil {
+		t.Fatalf("socks5 dialer: %v", err)
+	}
+	conn, err := dialer.Dial("tcp", "orders.default.svc:80")
+	if err != nil {
+		t.Fatalf("dial through proxy: %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	if _, err := dialer.Dial("tcp", "unknown.default.svc:80"); err == nil {
+		t.Fatalf("expected an unreachable target to fail")
+	}
+}
+
+func TestServerConnectsHTTPTunnels(t *testing.T) {
+	backend := startEchoServer(t)
+	server := startTestServer(t, map[string]string{"orders.default.svc:443": backend})
+
+	conn, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT orders.default.svc:443 HTTP/1.1\r\nHost: orders.default.svc:443\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT to succeed, got %s", response.Status)
+	}
+	assertEchoThrough(t, conn, reader)
+
+	rejected, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer rejected.Close()
+	fmt.Fprintf(rejected, "CONNECT unknown.default.svc:443 HTTP/1.1\r\nHost: unknown.default.svc:443\r\n\r\n")
+	response, err = http.ReadResponse(bufio.NewReader(rejected), nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if response.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected an unreachable target to answer 502, got %s", response.Status)
+	}
+}
+
+func TestServerForwardsPlainHTTPRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Host, r.URL.RequestURI(), r.Header.Get("Proxy-Connection"))
+	}))
+	t.Cleanup(backend.Close)
+	server := startTestServer(t, map[string]string{"orders.default.svc:80": strings.TrimPrefix(backend.URL, "http://")})
+
+	proxyURL, _ := url.Parse("http://" + server.Addr())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for range 2 {
+		response, err := client.Get("http://orders.default.svc/api/orders?page=2")
+		if err != nil {
+			t.Fatalf("get through proxy: %v", err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != "orders.default.svc /api/orders?page=2 " {
+			t.Fatalf("unexpected response %q", body)
+		}
+	}
+}
+
+func startTestServer(t *testing.T, targets map[string]string) *Server {
+	t.Helper()
+	server := NewServer(func(ctx context.Context, address string) (net.Conn, error) {
+		target, ok := targets[address]
+		if !ok {
+			return nil, fmt.Errorf("no route to %s", address)
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", target)
+	})
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	assertEchoThrough(t, conn, conn)
+}
+
+func assertEchoThrough(t *testing.T, conn net.Conn, reader io.Reader) {
+	t.Helper()
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("expected the echo, got %q", reply)
+	}
+}
@@ -40,6 +40,15 @@ func (r *DebugSessionRegistry) Has(sessionKey string) bool {
 	return ok
 }
 
+func (r *DebugSessionRegistry) Get(sessionKey string) (contracts.DebugServiceContext, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key := sessionkey.Trim(sessionKey)
+	context, ok := r.sessions[key]
+	return context, ok
+}
+
 func (r *DebugSessionRegistry) Remove(sessionKey string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -0,0 +1,337 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/streamcodec"
+	"github.com/ftechmax/krun/internal/wskeepalive"
+	"github.com/gorilla/websocket"
+)
+
+// streamLost is what the multiplexed stream delivers to each of its
+// sessions when it disconnects. It never goes on the wire.
+const streamLost = "stream-lost"
+
+var errMuxUnsupported = errors.New("manager does not serve multiplexed client streams")
+
+// muxClient is the helper's one stream to the manager, carrying every
+// attached session. Sessions attach with their own token; the manager tags
+// every envelope with its session id and the client hands it to that
+// session's attachment.
+type muxClient struct {
+	streamURL string
+	cancel    context.CancelFunc
+	doneCh    chan struct{}
+	sendCh    chan contracts.StreamEnvelope
+	// unsupported is closed when the manager turned out to predate
+	// multiplexed streams; sessions then dial streams of their own.
+	unsupported chan struct{}
+
+	mu        sync.Mutex
+	sessions  map[string]*sessionAttachment
+	connected bool
+}
+
+func newMuxClient(managerAddress string) (*muxClient, error) {
+	streamURL, err := buildStreamURL(managerAddress, muxStreamPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &muxClient{
+		streamURL:   streamURL,
+		doneCh:      make(chan struct{}),
+		sendCh:      make(chan contracts.StreamEnvelope, sendQueueSize),
+		unsupported: make(chan struct{}),
+		sessions:    map[string]*sessionAttachment{},
+	}, nil
+}
+
+func (m *muxClient) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	go m.run(ctx)
+}
+
+func (m *muxClient) stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	<-m.doneCh
+}
+
+func (m *muxClient) run(ctx context.Context) {
+	defer close(m.doneCh)
+
+	backoff := initialBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+		conn, response, err := streamcodec.Dial(dialCtx, m.streamURL, http.Header{})
+		cancel()
+		if err != nil {
+			if response != nil && response.StatusCode == http.StatusNotFound {
+				log.Printf("helper stream: %v", errMuxUnsupported)
+				close(m.unsupported)
+				return
+			}
+			log.Printf("helper stream connect failed (mux): %v", err)
+			if !sleepWithContext(ctx, backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		log.Printf("helper stream connected (mux)")
+		backoff = initialBackoff
+		if err := m.pumpConnection(ctx, conn); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("helper stream disconnected (mux): %v", err)
+		}
+		m.disconnected()
+	}
+}
+
+func (m *muxClient) pumpConnection(ctx context.Context, conn *websocket.Conn) error {
+	defer conn.Close()
+
+	wskeepalive.Configure(conn)
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go wskeepalive.Ping(conn, pingDone)
+
+	// Sessions added from now on queue their own attach.
+	m.mu.Lock()
+	m.connected = true
+	sessions := make([]*sessionAttachment, 0, len(m.sessions))
+	for _, attachment := range m.sessions {
+		sessions = append(sessions, attachment)
+	}
+	m.mu.Unlock()
+	for _, attachment := range sessions {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := streamcodec.Write(conn, attachment.attachEnvelope()); err != nil {
+			return err
+		}
+	}
+
+	readErrCh := make(chan error, 1)
+	envelopeCh := make(chan contracts.StreamEnvelope, inboundQueueSize)
+	go func() {
+		for {
+			envelope, err := streamcodec.Read(conn)
+			if err != nil {
+				readErrCh <- err
+				return
+			}
+			envelopeCh <- envelope
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case readErr := <-readErrCh:
+			return readErr
+		case envelope := <-envelopeCh:
+			m.mu.Lock()
+			attachment := m.sessions[envelope.SessionID]
+			m.mu.Unlock()
+			if attachment != nil {
+				attachment.deliver(envelope)
+			}
+		case outbound := <-m.sendCh:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := streamcodec.Write(conn, outbound); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// disconnected tells every session its stream is gone. The manager keeps
+// only the routing of connections that can resume.
+func (m *muxClient) disconnected() {
+	m.mu.Lock()
+	m.connected = false
+	sessions := make([]*sessionAttachment, 0, len(m.sessions))
+	for _, attachment := range m.sessions {
+		sessions = append(sessions, attachment)
+	}
+	m.mu.Unlock()
+	for _, attachment := range sessions {
+		attachment.deliver(contracts.StreamEnvelope{Type: streamLost, SessionID: attachment.sessionID})
+	}
+}
+
+// add registers a session. It reports false when the stream is up but
+// the attach could not be queued, in which case the session retries.
+func (m *muxClient) add(attachment *sessionAttachment) bool {
+	m.mu.Lock()
+	m.sessions[attachment.sessionID] = attachment
+	m.mu.Unlock()
+	return m.attach(attachment)
+}
+
+// attach queues the attach of a registered session. Sessions attach on
+// connect anyway, so there is nothing to queue while disconnected.
+func (m *muxClient) attach(attachment *sessionAttachment) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[attachment.sessionID] != attachment || !m.connected {
+		return true
+	}
+	return m.trySend(attachment.attachEnvelope())
+}
+
+func (m *muxClient) remove(attachment *sessionAttachment) {
+	m.mu.Lock()
+	current := m.sessions[attachment.sessionID] == attachment
+	if current {
+		delete(m.sessions, attachment.sessionID)
+	}
+	connected := m.connected
+	m.mu.Unlock()
+	if !current || !connected {
+		return
+	}
+	// Best effort: the manager also detaches sessions whose stream ends.
+	m.trySend(contracts.StreamEnvelope{Type: contracts.StreamTypeDetach, SessionID: attachment.sessionID})
+}
+
+// trySend queues an envelope without waiting. Sessions never block on the
+// shared queue, so the stream can always deliver to them.
+func (m *muxClient) trySend(envelope contracts.StreamEnvelope) bool {
+	select {
+	case m.sendCh <- envelope:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *sessionAttachment) attachEnvelope() contracts.StreamEnvelope {
+	return contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeAttach,
+		SessionID:    a.sessionID,
+		SessionToken: a.sessionToken,
+		Metadata:     map[string]string{contracts.StreamMetadataFeatures: contracts.StreamFeatureOpenAck},
+	}
+}
+
+// deliver hands the attachment an envelope from the multiplexed stream.
+func (a *sessionAttachment) deliver(envelope contracts.StreamEnvelope) {
+	select {
+	case a.inboundCh <- envelope:
+	case <-a.doneCh:
+	}
+}
+
+// serveMux serves the session over the multiplexed stream until ctx ends.
+// It returns errMuxUnsupported when the manager has no multiplexed stream.
+func (a *sessionAttachment) serveMux(ctx context.Context) error {
+	select {
+	case <-a.mux.unsupported:
+		return errMuxUnsupported
+	default:
+	}
+	queued := a.mux.add(a)
+	defer a.mux.remove(a)
+
+	var leaseCh <-chan time.Time
+	if a.leaseInterval > 0 {
+		leaseTicker := time.NewTicker(a.leaseInterval)
+		defer leaseTicker.Stop()
+		leaseCh = leaseTicker.C
+	}
+
+	attached := false
+	backoff := initialBackoff
+	var retry *time.Timer
+	var retryCh <-chan time.Time
+	defer func() {
+		if retry != nil {
+			retry.Stop()
+		}
+	}()
+	// pending holds an outbound envelope until the shared queue takes it;
+	// meanwhile the session keeps handling what the stream delivers.
+	var pending contracts.StreamEnvelope
+	var pendingCh chan<- contracts.StreamEnvelope
+	outboundCh := a.sendCh
+	// detach drops the session's connections, whose routing the manager
+	// dropped, and re-attaches after a backoff when the manager refused or
+	// displaced the session.
+	detach := func() {
+		attached = false
+		a.conns.CloseAll()
+		if retryCh != nil {
+			return
+		}
+		retry = time.NewTimer(backoff)
+		retryCh = retry.C
+		backoff = nextBackoff(backoff)
+	}
+	if !queued {
+		detach()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-a.mux.unsupported:
+			return errMuxUnsupported
+		case envelope := <-a.inboundCh:
+			switch {
+			case envelope.Type == contracts.StreamTypeAttached:
+				log.Printf("helper stream attached (session_id=%s)", a.sessionID)
+				attached = true
+				backoff = initialBackoff
+				a.conns.Reattach()
+			case envelope.Type == streamLost:
+				// The manager holds flow-controlled connections for a while;
+				// they resume once the session is attached again. The
+				// session re-attaches on reconnect.
+				attached = false
+				a.conns.Suspend()
+			case envelope.Type == contracts.StreamTypeDetach:
+				log.Printf("helper stream detached (session_id=%s): %s", a.sessionID, envelope.Message)
+				detach()
+			case envelope.Type == contracts.StreamTypeError && envelope.ConnectionID == "":
+				log.Printf("helper stream attach failed (session_id=%s): %s", a.sessionID, envelope.Message)
+				detach()
+			default:
+				a.handleInboundEnvelope(ctx, envelope)
+			}
+		case <-retryCh:
+			retry, retryCh = nil, nil
+			if !a.mux.attach(a) {
+				detach()
+			}
+		case <-leaseCh:
+			// A renewal lost to a full queue is covered by the next one.
+			if attached {
+				a.mux.trySend(contracts.StreamEnvelope{
+					Type:      contracts.StreamTypeLease,
+					SessionID: a.sessionID,
+				})
+			}
+		case outbound := <-outboundCh:
+			pending, pendingCh, outboundCh = outbound, a.mux.sendCh, nil
+		case pendingCh <- pending:
+			pending, pendingCh, outboundCh = contracts.StreamEnvelope{}, nil, a.sendCh
+		}
+	}
+}
@@ -12,30 +12,48 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ftechmax/krun/internal/contracts"
 	"github.com/ftechmax/krun/internal/sessionkey"
+	"github.com/ftechmax/krun/internal/streamcodec"
 	"github.com/ftechmax/krun/internal/streamconn"
 	"github.com/ftechmax/krun/internal/wskeepalive"
 	"github.com/gorilla/websocket"
 )
 
 const (
-	defaultStreamPath    = "/v1/stream/client"
-	connectTimeout       = 5 * time.Second
-	writeTimeout         = 10 * time.Second
-	initialBackoff       = time.Second
-	maxBackoff           = 10 * time.Second
-	sendQueueSize        = 2048
-	localDialTimeout     = 2 * time.Second
+	defaultStreamPath = "/v1/stream/client"
+	muxStreamPath     = "/v1/stream/mux"
+	connectTimeout    = 5 * time.Second
+	writeTimeout      = 10 * time.Second
+	initialBackoff    = time.Second
+	maxBackoff        = 10 * time.Second
+	sendQueueSize     = 2048
+	inboundQueueSize  = 128
+	localDialTimeout  = 2 * time.Second
+	// While an open is held for a restarting local app, the dial is
+	// retried every holdRetryInterval and the agent is told to keep the
+	// caller waiting every holdNotifyInterval, well within its open-ack
+	// timeout.
+	holdRetryInterval    = 250 * time.Millisecond
+	holdNotifyInterval   = time.Second
 	connectionReadBuffer = 32 * 1024
+	// Renew the manager-side session lease a few times per TTL so a single
+	// lost renewal does not expire an attached session.
+	leaseRenewalsPerTTL = 3
 )
 
+// SessionRegistry attaches the helper to its sessions' streams. All
+// sessions share one multiplexed stream to the manager; against managers
+// that predate it, each session falls back to a stream of its own.
 type SessionRegistry struct {
 	mu             sync.Mutex
 	managerAddress string
 	attachments    map[string]*sessionAttachment
+	// mux runs while at least one session is attached.
+	mux *muxClient
 }
 
 func NewSessionRegistry(managerAddress string) *SessionRegistry {
@@ -45,19 +63,34 @@ func NewSessionRegistry(managerAddress string) *SessionRegistry {
 	}
 }
 
-func (r *SessionRegistry) Upsert(sessionKey string, sessionID string, sessionToken string, interceptPort int) error {
+// Upsert attaches to the session stream, replacing any previous attachment
+// for the key. ports maps the intercepted container ports to local ports,
+// primary first. A positive leaseTTL makes the attachment renew the session
+// lease while it is connected; a positive holdTimeout makes connections
+// wait that long for a local app that is not listening.
+func (r *SessionRegistry) Upsert(sessionKey string, sessionID string, sessionToken string, ports []contracts.PortMapping, leaseTTL time.Duration, holdTimeout time.Duration) error {
 	key := sessionkey.Normalize(sessionKey)
-	attachment, err := newSessionAttachment(r.managerAddress, sessionID, sessionToken, interceptPort)
+	attachment, err := newSessionAttachment(r.managerAddress, sessionID, sessionToken, ports, leaseTTL, holdTimeout)
 	if err != nil {
 		return err
 	}
-	attachment.start()
 
 	r.mu.Lock()
+	if r.mux == nil {
+		mux, err := newMuxClient(r.managerAddress)
+		if err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		mux.start()
+		r.mux = mux
+	}
+	attachment.mux = r.mux
 	previous := r.attachments[key]
 	r.attachments[key] = attachment
 	r.mu.Unlock()
 
+	attachment.start()
 	if previous != nil {
 		previous.stop()
 	}
@@ -72,11 +105,15 @@ func (r *SessionRegistry) Remove(sessionKey string) error {
 	if ok {
 		delete(r.attachments, key)
 	}
+	mux := r.takeIdleMuxLocked()
 	r.mu.Unlock()
 
 	if ok {
 		attachment.stop()
 	}
+	if mux != nil {
+		mux.stop()
+	}
 	return nil
 }
 
@@ -87,48 +124,124 @@ func (r *SessionRegistry) Clear() error {
 		attachments = append(attachments, attachment)
 	}
 	r.attachments = map[string]*sessionAttachment{}
+	mux := r.takeIdleMuxLocked()
 	r.mu.Unlock()
 
 	for _, attachment := range attachments {
 		attachment.stop()
 	}
+	if mux != nil {
+		mux.stop()
+	}
 	return nil
 }
 
+// takeIdleMuxLocked hands over the multiplexed stream for stopping once no
+// session uses it.
+func (r *SessionRegistry) takeIdleMuxLocked() *muxClient {
+	if len(r.attachments) > 0 || r.mux == nil {
+		return nil
+	}
+	mux := r.mux
+	r.mux = nil
+	return mux
+}
+
+// SupersededBy returns the owner that took the session over, if the
+// manager reported one. The attachment stops once superseded.
+func (r *SessionRegistry) SupersededBy(sessionKey string) (string, bool) {
+	key := sessionkey.Normalize(sessionKey)
+
+	r.mu.Lock()
+	attachment, ok := r.attachments[key]
+	r.mu.Unlock()
+
+	if !ok {
+		return "", false
+	}
+	owner, _ := attachment.supersededBy.Load().(string)
+	return owner, owner != ""
+}
+
 type sessionAttachment struct {
 	sessionID    string
+	sessionToken string
 	interceptURL string
-	streamURL    string
+	// localAddresses are the local app's addresses by container port; opens
+	// that name no port go to interceptURL.
+	localAddresses map[int]string
+	// streamURL is the session's own stream, used when the manager does
+	// not serve multiplexed ones.
+	streamURL string
+	mux       *muxClient
+	// leaseInterval is how often the lease is renewed; zero disables it.
+	leaseInterval time.Duration
+	// holdTimeout is how long an open waits for the local app; zero
+	// refuses it on the first failed dial.
+	holdTimeout  time.Duration
+	supersededBy atomic.Value
 
 	cancel context.CancelFunc
 	doneCh chan struct{}
 	sendCh chan contracts.StreamEnvelope
+	// inboundCh carries the session's envelopes from the multiplexed stream.
+	inboundCh chan contracts.StreamEnvelope
 
 	conns *streamconn.Registry
+
+	holdMu sync.Mutex
+	// holds cancels the opens waiting for the local app, by connection.
+	holds map[string]context.CancelFunc
 }
 
-func newSessionAttachment(managerAddress string, sessionID string, sessionToken string, interceptPort int) (*sessionAttachment, error) {
+func newSessionAttachment(managerAddress string, sessionID string, sessionToken string, ports []contracts.PortMapping, leaseTTL time.Duration, holdTimeout time.Duration) (*sessionAttachment, error) {
 	trimmedSessionID := strings.TrimSpace(sessionID)
 	if trimmedSessionID == "" {
 		return nil, errors.New("stream session id is required")
 	}
-	if interceptPort < 1 || interceptPort > 65535 {
-		return nil, fmt.Errorf("invalid intercept port %d", interceptPort)
+	if len(ports) == 0 {
+		return nil, errors.New("stream intercept port is required")
+	}
+	localAddresses := make(map[int]string, len(ports))
+	for _, port := range ports {
+		if port.LocalPort < 1 || port.LocalPort > 65535 {
+			return nil, fmt.Errorf("invalid intercept port %d", port.LocalPort)
+		}
+		localAddresses[port.ServicePort] = net.JoinHostPort("127.0.0.1", strconv.Itoa(port.LocalPort))
 	}
 
-	streamURL, err := buildStreamURL(managerAddress, trimmedSessionID, sessionToken)
+	query := url.Values{}
+	query.Set("session_id", trimmedSessionID)
+	query.Set(contracts.StreamMetadataFeatures, contracts.StreamFeatureOpenAck)
+	if strings.TrimSpace(sessionToken) != "" {
+		query.Set("session_token", strings.TrimSpace(sessionToken))
+	}
+	streamURL, err := buildStreamURL(managerAddress, defaultStreamPath, query)
 	if err != nil {
 		return nil, err
 	}
 
-	return &sessionAttachment{
-		sessionID:    trimmedSessionID,
-		interceptURL: net.JoinHostPort("127.0.0.1", strconv.Itoa(interceptPort)),
-		streamURL:    streamURL,
-		doneCh:       make(chan struct{}),
-		sendCh:       make(chan contracts.StreamEnvelope, sendQueueSize),
-		conns:        streamconn.NewRegistry(),
-	}, nil
+	attachment := &sessionAttachment{
+		sessionID:      trimmedSessionID,
+		sessionToken:   strings.TrimSpace(sessionToken),
+		interceptURL:   localAddresses[ports[0].ServicePort],
+		localAddresses: localAddresses,
+		streamURL:      streamURL,
+		doneCh:         make(chan struct{}),
+		leaseInterval:  leaseTTL / leaseRenewalsPerTTL,
+		holdTimeout:    holdTimeout,
+		holds:          map[string]context.CancelFunc{},
+		sendCh:         make(chan contracts.StreamEnvelope, sendQueueSize),
+		inboundCh:      make(chan contracts.StreamEnvelope, inboundQueueSize),
+	}
+	attachment.conns = streamconn.NewRegistry(streamconn.Hooks{
+		Send:   attachment.sendChunk,
+		Resume: attachment.sendResume,
+		Credit: attachment.sendWindowUpdate,
+		Closed: attachment.sendClose,
+		Failed: attachment.sendWriteFailure,
+	})
+	return attachment, nil
 }
 
 func (a *sessionAttachment) start() {
@@ -148,6 +261,13 @@ func (a *sessionAttachment) run(ctx context.Context) {
 	defer close(a.doneCh)
 	defer a.conns.CloseAll()
 
+	if a.mux != nil {
+		if err := a.serveMux(ctx); !errors.Is(err, errMuxUnsupported) {
+			return
+		}
+		log.Printf("helper stream falls back to a session stream (session_id=%s)", a.sessionID)
+	}
+
 	backoff := initialBackoff
 	for {
 		select {
@@ -157,7 +277,7 @@ func (a *sessionAttachment) run(ctx context.Context) {
 		}
 
 		dialCtx, cancel := context.WithTimeout(ctx, connectTimeout)
-		conn, _, err := websocket.DefaultDialer.DialContext(dialCtx, a.streamURL, http.Header{})
+		conn, _, err := streamcodec.Dial(dialCtx, a.streamURL, http.Header{})
 		cancel()
 		if err != nil {
 			log.Printf("helper stream connect failed (session_id=%s): %v", a.sessionID, err)
@@ -170,12 +290,14 @@ func (a *sessionAttachment) run(ctx context.Context) {
 
 		log.Printf("helper stream connected (session_id=%s)", a.sessionID)
 		backoff = initialBackoff
+		a.conns.Reattach()
 		if err := a.pumpConnection(ctx, conn); err != nil && !errors.Is(err, context.Canceled) {
 			log.Printf("helper stream disconnected (session_id=%s): %v", a.sessionID, err)
 		}
-		// The manager drops all connection routing for this session when the
-		// client stream detaches, so any local conns from this epoch are dead.
-		a.conns.CloseAll()
+		// The manager keeps the routing of flow-controlled connections for a
+		// while after the client stream detaches; those resume on reconnect
+		// and any other local conns from this epoch are dead.
+		a.conns.Suspend()
 	}
 }
 
@@ -187,12 +309,19 @@ func (a *sessionAttachment) pumpConnection(ctx context.Context, conn *websocket.
 	defer close(pingDone)
 	go wskeepalive.Ping(conn, pingDone)
 
+	var leaseCh <-chan time.Time
+	if a.leaseInterval > 0 {
+		leaseTicker := time.NewTicker(a.leaseInterval)
+		defer leaseTicker.Stop()
+		leaseCh = leaseTicker.C
+	}
+
 	readErrCh := make(chan error, 1)
 	envelopeCh := make(chan contracts.StreamEnvelope, 128)
 	go func() {
 		for {
-			var envelope contracts.StreamEnvelope
-			if err := conn.ReadJSON(&envelope); err != nil {
+			envelope, err := streamcodec.Read(conn)
+			if err != nil {
 				readErrCh <- err
 				return
 			}
@@ -208,9 +337,17 @@ func (a *sessionAttachment) pumpConnection(ctx context.Context, conn *websocket.
 			return readErr
 		case envelope := <-envelopeCh:
 			a.handleInboundEnvelope(ctx, envelope)
+		case <-leaseCh:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := streamcodec.Write(conn, contracts.StreamEnvelope{
+				Type:      contracts.StreamTypeLease,
+				SessionID: a.sessionID,
+			}); err != nil {
+				return err
+			}
 		case outbound := <-a.sendCh:
 			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			if err := conn.WriteJSON(outbound); err != nil {
+			if err := streamcodec.Write(conn, outbound); err != nil {
 				return err
 			}
 		}
@@ -224,93 +361,259 @@ func (a *sessionAttachment) handleInboundEnvelope(ctx context.Context, envelope
 
 	switch envelope.Type {
 	case contracts.StreamTypeOpen:
-		a.handleOpen(ctx, connectionID)
+		a.handleOpen(ctx, connectionID, envelope.Metadata, envelope.Window)
 	case contracts.StreamTypeData:
-		a.handleData(connectionID, envelope.Data)
+		// Queued per connection: a local app paused on a breakpoint only
+		// holds up its own connection.
+		a.conns.Write(connectionID, envelope.Seq, envelope.Data)
+	case contracts.StreamTypeWindow:
+		a.conns.Grant(connectionID, envelope.Window, envelope.Seq)
 	case contracts.StreamTypeCloseWrite:
-		if a.conns.CloseWriteHalf(connectionID) {
-			_ = a.enqueueOutbound(ctx, contracts.StreamEnvelope{
-				Type:         contracts.StreamTypeClose,
-				SessionID:    a.sessionID,
-				ConnectionID: connectionID,
-			})
-		}
+		a.conns.CloseWriteHalf(connectionID, envelope.Seq)
+	case contracts.StreamTypeResume, contracts.StreamTypeResumed:
+		go a.resumeConnection(envelope)
 	case contracts.StreamTypeClose, contracts.StreamTypeError:
+		a.cancelHold(connectionID)
 		a.conns.CloseAndDelete(connectionID)
 	case contracts.StreamTypePing:
 		a.enqueueOutbound(ctx, contracts.StreamEnvelope{
 			Type:      contracts.StreamTypePing,
 			SessionID: a.sessionID,
 		})
+	case contracts.StreamTypeSuperseded:
+		// The manager deleted the session; reconnecting would only fail.
+		newOwner := strings.TrimSpace(envelope.Message)
+		if newOwner == "" {
+			newOwner = "another owner"
+		}
+		log.Printf("helper stream superseded (session_id=%s new_owner=%s)", a.sessionID, newOwner)
+		a.supersededBy.Store(newOwner)
+		if a.cancel != nil {
+			a.cancel()
+		}
 	}
 }
 
-func (a *sessionAttachment) handleOpen(ctx context.Context, connectionID string) {
+// handleOpen bridges a tunneled connection to the local app, on the local
+// port mapped to the container port the connection was sent to. Mirrored
+// connections are served by the in-pod container, so the local app's
+// responses have nowhere to go and are discarded. When the agent
+// advertised a receive window the connection is flow controlled in both
+// directions; older agents get the unbounded behaviour they expect.
+func (a *sessionAttachment) handleOpen(ctx context.Context, connectionID string, metadata map[string]string, agentWindow int) {
 	if connectionID == "" {
 		return
 	}
-
-	localConn, err := net.DialTimeout("tcp", a.interceptURL, localDialTimeout)
+	mirror := metadata[contracts.StreamMetadataMode] == contracts.SessionModeMirror
+	localAddress, err := a.localAddress(metadata[contracts.StreamMetadataTargetPort])
 	if err != nil {
-		a.enqueueOutbound(ctx, contracts.StreamEnvelope{
-			Type:         contracts.StreamTypeError,
-			SessionID:    a.sessionID,
-			ConnectionID: connectionID,
-			Message:      err.Error(),
-		})
-		a.enqueueOutbound(ctx, contracts.StreamEnvelope{
-			Type:         contracts.StreamTypeClose,
-			SessionID:    a.sessionID,
-			ConnectionID: connectionID,
-		})
+		a.refuseOpen(ctx, connectionID, err)
 		return
 	}
 
-	a.conns.Set(connectionID, localConn)
+	localConn, err := net.DialTimeout("tcp", localAddress, localDialTimeout)
+	if err != nil {
+		// Mirrored data does not wait for the ack, so only opens the agent
+		// holds its caller for can wait for the local app.
+		if mirror || a.holdTimeout <= 0 {
+			a.refuseOpen(ctx, connectionID, err)
+			return
+		}
+		holdCtx, cancel := context.WithTimeout(ctx, a.holdTimeout)
+		a.holdMu.Lock()
+		a.holds[connectionID] = cancel
+		a.holdMu.Unlock()
+		go a.holdOpen(ctx, holdCtx, connectionID, localAddress, agentWindow, err)
+		return
+	}
+	a.acceptOpen(ctx, connectionID, localConn, mirror, agentWindow)
+}
 
-	go a.pumpLocalConnection(ctx, connectionID, localConn)
+// localAddress returns the local app's address for a container port, or
+// the primary one for agents that do not name the port.
+func (a *sessionAttachment) localAddress(targetPort string) (string, error) {
+	if targetPort == "" {
+		return a.interceptURL, nil
+	}
+	port, err := strconv.Atoi(targetPort)
+	if err != nil {
+		return "", fmt.Errorf("invalid target port %q", targetPort)
+	}
+	address, ok := a.localAddresses[port]
+	if !ok {
+		return "", fmt.Errorf("no local port is mapped to container port %d", port)
+	}
+	return address, nil
 }
 
-func (a *sessionAttachment) handleData(connectionID string, payload []byte) {
-	if connectionID == "" || len(payload) == 0 {
+// holdOpen retries the local app while it restarts, for up to the hold
+// timeout. The agent keeps its caller waiting meanwhile, with nothing read
+// from it yet, so no data is lost once the app is back.
+func (a *sessionAttachment) holdOpen(ctx context.Context, holdCtx context.Context, connectionID string, localAddress string, agentWindow int, dialErr error) {
+	log.Printf("helper holds connection for the local app (session_id=%s connection_id=%s): %v", a.sessionID, connectionID, dialErr)
+	retry := time.NewTicker(holdRetryInterval)
+	defer retry.Stop()
+	var notifiedAt time.Time
+	for {
+		if time.Since(notifiedAt) >= holdNotifyInterval {
+			_ = a.enqueueOutbound(ctx, contracts.StreamEnvelope{
+				Type:         contracts.StreamTypeHold,
+				SessionID:    a.sessionID,
+				ConnectionID: connectionID,
+			})
+			notifiedAt = time.Now()
+		}
+
+		select {
+		case <-holdCtx.Done():
+			// A hold the agent cancelled is already gone.
+			if a.cancelHold(connectionID) {
+				a.refuseOpen(ctx, connectionID, dialErr)
+			}
+			return
+		case <-retry.C:
+		}
+
+		localConn, err := net.DialTimeout("tcp", localAddress, localDialTimeout)
+		if err != nil {
+			dialErr = err
+			continue
+		}
+		if !a.cancelHold(connectionID) {
+			_ = localConn.Close()
+			return
+		}
+		a.acceptOpen(ctx, connectionID, localConn, false, agentWindow)
 		return
 	}
-	localConn := a.conns.Get(connectionID)
-	if localConn == nil {
-		return
+}
+
+// cancelHold ends the hold of a connection and reports whether it was
+// still held.
+func (a *sessionAttachment) cancelHold(connectionID string) bool {
+	a.holdMu.Lock()
+	cancel, ok := a.holds[connectionID]
+	delete(a.holds, connectionID)
+	a.holdMu.Unlock()
+	if ok {
+		cancel()
 	}
-	// Bound the write so a local app that stopped reading cannot stall the
-	// session pump indefinitely (which would also hang attachment.stop()).
-	_ = localConn.SetWriteDeadline(time.Now().Add(writeTimeout))
-	if _, err := localConn.Write(payload); err != nil {
-		a.conns.CloseAndDelete(connectionID)
-		a.enqueueOutbound(context.Background(), contracts.StreamEnvelope{
-			Type:         contracts.StreamTypeError,
-			SessionID:    a.sessionID,
-			ConnectionID: connectionID,
-			Message:      err.Error(),
-		})
-		a.enqueueOutbound(context.Background(), contracts.StreamEnvelope{
-			Type:         contracts.StreamTypeClose,
-			SessionID:    a.sessionID,
-			ConnectionID: connectionID,
-		})
+	return ok
+}
+
+func (a *sessionAttachment) refuseOpen(ctx context.Context, connectionID string, err error) {
+	a.enqueueOutbound(ctx, contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeError,
+		SessionID:    a.sessionID,
+		ConnectionID: connectionID,
+		Message:      err.Error(),
+	})
+	a.enqueueOutbound(ctx, contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeClose,
+		SessionID:    a.sessionID,
+		ConnectionID: connectionID,
+	})
+}
+
+func (a *sessionAttachment) acceptOpen(ctx context.Context, connectionID string, localConn net.Conn, mirror bool, agentWindow int) {
+	var window *streamconn.Window
+	ack := contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeOpenAck,
+		SessionID:    a.sessionID,
+		ConnectionID: connectionID,
+	}
+	if agentWindow > 0 {
+		window = streamconn.NewWindow(agentWindow)
+		ack.Window = streamconn.DefaultWindow
+	}
+	a.conns.Set(connectionID, localConn, window)
+	a.enqueueOutbound(ctx, ack)
+
+	go a.pumpLocalConnection(ctx, connectionID, localConn, window, mirror)
+}
+
+// resumeConnection answers the agent's resume of a tunneled connection,
+// or completes the helper's own. A connection the helper no longer has is
+// closed on the agent's side too.
+func (a *sessionAttachment) resumeConnection(envelope contracts.StreamEnvelope) {
+	reply := envelope.Type == contracts.StreamTypeResume
+	err := a.conns.Resume(envelope.ConnectionID, envelope.Seq, envelope.Window, reply)
+	if errors.Is(err, streamconn.ErrUnknownConnection) {
+		a.sendWriteFailure(envelope.ConnectionID, err)
+	}
+}
+
+func (a *sessionAttachment) sendChunk(connectionID string, chunk streamconn.Chunk) error {
+	envelope := contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeData,
+		SessionID:    a.sessionID,
+		ConnectionID: connectionID,
+		Data:         chunk.Data,
+		Seq:          chunk.Seq,
+	}
+	if chunk.CloseWrite {
+		envelope.Type = contracts.StreamTypeCloseWrite
+	}
+	return a.enqueueOutbound(context.Background(), envelope)
+}
+
+func (a *sessionAttachment) sendResume(connectionID string, reply bool, received uint64, credited int) {
+	envelope := contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeResume,
+		SessionID:    a.sessionID,
+		ConnectionID: connectionID,
+		Window:       credited,
+		Seq:          received,
+	}
+	if reply {
+		envelope.Type = contracts.StreamTypeResumed
 	}
+	_ = a.enqueueOutbound(context.Background(), envelope)
+}
+
+func (a *sessionAttachment) sendWindowUpdate(connectionID string, bytes int, received uint64) {
+	_ = a.enqueueOutbound(context.Background(), contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeWindow,
+		SessionID:    a.sessionID,
+		ConnectionID: connectionID,
+		Window:       bytes,
+		Seq:          received,
+	})
 }
 
-func (a *sessionAttachment) pumpLocalConnection(ctx context.Context, connectionID string, localConn net.Conn) {
+func (a *sessionAttachment) sendClose(connectionID string) {
+	_ = a.enqueueOutbound(context.Background(), contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeClose,
+		SessionID:    a.sessionID,
+		ConnectionID: connectionID,
+	})
+}
+
+func (a *sessionAttachment) sendWriteFailure(connectionID string, err error) {
+	_ = a.enqueueOutbound(context.Background(), contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeError,
+		SessionID:    a.sessionID,
+		ConnectionID: connectionID,
+		Message:      err.Error(),
+	})
+	a.sendClose(connectionID)
+}
+
+func (a *sessionAttachment) pumpLocalConnection(ctx context.Context, connectionID string, localConn net.Conn, window *streamconn.Window, discard bool) {
 	buffer := make([]byte, connectionReadBuffer)
 	for {
-		readBytes, readErr := localConn.Read(buffer)
-		if readBytes > 0 {
+		// Leave response bytes in the local socket while the agent's caller
+		// is not draining them.
+		available, err := window.Acquire(ctx, len(buffer))
+		if err != nil {
+			return
+		}
+		readBytes, readErr := localConn.Read(buffer[:available])
+		if readBytes > 0 && !discard {
+			window.Consume(readBytes)
 			chunk := make([]byte, readBytes)
 			copy(chunk, buffer[:readBytes])
-			if err := a.enqueueOutbound(ctx, contracts.StreamEnvelope{
-				Type:         contracts.StreamTypeData,
-				SessionID:    a.sessionID,
-				ConnectionID: connectionID,
-				Data:         chunk,
-			}); err != nil {
+			if err := a.conns.SendData(connectionID, chunk); err != nil {
 				a.conns.CloseAndDelete(connectionID)
 				return
 			}
@@ -322,11 +625,7 @@ func (a *sessionAttachment) pumpLocalConnection(ctx context.Context, connectionI
 		if errors.Is(readErr, io.EOF) {
 			// Half-close: the local app finished its response stream, but the
 			// caller-to-app direction may still be open.
-			_ = a.enqueueOutbound(ctx, contracts.StreamEnvelope{
-				Type:         contracts.StreamTypeCloseWrite,
-				SessionID:    a.sessionID,
-				ConnectionID: connectionID,
-			})
+			_ = a.conns.SendCloseWrite(connectionID)
 			if a.conns.MarkReadClosed(connectionID) {
 				_ = a.enqueueOutbound(ctx, contracts.StreamEnvelope{
 					Type:         contracts.StreamTypeClose,
@@ -369,7 +668,7 @@ func (a *sessionAttachment) enqueueOutbound(ctx context.Context, envelope contra
 	}
 }
 
-func buildStreamURL(managerAddress string, sessionID string, sessionToken string) (string, error) {
+func buildStreamURL(managerAddress string, streamPath string, query url.Values) (string, error) {
 	rawAddress := strings.TrimSpace(managerAddress)
 	if rawAddress == "" {
 		return "", errors.New("manager address is required")
@@ -397,13 +696,12 @@ func buildStreamURL(managerAddress string, sessionID string, sessionToken string
 	}
 
 	basePath := strings.TrimRight(parsed.Path, "/")
-	parsed.Path = basePath + defaultStreamPath
-	query := parsed.Query()
-	query.Set("session_id", strings.TrimSpace(sessionID))
-	if strings.TrimSpace(sessionToken) != "" {
-		query.Set("session_token", strings.TrimSpace(sessionToken))
+	parsed.Path = basePath + streamPath
+	merged := parsed.Query()
+	for key, values := range query {
+		merged[key] = values
 	}
-	parsed.RawQuery = query.Encode()
+	parsed.RawQuery = merged.Encode()
 	return parsed.String(), nil
 }
 
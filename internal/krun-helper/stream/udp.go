@@ -0,0 +1,387 @@
+package stream
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/sessionkey"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	udpStreamPath = "/v1/stream/udp"
+	// A flow without datagrams either way for this long is closed; the
+	// next datagram from its client opens a new one.
+	udpFlowIdleTimeout = 2 * time.Minute
+	// A flow that could not reach the manager stays for this long,
+	// dropping its client's datagrams, before the next one dials again.
+	udpFlowRetryDelay = 5 * time.Second
+	udpFlowQueueSize  = 64
+	maxDatagramSize   = 65535
+
+	sessionIDHeader    = "X-Krun-Session-ID"
+	sessionTokenHeader = "X-Krun-Session-Token"
+)
+
+// UDPRegistry serves the UDP dependencies of the sessions. Each forward
+// listens on its local address, and every client address that sends to it
+// becomes a flow of its own: a websocket to the manager, which relays the
+// datagrams to the cluster. Sessions using the same forward share it; any
+// of them authorizes new flows.
+type UDPRegistry struct {
+	managerAddress string
+
+	mu       sync.Mutex
+	sessions map[string]udpSession
+	relays   map[string]*udpRelay
+}
+
+type udpSession struct {
+	sessionID    string
+	sessionToken string
+	forwardKeys  []string
+}
+
+func NewUDPRegistry(managerAddress string) *UDPRegistry {
+	return &UDPRegistry{
+		managerAddress: strings.TrimSpace(managerAddress),
+		sessions:       map[string]udpSession{},
+		relays:         map[string]*udpRelay{},
+	}
+}
+
+// Upsert replaces the UDP forwards of a session. Forwards the session no
+// longer uses, and no other session does, stop.
+func (r *UDPRegistry) Upsert(sessionKey string, sessionID string, sessionToken string, forwards []contracts.PortForward) error {
+	key := sessionkey.Normalize(sessionKey)
+
+	r.mu.Lock()
+	forwardKeys := make([]string, 0, len(forwards))
+	var started []string
+	for _, forward := range forwards {
+		normalized, err := normalizeUDPForward(forward)
+		if err == nil {
+			if slices.Contains(forwardKeys, udpForwardKey(normalized)) {
+				continue
+			}
+			err = r.startRelayLocked(normalized, &started)
+		}
+		if err != nil {
+			stopped := r.takeRelaysLocked(started)
+			r.mu.Unlock()
+			stopRelays(stopped)
+			return err
+		}
+		forwardKeys = append(forwardKeys, udpForwardKey(normalized))
+	}
+
+	if len(forwardKeys) == 0 {
+		delete(r.sessions, key)
+	} else {
+		r.sessions[key] = udpSession{
+			sessionID:    strings.TrimSpace(sessionID),
+			sessionToken: strings.TrimSpace(sessionToken),
+			forwardKeys:  forwardKeys,
+		}
+	}
+	unused := r.takeUnusedLocked()
+	r.mu.Unlock()
+
+	stopRelays(unused)
+	return nil
+}
+
+func (r *UDPRegistry) Remove(sessionKey string) error {
+	r.mu.Lock()
+	delete(r.sessions, sessionkey.Normalize(sessionKey))
+	unused := r.takeUnusedLocked()
+	r.mu.Unlock()
+
+	stopRelays(unused)
+	return nil
+}
+
+func (r *UDPRegistry) Clear() error {
+	r.mu.Lock()
+	r.sessions = map[string]udpSession{}
+	unused := r.takeUnusedLocked()
+	r.mu.Unlock()
+
+	stopRelays(unused)
+	return nil
+}
+
+// startRelayLocked listens for a forward that is not served yet and
+// records it in started.
+func (r *UDPRegistry) startRelayLocked(forward contracts.PortForward, started *[]string) error {
+	forwardKey := udpForwardKey(forward)
+	if _, ok := r.relays[forwardKey]; ok {
+		return nil
+	}
+
+	query := url.Values{}
+	query.Set("namespace", forward.Namespace)
+	query.Set("service", forward.Service)
+	if forward.Pod != "" {
+		query.Set("pod", forward.Pod)
+	}
+	query.Set("port", strconv.Itoa(forward.RemotePort))
+	streamURL, err := buildStreamURL(r.managerAddress, udpStreamPath, query)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenPacket("udp", udpLocalEndpoint(forward))
+	if err != nil {
+		return fmt.Errorf("listen on udp %s: %w", udpLocalEndpoint(forward), err)
+	}
+	relay := &udpRelay{
+		forward:   forward,
+		conn:      conn,
+		streamURL: streamURL,
+		credentials: func() (string, string, bool) {
+			return r.credentials(forwardKey)
+		},
+		flows: map[string]*udpFlow{},
+		done:  make(chan struct{}),
+	}
+	relay.wg.Add(1)
+	go relay.serve()
+
+	fmt.Printf("Started udp forward %s:%d -> %s\n", udpForwardTarget(forward), forward.RemotePort, udpLocalEndpoint(forward))
+	r.relays[forwardKey] = relay
+	*started = append(*started, forwardKey)
+	return nil
+}
+
+// credentials picks a session that uses the forward to authorize a flow.
+func (r *UDPRegistry) credentials(forwardKey string) (string, string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range slices.Sorted(maps.Keys(r.sessions)) {
+		session := r.sessions[key]
+		if slices.Contains(session.forwardKeys, forwardKey) {
+			return session.sessionID, session.sessionToken, true
+		}
+	}
+	return "", "", false
+}
+
+func (r *UDPRegistry) takeRelaysLocked(forwardKeys []string) []*udpRelay {
+	relays := make([]*udpRelay, 0, len(forwardKeys))
+	for _, forwardKey := range forwardKeys {
+		relays = append(relays, r.relays[forwardKey])
+		delete(r.relays, forwardKey)
+	}
+	return relays
+}
+
+func (r *UDPRegistry) takeUnusedLocked() []*udpRelay {
+	var unused []string
+	for forwardKey := range r.relays {
+		used := false
+		for _, session := range r.sessions {
+			if slices.Contains(session.forwardKeys, forwardKey) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			unused = append(unused, forwardKey)
+		}
+	}
+	return r.takeRelaysLocked(unused)
+}
+
+// stopRelays runs without the registry lock: stopping waits for flows
+// that may be asking the registry for credentials.
+func stopRelays(relays []*udpRelay) {
+	for _, relay := range relays {
+		fmt.Printf("Stopping udp forward %s:%d -> %s\n", udpForwardTarget(relay.forward), relay.forward.RemotePort, udpLocalEndpoint(relay.forward))
+		relay.stop()
+	}
+}
+
+type udpRelay struct {
+	forward     contracts.PortForward
+	conn        net.PacketConn
+	streamURL   string
+	credentials func() (string, string, bool)
+
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type udpFlow struct {
+	client net.Addr
+	queue  chan []byte
+}
+
+func (r *udpRelay) serve() {
+	defer r.wg.Done()
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := r.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		datagram := slices.Clone(buffer[:n])
+		select {
+		case r.flow(client).queue <- datagram:
+		default:
+			// The flow is still connecting or falling behind; UDP may
+			// drop, and so does the relay.
+		}
+	}
+}
+
+// flow returns the flow of a client address, opening it on first use.
+func (r *udpRelay) flow(client net.Addr) *udpFlow {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if flow, ok := r.flows[client.String()]; ok {
+		return flow
+	}
+	flow := &udpFlow{client: client, queue: make(chan []byte, udpFlowQueueSize)}
+	r.flows[client.String()] = flow
+	r.wg.Add(1)
+	go r.run(flow)
+	return flow
+}
+
+func (r *udpRelay) run(flow *udpFlow) {
+	defer r.wg.Done()
+	defer func() {
+		r.mu.Lock()
+		delete(r.flows, flow.client.String())
+		r.mu.Unlock()
+	}()
+
+	sessionID, sessionToken, ok := r.credentials()
+	if !ok {
+		r.backOff()
+		return
+	}
+	header := http.Header{}
+	header.Set(sessionIDHeader, sessionID)
+	header.Set(sessionTokenHeader, sessionToken)
+	dialCtx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	conn, _, err := websocket.DefaultDialer.DialContext(dialCtx, r.streamURL, header)
+	cancel()
+	if err != nil {
+		log.Printf("udp forward %s:%d: open flow for %s: %v", udpForwardTarget(r.forward), r.forward.RemotePort, flow.client, err)
+		r.backOff()
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxDatagramSize)
+
+	activity := make(chan struct{}, 1)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			messageType, datagram, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			_, _ = r.conn.WriteTo(datagram, flow.client)
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	idle := time.NewTimer(udpFlowIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case datagram := <-flow.queue:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteMessage(websocket.BinaryMessage, datagram); err != nil {
+				return
+			}
+			idle.Reset(udpFlowIdleTimeout)
+		case <-activity:
+			idle.Reset(udpFlowIdleTimeout)
+		case <-readDone:
+			return
+		case <-idle.C:
+			return
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// backOff keeps a failed flow registered for udpFlowRetryDelay, so its
+// client's datagrams are dropped instead of each dialing the manager.
+func (r *udpRelay) backOff() {
+	timer := time.NewTimer(udpFlowRetryDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.done:
+	}
+}
+
+func (r *udpRelay) stop() {
+	close(r.done)
+	_ = r.conn.Close()
+	r.wg.Wait()
+}
+
+func normalizeUDPForward(forward contracts.PortForward) (contracts.PortForward, error) {
+	normalized := contracts.PortForward{
+		Namespace:    cmp.Or(strings.TrimSpace(forward.Namespace), "default"),
+		Service:      strings.TrimSpace(forward.Service),
+		Pod:          strings.TrimSpace(forward.Pod),
+		Protocol:     contracts.ProtocolUDP,
+		LocalAddress: strings.TrimSpace(forward.LocalAddress),
+		LocalPort:    forward.LocalPort,
+		RemotePort:   forward.RemotePort,
+	}
+	if normalized.Service == "" {
+		return contracts.PortForward{}, fmt.Errorf("udp forward: service is required")
+	}
+	if _, err := strconv.Atoi(normalized.Pod); err == nil {
+		return contracts.PortForward{}, fmt.Errorf("udp forward to %s: the manager reaches pods by name, not ordinal", udpForwardTarget(normalized))
+	}
+	if normalized.LocalPort < 1 || normalized.RemotePort < 1 {
+		return contracts.PortForward{}, fmt.Errorf("udp forward to %s: ports must be greater than 0", udpForwardTarget(normalized))
+	}
+	return normalized, nil
+}
+
+func udpForwardKey(forward contracts.PortForward) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%d|%d", forward.Namespace, forward.Service, forward.Pod, forward.LocalAddress, forward.LocalPort, forward.RemotePort)
+}
+
+func udpForwardTarget(forward contracts.PortForward) string {
+	if forward.Pod == "" {
+		return forward.Namespace + "/" + forward.Service
+	}
+	return forward.Namespace + "/" + forward.Service + "/" + forward.Pod
+}
+
+func udpLocalEndpoint(forward contracts.PortForward) string {
+	return net.JoinHostPort(cmp.Or(forward.LocalAddress, "127.0.0.1"), strconv.Itoa(forward.LocalPort))
+}
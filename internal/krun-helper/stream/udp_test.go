@@ -0,0 +1,171 @@
+package stream
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/gorilla/websocket"
+)
+
+func TestUDPRegistryRelaysDatagramsThroughManager(t *testing.T) {
+	manager := startFakeUDPManager(t)
+	registry := NewUDPRegistry(manager.URL)
+	t.Cleanup(func() { _ = registry.Clear() })
+
+	forward := contracts.PortForward{Namespace: "monitoring", Service: "statsd", LocalAddress: "127.0.0.1", LocalPort: freeUDPPort(t), RemotePort: 8125}
+	if err := registry.Upsert("shop/orders", "sess-1", "token-1", []contracts.PortForward{forward, forward}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	client := dialUDP(t, forward)
+	for _, datagram := range []string{"orders.created:1|c", "orders.failed:1|c"} {
+		if _, err := client.Write([]byte(datagram)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		// The manager answers with the target it was asked for and the
+		// session that authorized the flow.
+		want := "sess-1 monitoring/statsd/8125 " + datagram
+		if got := readDatagram(t, client); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+
+	// A second session sharing the forward keeps it when the first goes.
+	if err := registry.Upsert("shop/billing", "sess-2", "token-2", []contracts.PortForward{forward}); err != nil {
+		t.Fatalf("upsert second session: %v", err)
+	}
+	if err := registry.Remove("shop/orders"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	other := dialUDP(t, forward)
+	if _, err := other.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readDatagram(t, other); got != "sess-2 monitoring/statsd/8125 ping" {
+		t.Fatalf("expected the remaining session to authorize the flow, got %q", got)
+	}
+
+	if err := registry.Remove("shop/billing"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	conn, err := net.ListenPacket("udp", udpLocalEndpoint(forward))
+	if err != nil {
+		t.Fatalf("expected the local port released after the last session: %v", err)
+	}
+	conn.Close()
+}
+
+func TestUDPRegistryBacksOffWhenManagerRejectsFlow(t *testing.T) {
+	var dials atomic.Int32
+	manager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dials.Add(1)
+		http.Error(w, "udp target is not a dependency of the session", http.StatusForbidden)
+	}))
+	t.Cleanup(manager.Close)
+	registry := NewUDPRegistry(manager.URL)
+
+	forward := contracts.PortForward{Namespace: "monitoring", Service: "statsd", LocalAddress: "127.0.0.1", LocalPort: freeUDPPort(t), RemotePort: 8125}
+	if err := registry.Upsert("shop/orders", "sess-1", "token-1", []contracts.PortForward{forward}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	client := dialUDP(t, forward)
+	for range 20 {
+		if _, err := client.Write([]byte("orders.created:1|c")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := dials.Load(); got != 1 {
+		t.Fatalf("expected a single dial while the flow backs off, got %d", got)
+	}
+
+	// Stopping does not wait out the back-off.
+	start := time.Now()
+	if err := registry.Clear(); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected clear to interrupt the back-off, took %v", elapsed)
+	}
+}
+
+func TestUDPRegistryRejectsPodOrdinals(t *testing.T) {
+	registry := NewUDPRegistry("http://127.0.0.1:1")
+	forward := contracts.PortForward{Namespace: "data", Service: "kafka", Pod: "0", LocalPort: freeUDPPort(t), RemotePort: 9093}
+	if err := registry.Upsert("shop/orders", "sess-1", "token-1", []contracts.PortForward{forward}); err == nil {
+		t.Fatalf("expected an ordinal pod to be rejected")
+	}
+}
+
+func startFakeUDPManager(t *testing.T) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != udpStreamPath {
+			http.NotFound(w, r)
+			return
+		}
+		sessionID := r.Header.Get(sessionIDHeader)
+		if r.Header.Get(sessionTokenHeader) != "token-"+sessionID[len("sess-"):] {
+			http.Error(w, "invalid session token", http.StatusUnauthorized)
+			return
+		}
+		query := r.URL.Query()
+		prefix := sessionID + " " + query.Get("namespace") + "/" + query.Get("service") + "/" + query.Get("port") + " "
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, datagram, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, append([]byte(prefix), datagram...)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer conn.Close()
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	value, _ := strconv.Atoi(port)
+	return value
+}
+
+func dialUDP(t *testing.T, forward contracts.PortForward) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp", udpLocalEndpoint(forward))
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readDatagram(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(buffer[:n])
+}
@@ -12,12 +12,14 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
 	cfg "github.com/ftechmax/krun/internal/config"
 	"github.com/ftechmax/krun/internal/contracts"
 	"github.com/ftechmax/krun/internal/helperipc"
+	"github.com/ftechmax/krun/internal/intercept"
 	deploy "github.com/ftechmax/krun/internal/krun/deploy"
 	"github.com/ftechmax/krun/internal/kube"
 	"github.com/ftechmax/krun/internal/utils"
@@ -63,7 +65,28 @@ func List(config cfg.Config) {
 		}
 
 		fmt.Printf("Service: %s (namespace: %s)\n", serviceName, namespace)
-		fmt.Printf("Intercept port: %d\n", session.Context.InterceptPort)
+		if session.SupersededBy != "" {
+			fmt.Println(utils.Colorize(fmt.Sprintf("Taken over by %s; this session no longer receives traffic (run `krun debug disable %s` to clean up)", session.SupersededBy, serviceName), utils.Yellow))
+		}
+		fmt.Printf("Intercept port: %s\n", formatInterceptPorts(session.Context))
+		if len(session.Context.InterceptHeaders) > 0 {
+			fmt.Printf("Intercept headers: %s\n", intercept.FormatHeaders(session.Context.InterceptHeaders))
+		}
+		if intercept.IsMirror(session.Context.Mode) {
+			fmt.Println("Mode: mirror (responses from the local app are discarded)")
+		}
+		if session.Context.SingleReplica {
+			fmt.Println("Scope: single replica (the other replicas keep serving)")
+		}
+		if intercept.IsEphemeral(session.Context.Injection) {
+			fmt.Println("Injection: ephemeral (pods started later are not intercepted)")
+		}
+		if session.Context.InterceptStrategy != "" {
+			fmt.Printf("Interception: %s\n", intercept.DescribeStrategy(session.Context.InterceptStrategy))
+		}
+		if session.Context.LeaseTTLSeconds > 0 {
+			fmt.Printf("Session TTL: %s\n", time.Duration(session.Context.LeaseTTLSeconds)*time.Second)
+		}
 		fmt.Println("Service dependencies:")
 
 		if len(session.Context.ServiceDependencies) == 0 {
@@ -90,14 +113,48 @@ func List(config cfg.Config) {
 	}
 }
 
-func Enable(service cfg.Service, config cfg.Config, containerName string) {
+// EnableOptions carries the `debug enable` flags.
+type EnableOptions struct {
+	// ContainerName picks the workload container whose env is exported.
+	ContainerName string
+	// InterceptHeaders limits the session to HTTP requests carrying all of
+	// these headers; the rest of the traffic keeps reaching the workload.
+	InterceptHeaders map[string]string
+	// Mirror copies matching traffic to the local app while the in-pod
+	// container keeps serving callers.
+	Mirror bool
+	// SingleReplica intercepts one cloned pod; the workload's own replicas
+	// keep serving their share of the traffic.
+	SingleReplica bool
+	// Ephemeral attaches the traffic-agent to the running pods as an
+	// ephemeral container instead of rolling them with a sidecar.
+	Ephemeral bool
+	// SessionTTL is how long the manager keeps the session once the helper
+	// stops renewing it; zero uses the manager default.
+	SessionTTL time.Duration
+	// Force takes over a session another developer holds on the service.
+	Force bool
+}
+
+func Enable(service cfg.Service, config cfg.Config, options EnableOptions) {
 	if err := ensureHelperStarted(config); err != nil {
 		fmt.Println(utils.Colorize(fmt.Sprintf("cannot start helper: %v", err), utils.Red))
 		return
 	}
 
+	debugContext := buildDebugServiceContext(service)
+	debugContext.InterceptHeaders = intercept.NormalizeHeaders(options.InterceptHeaders)
+	if options.Mirror {
+		debugContext.Mode = contracts.SessionModeMirror
+	}
+	debugContext.SingleReplica = options.SingleReplica
+	if options.Ephemeral {
+		debugContext.Injection = contracts.SessionInjectionEphemeral
+	}
+	debugContext.LeaseTTLSeconds = int(options.SessionTTL / time.Second)
+	debugContext.Force = options.Force
 	request := contracts.DebugSessionCommandRequest{
-		Context: buildDebugServiceContext(service),
+		Context: debugContext,
 	}
 	response, err := helperRequest(http.MethodPost, "/v1/debug/enable", request, commandTimeout)
 	if err != nil {
@@ -110,8 +167,18 @@ func Enable(service cfg.Service, config cfg.Config, containerName string) {
 	}
 
 	fmt.Println(utils.Colorize("Session created", utils.Green))
+	if response.Session != nil {
+		fmt.Printf("Interception: %s\n", intercept.DescribeStrategy(response.Session.Context.InterceptStrategy))
+	}
 
-	if err := deploy.CreateEnvFile(service, config, containerName); err != nil {
+	if len(debugContext.InterceptHeaders) > 0 {
+		fmt.Printf("Intercepting requests with %s\n", intercept.FormatHeaders(debugContext.InterceptHeaders))
+	}
+	if options.Mirror {
+		fmt.Println("Mirroring traffic: callers are still served by the workload, local responses are discarded")
+	}
+
+	if err := deploy.CreateEnvFile(service, config, options.ContainerName); err != nil {
 		fmt.Println(utils.Colorize(fmt.Sprintf("warning: could not create env file: %v", err), utils.Yellow))
 	}
 }
@@ -168,7 +235,7 @@ func HelperStatus(config cfg.Config) {
 	}
 	fmt.Println("Active debug sessions:")
 	for _, session := range sessions {
-		fmt.Printf("  - %s (intercept port %d)\n", session.Context.ServiceName, session.Context.InterceptPort)
+		fmt.Printf("  - %s (intercept port %s)\n", session.Context.ServiceName, formatInterceptPorts(session.Context))
 	}
 }
 
@@ -354,10 +421,16 @@ func startHelperProcess(config cfg.Config) error {
 		return err
 	}
 
-	args := make([]string, 0, 2)
+	args := make([]string, 0, 6)
 	if trimmedKubeConfig := strings.TrimSpace(config.KubeConfig); trimmedKubeConfig != "" {
 		args = append(args, "--kubeconfig", trimmedKubeConfig)
 	}
+	if resolver := strings.TrimSpace(config.Resolver); resolver != "" {
+		args = append(args, "--resolver", resolver)
+	}
+	if proxyAddress := strings.TrimSpace(config.Proxy); proxyAddress != "" {
+		args = append(args, "--proxy", proxyAddress)
+	}
 
 	if err := startElevatedProcess(helperBinaryPath, args); err != nil {
 		return fmt.Errorf("failed to start helper: %w", err)
@@ -493,6 +566,19 @@ func helperListSessions() ([]contracts.HelperDebugSession, error) {
 	return listResponse.Sessions, nil
 }
 
+// formatInterceptPorts lists the local ports of a session, naming the
+// container port each one serves when there are several.
+func formatInterceptPorts(ctx contracts.DebugServiceContext) string {
+	if len(ctx.Ports) < 2 {
+		return strconv.Itoa(ctx.InterceptPort)
+	}
+	parts := make([]string, 0, len(ctx.Ports))
+	for _, port := range ctx.Ports {
+		parts = append(parts, fmt.Sprintf("%d (container port %d)", port.InterceptPort, port.ContainerPort))
+	}
+	return strings.Join(parts, ", ")
+}
+
 func buildDebugServiceContext(service cfg.Service) contracts.DebugServiceContext {
 	dependencies := make([]contracts.DebugServiceDependencyContext, 0, len(service.ServiceDependencies))
 	for _, dependency := range service.ServiceDependencies {
@@ -502,15 +588,27 @@ func buildDebugServiceContext(service cfg.Service) contracts.DebugServiceContext
 			Service:   dependency.Service,
 			Port:      dependency.Port,
 			Aliases:   dependency.Aliases,
+			Pod:       dependency.Pod,
+			Protocol:  dependency.Protocol,
+		})
+	}
+
+	var ports []contracts.DebugServicePortContext
+	for _, port := range service.Ports {
+		ports = append(ports, contracts.DebugServicePortContext{
+			ContainerPort: port.ContainerPort,
+			InterceptPort: port.InterceptPort,
 		})
 	}
 
 	return contracts.DebugServiceContext{
-		Project:             service.Project,
-		ServiceName:         service.Name,
-		Namespace:           service.Namespace,
-		ContainerPort:       service.ContainerPort,
-		InterceptPort:       service.InterceptPort,
-		ServiceDependencies: dependencies,
+		Project:              service.Project,
+		ServiceName:          service.Name,
+		Namespace:            service.Namespace,
+		ContainerPort:        service.ContainerPort,
+		InterceptPort:        service.InterceptPort,
+		InterceptHoldSeconds: service.InterceptHoldSeconds,
+		Ports:                ports,
+		ServiceDependencies:  dependencies,
 	}
 }
@@ -0,0 +1,284 @@
+// Package streamcodec reads and writes stream envelopes on a session
+// websocket. Peers negotiate the format through the websocket subprotocol:
+// SubprotocolBinary sends each envelope as one binary message with a
+// compact header followed by the raw payload, while connections without a
+// negotiated subprotocol (older agents, helpers and managers) keep using
+// one JSON text message per envelope with base64-encoded data.
+//
+// Binary message layout:
+//
+//	byte     format version (binaryVersion)
+//	byte     envelope type code; 0 is followed by the type as a string
+//	string   session id
+//	string   session token
+//	string   connection id
+//	string   message
+//	uvarint  metadata entry count, then key and value strings per entry
+//	uvarint  window
+//	uvarint  seq
+//	...      data, up to the end of the message
+//
+// Strings are a uvarint byte length followed by the bytes.
+package streamcodec
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SubprotocolBinary = "krun.stream.binary.v1"
+	SubprotocolJSON   = "krun.stream.json.v1"
+
+	binaryVersion = 1
+	customType    = 0
+)
+
+// Subprotocols lists the supported formats in order of preference, for
+// both the dialer's offer and the manager's upgrader.
+var Subprotocols = []string{SubprotocolBinary, SubprotocolJSON}
+
+var errMalformed = errors.New("malformed binary envelope")
+
+// readBuffers hold whole binary messages while they are decoded, so reads
+// do not regrow a fresh buffer for every message.
+var readBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// typeCodes keeps the header of the common envelope types to one byte.
+// Codes are part of the wire format: never renumber, only append.
+var typeCodes = map[string]byte{
+	contracts.StreamTypeOpen:       1,
+	contracts.StreamTypeOpenAck:    2,
+	contracts.StreamTypeData:       3,
+	contracts.StreamTypeCloseWrite: 4,
+	contracts.StreamTypeClose:      5,
+	contracts.StreamTypeError:      6,
+	contracts.StreamTypePing:       7,
+	contracts.StreamTypeLease:      8,
+	contracts.StreamTypeSuperseded: 9,
+	contracts.StreamTypeWindow:     10,
+	contracts.StreamTypeAttach:     11,
+	contracts.StreamTypeAttached:   12,
+	contracts.StreamTypeDetach:     13,
+	contracts.StreamTypeResume:     14,
+	contracts.StreamTypeResumed:    15,
+	contracts.StreamTypeHold:       16,
+	contracts.StreamTypeRelease:    17,
+}
+
+var typeNames = func() map[byte]string {
+	names := make(map[byte]string, len(typeCodes))
+	for name, code := range typeCodes {
+		names[code] = name
+	}
+	return names
+}()
+
+// Dial opens a session stream, offering every supported format.
+func Dial(ctx context.Context, url string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = Subprotocols
+	return dialer.DialContext(ctx, url, header)
+}
+
+// Write sends one envelope in the format negotiated for conn.
+func Write(conn *websocket.Conn, envelope contracts.StreamEnvelope) error {
+	if conn.Subprotocol() != SubprotocolBinary {
+		return conn.WriteJSON(envelope)
+	}
+
+	writer, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(AppendHeader(make([]byte, 0, headerSizeHint(envelope)), envelope)); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	if len(envelope.Data) > 0 {
+		if _, err := writer.Write(envelope.Data); err != nil {
+			_ = writer.Close()
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// Read receives one envelope. Binary and text messages are both accepted
+// whatever was negotiated, so either side may fall back to JSON.
+func Read(conn *websocket.Conn) (contracts.StreamEnvelope, error) {
+	messageType, reader, err := conn.NextReader()
+	if err != nil {
+		return contracts.StreamEnvelope{}, err
+	}
+
+	var envelope contracts.StreamEnvelope
+	if messageType != websocket.BinaryMessage {
+		err := json.NewDecoder(reader).Decode(&envelope)
+		if errors.Is(err, io.EOF) {
+			// Match websocket.Conn.ReadJSON: an empty message is not a
+			// closed stream.
+			err = io.ErrUnexpectedEOF
+		}
+		return envelope, err
+	}
+
+	buffer := readBuffers.Get().(*bytes.Buffer)
+	defer readBuffers.Put(buffer)
+	buffer.Reset()
+	if _, err := buffer.ReadFrom(reader); err != nil {
+		return contracts.StreamEnvelope{}, err
+	}
+	envelope, err = Unmarshal(buffer.Bytes())
+	if err != nil {
+		return contracts.StreamEnvelope{}, err
+	}
+	// The buffer is reused; the envelope outlives this call.
+	envelope.Data = bytes.Clone(envelope.Data)
+	return envelope, nil
+}
+
+// Marshal encodes an envelope as a binary message.
+func Marshal(envelope contracts.StreamEnvelope) []byte {
+	message := AppendHeader(make([]byte, 0, headerSizeHint(envelope)+len(envelope.Data)), envelope)
+	return append(message, envelope.Data...)
+}
+
+// AppendHeader appends everything but the data of a binary message.
+func AppendHeader(buffer []byte, envelope contracts.StreamEnvelope) []byte {
+	buffer = append(buffer, binaryVersion)
+	if code, ok := typeCodes[envelope.Type]; ok {
+		buffer = append(buffer, code)
+	} else {
+		buffer = append(buffer, customType)
+		buffer = appendString(buffer, envelope.Type)
+	}
+	buffer = appendString(buffer, envelope.SessionID)
+	buffer = appendString(buffer, envelope.SessionToken)
+	buffer = appendString(buffer, envelope.ConnectionID)
+	buffer = appendString(buffer, envelope.Message)
+	buffer = binary.AppendUvarint(buffer, uint64(len(envelope.Metadata)))
+	for key, value := range envelope.Metadata {
+		buffer = appendString(buffer, key)
+		buffer = appendString(buffer, value)
+	}
+	buffer = binary.AppendUvarint(buffer, uint64(max(envelope.Window, 0)))
+	return binary.AppendUvarint(buffer, envelope.Seq)
+}
+
+// Unmarshal decodes a binary message. The envelope's data aliases message.
+func Unmarshal(message []byte) (contracts.StreamEnvelope, error) {
+	decoder := binaryDecoder{buffer: message}
+	version := decoder.byte()
+	if decoder.err == nil && version != binaryVersion {
+		return contracts.StreamEnvelope{}, fmt.Errorf("unsupported binary envelope version %d", version)
+	}
+
+	var envelope contracts.StreamEnvelope
+	code := decoder.byte()
+	if code == customType {
+		envelope.Type = decoder.string()
+	} else if name, ok := typeNames[code]; ok {
+		envelope.Type = name
+	} else if decoder.err == nil {
+		return contracts.StreamEnvelope{}, fmt.Errorf("%w: unknown type code %d", errMalformed, code)
+	}
+	envelope.SessionID = decoder.string()
+	envelope.SessionToken = decoder.string()
+	envelope.ConnectionID = decoder.string()
+	envelope.Message = decoder.string()
+	if count := decoder.uvarint(); count > 0 {
+		if count > uint64(len(decoder.buffer)) {
+			return contracts.StreamEnvelope{}, errMalformed
+		}
+		envelope.Metadata = make(map[string]string, count)
+		for range count {
+			key := decoder.string()
+			envelope.Metadata[key] = decoder.string()
+		}
+	}
+	window := decoder.uvarint()
+	if window > math.MaxInt32 {
+		return contracts.StreamEnvelope{}, fmt.Errorf("%w: window %d out of range", errMalformed, window)
+	}
+	envelope.Window = int(window)
+	envelope.Seq = decoder.uvarint()
+	if decoder.err != nil {
+		return contracts.StreamEnvelope{}, decoder.err
+	}
+	if len(decoder.buffer) > 0 {
+		envelope.Data = decoder.buffer
+	}
+	return envelope, nil
+}
+
+func headerSizeHint(envelope contracts.StreamEnvelope) int {
+	size := 16 + len(envelope.SessionID) + len(envelope.SessionToken) + len(envelope.ConnectionID) + len(envelope.Message)
+	for key, value := range envelope.Metadata {
+		size += 4 + len(key) + len(value)
+	}
+	return size
+}
+
+func appendString(buffer []byte, value string) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+type binaryDecoder struct {
+	buffer []byte
+	err    error
+}
+
+func (d *binaryDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buffer) == 0 {
+		d.err = errMalformed
+		return 0
+	}
+	value := d.buffer[0]
+	d.buffer = d.buffer[1:]
+	return value
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	value, size := binary.Uvarint(d.buffer)
+	if size <= 0 {
+		d.err = errMalformed
+		return 0
+	}
+	d.buffer = d.buffer[size:]
+	return value
+}
+
+func (d *binaryDecoder) string() string {
+	length := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if length > uint64(len(d.buffer)) {
+		d.err = errMalformed
+		return ""
+	}
+	value := string(d.buffer[:length])
+	d.buffer = d.buffer[length:]
+	return value
+}
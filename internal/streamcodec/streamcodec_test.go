@@ -0,0 +1,191 @@
+package streamcodec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/gorilla/websocket"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	envelopes := []contracts.StreamEnvelope{
+		{
+			Type:         contracts.StreamTypeOpen,
+			SessionID:    "sess_a",
+			SessionToken: "token",
+			ConnectionID: "conn-1",
+			Metadata:     map[string]string{"remote_addr": "10.0.0.1:1234", "mode": "mirror"},
+		},
+		{Type: contracts.StreamTypeData, SessionID: "sess_a", ConnectionID: "conn-1", Data: []byte{0, 1, 2, 0xff}},
+		{Type: contracts.StreamTypeOpenAck, SessionID: "sess_a", ConnectionID: "conn-1", Window: 512 * 1024},
+		{Type: contracts.StreamTypeWindow, SessionID: "sess_a", ConnectionID: "conn-1", Window: 128 * 1024, Seq: 42},
+		{Type: contracts.StreamTypeResume, SessionID: "sess_a", ConnectionID: "conn-1", Window: 1 << 30, Seq: 1 << 40},
+		{Type: contracts.StreamTypeError, SessionID: "sess_a", ConnectionID: "conn-1", Message: "dial local: refused"},
+		{Type: contracts.StreamTypeHold, SessionID: "sess_a", ConnectionID: "conn-1"},
+		{Type: contracts.StreamTypeRelease, SessionID: "sess_a"},
+		{Type: "future-type", SessionID: "sess_a"},
+		{},
+	}
+	for _, envelope := range envelopes {
+		decoded, err := Unmarshal(Marshal(envelope))
+		if err != nil {
+			t.Fatalf("unmarshal %+v: %v", envelope, err)
+		}
+		if !reflect.DeepEqual(decoded, envelope) {
+			t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", decoded, envelope)
+		}
+	}
+
+	for envelopeType, code := range map[string]byte{contracts.StreamTypeHold: 16, contracts.StreamTypeRelease: 17} {
+		if message := Marshal(contracts.StreamEnvelope{Type: envelopeType}); message[1] != code {
+			t.Fatalf("expected %s to be sent as code %d, got %d", envelopeType, code, message[1])
+		}
+	}
+}
+
+func TestUnmarshalRejectsMalformedMessages(t *testing.T) {
+	valid := Marshal(contracts.StreamEnvelope{
+		Type:      contracts.StreamTypeOpen,
+		SessionID: "sess_a",
+		Metadata:  map[string]string{"k": "v"},
+	})
+	// Every strict prefix of the header is truncated.
+	for length := range len(valid) {
+		if _, err := Unmarshal(valid[:length]); err == nil {
+			t.Fatalf("expected error for %d-byte prefix", length)
+		}
+	}
+	if _, err := Unmarshal([]byte{binaryVersion + 1, 1}); err == nil {
+		t.Fatal("expected error for unknown version")
+	}
+	if _, err := Unmarshal([]byte{binaryVersion, 200, 0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Fatal("expected error for unknown type code")
+	}
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	received := make(chan contracts.StreamEnvelope, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: Subprotocols}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		envelope, err := Read(conn)
+		if err != nil {
+			return
+		}
+		received <- envelope
+		_ = Write(conn, envelope)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	payload := contracts.StreamEnvelope{Type: contracts.StreamTypeData, ConnectionID: "c1", Data: []byte("hello")}
+
+	t.Run("binary", func(t *testing.T) {
+		conn, _, err := Dial(context.Background(), url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		if conn.Subprotocol() != SubprotocolBinary {
+			t.Fatalf("expected binary subprotocol, got %q", conn.Subprotocol())
+		}
+		if err := Write(conn, payload); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if got := <-received; !bytes.Equal(got.Data, payload.Data) {
+			t.Fatalf("server got %+v", got)
+		}
+		messageType, message, err := conn.ReadMessage()
+		if err != nil || messageType != websocket.BinaryMessage {
+			t.Fatalf("expected binary echo, got type=%d err=%v", messageType, err)
+		}
+		if echoed, err := Unmarshal(message); err != nil || !bytes.Equal(echoed.Data, payload.Data) {
+			t.Fatalf("unexpected echo %+v err=%v", echoed, err)
+		}
+	})
+
+	t.Run("legacy json", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		if conn.Subprotocol() != "" {
+			t.Fatalf("expected no subprotocol, got %q", conn.Subprotocol())
+		}
+		if err := conn.WriteJSON(payload); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if got := <-received; !bytes.Equal(got.Data, payload.Data) {
+			t.Fatalf("server got %+v", got)
+		}
+		var echoed contracts.StreamEnvelope
+		if err := conn.ReadJSON(&echoed); err != nil || !bytes.Equal(echoed.Data, payload.Data) {
+			t.Fatalf("expected json echo, got %+v err=%v", echoed, err)
+		}
+	})
+}
+
+func benchmarkEnvelope() contracts.StreamEnvelope {
+	return contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeData,
+		SessionID:    "sess_0123456789abcdef",
+		ConnectionID: "conn-0123456789",
+		Data:         bytes.Repeat([]byte{0xa5}, 32*1024),
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	envelope := benchmarkEnvelope()
+	b.SetBytes(int64(len(envelope.Data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := json.Marshal(envelope); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeBinary(b *testing.B) {
+	envelope := benchmarkEnvelope()
+	b.SetBytes(int64(len(envelope.Data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		Marshal(envelope)
+	}
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	envelope := benchmarkEnvelope()
+	message, _ := json.Marshal(envelope)
+	b.SetBytes(int64(len(envelope.Data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		var decoded contracts.StreamEnvelope
+		if err := json.Unmarshal(message, &decoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeBinary(b *testing.B) {
+	envelope := benchmarkEnvelope()
+	message := Marshal(envelope)
+	b.SetBytes(int64(len(envelope.Data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := Unmarshal(message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -3,40 +3,148 @@
 // fully torn down once both its read side (local EOF observed) and write
 // side (peer sent close-write) are closed, so protocols where one end
 // half-closes and then waits for a response keep working.
+//
+// Writes to a connection are queued and performed by a goroutine of its
+// own, so a local side that stops reading (a caller that went away, an app
+// paused on a breakpoint) only stalls its own connection and never the
+// session stream that delivers data for all of them.
+//
+// Flow-controlled connections also survive a stream reconnect. Their data
+// is numbered and kept until the peer acknowledges it; when the stream
+// drops they are suspended instead of closed, and once both sides are back
+// they exchange what they received and replay the rest.
 package streamconn
 
 import (
+	"errors"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
+const (
+	// DefaultWindow is the receive window each side advertises for a
+	// connection: the bytes it buffers for the local side before the peer
+	// has to wait for credit.
+	DefaultWindow = 512 * 1024
+	// creditThreshold batches window updates, so a stream of small writes
+	// does not answer every data envelope with a window envelope.
+	creditThreshold = DefaultWindow / 4
+	// maxQueuedBytes bounds what is buffered for a connection whose peer
+	// does not do flow control. A local side that falls that far behind
+	// gets its connection closed instead of growing the queue further.
+	maxQueuedBytes = 4 * DefaultWindow
+	// ResumeTimeout is how long a suspended connection waits for its
+	// stream to come back before it is closed.
+	ResumeTimeout = 30 * time.Second
+)
+
+var (
+	ErrWriteQueueFull    = errors.New("connection write queue is full")
+	ErrUnknownConnection = errors.New("unknown connection")
+)
+
+// Chunk is one piece of a connection's outbound byte stream: data read
+// from the local side, or the close-write that ends it. Seq numbers the
+// chunks of a flow-controlled connection and is zero otherwise.
+type Chunk struct {
+	Seq        uint64
+	Data       []byte
+	CloseWrite bool
+}
+
+// Hooks report what the writer goroutines did, so the owner of the
+// registry can send the matching envelopes to the peer. They run on the
+// connection's writer goroutine, or on the caller's for a queue overflow.
+type Hooks struct {
+	// Send delivers a chunk to the peer, in order per connection. It runs
+	// on the goroutine of SendData, SendCloseWrite or Resume.
+	Send func(connectionID string, chunk Chunk) error
+	// Resume sends the connection's resume state to the peer: received is
+	// the last chunk taken from the peer and credited the credit granted
+	// in total. reply marks the answer to a resume of the peer.
+	Resume func(connectionID string, reply bool, received uint64, credited int)
+	// Credit hands written bytes back to the peer of a flow-controlled
+	// connection as a window update, acknowledging the chunks received up
+	// to received.
+	Credit func(connectionID string, bytes int, received uint64)
+	// Closed reports a connection whose queued close-write completed its
+	// teardown; the owner emits the final close envelope.
+	Closed func(connectionID string)
+	// Failed reports a connection whose write failed or whose queue
+	// overflowed. It has already been closed and removed.
+	Failed func(connectionID string, err error)
+}
+
 type Registry struct {
 	mu    sync.Mutex
 	conns map[string]*entry
+	hooks Hooks
+	// suspensions counts Suspend calls, so an expiry only closes the
+	// connections suspended by its own call.
+	suspensions   uint64
+	resumeTimeout time.Duration
 }
 
 type entry struct {
-	conn        net.Conn
+	conn   net.Conn
+	window *Window
+	// Guarded by Registry.mu.
 	readClosed  bool
 	writeClosed bool
+	suspended   bool
+	suspension  uint64
+
+	mu               sync.Mutex
+	pending          [][]byte
+	queued           int
+	closeWriteQueued bool
+	wake             chan struct{}
+	stopped          chan struct{}
+	stopOnce         sync.Once
+	// Inbound sequencing and credit, guarded by mu.
+	received           uint64
+	credited           int
+	unacknowledgedSize int
+
+	// sendMu keeps the chunks of the connection in order across senders
+	// and replays; replayMu guards the chunks the peer has yet to
+	// acknowledge, which the stream's reader prunes without waiting for a
+	// sender.
+	sendMu   sync.Mutex
+	sent     uint64
+	replayMu sync.Mutex
+	replay   []Chunk
 }
 
-func NewRegistry() *Registry {
+func NewRegistry(hooks Hooks) *Registry {
 	return &Registry{
-		conns: map[string]*entry{},
+		conns:         map[string]*entry{},
+		hooks:         hooks,
+		resumeTimeout: ResumeTimeout,
 	}
 }
 
 // Set registers a connection, closing any previous one under the same id.
-func (r *Registry) Set(connectionID string, conn net.Conn) {
+// window is the connection's send credit, or nil when the peer does not do
+// flow control; it is closed along with the connection. Only connections
+// with a window are numbered and can be resumed.
+func (r *Registry) Set(connectionID string, conn net.Conn, window *Window) {
+	e := &entry{
+		conn:    conn,
+		window:  window,
+		wake:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
 	r.mu.Lock()
 	previous, ok := r.conns[connectionID]
-	r.conns[connectionID] = &entry{conn: conn}
+	r.conns[connectionID] = e
 	r.mu.Unlock()
 	if ok {
-		_ = previous.conn.Close()
+		previous.close()
 	}
+	go r.runWriter(connectionID, e)
 }
 
 func (r *Registry) Get(connectionID string) net.Conn {
@@ -48,6 +156,79 @@ func (r *Registry) Get(connectionID string) net.Conn {
 	return nil
 }
 
+// SendData sends data read from the local side of a connection to the
+// peer. Data of a flow-controlled connection is kept until the peer
+// acknowledges it; while the connection is suspended it is only kept, and
+// goes out when the connection resumes.
+func (r *Registry) SendData(connectionID string, data []byte) error {
+	return r.send(connectionID, Chunk{Data: data})
+}
+
+// SendCloseWrite tells the peer the local side finished sending, in order
+// with the data before it.
+func (r *Registry) SendCloseWrite(connectionID string) error {
+	return r.send(connectionID, Chunk{CloseWrite: true})
+}
+
+func (r *Registry) send(connectionID string, chunk Chunk) error {
+	e := r.lookup(connectionID)
+	if e == nil {
+		return ErrUnknownConnection
+	}
+	e.sendMu.Lock()
+	defer e.sendMu.Unlock()
+	if e.window == nil {
+		return r.hooks.Send(connectionID, chunk)
+	}
+
+	e.sent++
+	chunk.Seq = e.sent
+	e.replayMu.Lock()
+	e.replay = append(e.replay, chunk)
+	e.replayMu.Unlock()
+
+	r.mu.Lock()
+	suspended := e.suspended
+	r.mu.Unlock()
+	if suspended {
+		return nil
+	}
+	return r.hooks.Send(connectionID, chunk)
+}
+
+// Write queues data for the local side of a connection. seq is the data's
+// sequence number, zero when unnumbered; replayed and out-of-order data is
+// dropped. Unknown ids and data after a close-write are ignored.
+func (r *Registry) Write(connectionID string, seq uint64, data []byte) {
+	e := r.lookup(connectionID)
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	if !e.acceptLocked(seq) || e.closeWriteQueued || len(data) == 0 {
+		e.mu.Unlock()
+		return
+	}
+	if e.queued+len(data) > maxQueuedBytes {
+		e.mu.Unlock()
+		r.fail(connectionID, e, ErrWriteQueueFull)
+		return
+	}
+	e.pending = append(e.pending, data)
+	e.queued += len(data)
+	e.mu.Unlock()
+	e.signal()
+}
+
+// Grant adds send credit from a window envelope of the peer and drops the
+// chunks it acknowledged.
+func (r *Registry) Grant(connectionID string, bytes int, acknowledged uint64) {
+	if e := r.lookup(connectionID); e != nil {
+		e.window.Grant(bytes)
+		e.acknowledge(acknowledged)
+	}
+}
+
 // MarkReadClosed records that the local read side hit EOF. It reports true
 // when the write side was already closed, in which case the connection has
 // been removed and closed and the caller should emit a final close envelope.
@@ -65,35 +246,118 @@ func (r *Registry) MarkReadClosed(connectionID string) bool {
 	}
 	delete(r.conns, connectionID)
 	r.mu.Unlock()
-	_ = e.conn.Close()
+	e.close()
 	return true
 }
 
-// CloseWriteHalf half-closes the write side after the peer sent close-write.
-// It reports true when the read side was already closed, in which case the
-// connection has been removed and closed and the caller should emit a final
-// close envelope.
-func (r *Registry) CloseWriteHalf(connectionID string) bool {
+// CloseWriteHalf queues a half-close of the write side after the peer sent
+// close-write with sequence number seq; data queued before it is still
+// written first. When the read side was already closed by then, the
+// connection is removed and closed and the Closed hook runs.
+func (r *Registry) CloseWriteHalf(connectionID string, seq uint64) {
+	e := r.lookup(connectionID)
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	if !e.acceptLocked(seq) {
+		e.mu.Unlock()
+		return
+	}
+	e.closeWriteQueued = true
+	e.mu.Unlock()
+	e.signal()
+}
+
+// Suspend holds the flow-controlled connections while the stream is down
+// and closes the others, which the peer cannot resume. A connection that
+// has not resumed within ResumeTimeout is closed without notice; the
+// manager tells the peer when it gives up on the connection.
+func (r *Registry) Suspend() {
 	r.mu.Lock()
-	e, ok := r.conns[connectionID]
-	if !ok {
-		r.mu.Unlock()
-		return false
+	r.suspensions++
+	suspension := r.suspensions
+	var dropped []*entry
+	for connectionID, e := range r.conns {
+		if e.window == nil {
+			delete(r.conns, connectionID)
+			dropped = append(dropped, e)
+			continue
+		}
+		if !e.suspended {
+			e.suspended = true
+			e.suspension = suspension
+		}
 	}
-	e.writeClosed = true
-	if e.readClosed {
-		delete(r.conns, connectionID)
-		r.mu.Unlock()
-		_ = e.conn.Close()
-		return true
+	r.mu.Unlock()
+
+	for _, e := range dropped {
+		e.close()
+	}
+	time.AfterFunc(r.resumeTimeout, func() { r.expire(suspension) })
+}
+
+// Reattach asks the peer to resume every suspended connection once the
+// stream is back. They stay suspended until the peer answers.
+func (r *Registry) Reattach() {
+	if r.hooks.Resume == nil {
+		return
+	}
+	r.mu.Lock()
+	suspended := map[string]*entry{}
+	for connectionID, e := range r.conns {
+		if e.suspended {
+			suspended[connectionID] = e
+		}
 	}
-	conn := e.conn
 	r.mu.Unlock()
 
-	if closeWriter, ok := conn.(interface{ CloseWrite() error }); ok {
-		_ = closeWriter.CloseWrite()
+	for connectionID, e := range suspended {
+		received, credited := e.resumeState()
+		r.hooks.Resume(connectionID, false, received, credited)
+	}
+}
+
+// Resume continues a connection after the peer sent its resume state:
+// peerReceived is the last chunk it took and peerCredited the credit it
+// granted in total. Chunks the peer missed are replayed. With reply set the
+// connection's own state goes back first, so the peer replays in turn.
+//
+// Resume waits for the connection's senders; it must not run on the
+// goroutine that drains the stream.
+func (r *Registry) Resume(connectionID string, peerReceived uint64, peerCredited int, reply bool) error {
+	e := r.lookup(connectionID)
+	if e == nil || e.window == nil {
+		return ErrUnknownConnection
 	}
-	return false
+	e.window.Resync(peerCredited)
+	if reply && r.hooks.Resume != nil {
+		received, credited := e.resumeState()
+		r.hooks.Resume(connectionID, true, received, credited)
+	}
+
+	e.sendMu.Lock()
+	defer e.sendMu.Unlock()
+	r.mu.Lock()
+	if r.conns[connectionID] == e {
+		e.suspended = false
+	}
+	r.mu.Unlock()
+
+	e.acknowledge(peerReceived)
+	e.replayMu.Lock()
+	missed := append([]Chunk(nil), e.replay...)
+	e.replayMu.Unlock()
+	for _, chunk := range missed {
+		if err := r.hooks.Send(connectionID, chunk); err != nil {
+			r.fail(connectionID, e, err)
+			return err
+		}
+	}
+	// Credit held back while suspended goes out now rather than with the
+	// next write, which may never come.
+	r.credit(connectionID, e, 0)
+	return nil
 }
 
 func (r *Registry) CloseAndDelete(connectionID string) {
@@ -107,7 +371,7 @@ func (r *Registry) CloseAndDelete(connectionID string) {
 	}
 	r.mu.Unlock()
 	if ok {
-		_ = e.conn.Close()
+		e.close()
 	}
 }
 
@@ -121,6 +385,177 @@ func (r *Registry) CloseAll() {
 	r.mu.Unlock()
 
 	for _, e := range entries {
-		_ = e.conn.Close()
+		e.close()
+	}
+}
+
+func (r *Registry) lookup(connectionID string) *entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[connectionID]
+}
+
+func (r *Registry) expire(suspension uint64) {
+	r.mu.Lock()
+	var expired []*entry
+	for connectionID, e := range r.conns {
+		if e.suspended && e.suspension == suspension {
+			delete(r.conns, connectionID)
+			expired = append(expired, e)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, e := range expired {
+		e.close()
+	}
+}
+
+// runWriter drains the connection's queue in order until the connection
+// is removed, a write fails or the queued close-write has been applied.
+func (r *Registry) runWriter(connectionID string, e *entry) {
+	for {
+		select {
+		case <-e.stopped:
+			return
+		case <-e.wake:
+		}
+		for {
+			e.mu.Lock()
+			if len(e.pending) == 0 {
+				closeWrite := e.closeWriteQueued
+				e.mu.Unlock()
+				if closeWrite {
+					r.finishCloseWrite(connectionID, e)
+					return
+				}
+				break
+			}
+			data := e.pending[0]
+			e.pending[0] = nil
+			e.pending = e.pending[1:]
+			e.mu.Unlock()
+
+			if _, err := e.conn.Write(data); err != nil {
+				r.fail(connectionID, e, err)
+				return
+			}
+
+			e.mu.Lock()
+			e.queued -= len(data)
+			e.mu.Unlock()
+			r.credit(connectionID, e, len(data))
+		}
 	}
 }
+
+func (r *Registry) finishCloseWrite(connectionID string, e *entry) {
+	r.mu.Lock()
+	if r.conns[connectionID] != e {
+		r.mu.Unlock()
+		return
+	}
+	e.writeClosed = true
+	if e.readClosed {
+		delete(r.conns, connectionID)
+		r.mu.Unlock()
+		e.close()
+		if r.hooks.Closed != nil {
+			r.hooks.Closed(connectionID)
+		}
+		return
+	}
+	r.mu.Unlock()
+
+	if closeWriter, ok := e.conn.(interface{ CloseWrite() error }); ok {
+		_ = closeWriter.CloseWrite()
+	}
+}
+
+// fail removes a connection after a write error, unless it was already
+// removed, in which case the error is the result of closing it.
+func (r *Registry) fail(connectionID string, e *entry, err error) {
+	r.mu.Lock()
+	if r.conns[connectionID] != e {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.conns, connectionID)
+	r.mu.Unlock()
+	e.close()
+	if r.hooks.Failed != nil {
+		r.hooks.Failed(connectionID, err)
+	}
+}
+
+// credit accounts written bytes and hands them back to the peer once
+// enough have accumulated. Credit is held back while the connection is
+// suspended, so the total a resume reports matches what went out.
+func (r *Registry) credit(connectionID string, e *entry, written int) {
+	if e.window == nil || r.hooks.Credit == nil {
+		return
+	}
+	r.mu.Lock()
+	suspended := e.suspended
+	r.mu.Unlock()
+
+	e.mu.Lock()
+	e.unacknowledgedSize += written
+	if suspended || e.unacknowledgedSize < creditThreshold {
+		e.mu.Unlock()
+		return
+	}
+	bytes, received := e.unacknowledgedSize, e.received
+	e.credited += bytes
+	e.unacknowledgedSize = 0
+	e.mu.Unlock()
+	r.hooks.Credit(connectionID, bytes, received)
+}
+
+// acceptLocked takes the next chunk from the peer. Unnumbered chunks are
+// always taken; numbered ones only in sequence, which drops replays of
+// chunks that arrived before the stream dropped.
+func (e *entry) acceptLocked(seq uint64) bool {
+	if seq == 0 {
+		return true
+	}
+	if seq != e.received+1 {
+		return false
+	}
+	e.received = seq
+	return true
+}
+
+func (e *entry) resumeState() (uint64, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.received, e.credited
+}
+
+// acknowledge drops the chunks the peer received, up to seq.
+func (e *entry) acknowledge(seq uint64) {
+	e.replayMu.Lock()
+	defer e.replayMu.Unlock()
+	acknowledged := 0
+	for acknowledged < len(e.replay) && e.replay[acknowledged].Seq <= seq {
+		acknowledged++
+	}
+	if acknowledged > 0 {
+		e.replay = append(e.replay[:0:0], e.replay[acknowledged:]...)
+	}
+}
+
+func (e *entry) signal() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *entry) close() {
+	e.stopOnce.Do(func() {
+		close(e.stopped)
+		e.window.Close()
+		_ = e.conn.Close()
+	})
+}
@@ -1,8 +1,11 @@
 package streamconn
 
 import (
+	"errors"
+	"io"
 	"net"
 	"testing"
+	"time"
 )
 
 func newPipeConn(t *testing.T) net.Conn {
@@ -15,9 +18,46 @@ func newPipeConn(t *testing.T) net.Conn {
 	return local
 }
 
+// newTCPPair returns both ends of a loopback TCP connection, which unlike
+// net.Pipe supports half-close.
+func newTCPPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = dialed.Close()
+		_ = accepted.Close()
+	})
+	return dialed, accepted
+}
+
+func waitFor[T any](t *testing.T, values <-chan T) T {
+	t.Helper()
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+		var zero T
+		return zero
+	}
+}
+
 func TestHalfCloseReadThenWrite(t *testing.T) {
-	registry := NewRegistry()
-	registry.Set("c1", newPipeConn(t))
+	closed := make(chan string, 1)
+	registry := NewRegistry(Hooks{Closed: func(connectionID string) { closed <- connectionID }})
+	registry.Set("c1", newPipeConn(t), nil)
 
 	if registry.MarkReadClosed("c1") {
 		t.Fatal("read close alone must not fully close the connection")
@@ -25,8 +65,9 @@ func TestHalfCloseReadThenWrite(t *testing.T) {
 	if registry.Get("c1") == nil {
 		t.Fatal("connection must stay registered after read close")
 	}
-	if !registry.CloseWriteHalf("c1") {
-		t.Fatal("write close after read close must fully close the connection")
+	registry.CloseWriteHalf("c1", 0)
+	if id := waitFor(t, closed); id != "c1" {
+		t.Fatalf("expected c1 to be reported closed, got %q", id)
 	}
 	if registry.Get("c1") != nil {
 		t.Fatal("connection must be removed once both directions are closed")
@@ -34,11 +75,16 @@ func TestHalfCloseReadThenWrite(t *testing.T) {
 }
 
 func TestHalfCloseWriteThenRead(t *testing.T) {
-	registry := NewRegistry()
-	registry.Set("c1", newPipeConn(t))
+	registry := NewRegistry(Hooks{})
+	conn, peer := newTCPPair(t)
+	registry.Set("c1", conn, nil)
 
-	if registry.CloseWriteHalf("c1") {
-		t.Fatal("write close alone must not fully close the connection")
+	registry.Write("c1", 0, []byte("request"))
+	registry.CloseWriteHalf("c1", 0)
+	// The peer sees the queued data, then EOF once the half-close applied.
+	received, err := io.ReadAll(peer)
+	if err != nil || string(received) != "request" {
+		t.Fatalf("expected queued data before EOF, got %q err=%v", received, err)
 	}
 	if registry.Get("c1") == nil {
 		t.Fatal("connection must stay registered after write close")
@@ -51,21 +97,66 @@ func TestHalfCloseWriteThenRead(t *testing.T) {
 	}
 }
 
+func TestSlowConnectionDoesNotBlockWriter(t *testing.T) {
+	failed := make(chan error, 1)
+	registry := NewRegistry(Hooks{Failed: func(_ string, err error) { failed <- err }})
+	// Nobody reads the other end of the pipe.
+	registry.Set("stalled", newPipeConn(t), nil)
+	conn, peer := newTCPPair(t)
+	registry.Set("c2", conn, nil)
+
+	chunk := make([]byte, 64*1024)
+	for range maxQueuedBytes / len(chunk) {
+		registry.Write("stalled", 0, chunk)
+	}
+	registry.Write("c2", 0, []byte("ok"))
+	buffer := make([]byte, 2)
+	if _, err := io.ReadFull(peer, buffer); err != nil || string(buffer) != "ok" {
+		t.Fatalf("expected unrelated connection to keep flowing, got %q err=%v", buffer, err)
+	}
+
+	// Without flow control the stalled queue is bounded.
+	registry.Write("stalled", 0, chunk)
+	if err := waitFor(t, failed); !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatalf("expected queue overflow, got %v", err)
+	}
+	if registry.Get("stalled") != nil {
+		t.Fatal("overflowing connection must be removed")
+	}
+}
+
+func TestWrittenBytesAreCredited(t *testing.T) {
+	credited := make(chan int, 4)
+	registry := NewRegistry(Hooks{Credit: func(_ string, bytes int, _ uint64) { credited <- bytes }})
+	conn, peer := newTCPPair(t)
+	registry.Set("c1", conn, NewWindow(DefaultWindow))
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+
+	registry.Write("c1", 0, make([]byte, creditThreshold-1))
+	registry.Write("c1", 0, make([]byte, 1))
+	if bytes := waitFor(t, credited); bytes != creditThreshold {
+		t.Fatalf("expected one batched credit of %d bytes, got %d", creditThreshold, bytes)
+	}
+}
+
 func TestUnknownConnectionIsNoop(t *testing.T) {
-	registry := NewRegistry()
-	if registry.MarkReadClosed("missing") || registry.CloseWriteHalf("missing") {
+	registry := NewRegistry(Hooks{})
+	if registry.MarkReadClosed("missing") {
 		t.Fatal("unknown connection ids must report not-fully-closed")
 	}
+	registry.CloseWriteHalf("missing", 0)
+	registry.Write("missing", 0, []byte("x"))
+	registry.Grant("missing", 1, 1)
 	registry.CloseAndDelete("missing")
 }
 
 func TestSetReplacesPreviousConnection(t *testing.T) {
-	registry := NewRegistry()
+	registry := NewRegistry(Hooks{})
 	first := newPipeConn(t)
 	second := newPipeConn(t)
 
-	registry.Set("c1", first)
-	registry.Set("c1", second)
+	registry.Set("c1", first, nil)
+	registry.Set("c1", second, nil)
 
 	if registry.Get("c1") != second {
 		t.Fatal("expected replacement connection to be registered")
@@ -74,3 +165,90 @@ func TestSetReplacesPreviousConnection(t *testing.T) {
 		t.Fatal("expected previous connection to be closed")
 	}
 }
+
+func TestNumberedDataIsWrittenInOrderOnce(t *testing.T) {
+	registry := NewRegistry(Hooks{})
+	conn, peer := newTCPPair(t)
+	registry.Set("c1", conn, NewWindow(DefaultWindow))
+
+	registry.Write("c1", 1, []byte("a"))
+	registry.Write("c1", 1, []byte("a"))
+	registry.Write("c1", 3, []byte("c"))
+	registry.Write("c1", 2, []byte("b"))
+	registry.CloseWriteHalf("c1", 3)
+
+	received, err := io.ReadAll(peer)
+	if err != nil || string(received) != "ab" {
+		t.Fatalf("expected replays and gaps dropped, got %q err=%v", received, err)
+	}
+}
+
+func TestSuspendedConnectionReplaysOnResume(t *testing.T) {
+	sent := make(chan Chunk, 8)
+	resumes := make(chan uint64, 1)
+	registry := NewRegistry(Hooks{
+		Send: func(_ string, chunk Chunk) error {
+			sent <- chunk
+			return nil
+		},
+		Resume: func(_ string, _ bool, received uint64, _ int) { resumes <- received },
+	})
+	registry.Set("legacy", newPipeConn(t), nil)
+	registry.Set("c1", newPipeConn(t), NewWindow(DefaultWindow))
+
+	if err := registry.SendData("c1", []byte("one")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if chunk := waitFor(t, sent); chunk.Seq != 1 || string(chunk.Data) != "one" {
+		t.Fatalf("expected the first numbered chunk, got %+v", chunk)
+	}
+
+	registry.Suspend()
+	if registry.Get("legacy") != nil {
+		t.Fatal("connections without flow control cannot resume and must be closed")
+	}
+	if err := registry.SendData("c1", []byte("two")); err != nil {
+		t.Fatalf("send while suspended: %v", err)
+	}
+	if err := registry.SendCloseWrite("c1"); err != nil {
+		t.Fatalf("close-write while suspended: %v", err)
+	}
+	select {
+	case chunk := <-sent:
+		t.Fatalf("suspended connection must hold its data, sent %+v", chunk)
+	default:
+	}
+
+	registry.Reattach()
+	if received := waitFor(t, resumes); received != 0 {
+		t.Fatalf("expected resume state with nothing received, got %d", received)
+	}
+	// The peer received the first chunk before the stream dropped.
+	if err := registry.Resume("c1", 1, 0, false); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if chunk := waitFor(t, sent); chunk.Seq != 2 || string(chunk.Data) != "two" {
+		t.Fatalf("expected the missed data replayed, got %+v", chunk)
+	}
+	if chunk := waitFor(t, sent); chunk.Seq != 3 || !chunk.CloseWrite {
+		t.Fatalf("expected the missed close-write replayed, got %+v", chunk)
+	}
+}
+
+func TestSuspendedConnectionExpires(t *testing.T) {
+	registry := NewRegistry(Hooks{Send: func(string, Chunk) error { return nil }})
+	registry.resumeTimeout = 20 * time.Millisecond
+	registry.Set("c1", newPipeConn(t), NewWindow(DefaultWindow))
+
+	registry.Suspend()
+	deadline := time.Now().Add(2 * time.Second)
+	for registry.Get("c1") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the suspended connection to be closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := registry.Resume("c1", 0, 0, true); !errors.Is(err, ErrUnknownConnection) {
+		t.Fatalf("expected an expired connection to be unknown, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package streamconn
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrWindowClosed = errors.New("connection closed")
+
+// Window is the send credit of a flow-controlled connection: how many more
+// bytes the peer is willing to buffer for its local side. The reader of
+// the connection acquires credit before each read, so a peer that stops
+// draining one connection pauses only that connection's reader.
+//
+// A nil Window stands for a peer without flow control and never blocks.
+type Window struct {
+	mu     sync.Mutex
+	credit int
+	// granted totals the credit the peer handed out after the initial
+	// window, so a resume can recover updates lost with the stream.
+	granted int
+	closed  bool
+	changed chan struct{}
+}
+
+func NewWindow(initial int) *Window {
+	return &Window{
+		credit:  initial,
+		changed: make(chan struct{}),
+	}
+}
+
+// Acquire waits for credit and returns how much may be sent, at most
+// limit. It fails once the window is closed or ctx ends.
+func (w *Window) Acquire(ctx context.Context, limit int) (int, error) {
+	if w == nil {
+		return limit, nil
+	}
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return 0, ErrWindowClosed
+		}
+		if w.credit > 0 {
+			available := min(w.credit, limit)
+			w.mu.Unlock()
+			return available, nil
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Consume spends credit for bytes that were sent.
+func (w *Window) Consume(bytes int) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.credit -= bytes
+	w.mu.Unlock()
+}
+
+// Grant adds credit from a window update of the peer.
+func (w *Window) Grant(bytes int) {
+	if w == nil || bytes <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.credit += bytes
+	w.granted += bytes
+	w.notifyLocked()
+}
+
+// Resync catches up with the credit the peer says it granted in total,
+// adding whatever window updates went missing.
+func (w *Window) Resync(total int) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if total <= w.granted {
+		return
+	}
+	w.credit += total - w.granted
+	w.granted = total
+	w.notifyLocked()
+}
+
+// Close releases a reader blocked in Acquire.
+func (w *Window) Close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		w.notifyLocked()
+	}
+}
+
+func (w *Window) notifyLocked() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
@@ -0,0 +1,65 @@
+package streamconn
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWindowBlocksUntilGranted(t *testing.T) {
+	window := NewWindow(10)
+	if available, err := window.Acquire(context.Background(), 64); err != nil || available != 10 {
+		t.Fatalf("expected the initial credit, got %d err=%v", available, err)
+	}
+	window.Consume(10)
+
+	acquired := make(chan int, 1)
+	go func() {
+		available, _ := window.Acquire(context.Background(), 64)
+		acquired <- available
+	}()
+	select {
+	case available := <-acquired:
+		t.Fatalf("acquire must wait for credit, got %d", available)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	window.Grant(100)
+	if available := waitFor(t, acquired); available != 64 {
+		t.Fatalf("expected credit capped at the limit, got %d", available)
+	}
+}
+
+func TestWindowCloseReleasesReader(t *testing.T) {
+	window := NewWindow(0)
+	done := make(chan error, 1)
+	go func() {
+		_, err := window.Acquire(context.Background(), 1)
+		done <- err
+	}()
+	window.Close()
+	if err := waitFor(t, done); !errors.Is(err, ErrWindowClosed) {
+		t.Fatalf("expected closed window, got %v", err)
+	}
+}
+
+func TestNilWindowNeverBlocks(t *testing.T) {
+	var window *Window
+	if available, err := window.Acquire(context.Background(), 32); err != nil || available != 32 {
+		t.Fatalf("expected the full limit, got %d err=%v", available, err)
+	}
+	window.Consume(32)
+	window.Grant(32)
+	window.Close()
+}
+
+func TestWindowResyncAddsMissedCredit(t *testing.T) {
+	window := NewWindow(0)
+	window.Grant(10)
+	window.Resync(25)
+	window.Resync(5)
+	if available, err := window.Acquire(context.Background(), 64); err != nil || available != 25 {
+		t.Fatalf("expected the missed 15 bytes added once, got %d err=%v", available, err)
+	}
+}
@@ -0,0 +1,276 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/intercept"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ephemeralEnv tells the traffic-agent it runs as an ephemeral container:
+// it picks its own listen ports, serves no probes, and exits once its
+// session is released.
+const ephemeralEnv = "KRUN_AGENT_EPHEMERAL"
+
+// EphemeralInjector attaches the traffic-agent to the running pods of a
+// workload as an ephemeral container, one per session, so nothing
+// restarts. Each new agent puts its redirect rules first and so takes
+// every connection of the pod: it serves the routes of the pod's other
+// live sessions too, and the older agents stay idle behind it. Ephemeral
+// containers cannot be removed again: the manager releases the agent over
+// its stream instead, and the agent takes its redirect rules down and
+// exits once all its sessions are released. Probes are left alone, and
+// pods started after the session was created are not intercepted.
+type EphemeralInjector struct {
+	workloads *WorkloadInjector
+	// release asks the agents of a session to stand down.
+	release func(sessionID string)
+
+	mu sync.Mutex
+	// released holds the sessions whose agents were told to exit but may
+	// still be running; injecting such a session again starts new ones.
+	released map[string]bool
+}
+
+func NewEphemeralInjector(client kubernetes.Interface, options Options, release func(sessionID string)) *EphemeralInjector {
+	return &EphemeralInjector{
+		workloads: NewWorkloadInjector(client, options),
+		release:   release,
+		released:  map[string]bool{},
+	}
+}
+
+func (i *EphemeralInjector) Inject(ctx context.Context, session contracts.DebugSession) error {
+	namespace, workload, err := resolveTarget(session)
+	if err != nil {
+		return err
+	}
+	pods, err := i.runningPods(ctx, namespace, workload)
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return fmt.Errorf("no running pods of %s/%s to attach the traffic-agent to", namespace, workload)
+	}
+
+	route := sessionRoute(session)
+	i.mu.Lock()
+	fresh := i.released[session.SessionID]
+	delete(i.released, session.SessionID)
+	i.mu.Unlock()
+
+	// The registry already superseded the sessions serving the same route;
+	// their agents still hold the pods' ports until released, and the new
+	// agent leaves their routes out.
+	superseded := map[string]bool{}
+	for _, pod := range pods {
+		for _, existing := range runningEphemeralRoutes(pod, i.workloads.options.ContainerName) {
+			if existing.SessionID != route.SessionID && existing.Mirror == route.Mirror &&
+				intercept.EqualHeaders(existing.Headers, route.Headers) {
+				superseded[existing.SessionID] = true
+			}
+		}
+	}
+	i.mu.Lock()
+	for sessionID := range superseded {
+		i.released[sessionID] = true
+	}
+	i.mu.Unlock()
+
+	var errs []error
+	for _, pod := range pods {
+		route := i.workloads.withOpaquePorts(ctx, session, pod.Spec, route)
+		if err := i.attach(ctx, namespace, pod.Name, session, route, fresh); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for sessionID := range superseded {
+		i.release(sessionID)
+	}
+	return errors.Join(errs...)
+}
+
+// Remove releases the session's agents. Their containers stay in the pod
+// spec, terminated, until the pod goes.
+func (i *EphemeralInjector) Remove(_ context.Context, session contracts.DebugSession) error {
+	if _, _, err := resolveTarget(session); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	i.released[session.SessionID] = true
+	i.mu.Unlock()
+	i.release(session.SessionID)
+	return nil
+}
+
+// Reconcile keeps the sessions a running agent still serves in at least
+// one pod, be it their own or a newer one that took their route over.
+// Agents of forgotten sessions exit on their own: the manager refuses
+// their reconnect.
+func (i *EphemeralInjector) Reconcile(ctx context.Context, sessions []contracts.DebugSession) ([]contracts.DebugSession, error) {
+	var kept []contracts.DebugSession
+	var errs []error
+	for _, debugSession := range sessions {
+		namespace, workload, err := resolveTarget(debugSession)
+		if err != nil {
+			continue
+		}
+		pods, err := i.runningPods(ctx, namespace, workload)
+		if err != nil {
+			if !errors.Is(err, ErrWorkloadNotFound) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		for _, pod := range pods {
+			served := slices.ContainsFunc(runningEphemeralRoutes(pod, i.workloads.options.ContainerName), func(route contracts.InterceptRoute) bool {
+				return route.SessionID == debugSession.SessionID
+			})
+			if served {
+				kept = append(kept, debugSession)
+				break
+			}
+		}
+	}
+	return kept, errors.Join(errs...)
+}
+
+// runningPods lists the live pods the workload selects.
+func (i *EphemeralInjector) runningPods(ctx context.Context, namespace string, workload string) ([]corev1.Pod, error) {
+	target, err := i.workloads.findWorkloadTarget(ctx, namespace, workload)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := i.workloads.selectPods(ctx, target, namespace, workload)
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]corev1.Pod, 0, len(candidates))
+	for _, pod := range candidates {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// attach adds the session's agent to a pod unless one runs there already.
+// A fresh agent is added regardless, next to the released one on its way
+// out.
+func (i *EphemeralInjector) attach(
+	ctx context.Context,
+	namespace string,
+	podName string,
+	session contracts.DebugSession,
+	route contracts.InterceptRoute,
+	fresh bool,
+) error {
+	prefix := ephemeralContainerPrefix(i.workloads.options.ContainerName, session.SessionID)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err := i.workloads.client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("get pod %s/%s: %w", namespace, podName, err)
+		}
+		if !fresh && len(runningEphemeralContainers(*pod, prefix)) > 0 {
+			return nil
+		}
+		attempt := 0
+		for _, existing := range pod.Spec.EphemeralContainers {
+			if strings.HasPrefix(existing.Name, prefix) {
+				attempt++
+			}
+		}
+		container := i.buildContainer(session, i.podRoutes(*pod, route), prefix+strconv.Itoa(attempt))
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, container)
+		_, err = i.workloads.client.CoreV1().Pods(namespace).UpdateEphemeralContainers(ctx, podName, pod, metav1.UpdateOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("attach traffic-agent to pod %s/%s: %w", namespace, podName, err)
+		}
+		return nil
+	})
+}
+
+// podRoutes is the route of the session together with the routes the
+// pod's running agents serve for sessions that were not released.
+func (i *EphemeralInjector) podRoutes(pod corev1.Pod, route contracts.InterceptRoute) []contracts.InterceptRoute {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var routes []contracts.InterceptRoute
+	for _, existing := range runningEphemeralRoutes(pod, i.workloads.options.ContainerName) {
+		if !i.released[existing.SessionID] {
+			routes = mergeRoute(routes, existing)
+		}
+	}
+	return mergeRoute(routes, route)
+}
+
+// buildContainer is the sidecar container serving routes, made ephemeral.
+// An ephemeral agent joins a running pod, after its init containers, so it
+// always installs its redirect rules itself.
+func (i *EphemeralInjector) buildContainer(session contracts.DebugSession, routes []contracts.InterceptRoute, name string) corev1.EphemeralContainer {
+	sidecar := i.workloads.buildContainer(session, routes)
+	env := slices.DeleteFunc(sidecar.Env, func(envVar corev1.EnvVar) bool {
+		return envVar.Name == agentRedirectEnv
+	})
+	return corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:            name,
+			Image:           sidecar.Image,
+			ImagePullPolicy: sidecar.ImagePullPolicy,
+			Env:             append(env, corev1.EnvVar{Name: ephemeralEnv, Value: "true"}),
+			SecurityContext: redirectingSecurityContext(),
+		},
+	}
+}
+
+// ephemeralContainerPrefix starts the names of the agents of one session,
+// which are numbered: names of ephemeral containers cannot be reused
+// within a pod. Session ids of declared sessions need not be valid
+// container names, hence the hash.
+func ephemeralContainerPrefix(containerName string, sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return containerName + "-" + hex.EncodeToString(sum[:4]) + "-"
+}
+
+// runningEphemeralContainers returns the ephemeral containers of a pod
+// whose names start with prefix and that run or are about to; one that
+// terminated never comes back.
+func runningEphemeralContainers(pod corev1.Pod, prefix string) []corev1.EphemeralContainer {
+	terminated := map[string]bool{}
+	for _, status := range pod.Status.EphemeralContainerStatuses {
+		terminated[status.Name] = status.State.Terminated != nil
+	}
+	var running []corev1.EphemeralContainer
+	for _, container := range pod.Spec.EphemeralContainers {
+		if strings.HasPrefix(container.Name, prefix) && !terminated[container.Name] {
+			running = append(running, container)
+		}
+	}
+	return running
+}
+
+// runningEphemeralRoutes returns the routes of the agents that still run in
+// a pod as ephemeral containers.
+func runningEphemeralRoutes(pod corev1.Pod, containerName string) []contracts.InterceptRoute {
+	var routes []contracts.InterceptRoute
+	for _, container := range runningEphemeralContainers(pod, containerName+"-") {
+		routes = append(routes, readRoutes(corev1.Container{Env: container.Env})...)
+	}
+	return routes
+}
@@ -0,0 +1,274 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEphemeralInjectorAttachesAgentToRunningPods(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newTestDeployment("default", "orders-api"),
+		newTestPod("default", "orders-api-1", "orders-api", corev1.PodRunning),
+		newTestPod("default", "orders-api-2", "orders-api", corev1.PodPending),
+		newTestPod("default", "billing-api-1", "billing-api", corev1.PodRunning),
+	)
+	var released []string
+	injector := NewEphemeralInjector(client, Options{}, func(sessionID string) {
+		released = append(released, sessionID)
+	})
+	session := contracts.DebugSession{
+		SessionID:    "sess_1",
+		SessionToken: "token-1",
+		Namespace:    "default",
+		Workload:     "orders-api",
+		ServicePort:  8080,
+		Injection:    contracts.SessionInjectionEphemeral,
+	}
+
+	if err := injector.Inject(context.Background(), session); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	// Injecting again while the agent runs adds nothing.
+	if err := injector.Inject(context.Background(), session); err != nil {
+		t.Fatalf("re-inject: %v", err)
+	}
+
+	agents := getEphemeralContainers(t, client, "default", "orders-api-1")
+	if len(agents) != 1 {
+		t.Fatalf("expected one agent in the running pod, got %+v", agents)
+	}
+	env := map[string]string{}
+	for _, envVar := range agents[0].Env {
+		env[envVar.Name] = envVar.Value
+	}
+	if env[sessionIDEnv] != "sess_1" || env["KRUN_TARGET_PORT"] != "8080" || env[ephemeralEnv] != "true" {
+		t.Fatalf("unexpected agent env: %v", env)
+	}
+	if agents[0].SecurityContext == nil || !slices.Contains(agents[0].SecurityContext.Capabilities.Add, "NET_ADMIN") {
+		t.Fatalf("expected the agent to be allowed to install redirect rules, got %+v", agents[0].SecurityContext)
+	}
+	if len(getEphemeralContainers(t, client, "default", "orders-api-2")) != 0 ||
+		len(getEphemeralContainers(t, client, "default", "billing-api-1")) != 0 {
+		t.Fatal("expected only running pods of the workload to get an agent")
+	}
+	if containers := getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api"); len(containers) != 1 {
+		t.Fatalf("expected the pod template untouched, got %d containers", len(containers))
+	}
+
+	if err := injector.Remove(context.Background(), session); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if !slices.Equal(released, []string{"sess_1"}) {
+		t.Fatalf("expected the session's agents to be released, got %v", released)
+	}
+	// The released agent may still be on its way out; a new one replaces it.
+	if err := injector.Inject(context.Background(), session); err != nil {
+		t.Fatalf("inject after remove: %v", err)
+	}
+	agents = getEphemeralContainers(t, client, "default", "orders-api-1")
+	if len(agents) != 2 || agents[0].Name == agents[1].Name {
+		t.Fatalf("expected a second agent next to the released one, got %+v", agents)
+	}
+}
+
+func TestEphemeralInjectorInstallsRulesInInitRedirectMode(t *testing.T) {
+	injector := NewEphemeralInjector(fake.NewSimpleClientset(), Options{InitRedirect: true}, nil)
+	agent := injector.buildContainer(contracts.DebugSession{
+		SessionID:   "sess_1",
+		Namespace:   "default",
+		Workload:    "orders-api",
+		ServicePort: 8080,
+	}, []contracts.InterceptRoute{{SessionID: "sess_1"}}, "krun-traffic-agent-0")
+
+	if value := envValue(agent.Env, agentRedirectEnv); value != "" {
+		t.Fatalf("expected the ephemeral agent to install its own rules, got %s=%q", agentRedirectEnv, value)
+	}
+	if agent.SecurityContext == nil || !slices.Contains(agent.SecurityContext.Capabilities.Add, "NET_ADMIN") {
+		t.Fatalf("expected the ephemeral agent to keep NET_ADMIN, got %+v", agent.SecurityContext)
+	}
+}
+
+func TestEphemeralInjectorReleasesSupersededAgents(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newTestDeployment("default", "orders-api"),
+		newTestPod("default", "orders-api-1", "orders-api", corev1.PodRunning),
+	)
+	var released []string
+	injector := NewEphemeralInjector(client, Options{}, func(sessionID string) {
+		released = append(released, sessionID)
+	})
+	newSession := func(sessionID string, headers map[string]string) contracts.DebugSession {
+		return contracts.DebugSession{
+			SessionID:        sessionID,
+			Namespace:        "default",
+			Workload:         "orders-api",
+			ServicePort:      8080,
+			InterceptHeaders: headers,
+			Injection:        contracts.SessionInjectionEphemeral,
+		}
+	}
+
+	for _, session := range []contracts.DebugSession{
+		newSession("sess_old", nil),
+		newSession("sess_header", map[string]string{"X-Dev": "bob"}),
+		newSession("sess_new", nil),
+	} {
+		if err := injector.Inject(context.Background(), session); err != nil {
+			t.Fatalf("inject %s: %v", session.SessionID, err)
+		}
+	}
+
+	if !slices.Equal(released, []string{"sess_old"}) {
+		t.Fatalf("expected only the agent serving the same route to be released, got %v", released)
+	}
+	agents := getEphemeralContainers(t, client, "default", "orders-api-1")
+	if len(agents) != 3 {
+		t.Fatalf("expected three agents, got %d", len(agents))
+	}
+	var sessionIDs []string
+	for _, route := range readRoutes(corev1.Container{Env: agents[2].Env}) {
+		sessionIDs = append(sessionIDs, route.SessionID)
+	}
+	if !slices.Equal(sessionIDs, []string{"sess_header", "sess_new"}) {
+		t.Fatalf("expected the newest agent to leave the superseded route out, got %v", sessionIDs)
+	}
+}
+
+func TestEphemeralInjectorSharesPodBetweenHeaderSessions(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newTestDeployment("default", "orders-api"),
+		newTestPod("default", "orders-api-1", "orders-api", corev1.PodRunning),
+	)
+	var released []string
+	injector := NewEphemeralInjector(client, Options{}, func(sessionID string) {
+		released = append(released, sessionID)
+	})
+	alice := contracts.DebugSession{
+		SessionID:        "sess_alice",
+		SessionToken:     "token-alice",
+		Namespace:        "default",
+		Workload:         "orders-api",
+		ServicePort:      8080,
+		InterceptHeaders: map[string]string{"X-Dev": "alice"},
+		Injection:        contracts.SessionInjectionEphemeral,
+	}
+	bob := alice
+	bob.SessionID = "sess_bob"
+	bob.SessionToken = "token-bob"
+	bob.ServicePort = 9090
+	bob.InterceptHeaders = map[string]string{"X-Dev": "bob"}
+
+	for _, session := range []contracts.DebugSession{alice, bob} {
+		if err := injector.Inject(context.Background(), session); err != nil {
+			t.Fatalf("inject %s: %v", session.SessionID, err)
+		}
+	}
+
+	if len(released) != 0 {
+		t.Fatalf("expected no session released, got %v", released)
+	}
+	agents := getEphemeralContainers(t, client, "default", "orders-api-1")
+	if len(agents) != 2 {
+		t.Fatalf("expected an agent per session, got %d", len(agents))
+	}
+	// The newest agent redirects first and so takes every connection; it
+	// routes alice's requests too, on the port her agent served.
+	routes := map[string]contracts.InterceptRoute{}
+	for _, route := range readRoutes(corev1.Container{Env: agents[1].Env}) {
+		routes[route.SessionID] = route
+	}
+	if len(routes) != 2 {
+		t.Fatalf("expected the newest agent to serve both sessions, got %+v", routes)
+	}
+	if route := routes["sess_alice"]; route.SessionToken != "token-alice" || route.Headers["X-Dev"] != "alice" || !slices.Equal(route.Ports, []int{8080}) {
+		t.Fatalf("unexpected route for alice: %+v", route)
+	}
+	if route := routes["sess_bob"]; route.SessionToken != "token-bob" || route.Headers["X-Dev"] != "bob" || !slices.Equal(route.Ports, []int{9090}) {
+		t.Fatalf("unexpected route for bob: %+v", route)
+	}
+
+	// Alice's session lives on in bob's agent after her own agent exits.
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "orders-api-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get pod: %v", err)
+	}
+	pod.Status.EphemeralContainerStatuses = []corev1.ContainerStatus{
+		{Name: agents[0].Name, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}},
+	}
+	if _, err := client.CoreV1().Pods("default").UpdateStatus(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update pod status: %v", err)
+	}
+	kept, err := injector.Reconcile(context.Background(), []contracts.DebugSession{alice, bob})
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if len(kept) != 2 {
+		t.Fatalf("expected both sessions kept, got %+v", kept)
+	}
+}
+
+func TestEphemeralInjectorReconcileKeepsRunningAgents(t *testing.T) {
+	pod := newTestPod("default", "orders-api-1", "orders-api", corev1.PodRunning)
+	running := ephemeralContainerPrefix(DefaultContainerName, "sess_running") + "0"
+	exited := ephemeralContainerPrefix(DefaultContainerName, "sess_exited") + "0"
+	for name, sessionID := range map[string]string{running: "sess_running", exited: "sess_exited"} {
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+				Name: name,
+				Env:  []corev1.EnvVar{{Name: sessionIDEnv, Value: sessionID}},
+			},
+		})
+	}
+	pod.Status.EphemeralContainerStatuses = []corev1.ContainerStatus{
+		{Name: running, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+		{Name: exited, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}},
+	}
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"), pod)
+	injector := NewEphemeralInjector(client, Options{}, func(string) {})
+
+	var sessions []contracts.DebugSession
+	for _, sessionID := range []string{"sess_running", "sess_exited", "sess_never"} {
+		sessions = append(sessions, contracts.DebugSession{
+			SessionID: sessionID,
+			Namespace: "default",
+			Workload:  "orders-api",
+			Injection: contracts.SessionInjectionEphemeral,
+		})
+	}
+	kept, err := injector.Reconcile(context.Background(), sessions)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if len(kept) != 1 || kept[0].SessionID != "sess_running" {
+		t.Fatalf("expected only the session with a running agent kept, got %+v", kept)
+	}
+}
+
+func newTestPod(namespace string, name string, app string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{"app": app},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "app:latest"}},
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+}
+
+func getEphemeralContainers(t *testing.T, client *fake.Clientset, namespace string, name string) []corev1.EphemeralContainer {
+	t.Helper()
+	pod, err := client.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get pod: %v", err)
+	}
+	return pod.Spec.EphemeralContainers
+}
@@ -6,14 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/intercept"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
 )
@@ -27,8 +30,19 @@ const (
 	InjectedLabelKey       = "krun.ftechmax.net/traffic-agent-injected"
 	injectedLabelValue     = "true"
 	// OriginalProbesAnnotation stores the pre-rewrite probe specs so
-	// Remove/Cleanup can restore them when the sidecar is taken out.
+	// Remove/Reconcile can restore them when the sidecar is taken out.
 	OriginalProbesAnnotation = "krun.ftechmax.net/original-probes"
+
+	sessionIDEnv        = "KRUN_SESSION_ID"
+	targetPortEnv       = "KRUN_TARGET_PORT"
+	agentRedirectEnv    = "KRUN_AGENT_REDIRECT"
+	agentDiagnosticsEnv = "KRUN_AGENT_DIAGNOSTICS"
+	agentStrategyEnv    = "KRUN_AGENT_INTERCEPT_STRATEGY"
+	// initContainerSuffix names the init container that installs the
+	// redirect rules in init-redirect mode.
+	initContainerSuffix = "-init"
+	sessionTokenEnv     = "KRUN_SESSION_TOKEN"
+	interceptRoutesEnv  = "KRUN_INTERCEPT_ROUTES"
 )
 
 var ErrWorkloadNotFound = errors.New("target workload not found")
@@ -36,7 +50,10 @@ var ErrWorkloadNotFound = errors.New("target workload not found")
 type Injector interface {
 	Inject(ctx context.Context, session contracts.DebugSession) error
 	Remove(ctx context.Context, session contracts.DebugSession) error
-	Cleanup(ctx context.Context) error
+	// Reconcile runs at manager startup. It keeps the sidecar routes of the
+	// given (restored) sessions, strips every other route and returns the
+	// sessions that are still served by a sidecar.
+	Reconcile(ctx context.Context, sessions []contracts.DebugSession) ([]contracts.DebugSession, error)
 }
 
 type NoopInjector struct{}
@@ -49,8 +66,57 @@ func (NoopInjector) Remove(context.Context, contracts.DebugSession) error {
 	return nil
 }
 
-func (NoopInjector) Cleanup(context.Context) error {
-	return nil
+func (NoopInjector) Reconcile(_ context.Context, sessions []contracts.DebugSession) ([]contracts.DebugSession, error) {
+	return sessions, nil
+}
+
+// SessionInjector hands every session to the injector its injection asks
+// for.
+type SessionInjector struct {
+	Sidecar   Injector
+	Ephemeral Injector
+}
+
+func (s SessionInjector) Inject(ctx context.Context, session contracts.DebugSession) error {
+	return s.pick(session).Inject(ctx, session)
+}
+
+func (s SessionInjector) Remove(ctx context.Context, session contracts.DebugSession) error {
+	return s.pick(session).Remove(ctx, session)
+}
+
+// Reconcile lets each injector reconcile its own sessions only: the
+// sidecar injector strips the routes of every session it is not given.
+func (s SessionInjector) Reconcile(ctx context.Context, sessions []contracts.DebugSession) ([]contracts.DebugSession, error) {
+	var sidecar, ephemeral []contracts.DebugSession
+	for _, debugSession := range sessions {
+		if intercept.IsEphemeral(debugSession.Injection) {
+			ephemeral = append(ephemeral, debugSession)
+		} else {
+			sidecar = append(sidecar, debugSession)
+		}
+	}
+	keptSidecar, sidecarErr := s.Sidecar.Reconcile(ctx, sidecar)
+	keptEphemeral, ephemeralErr := s.Ephemeral.Reconcile(ctx, ephemeral)
+
+	served := map[string]bool{}
+	for _, debugSession := range slices.Concat(keptSidecar, keptEphemeral) {
+		served[debugSession.SessionID] = true
+	}
+	kept := make([]contracts.DebugSession, 0, len(served))
+	for _, debugSession := range sessions {
+		if served[debugSession.SessionID] {
+			kept = append(kept, debugSession)
+		}
+	}
+	return kept, errors.Join(sidecarErr, ephemeralErr)
+}
+
+func (s SessionInjector) pick(session contracts.DebugSession) Injector {
+	if intercept.IsEphemeral(session.Injection) {
+		return s.Ephemeral
+	}
+	return s.Sidecar
 }
 
 type Options struct {
@@ -59,6 +125,15 @@ type Options struct {
 	ImagePullPolicy string
 	ManagerAddress  string
 	ProbePort       int
+	// InitRedirect has an init container install the redirect rules, so
+	// the long-running agent runs as non-root without capabilities.
+	InitRedirect bool
+	// Diagnostics has the agents log their redirect backend's rules and
+	// counters.
+	Diagnostics bool
+	// Dynamic reaches workload kinds that come from CRDs, such as Argo
+	// Rollouts. Without it those kinds are never found.
+	Dynamic dynamic.Interface
 }
 
 type WorkloadInjector struct {
@@ -72,11 +147,29 @@ const (
 	workloadKindDeployment  workloadKind = "deployment"
 	workloadKindStatefulSet workloadKind = "statefulset"
 	workloadKindDaemonSet   workloadKind = "daemonset"
+	workloadKindRollout     workloadKind = "rollout"
+	workloadKindReplicaSet  workloadKind = "replicaset"
+	workloadKindCronJob     workloadKind = "cronjob"
+	workloadKindJob         workloadKind = "job"
+	workloadKindPod         workloadKind = "pod"
 )
 
+// workloadKinds are tried in order when a session names a workload.
+var workloadKinds = []workloadKind{
+	workloadKindDeployment,
+	workloadKindStatefulSet,
+	workloadKindDaemonSet,
+	workloadKindRollout,
+	workloadKindReplicaSet,
+	workloadKindCronJob,
+	workloadKindJob,
+	workloadKindPod,
+}
+
 type workloadTarget struct {
 	kind     workloadKind
 	object   metav1.Object
+	selector *metav1.LabelSelector
 	template *corev1.PodTemplateSpec
 	update   func(ctx context.Context) error
 }
@@ -94,12 +187,29 @@ func (i *WorkloadInjector) Inject(ctx context.Context, session contracts.DebugSe
 		return err
 	}
 
-	desiredContainer := i.buildContainer(session)
-	return i.mutateWorkload(ctx, namespace, workload, i.findWorkloadTarget, "with traffic-agent sidecar", func(target *workloadTarget) bool {
+	route := sessionRoute(session)
+	findTarget := i.findWorkloadTarget
+	if session.SingleReplica {
+		// The sidecar goes into a one-pod clone; the workload's own
+		// replicas are left untouched.
+		if _, err := i.ensureReplica(ctx, namespace, workload); err != nil {
+			return err
+		}
+		workload = ReplicaName(workload)
+		findTarget = i.findReplicaTarget
+	}
+	return i.mutateWorkload(ctx, namespace, workload, findTarget, "with traffic-agent sidecar", func(target *workloadTarget) bool {
 		changed := false
 
 		updated := append([]corev1.Container(nil), target.template.Spec.Containers...)
 		index := findContainerIndex(updated, i.options.ContainerName)
+		// Sessions with different intercept headers share one sidecar, so
+		// merge into the routes the running agent already serves.
+		var routes []contracts.InterceptRoute
+		if index >= 0 {
+			routes = readRoutes(updated[index])
+		}
+		desiredContainer := i.buildContainer(session, mergeRoute(routes, i.withOpaquePorts(ctx, session, target.template.Spec, route)))
 		if index >= 0 {
 			if !reflect.DeepEqual(updated[index], desiredContainer) {
 				updated[index] = desiredContainer
@@ -111,11 +221,15 @@ func (i *WorkloadInjector) Inject(ctx context.Context, session contracts.DebugSe
 			changed = true
 		}
 
+		if i.syncInitContainer(target.template) {
+			changed = true
+		}
+
 		if ensureInjectedLabel(target.object) {
 			changed = true
 		}
 
-		if i.rewriteProbes(target, session.ServicePort) {
+		if i.rewriteProbes(target, intercept.SessionPorts(session)) {
 			changed = true
 		}
 
@@ -124,52 +238,74 @@ func (i *WorkloadInjector) Inject(ctx context.Context, session contracts.DebugSe
 }
 
 func (i *WorkloadInjector) Remove(ctx context.Context, session contracts.DebugSession) error {
-	namespace, workload, err := resolveTarget(session)
+	namespace, workload, err := resolveInjectedTarget(session)
 	if err != nil {
 		return err
 	}
+	findTarget := i.findWorkloadTarget
+	if session.SingleReplica {
+		findTarget = i.findReplicaTarget
+	}
 
-	return i.mutateWorkload(ctx, namespace, workload, i.findWorkloadTarget, "removing traffic-agent sidecar", func(target *workloadTarget) bool {
-		filtered := make([]corev1.Container, 0, len(target.template.Spec.Containers))
-		removed := false
-		for _, container := range target.template.Spec.Containers {
-			if container.Name == i.options.ContainerName {
-				removed = true
-				continue
+	drained := false
+	err = i.mutateWorkload(ctx, namespace, workload, findTarget, "removing traffic-agent sidecar", func(target *workloadTarget) bool {
+		drained = false
+		// Other sessions still routed through the sidecar keep it alive;
+		// only this session's route is dropped.
+		index := findContainerIndex(target.template.Spec.Containers, i.options.ContainerName)
+		if index >= 0 {
+			routes := readRoutes(target.template.Spec.Containers[index])
+			remaining := slices.DeleteFunc(slices.Clone(routes), func(route contracts.InterceptRoute) bool {
+				return route.SessionID == session.SessionID
+			})
+			if len(remaining) > 0 {
+				if len(remaining) == len(routes) {
+					return false
+				}
+				updated := append([]corev1.Container(nil), target.template.Spec.Containers...)
+				updated[index] = withRoutes(updated[index], remaining)
+				target.template.Spec.Containers = updated
+				i.syncInitContainer(target.template)
+				return true
 			}
-			filtered = append(filtered, container)
 		}
-		changed := false
-		if removed {
-			target.template.Spec.Containers = filtered
-			changed = true
-		}
-		if removeInjectedLabel(target.object) {
-			changed = true
-		}
-		if restoreProbes(target) {
-			changed = true
-		}
-		return changed
+		return i.releaseSidecar(target, &drained)
 	})
+	if err == nil && drained {
+		return i.deleteReplica(ctx, namespace, workload)
+	}
+	return err
 }
 
-func (i *WorkloadInjector) Cleanup(ctx context.Context) error {
-	kinds := []workloadKind{
-		workloadKindDeployment,
-		workloadKindStatefulSet,
-		workloadKindDaemonSet,
+func (i *WorkloadInjector) Reconcile(ctx context.Context, sessions []contracts.DebugSession) ([]contracts.DebugSession, error) {
+	known := make(map[string]contracts.DebugSession, len(sessions))
+	for _, debugSession := range sessions {
+		known[debugSession.SessionID] = debugSession
 	}
+
+	served := map[string]bool{}
 	var errs []error
-	for _, kind := range kinds {
-		if err := i.cleanupLabeledByKind(ctx, kind); err != nil {
+	for _, kind := range workloadKinds {
+		if err := i.reconcileLabeledByKind(ctx, kind, known, served); err != nil {
 			errs = append(errs, err)
 		}
 	}
-	return errors.Join(errs...)
+
+	kept := make([]contracts.DebugSession, 0, len(served))
+	for _, debugSession := range sessions {
+		if served[debugSession.SessionID] {
+			kept = append(kept, debugSession)
+		}
+	}
+	return kept, errors.Join(errs...)
 }
 
-func (i *WorkloadInjector) cleanupLabeledByKind(ctx context.Context, kind workloadKind) error {
+func (i *WorkloadInjector) reconcileLabeledByKind(
+	ctx context.Context,
+	kind workloadKind,
+	known map[string]contracts.DebugSession,
+	served map[string]bool,
+) error {
 	targets, err := i.listLabeledWorkloadsByKind(ctx, kind)
 	if err != nil {
 		return err
@@ -177,6 +313,10 @@ func (i *WorkloadInjector) cleanupLabeledByKind(ctx context.Context, kind worklo
 
 	var errs []error
 	for _, target := range targets {
+		// The mutation may be retried on conflict, so only the routes of the
+		// attempt that was actually written count as served.
+		var keptIDs []string
+		drained := false
 		err := i.mutateWorkload(
 			ctx,
 			target.namespace,
@@ -184,18 +324,87 @@ func (i *WorkloadInjector) cleanupLabeledByKind(ctx context.Context, kind worklo
 			func(ctx context.Context, namespace string, workload string) (*workloadTarget, error) {
 				return i.findWorkloadTargetByKind(ctx, kind, namespace, workload)
 			},
-			"removing traffic-agent sidecar during startup cleanup",
+			"reconciling traffic-agent sidecar during startup",
 			func(target *workloadTarget) bool {
-				return i.removeInjectedSidecarAndAnnotation(target)
+				keptIDs = nil
+				drained = false
+				index := findContainerIndex(target.template.Spec.Containers, i.options.ContainerName)
+				if index < 0 {
+					return i.releaseSidecar(target, &drained)
+				}
+				routes := readRoutes(target.template.Spec.Containers[index])
+				kept := slices.DeleteFunc(slices.Clone(routes), func(route contracts.InterceptRoute) bool {
+					return !routeBelongsTo(route, known, target.object)
+				})
+				if len(kept) == 0 {
+					return i.releaseSidecar(target, &drained)
+				}
+				for _, route := range kept {
+					keptIDs = append(keptIDs, route.SessionID)
+				}
+				sidecar := target.template.Spec.Containers[index]
+				if len(kept) != len(routes) {
+					sidecar = withRoutes(sidecar, kept)
+				}
+				// A manager restarted with the other redirect mode moves the
+				// sidecar over.
+				sidecar = i.withRedirectMode(sidecar)
+				changed := !reflect.DeepEqual(sidecar, target.template.Spec.Containers[index])
+				if changed {
+					updated := append([]corev1.Container(nil), target.template.Spec.Containers...)
+					updated[index] = sidecar
+					target.template.Spec.Containers = updated
+				}
+				if i.syncInitContainer(target.template) {
+					changed = true
+				}
+				return changed
 			},
 		)
-		if err != nil && !errors.Is(err, ErrWorkloadNotFound) {
-			errs = append(errs, err)
+		if err != nil {
+			if !errors.Is(err, ErrWorkloadNotFound) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if drained {
+			if err := i.deleteReplica(ctx, target.namespace, target.workload); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		for _, sessionID := range keptIDs {
+			served[sessionID] = true
 		}
 	}
 	return errors.Join(errs...)
 }
 
+// routeBelongsTo reports whether a sidecar route matches a known session
+// for the same workload and token.
+func routeBelongsTo(route contracts.InterceptRoute, known map[string]contracts.DebugSession, object metav1.Object) bool {
+	debugSession, ok := known[route.SessionID]
+	if !ok || debugSession.SessionToken != route.SessionToken {
+		return false
+	}
+	namespace, workload, err := resolveInjectedTarget(debugSession)
+	if err != nil {
+		return false
+	}
+	return namespace == object.GetNamespace() && workload == object.GetName()
+}
+
+// releaseSidecar takes the sidecar out of a workload none of whose routes
+// are left. A single-replica clone only exists for its sidecar, so it is
+// marked drained, to be deleted, instead.
+func (i *WorkloadInjector) releaseSidecar(target *workloadTarget, drained *bool) bool {
+	if isReplica(target.object) {
+		*drained = true
+		return false
+	}
+	return i.removeInjectedSidecarAndAnnotation(target)
+}
+
 func (i *WorkloadInjector) removeInjectedSidecarAndAnnotation(target *workloadTarget) bool {
 	filtered := make([]corev1.Container, 0, len(target.template.Spec.Containers))
 	removed := false
@@ -212,6 +421,9 @@ func (i *WorkloadInjector) removeInjectedSidecarAndAnnotation(target *workloadTa
 		target.template.Spec.Containers = filtered
 		changed = true
 	}
+	if i.syncInitContainer(target.template) {
+		changed = true
+	}
 	if removeInjectedLabel(target.object) {
 		changed = true
 	}
@@ -259,7 +471,50 @@ func (i *WorkloadInjector) listLabeledWorkloadsByKind(ctx context.Context, kind
 			workloads = append(workloads, workloadIdentifier{namespace: item.Namespace, workload: item.Name})
 		}
 		return workloads, nil
+	case workloadKindReplicaSet:
+		list, err := i.client.AppsV1().ReplicaSets(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("list %ss for startup cleanup: %w", kind, err)
+		}
+		workloads := make([]workloadIdentifier, 0, len(list.Items))
+		for _, item := range list.Items {
+			workloads = append(workloads, workloadIdentifier{namespace: item.Namespace, workload: item.Name})
+		}
+		return workloads, nil
+	case workloadKindCronJob:
+		list, err := i.client.BatchV1().CronJobs(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("list %ss for startup cleanup: %w", kind, err)
+		}
+		workloads := make([]workloadIdentifier, 0, len(list.Items))
+		for _, item := range list.Items {
+			workloads = append(workloads, workloadIdentifier{namespace: item.Namespace, workload: item.Name})
+		}
+		return workloads, nil
+	case workloadKindJob:
+		list, err := i.client.BatchV1().Jobs(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("list %ss for startup cleanup: %w", kind, err)
+		}
+		workloads := make([]workloadIdentifier, 0, len(list.Items))
+		for _, item := range list.Items {
+			workloads = append(workloads, workloadIdentifier{namespace: item.Namespace, workload: item.Name})
+		}
+		return workloads, nil
+	case workloadKindPod:
+		list, err := i.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("list %ss for startup cleanup: %w", kind, err)
+		}
+		workloads := make([]workloadIdentifier, 0, len(list.Items))
+		for _, item := range list.Items {
+			workloads = append(workloads, workloadIdentifier{namespace: item.Namespace, workload: item.Name})
+		}
+		return workloads, nil
 	default:
+		if custom, ok := findCustomWorkload(kind); ok {
+			return i.listLabeledCustomWorkloads(ctx, custom, opts)
+		}
 		return nil, fmt.Errorf("unsupported workload kind: %s", kind)
 	}
 }
@@ -296,12 +551,7 @@ func (i *WorkloadInjector) mutateWorkload(
 }
 
 func (i *WorkloadInjector) findWorkloadTarget(ctx context.Context, namespace string, workload string) (*workloadTarget, error) {
-	kinds := []workloadKind{
-		workloadKindDeployment,
-		workloadKindStatefulSet,
-		workloadKindDaemonSet,
-	}
-	for _, kind := range kinds {
+	for _, kind := range workloadKinds {
 		target, err := i.findWorkloadTargetByKind(ctx, kind, namespace, workload)
 		if err == nil {
 			return target, nil
@@ -322,6 +572,7 @@ func (i *WorkloadInjector) findWorkloadTargetByKind(ctx context.Context, kind wo
 			return &workloadTarget{
 				kind:     workloadKindDeployment,
 				object:   updated,
+				selector: updated.Spec.Selector,
 				template: &updated.Spec.Template,
 				update: func(ctx context.Context) error {
 					_, err := i.client.AppsV1().Deployments(namespace).Update(ctx, updated, metav1.UpdateOptions{})
@@ -340,6 +591,7 @@ func (i *WorkloadInjector) findWorkloadTargetByKind(ctx context.Context, kind wo
 			return &workloadTarget{
 				kind:     workloadKindStatefulSet,
 				object:   updated,
+				selector: updated.Spec.Selector,
 				template: &updated.Spec.Template,
 				update: func(ctx context.Context) error {
 					_, err := i.client.AppsV1().StatefulSets(namespace).Update(ctx, updated, metav1.UpdateOptions{})
@@ -358,6 +610,7 @@ func (i *WorkloadInjector) findWorkloadTargetByKind(ctx context.Context, kind wo
 			return &workloadTarget{
 				kind:     workloadKindDaemonSet,
 				object:   updated,
+				selector: updated.Spec.Selector,
 				template: &updated.Spec.Template,
 				update: func(ctx context.Context) error {
 					_, err := i.client.AppsV1().DaemonSets(namespace).Update(ctx, updated, metav1.UpdateOptions{})
@@ -369,32 +622,330 @@ func (i *WorkloadInjector) findWorkloadTargetByKind(ctx context.Context, kind wo
 			return nil, fmt.Errorf("%w: %s %s/%s", ErrWorkloadNotFound, kind, namespace, workload)
 		}
 		return nil, fmt.Errorf("get %s %s/%s: %w", kind, namespace, workload, err)
+	case workloadKindReplicaSet:
+		replicaSet, err := i.client.AppsV1().ReplicaSets(namespace).Get(ctx, workload, metav1.GetOptions{})
+		if err == nil {
+			updated := replicaSet.DeepCopy()
+			return &workloadTarget{
+				kind:     workloadKindReplicaSet,
+				object:   updated,
+				selector: updated.Spec.Selector,
+				template: &updated.Spec.Template,
+				update: func(ctx context.Context) error {
+					_, err := i.client.AppsV1().ReplicaSets(namespace).Update(ctx, updated, metav1.UpdateOptions{})
+					if err != nil {
+						return err
+					}
+					return i.replaceReplicaSetPods(ctx, namespace, workload, string(updated.UID), updated.Spec.Selector)
+				},
+			}, nil
+		}
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s %s/%s", ErrWorkloadNotFound, kind, namespace, workload)
+		}
+		return nil, fmt.Errorf("get %s %s/%s: %w", kind, namespace, workload, err)
+	case workloadKindCronJob:
+		// Only Jobs the CronJob starts from now on run with the change.
+		cronJob, err := i.client.BatchV1().CronJobs(namespace).Get(ctx, workload, metav1.GetOptions{})
+		if err == nil {
+			updated := cronJob.DeepCopy()
+			return &workloadTarget{
+				kind:     workloadKindCronJob,
+				object:   updated,
+				selector: updated.Spec.JobTemplate.Spec.Selector,
+				template: &updated.Spec.JobTemplate.Spec.Template,
+				update: func(ctx context.Context) error {
+					_, err := i.client.BatchV1().CronJobs(namespace).Update(ctx, updated, metav1.UpdateOptions{})
+					return err
+				},
+			}, nil
+		}
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s %s/%s", ErrWorkloadNotFound, kind, namespace, workload)
+		}
+		return nil, fmt.Errorf("get %s %s/%s: %w", kind, namespace, workload, err)
+	case workloadKindJob:
+		job, err := i.client.BatchV1().Jobs(namespace).Get(ctx, workload, metav1.GetOptions{})
+		if err == nil {
+			updated := job.DeepCopy()
+			return &workloadTarget{
+				kind:     workloadKindJob,
+				object:   updated,
+				selector: updated.Spec.Selector,
+				template: &updated.Spec.Template,
+				update: func(ctx context.Context) error {
+					return i.recreateJob(ctx, updated)
+				},
+			}, nil
+		}
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s %s/%s", ErrWorkloadNotFound, kind, namespace, workload)
+		}
+		return nil, fmt.Errorf("get %s %s/%s: %w", kind, namespace, workload, err)
+	case workloadKindPod:
+		pod, err := i.client.CoreV1().Pods(namespace).Get(ctx, workload, metav1.GetOptions{})
+		if err == nil {
+			// A Pod with a controller is replaced by it; target that instead.
+			if owner := metav1.GetControllerOf(pod); owner != nil {
+				return nil, fmt.Errorf("pod %s/%s is managed by %s %s; target it instead", namespace, workload, owner.Kind, owner.Name)
+			}
+			updated := pod.DeepCopy()
+			template := &corev1.PodTemplateSpec{Spec: updated.Spec}
+			return &workloadTarget{
+				kind:     workloadKindPod,
+				object:   updated,
+				template: template,
+				update: func(ctx context.Context) error {
+					return i.recreatePod(ctx, updated, template)
+				},
+			}, nil
+		}
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s %s/%s", ErrWorkloadNotFound, kind, namespace, workload)
+		}
+		return nil, fmt.Errorf("get %s %s/%s: %w", kind, namespace, workload, err)
 	default:
+		if custom, ok := findCustomWorkload(kind); ok {
+			return i.findCustomTarget(ctx, custom, namespace, workload)
+		}
 		return nil, fmt.Errorf("unsupported workload kind: %s", kind)
 	}
 }
 
-func (i *WorkloadInjector) buildContainer(session contracts.DebugSession) corev1.Container {
-	return corev1.Container{
+func (i *WorkloadInjector) buildContainer(session contracts.DebugSession, routes []contracts.InterceptRoute) corev1.Container {
+	container := corev1.Container{
 		Name:            i.options.ContainerName,
 		Image:           i.options.Image,
 		ImagePullPolicy: parsePullPolicy(i.options.ImagePullPolicy),
-		Env: []corev1.EnvVar{
-			{Name: "KRUN_SESSION_ID", Value: session.SessionID},
-			{Name: "KRUN_SESSION_TOKEN", Value: session.SessionToken},
+		Env: append(routeEnv(withTargetPort(routes, session.ServicePort)), []corev1.EnvVar{
 			{Name: "KRUN_MANAGER_ADDRESS", Value: i.options.ManagerAddress},
 			{Name: "KRUN_TARGET_NAMESPACE", Value: session.Namespace},
 			{Name: "KRUN_TARGET_WORKLOAD", Value: session.Workload},
-			{Name: "KRUN_TARGET_PORT", Value: strconv.Itoa(session.ServicePort)},
+			{Name: targetPortEnv, Value: strconv.Itoa(session.ServicePort)},
 			{Name: "KRUN_AGENT_PROBE_PORT", Value: strconv.Itoa(i.options.ProbePort)},
+		}...),
+	}
+	if i.options.Diagnostics {
+		container.Env = append(container.Env, corev1.EnvVar{Name: agentDiagnosticsEnv, Value: "true"})
+	}
+	if session.InterceptStrategy != "" {
+		container.Env = append(container.Env, corev1.EnvVar{Name: agentStrategyEnv, Value: session.InterceptStrategy})
+	}
+	return i.withRedirectMode(container)
+}
+
+// withRedirectMode sets the sidecar up for whoever installs the redirect
+// rules: the sidecar itself, or an init container.
+func (i *WorkloadInjector) withRedirectMode(container corev1.Container) corev1.Container {
+	container.Env = slices.DeleteFunc(slices.Clone(container.Env), func(envVar corev1.EnvVar) bool {
+		return envVar.Name == agentRedirectEnv
+	})
+	container.SecurityContext = redirectingSecurityContext()
+	if i.options.InitRedirect {
+		container.Env = append(container.Env, corev1.EnvVar{Name: agentRedirectEnv, Value: "external"})
+		container.SecurityContext = restrictedSecurityContext()
+	}
+	return container
+}
+
+// buildInitContainer runs the agent image once, before the sidecar, with
+// the sidecar's configuration to install its redirect rules.
+func (i *WorkloadInjector) buildInitContainer(sidecar corev1.Container) corev1.Container {
+	env := slices.DeleteFunc(slices.Clone(sidecar.Env), func(envVar corev1.EnvVar) bool {
+		return envVar.Name == agentRedirectEnv
+	})
+	return corev1.Container{
+		Name:            sidecar.Name + initContainerSuffix,
+		Image:           sidecar.Image,
+		ImagePullPolicy: sidecar.ImagePullPolicy,
+		Env:             append(env, corev1.EnvVar{Name: agentRedirectEnv, Value: "init"}),
+		SecurityContext: redirectingSecurityContext(),
+	}
+}
+
+// syncInitContainer makes the init container match the sidecar: there,
+// with the sidecar's routes, in init-redirect mode while the sidecar is,
+// and gone otherwise.
+func (i *WorkloadInjector) syncInitContainer(template *corev1.PodTemplateSpec) bool {
+	name := i.options.ContainerName + initContainerSuffix
+	index := findContainerIndex(template.Spec.InitContainers, name)
+	sidecar := findContainerIndex(template.Spec.Containers, i.options.ContainerName)
+	if sidecar < 0 || !i.options.InitRedirect {
+		if index < 0 {
+			return false
+		}
+		template.Spec.InitContainers = slices.Delete(slices.Clone(template.Spec.InitContainers), index, index+1)
+		if len(template.Spec.InitContainers) == 0 {
+			template.Spec.InitContainers = nil
+		}
+		return true
+	}
+
+	desired := i.buildInitContainer(template.Spec.Containers[sidecar])
+	if index < 0 {
+		template.Spec.InitContainers = append(slices.Clone(template.Spec.InitContainers), desired)
+		return true
+	}
+	if reflect.DeepEqual(template.Spec.InitContainers[index], desired) {
+		return false
+	}
+	updated := slices.Clone(template.Spec.InitContainers)
+	updated[index] = desired
+	template.Spec.InitContainers = updated
+	return true
+}
+
+// redirectingSecurityContext lets the agent install redirect rules in the
+// pod's network namespace.
+func redirectingSecurityContext() *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		RunAsUser: new(int64(0)),
+		Capabilities: &corev1.Capabilities{
+			Add: []corev1.Capability{"NET_ADMIN"},
 		},
-		SecurityContext: &corev1.SecurityContext{
-			RunAsUser: new(int64(0)),
-			Capabilities: &corev1.Capabilities{
-				Add: []corev1.Capability{"NET_ADMIN"},
-			},
+	}
+}
+
+// restrictedSecurityContext meets the restricted Pod Security level.
+func restrictedSecurityContext() *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		RunAsNonRoot:             new(true),
+		RunAsUser:                new(int64(65532)),
+		AllowPrivilegeEscalation: new(false),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
 		},
+		SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+	}
+}
+
+// sessionRoute is the route the traffic-agent serves for a session.
+func sessionRoute(session contracts.DebugSession) contracts.InterceptRoute {
+	return contracts.InterceptRoute{
+		SessionID:    session.SessionID,
+		SessionToken: session.SessionToken,
+		Headers:      intercept.NormalizeHeaders(session.InterceptHeaders),
+		Mirror:       intercept.IsMirror(session.Mode),
+		Ports:        routePorts(session),
+	}
+}
+
+// routePorts lists the container ports of a session that intercepts more
+// than one; a route without ports serves KRUN_TARGET_PORT.
+func routePorts(session contracts.DebugSession) []int {
+	if len(session.Ports) < 2 {
+		return nil
+	}
+	ports := make([]int, 0, len(session.Ports))
+	for _, port := range session.Ports {
+		ports = append(ports, port.ServicePort)
+	}
+	return ports
+}
+
+// withTargetPort gives routes without ports the agent's KRUN_TARGET_PORT
+// explicitly. The target port follows the newest session, so a shared
+// agent would otherwise move the other sessions' routes onto it. A lone
+// route on just the target port keeps the short form.
+func withTargetPort(routes []contracts.InterceptRoute, targetPort int) []contracts.InterceptRoute {
+	explicit := slices.Clone(routes)
+	for index := range explicit {
+		if len(explicit[index].Ports) == 0 {
+			explicit[index].Ports = []int{targetPort}
+		}
+	}
+	if len(explicit) == 1 && slices.Equal(explicit[0].Ports, []int{targetPort}) {
+		explicit[0].Ports = nil
+	}
+	return explicit
+}
+
+// routeEnv encodes the sessions served by the sidecar. A lone catch-all
+// intercept session on a single port keeps the plain
+// KRUN_SESSION_ID/KRUN_SESSION_TOKEN pair; header routing, mirroring and
+// extra ports need the full route list as JSON.
+func routeEnv(routes []contracts.InterceptRoute) []corev1.EnvVar {
+	if len(routes) == 1 && len(routes[0].Headers) == 0 && !routes[0].Mirror && len(routes[0].Ports) == 0 {
+		return []corev1.EnvVar{
+			{Name: sessionIDEnv, Value: routes[0].SessionID},
+			{Name: sessionTokenEnv, Value: routes[0].SessionToken},
+		}
+	}
+	data, err := json.Marshal(routes)
+	if err != nil {
+		return nil
+	}
+	return []corev1.EnvVar{{Name: interceptRoutesEnv, Value: string(data)}}
+}
+
+// readRoutes recovers the sessions an injected sidecar currently serves.
+// Routes without ports get the sidecar's target port, the one they are
+// served on.
+func readRoutes(container corev1.Container) []contracts.InterceptRoute {
+	env := map[string]string{}
+	for _, envVar := range container.Env {
+		env[envVar.Name] = envVar.Value
+	}
+	var routes []contracts.InterceptRoute
+	if raw := env[interceptRoutesEnv]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &routes); err != nil {
+			return nil
+		}
+	} else if sessionID := env[sessionIDEnv]; sessionID != "" {
+		routes = []contracts.InterceptRoute{{SessionID: sessionID, SessionToken: env[sessionTokenEnv]}}
+	}
+	if targetPort, err := strconv.Atoi(env[targetPortEnv]); err == nil && targetPort > 0 {
+		for index := range routes {
+			if len(routes[index].Ports) == 0 {
+				routes[index].Ports = []int{targetPort}
+			}
+		}
+	}
+	return routes
+}
+
+// mergeRoute adds a route, replacing any route for the same session or the
+// same header set and mode (the registry has already superseded that
+// session).
+func mergeRoute(routes []contracts.InterceptRoute, route contracts.InterceptRoute) []contracts.InterceptRoute {
+	merged := make([]contracts.InterceptRoute, 0, len(routes)+1)
+	for _, existing := range routes {
+		if existing.SessionID == route.SessionID ||
+			(existing.Mirror == route.Mirror && intercept.EqualHeaders(existing.Headers, route.Headers)) {
+			continue
+		}
+		merged = append(merged, existing)
+	}
+	merged = append(merged, route)
+	intercept.SortRoutes(merged)
+	return merged
+}
+
+// withRoutes swaps the route env vars of an existing sidecar container.
+func withRoutes(container corev1.Container, routes []contracts.InterceptRoute) corev1.Container {
+	if targetPort, err := strconv.Atoi(envValue(container.Env, targetPortEnv)); err == nil {
+		routes = withTargetPort(routes, targetPort)
+	}
+	env := routeEnv(routes)
+	for _, envVar := range container.Env {
+		switch envVar.Name {
+		case sessionIDEnv, sessionTokenEnv, interceptRoutesEnv:
+			continue
+		}
+		env = append(env, envVar)
+	}
+	container.Env = env
+	return container
+}
+
+// envValue is the value of the named env var, empty when unset.
+func envValue(env []corev1.EnvVar, name string) string {
+	for _, envVar := range env {
+		if envVar.Name == name {
+			return envVar.Value
+		}
 	}
+	return ""
 }
 
 // savedProbes records a container's pre-rewrite probe specs. Only probes
@@ -405,11 +956,11 @@ type savedProbes struct {
 	Startup   *corev1.Probe `json:"startup,omitempty"`
 }
 
-// rewriteProbes points every probe that targets the intercepted port at the
+// rewriteProbes points every probe that targets an intercepted port at the
 // agent's probe server instead. Otherwise kubelet probes get redirected to
 // the developer's local app, and the pod goes NotReady the moment that app
 // is stopped or paused on a breakpoint.
-func (i *WorkloadInjector) rewriteProbes(target *workloadTarget, targetPort int) bool {
+func (i *WorkloadInjector) rewriteProbes(target *workloadTarget, ports []contracts.PortMapping) bool {
 	saved := map[string]savedProbes{}
 	changed := false
 
@@ -430,7 +981,9 @@ func (i *WorkloadInjector) rewriteProbes(target *workloadTarget, targetPort int)
 			{&container.StartupProbe, &record.Startup},
 		}
 		for _, slot := range slots {
-			if !probeTargetsPort(*slot.probe, *container, targetPort) {
+			if !slices.ContainsFunc(ports, func(port contracts.PortMapping) bool {
+				return probeTargetsPort(*slot.probe, *container, port.ServicePort)
+			}) {
 				continue
 			}
 			*slot.original = (*slot.probe).DeepCopy()
@@ -3,14 +3,19 @@ package agent
 import (
 	"context"
 	"errors"
+	"slices"
 	"testing"
 
 	"github.com/ftechmax/krun/internal/contracts"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
@@ -22,6 +27,10 @@ func TestWorkloadInjectorInjectAndRemove(t *testing.T) {
 		{name: "deployment", kind: workloadKindDeployment},
 		{name: "statefulset", kind: workloadKindStatefulSet},
 		{name: "daemonset", kind: workloadKindDaemonSet},
+		{name: "replicaset", kind: workloadKindReplicaSet},
+		{name: "cronjob", kind: workloadKindCronJob},
+		{name: "job", kind: workloadKindJob},
+		{name: "pod", kind: workloadKindPod},
 	}
 
 	for _, tc := range cases {
@@ -86,7 +95,7 @@ func TestWorkloadInjectorInjectAndRemove(t *testing.T) {
 	}
 }
 
-func TestWorkloadInjectorCleanupRemovesAnnotatedAgents(t *testing.T) {
+func TestWorkloadInjectorReconcileRemovesUnknownAgents(t *testing.T) {
 	deployment := newTestDeployment("default", "orders-api")
 	deployment.Labels[InjectedLabelKey] = "true"
 	deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, corev1.Container{
@@ -104,17 +113,28 @@ func TestWorkloadInjectorCleanupRemovesAnnotatedAgents(t *testing.T) {
 	daemonSet := newTestDaemonSet("team-b", "node-proxy")
 	daemonSet.Labels[InjectedLabelKey] = "true"
 
+	job := newTestJob("team-c", "nightly-import")
+	job.Labels[InjectedLabelKey] = "true"
+	job.Spec.Template.Spec.Containers = append(job.Spec.Template.Spec.Containers, corev1.Container{
+		Name:  DefaultContainerName,
+		Image: "agent:latest",
+	})
+
 	unannotatedDeployment := newTestDeployment("default", "legacy-api")
 	unannotatedDeployment.Spec.Template.Spec.Containers = append(unannotatedDeployment.Spec.Template.Spec.Containers, corev1.Container{
 		Name:  DefaultContainerName,
 		Image: "agent:latest",
 	})
 
-	client := fake.NewSimpleClientset(deployment, statefulSet, daemonSet, unannotatedDeployment)
+	client := fake.NewSimpleClientset(deployment, statefulSet, daemonSet, job, unannotatedDeployment)
 	injector := NewWorkloadInjector(client, Options{})
 
-	if err := injector.Cleanup(context.Background()); err != nil {
-		t.Fatalf("cleanup injected sidecars: %v", err)
+	kept, err := injector.Reconcile(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("reconcile injected sidecars: %v", err)
+	}
+	if len(kept) != 0 {
+		t.Fatalf("expected no sessions to be kept, got %+v", kept)
 	}
 
 	containers := getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api")
@@ -144,6 +164,11 @@ func TestWorkloadInjectorCleanupRemovesAnnotatedAgents(t *testing.T) {
 		t.Fatalf("expected daemonset annotation to be removed, got %v", annotations)
 	}
 
+	containers = getWorkloadContainers(t, client, workloadKindJob, "team-c", "nightly-import")
+	if len(containers) != 1 || containers[0].Name != "app" {
+		t.Fatalf("expected the job to be recreated without the sidecar, got %+v", containers)
+	}
+
 	containers = getWorkloadContainers(t, client, workloadKindDeployment, "default", "legacy-api")
 	if len(containers) != 2 {
 		t.Fatalf("expected unannotated workload to remain unchanged, got %+v", containers)
@@ -184,6 +209,103 @@ func TestWorkloadInjectorLookupOrder(t *testing.T) {
 	}
 }
 
+func TestWorkloadInjectorReplacesReplicaSetPods(t *testing.T) {
+	replicaSet := newTestReplicaSet("default", "orders-api")
+	replicaSet.UID = "rs-uid"
+	owned := newTestPod("default", "orders-api-abcde", "orders-api", corev1.PodRunning)
+	owned.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "orders-api", UID: "rs-uid", Controller: new(true)}}
+	stray := newTestPod("default", "orders-api-debug", "orders-api", corev1.PodRunning)
+	client := fake.NewSimpleClientset(replicaSet, owned, stray)
+	injector := NewWorkloadInjector(client, Options{})
+
+	err := injector.Inject(context.Background(), contracts.DebugSession{
+		SessionID:   "session-1",
+		Namespace:   "default",
+		Workload:    "orders-api",
+		ServicePort: 8080,
+	})
+	if err != nil {
+		t.Fatalf("inject sidecar: %v", err)
+	}
+
+	pods, err := client.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list pods: %v", err)
+	}
+	if len(pods.Items) != 1 || pods.Items[0].Name != "orders-api-debug" {
+		t.Fatalf("expected only the replicaset's own pods to be replaced, got %+v", pods.Items)
+	}
+}
+
+func TestWorkloadInjectorInjectsRollout(t *testing.T) {
+	rollout := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]any{"namespace": "default", "name": "orders-api"},
+		"spec": map[string]any{
+			"selector": map[string]any{"matchLabels": map[string]any{"app": "orders-api"}},
+			"template": map[string]any{
+				"metadata": map[string]any{"labels": map[string]any{"app": "orders-api"}},
+				"spec": map[string]any{
+					"containers": []any{map[string]any{"name": "app", "image": "app:latest"}},
+				},
+			},
+		},
+	}}
+	rollouts := schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		rollouts: "RolloutList",
+	}, rollout)
+	injector := NewWorkloadInjector(fake.NewSimpleClientset(), Options{Dynamic: dynamicClient})
+	session := contracts.DebugSession{
+		SessionID:   "session-1",
+		Namespace:   "default",
+		Workload:    "orders-api",
+		ServicePort: 8080,
+	}
+
+	if err := injector.Inject(context.Background(), session); err != nil {
+		t.Fatalf("inject sidecar: %v", err)
+	}
+	updated, err := dynamicClient.Resource(rollouts).Namespace("default").Get(context.Background(), "orders-api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get rollout: %v", err)
+	}
+	containers, _, _ := unstructured.NestedSlice(updated.Object, "spec", "template", "spec", "containers")
+	if len(containers) != 2 || updated.GetLabels()[InjectedLabelKey] != "true" {
+		t.Fatalf("expected the sidecar in the rollout's template, got %v containers and labels %v", len(containers), updated.GetLabels())
+	}
+
+	// Cleanup finds the labelled rollout.
+	if _, err := injector.Reconcile(context.Background(), nil); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	updated, err = dynamicClient.Resource(rollouts).Namespace("default").Get(context.Background(), "orders-api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get rollout: %v", err)
+	}
+	containers, _, _ = unstructured.NestedSlice(updated.Object, "spec", "template", "spec", "containers")
+	if len(containers) != 1 {
+		t.Fatalf("expected the sidecar to be removed from the rollout, got %d containers", len(containers))
+	}
+}
+
+func TestWorkloadInjectorRejectsControlledPod(t *testing.T) {
+	pod := newTestPod("default", "orders-api-abcde", "orders-api", corev1.PodRunning)
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "orders-api-5d8f", Controller: new(true)}}
+	injector := NewWorkloadInjector(fake.NewSimpleClientset(pod), Options{})
+
+	err := injector.Inject(context.Background(), contracts.DebugSession{
+		SessionID:   "session-1",
+		Namespace:   "default",
+		Workload:    "orders-api-abcde",
+		ServicePort: 8080,
+	})
+	if err == nil || errors.Is(err, ErrWorkloadNotFound) {
+		t.Fatalf("expected the pod's controller to be named as the target, got %v", err)
+	}
+}
+
 func TestWorkloadInjectorInjectMissingWorkload(t *testing.T) {
 	client := fake.NewSimpleClientset()
 	injector := NewWorkloadInjector(client, Options{})
@@ -220,6 +342,28 @@ func TestWorkloadInjectorDefaults(t *testing.T) {
 	if sidecar.ImagePullPolicy != corev1.PullIfNotPresent {
 		t.Fatalf("expected default pull policy %q, got %q", corev1.PullIfNotPresent, sidecar.ImagePullPolicy)
 	}
+	if value := envValue(sidecar.Env, agentDiagnosticsEnv); value != "" {
+		t.Fatalf("expected diagnostics off by default, got %q", value)
+	}
+}
+
+func TestWorkloadInjectorEnablesAgentDiagnostics(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"))
+	injector := NewWorkloadInjector(client, Options{Diagnostics: true})
+	session := contracts.DebugSession{
+		SessionID:    "session-1",
+		SessionToken: "token-1",
+		Namespace:    "default",
+		Workload:     "orders-api",
+		ServicePort:  8080,
+	}
+	if err := injector.Inject(context.Background(), session); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	sidecar := getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api")[1]
+	if value := envValue(sidecar.Env, agentDiagnosticsEnv); value != "true" {
+		t.Fatalf("expected the agent to log diagnostics, got %s=%q", agentDiagnosticsEnv, value)
+	}
 }
 
 func getWorkloadContainers(t *testing.T, client *fake.Clientset, kind workloadKind, namespace string, name string) []corev1.Container {
@@ -243,6 +387,30 @@ func getWorkloadContainers(t *testing.T, client *fake.Clientset, kind workloadKi
 			t.Fatalf("get daemonset: %v", err)
 		}
 		return daemonSet.Spec.Template.Spec.Containers
+	case workloadKindReplicaSet:
+		replicaSet, err := client.AppsV1().ReplicaSets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get replicaset: %v", err)
+		}
+		return replicaSet.Spec.Template.Spec.Containers
+	case workloadKindCronJob:
+		cronJob, err := client.BatchV1().CronJobs(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get cronjob: %v", err)
+		}
+		return cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers
+	case workloadKindJob:
+		job, err := client.BatchV1().Jobs(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get job: %v", err)
+		}
+		return job.Spec.Template.Spec.Containers
+	case workloadKindPod:
+		pod, err := client.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get pod: %v", err)
+		}
+		return pod.Spec.Containers
 	default:
 		t.Fatalf("unsupported workload kind: %s", kind)
 		return nil
@@ -270,6 +438,30 @@ func getWorkloadLabels(t *testing.T, client *fake.Clientset, kind workloadKind,
 			t.Fatalf("get daemonset: %v", err)
 		}
 		return daemonSet.Labels
+	case workloadKindReplicaSet:
+		replicaSet, err := client.AppsV1().ReplicaSets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get replicaset: %v", err)
+		}
+		return replicaSet.Labels
+	case workloadKindCronJob:
+		cronJob, err := client.BatchV1().CronJobs(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get cronjob: %v", err)
+		}
+		return cronJob.Labels
+	case workloadKindJob:
+		job, err := client.BatchV1().Jobs(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get job: %v", err)
+		}
+		return job.Labels
+	case workloadKindPod:
+		pod, err := client.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get pod: %v", err)
+		}
+		return pod.Labels
 	default:
 		t.Fatalf("unsupported workload kind: %s", kind)
 		return nil
@@ -284,6 +476,14 @@ func newTestWorkload(kind workloadKind, namespace string, name string) runtime.O
 		return newTestStatefulSet(namespace, name)
 	case workloadKindDaemonSet:
 		return newTestDaemonSet(namespace, name)
+	case workloadKindReplicaSet:
+		return newTestReplicaSet(namespace, name)
+	case workloadKindCronJob:
+		return newTestCronJob(namespace, name)
+	case workloadKindJob:
+		return newTestJob(namespace, name)
+	case workloadKindPod:
+		return newTestPod(namespace, name, name, corev1.PodRunning)
 	default:
 		panic("unsupported workload kind")
 	}
@@ -447,3 +647,445 @@ func TestWorkloadInjectorRewritesAndRestoresProbes(t *testing.T) {
 		t.Fatal("original-probes annotation must be removed on restore")
 	}
 }
+
+func TestWorkloadInjectorRoutesEveryInterceptedPort(t *testing.T) {
+	deployment := newTestDeployment("default", "orders-api")
+	deployment.Spec.Template.Spec.Containers[0].ReadinessProbe = &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{Path: "/ready", Port: intstr.FromInt32(9090)},
+		},
+	}
+	client := fake.NewSimpleClientset(deployment)
+	injector := NewWorkloadInjector(client, Options{})
+	session := contracts.DebugSession{
+		SessionID:   "sess_1",
+		Namespace:   "default",
+		Workload:    "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+		Ports: []contracts.PortMapping{
+			{ServicePort: 8080, LocalPort: 5000},
+			{ServicePort: 9090, LocalPort: 5001},
+		},
+	}
+
+	if err := injector.Inject(context.Background(), session); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+
+	containers := getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api")
+	if len(containers) != 2 {
+		t.Fatalf("expected the sidecar to be injected, got %d containers", len(containers))
+	}
+	routes := readRoutes(containers[1])
+	if len(routes) != 1 || !slices.Equal(routes[0].Ports, []int{8080, 9090}) {
+		t.Fatalf("expected the route to carry both ports, got %+v", routes)
+	}
+	if got := containers[0].ReadinessProbe.HTTPGet.Port.IntValue(); got != DefaultProbePort {
+		t.Fatalf("readiness probe on the second port = %d, want %d", got, DefaultProbePort)
+	}
+}
+
+func TestWorkloadInjectorSharesSidecarAcrossHeaderRoutes(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"))
+	injector := NewWorkloadInjector(client, Options{})
+
+	alice := contracts.DebugSession{
+		SessionID:        "session-alice",
+		SessionToken:     "token-alice",
+		Namespace:        "default",
+		Workload:         "orders-api",
+		ServicePort:      8080,
+		InterceptHeaders: map[string]string{"x-krun-intercept": "alice"},
+	}
+	bob := alice
+	bob.SessionID = "session-bob"
+	bob.SessionToken = "token-bob"
+	bob.InterceptHeaders = map[string]string{"x-krun-intercept": "bob"}
+
+	for _, session := range []contracts.DebugSession{alice, bob} {
+		if err := injector.Inject(context.Background(), session); err != nil {
+			t.Fatalf("inject %s: %v", session.SessionID, err)
+		}
+	}
+
+	containers := getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api")
+	if len(containers) != 2 {
+		t.Fatalf("expected one shared sidecar, got %d containers", len(containers))
+	}
+	routes := readRoutes(containers[1])
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %+v", routes)
+	}
+	if routes[0].SessionID != "session-alice" || routes[0].Headers["X-Krun-Intercept"] != "alice" {
+		t.Fatalf("unexpected first route: %+v", routes[0])
+	}
+
+	if err := injector.Remove(context.Background(), alice); err != nil {
+		t.Fatalf("remove alice: %v", err)
+	}
+	containers = getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api")
+	if len(containers) != 2 {
+		t.Fatalf("sidecar must stay while bob's route remains, got %d containers", len(containers))
+	}
+	routes = readRoutes(containers[1])
+	if len(routes) != 1 || routes[0].SessionID != "session-bob" {
+		t.Fatalf("expected only bob's route, got %+v", routes)
+	}
+
+	if err := injector.Remove(context.Background(), bob); err != nil {
+		t.Fatalf("remove bob: %v", err)
+	}
+	containers = getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api")
+	if len(containers) != 1 {
+		t.Fatalf("expected sidecar removed with the last route, got %d containers", len(containers))
+	}
+}
+
+func TestWorkloadInjectorKeepsEachRouteOnItsPort(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"))
+	injector := NewWorkloadInjector(client, Options{})
+
+	web := contracts.DebugSession{
+		SessionID:        "session-web",
+		Namespace:        "default",
+		Workload:         "orders-api",
+		ServicePort:      8080,
+		InterceptHeaders: map[string]string{"x-krun-intercept": "alice"},
+	}
+	admin := web
+	admin.SessionID = "session-admin"
+	admin.ServicePort = 9090
+	admin.InterceptHeaders = map[string]string{"x-krun-intercept": "bob"}
+
+	for _, session := range []contracts.DebugSession{web, admin} {
+		if err := injector.Inject(context.Background(), session); err != nil {
+			t.Fatalf("inject %s: %v", session.SessionID, err)
+		}
+	}
+	containers := getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api")
+	ports := map[string][]int{}
+	for _, route := range readRoutes(containers[1]) {
+		ports[route.SessionID] = route.Ports
+	}
+	if !slices.Equal(ports["session-web"], []int{8080}) || !slices.Equal(ports["session-admin"], []int{9090}) {
+		t.Fatalf("expected each route to keep its session's port, got %v", ports)
+	}
+
+	// Dropping the newest session leaves the other route on its own port.
+	if err := injector.Remove(context.Background(), admin); err != nil {
+		t.Fatalf("remove admin: %v", err)
+	}
+	containers = getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api")
+	routes := readRoutes(containers[1])
+	if len(routes) != 1 || !slices.Equal(routes[0].Ports, []int{8080}) {
+		t.Fatalf("expected web's route to stay on 8080, got %+v", routes)
+	}
+}
+
+func TestWorkloadInjectorInstallsRedirectFromInitContainer(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"))
+	injector := NewWorkloadInjector(client, Options{InitRedirect: true})
+	alice := contracts.DebugSession{
+		SessionID:        "session-alice",
+		SessionToken:     "token-alice",
+		Namespace:        "default",
+		Workload:         "orders-api",
+		ServicePort:      8080,
+		InterceptHeaders: map[string]string{"x-krun-intercept": "alice"},
+	}
+	bob := alice
+	bob.SessionID = "session-bob"
+	bob.SessionToken = "token-bob"
+	bob.InterceptHeaders = map[string]string{"x-krun-intercept": "bob"}
+	for _, session := range []contracts.DebugSession{alice, bob} {
+		if err := injector.Inject(context.Background(), session); err != nil {
+			t.Fatalf("inject %s: %v", session.SessionID, err)
+		}
+	}
+
+	spec := getDeploymentPodSpec(t, client, "default", "orders-api")
+	if len(spec.Containers) != 2 || len(spec.InitContainers) != 1 {
+		t.Fatalf("expected a sidecar and an init container, got %d containers and %d init containers", len(spec.Containers), len(spec.InitContainers))
+	}
+	sidecar, initContainer := spec.Containers[1], spec.InitContainers[0]
+	if initContainer.Name != DefaultContainerName+initContainerSuffix || envValue(initContainer.Env, agentRedirectEnv) != "init" {
+		t.Fatalf("unexpected init container: %+v", initContainer)
+	}
+	if capabilities := initContainer.SecurityContext.Capabilities; capabilities == nil || len(capabilities.Add) != 1 || capabilities.Add[0] != "NET_ADMIN" {
+		t.Fatalf("expected the init container to get NET_ADMIN, got %+v", initContainer.SecurityContext)
+	}
+	if envValue(sidecar.Env, agentRedirectEnv) != "external" {
+		t.Fatalf("expected the sidecar to leave the rules to the init container, got env %+v", sidecar.Env)
+	}
+	if security := sidecar.SecurityContext; security.RunAsNonRoot == nil || !*security.RunAsNonRoot || security.Capabilities.Add != nil {
+		t.Fatalf("expected the sidecar to run unprivileged, got %+v", security)
+	}
+
+	if err := injector.Remove(context.Background(), alice); err != nil {
+		t.Fatalf("remove alice: %v", err)
+	}
+	spec = getDeploymentPodSpec(t, client, "default", "orders-api")
+	if routes := readRoutes(spec.InitContainers[0]); len(routes) != 1 || routes[0].SessionID != "session-bob" {
+		t.Fatalf("expected the init container to follow the sidecar's routes, got %+v", routes)
+	}
+
+	if err := injector.Remove(context.Background(), bob); err != nil {
+		t.Fatalf("remove bob: %v", err)
+	}
+	spec = getDeploymentPodSpec(t, client, "default", "orders-api")
+	if len(spec.Containers) != 1 || len(spec.InitContainers) != 0 {
+		t.Fatalf("expected the init container removed with the sidecar, got %d containers and %d init containers", len(spec.Containers), len(spec.InitContainers))
+	}
+}
+
+func TestWorkloadInjectorReconcileSwitchesRedirectMode(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"))
+	session := contracts.DebugSession{
+		SessionID:    "session-alice",
+		SessionToken: "token-alice",
+		Namespace:    "default",
+		Workload:     "orders-api",
+		ServicePort:  8080,
+	}
+	if err := NewWorkloadInjector(client, Options{}).Inject(context.Background(), session); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+
+	if _, err := NewWorkloadInjector(client, Options{InitRedirect: true}).Reconcile(context.Background(), []contracts.DebugSession{session}); err != nil {
+		t.Fatalf("reconcile in init mode: %v", err)
+	}
+	spec := getDeploymentPodSpec(t, client, "default", "orders-api")
+	if len(spec.InitContainers) != 1 || envValue(spec.Containers[1].Env, agentRedirectEnv) != "external" {
+		t.Fatalf("expected the sidecar moved to init mode, got %+v", spec)
+	}
+
+	if _, err := NewWorkloadInjector(client, Options{}).Reconcile(context.Background(), []contracts.DebugSession{session}); err != nil {
+		t.Fatalf("reconcile in self mode: %v", err)
+	}
+	spec = getDeploymentPodSpec(t, client, "default", "orders-api")
+	if len(spec.InitContainers) != 0 || envValue(spec.Containers[1].Env, agentRedirectEnv) != "" {
+		t.Fatalf("expected the sidecar back to installing its own rules, got %+v", spec)
+	}
+	if routes := readRoutes(spec.Containers[1]); len(routes) != 1 || routes[0].SessionID != "session-alice" {
+		t.Fatalf("expected the session kept across mode switches, got %+v", routes)
+	}
+}
+
+func getDeploymentPodSpec(t *testing.T, client *fake.Clientset, namespace string, name string) corev1.PodSpec {
+	t.Helper()
+	deployment, err := client.AppsV1().Deployments(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+	return deployment.Spec.Template.Spec
+}
+
+func TestWorkloadInjectorReconcileKeepsStoredSessions(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"), newTestDeployment("default", "billing-api"))
+	injector := NewWorkloadInjector(client, Options{})
+
+	alice := contracts.DebugSession{
+		SessionID:        "session-alice",
+		SessionToken:     "token-alice",
+		Namespace:        "default",
+		Workload:         "orders-api",
+		ServicePort:      8080,
+		InterceptHeaders: map[string]string{"x-krun-intercept": "alice"},
+	}
+	bob := alice
+	bob.SessionID = "session-bob"
+	bob.SessionToken = "token-bob"
+	bob.InterceptHeaders = map[string]string{"x-krun-intercept": "bob"}
+	billing := contracts.DebugSession{
+		SessionID:    "session-billing",
+		SessionToken: "token-billing",
+		Namespace:    "default",
+		Workload:     "billing-api",
+		ServicePort:  8080,
+	}
+	for _, session := range []contracts.DebugSession{alice, bob, billing} {
+		if err := injector.Inject(context.Background(), session); err != nil {
+			t.Fatalf("inject %s: %v", session.SessionID, err)
+		}
+	}
+
+	// Only alice survived in the store; a session that lost its route must
+	// not be reported as kept.
+	orphan := contracts.DebugSession{SessionID: "session-orphan", SessionToken: "token-orphan", Namespace: "default", Workload: "orders-api"}
+	kept, err := injector.Reconcile(context.Background(), []contracts.DebugSession{alice, orphan})
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if len(kept) != 1 || kept[0].SessionID != "session-alice" {
+		t.Fatalf("expected only alice to be kept, got %+v", kept)
+	}
+
+	containers := getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api")
+	if len(containers) != 2 {
+		t.Fatalf("expected the orders-api sidecar to stay, got %d containers", len(containers))
+	}
+	routes := readRoutes(containers[1])
+	if len(routes) != 1 || routes[0].SessionID != "session-alice" {
+		t.Fatalf("expected only alice's route, got %+v", routes)
+	}
+
+	containers = getWorkloadContainers(t, client, workloadKindDeployment, "default", "billing-api")
+	if len(containers) != 1 {
+		t.Fatalf("expected the billing-api sidecar to be removed, got %d containers", len(containers))
+	}
+}
+
+func TestMergeRouteReplacesSameHeaderSet(t *testing.T) {
+	routes := []contracts.InterceptRoute{
+		{SessionID: "catch-all"},
+		{SessionID: "old-alice", Headers: map[string]string{"X-Krun-Intercept": "alice"}},
+	}
+
+	merged := mergeRoute(routes, contracts.InterceptRoute{
+		SessionID: "new-alice",
+		Headers:   map[string]string{"X-Krun-Intercept": "alice"},
+	})
+
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 routes, got %+v", merged)
+	}
+	if merged[0].SessionID != "new-alice" || merged[1].SessionID != "catch-all" {
+		t.Fatalf("expected header route before catch-all, got %+v", merged)
+	}
+
+	merged = mergeRoute(merged, contracts.InterceptRoute{SessionID: "mirror", Mirror: true})
+	if len(merged) != 3 {
+		t.Fatalf("mirror route must not replace the catch-all intercept route, got %+v", merged)
+	}
+	if env := routeEnv(merged[1:]); len(env) != 1 || env[0].Name != interceptRoutesEnv {
+		t.Fatalf("expected JSON routes when a mirror route is present, got %+v", env)
+	}
+}
+
+type recordingInjector struct {
+	injected   []string
+	removed    []string
+	reconciled []string
+}
+
+func (r *recordingInjector) Inject(_ context.Context, session contracts.DebugSession) error {
+	r.injected = append(r.injected, session.SessionID)
+	return nil
+}
+
+func (r *recordingInjector) Remove(_ context.Context, session contracts.DebugSession) error {
+	r.removed = append(r.removed, session.SessionID)
+	return nil
+}
+
+func (r *recordingInjector) Reconcile(_ context.Context, sessions []contracts.DebugSession) ([]contracts.DebugSession, error) {
+	for _, session := range sessions {
+		r.reconciled = append(r.reconciled, session.SessionID)
+	}
+	return sessions, nil
+}
+
+func TestSessionInjectorPicksInjectorPerSession(t *testing.T) {
+	sidecar := &recordingInjector{}
+	ephemeral := &recordingInjector{}
+	injector := SessionInjector{Sidecar: sidecar, Ephemeral: ephemeral}
+	sessions := []contracts.DebugSession{
+		{SessionID: "sess_legacy"},
+		{SessionID: "sess_ephemeral", Injection: contracts.SessionInjectionEphemeral},
+		{SessionID: "sess_sidecar", Injection: contracts.SessionInjectionSidecar},
+	}
+
+	for _, session := range sessions {
+		if err := injector.Inject(context.Background(), session); err != nil {
+			t.Fatalf("inject %s: %v", session.SessionID, err)
+		}
+		if err := injector.Remove(context.Background(), session); err != nil {
+			t.Fatalf("remove %s: %v", session.SessionID, err)
+		}
+	}
+	kept, err := injector.Reconcile(context.Background(), sessions)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	if !slices.Equal(sidecar.injected, []string{"sess_legacy", "sess_sidecar"}) || !slices.Equal(sidecar.removed, sidecar.injected) {
+		t.Fatalf("unexpected sidecar sessions: injected=%v removed=%v", sidecar.injected, sidecar.removed)
+	}
+	if !slices.Equal(ephemeral.injected, []string{"sess_ephemeral"}) || !slices.Equal(ephemeral.removed, ephemeral.injected) {
+		t.Fatalf("unexpected ephemeral sessions: injected=%v removed=%v", ephemeral.injected, ephemeral.removed)
+	}
+	// The sidecar injector strips the routes of sessions it is not given.
+	if !slices.Equal(sidecar.reconciled, []string{"sess_legacy", "sess_sidecar"}) || !slices.Equal(ephemeral.reconciled, []string{"sess_ephemeral"}) {
+		t.Fatalf("expected each injector to reconcile its own sessions, got sidecar=%v ephemeral=%v", sidecar.reconciled, ephemeral.reconciled)
+	}
+	if len(kept) != 3 || kept[0].SessionID != "sess_legacy" || kept[1].SessionID != "sess_ephemeral" {
+		t.Fatalf("expected the kept sessions in their original order, got %+v", kept)
+	}
+}
+
+func newTestReplicaSet(namespace string, name string) *appsv1.ReplicaSet {
+	return &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": name},
+			},
+			Template: newTestPodTemplate(name),
+		},
+	}
+}
+
+func newTestCronJob(namespace string, name string) *batchv1.CronJob {
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{},
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule: "0 * * * *",
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{Template: newTestPodTemplate(name)},
+			},
+		},
+	}
+}
+
+func newTestJob(namespace string, name string) *batchv1.Job {
+	template := newTestPodTemplate(name)
+	template.Labels[batchv1.JobNameLabel] = name
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{},
+		},
+		Spec: batchv1.JobSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{batchv1.JobNameLabel: name},
+			},
+			Template: template,
+		},
+	}
+}
+
+func newTestPodTemplate(app string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"app": app},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "app",
+					Image: "app:latest",
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// customWorkload describes a workload kind that comes from a CRD and is
+// reached through the dynamic client: where its pod template and selector
+// live in the object.
+type customWorkload struct {
+	kind         workloadKind
+	resource     schema.GroupVersionResource
+	templatePath []string
+	selectorPath []string
+}
+
+var customWorkloads = []customWorkload{
+	{
+		kind:         workloadKindRollout,
+		resource:     schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"},
+		templatePath: []string{"spec", "template"},
+		selectorPath: []string{"spec", "selector"},
+	},
+}
+
+// recreateTimeout bounds the wait for a replaced Pod to be gone.
+const recreateTimeout = 2 * time.Minute
+
+// Labels the Job controller adds to the pod template of a Job without a
+// manual selector. A replacement Job must come without them to get its own.
+var jobControllerLabels = []string{
+	"controller-uid",
+	"job-name",
+	batchv1.ControllerUidLabel,
+	batchv1.JobNameLabel,
+}
+
+func findCustomWorkload(kind workloadKind) (customWorkload, bool) {
+	for _, custom := range customWorkloads {
+		if custom.kind == kind {
+			return custom, true
+		}
+	}
+	return customWorkload{}, false
+}
+
+// findCustomTarget reads the pod template out of a CRD object. Without a
+// dynamic client, or without the CRD in the cluster, there is no such
+// workload.
+func (i *WorkloadInjector) findCustomTarget(ctx context.Context, custom customWorkload, namespace string, workload string) (*workloadTarget, error) {
+	if i.options.Dynamic == nil {
+		return nil, fmt.Errorf("%w: %s %s/%s", ErrWorkloadNotFound, custom.kind, namespace, workload)
+	}
+	resource := i.options.Dynamic.Resource(custom.resource).Namespace(namespace)
+	object, err := resource.Get(ctx, workload, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: %s %s/%s", ErrWorkloadNotFound, custom.kind, namespace, workload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s %s/%s: %w", custom.kind, namespace, workload, err)
+	}
+
+	rawTemplate, found, err := unstructured.NestedMap(object.Object, custom.templatePath...)
+	if err != nil || !found {
+		// Rollouts can reference a Deployment's template instead of carrying
+		// one; that Deployment is the one to target.
+		return nil, fmt.Errorf("%s %s/%s has no pod template", custom.kind, namespace, workload)
+	}
+	template := &corev1.PodTemplateSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawTemplate, template); err != nil {
+		return nil, fmt.Errorf("decode pod template of %s %s/%s: %w", custom.kind, namespace, workload, err)
+	}
+	var selector *metav1.LabelSelector
+	if rawSelector, found, err := unstructured.NestedMap(object.Object, custom.selectorPath...); err == nil && found {
+		selector = &metav1.LabelSelector{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawSelector, selector); err != nil {
+			return nil, fmt.Errorf("decode selector of %s %s/%s: %w", custom.kind, namespace, workload, err)
+		}
+	}
+
+	return &workloadTarget{
+		kind:     custom.kind,
+		object:   object,
+		selector: selector,
+		template: template,
+		update: func(ctx context.Context) error {
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(template)
+			if err != nil {
+				return fmt.Errorf("encode pod template: %w", err)
+			}
+			if err := unstructured.SetNestedMap(object.Object, content, custom.templatePath...); err != nil {
+				return fmt.Errorf("set pod template: %w", err)
+			}
+			_, err = resource.Update(ctx, object, metav1.UpdateOptions{})
+			return err
+		},
+	}, nil
+}
+
+func (i *WorkloadInjector) listLabeledCustomWorkloads(ctx context.Context, custom customWorkload, opts metav1.ListOptions) ([]workloadIdentifier, error) {
+	if i.options.Dynamic == nil {
+		return nil, nil
+	}
+	list, err := i.options.Dynamic.Resource(custom.resource).Namespace(metav1.NamespaceAll).List(ctx, opts)
+	if apierrors.IsNotFound(err) {
+		// The CRD is not installed.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list %ss for startup cleanup: %w", custom.kind, err)
+	}
+	workloads := make([]workloadIdentifier, 0, len(list.Items))
+	for _, item := range list.Items {
+		workloads = append(workloads, workloadIdentifier{namespace: item.GetNamespace(), workload: item.GetName()})
+	}
+	return workloads, nil
+}
+
+// selectPods lists the pods of a workload target. CronJobs have no
+// selector of their own; their pods carry the labels of the job template.
+func (i *WorkloadInjector) selectPods(ctx context.Context, target *workloadTarget, namespace string, workload string) ([]corev1.Pod, error) {
+	if pod, ok := target.object.(*corev1.Pod); ok {
+		return []corev1.Pod{*pod}, nil
+	}
+	labelSelector := target.selector
+	if labelSelector == nil {
+		labelSelector = &metav1.LabelSelector{MatchLabels: target.template.Labels}
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("selector of %s %s/%s: %w", target.kind, namespace, workload, err)
+	}
+	if selector.Empty() {
+		return nil, fmt.Errorf("%s %s/%s does not tell its pods apart by labels", target.kind, namespace, workload)
+	}
+	list, err := i.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("list pods of %s %s/%s: %w", target.kind, namespace, workload, err)
+	}
+	return list.Items, nil
+}
+
+// replaceReplicaSetPods deletes the pods of a ReplicaSet after its
+// template changed: unlike a Deployment, a ReplicaSet does not roll its
+// pods, it only recreates the missing ones.
+func (i *WorkloadInjector) replaceReplicaSetPods(ctx context.Context, namespace string, name string, uid string, selector *metav1.LabelSelector) error {
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return fmt.Errorf("selector of %s %s/%s: %w", workloadKindReplicaSet, namespace, name, err)
+	}
+	pods, err := i.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector.String()})
+	if err != nil {
+		return fmt.Errorf("list pods of %s %s/%s: %w", workloadKindReplicaSet, namespace, name, err)
+	}
+	for _, pod := range pods.Items {
+		owner := metav1.GetControllerOf(&pod)
+		if owner == nil || string(owner.UID) != uid {
+			continue
+		}
+		err := i.client.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("delete pod %s/%s: %w", namespace, pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// recreateJob replaces a Job, whose pod template is immutable, with one
+// running the changed template. The old Job's pods go with it.
+func (i *WorkloadInjector) recreateJob(ctx context.Context, job *batchv1.Job) error {
+	jobs := i.client.BatchV1().Jobs(job.Namespace)
+	propagation := metav1.DeletePropagationBackground
+	err := jobs.Delete(ctx, job.Name, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+		Preconditions:     &metav1.Preconditions{UID: &job.UID},
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	replacement := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            job.Name,
+			Namespace:       job.Namespace,
+			Labels:          job.Labels,
+			Annotations:     job.Annotations,
+			OwnerReferences: job.OwnerReferences,
+		},
+		Spec: *job.Spec.DeepCopy(),
+	}
+	if replacement.Spec.ManualSelector == nil || !*replacement.Spec.ManualSelector {
+		replacement.Spec.Selector = nil
+		for _, label := range jobControllerLabels {
+			delete(replacement.Spec.Template.Labels, label)
+		}
+	}
+	_, err = jobs.Create(ctx, replacement, metav1.CreateOptions{})
+	return err
+}
+
+// recreatePod replaces a bare Pod, whose containers cannot change, with
+// one running the changed spec under the same name.
+func (i *WorkloadInjector) recreatePod(ctx context.Context, pod *corev1.Pod, template *corev1.PodTemplateSpec) error {
+	pods := i.client.CoreV1().Pods(pod.Namespace)
+	err := pods.Delete(ctx, pod.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &pod.UID}})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	err = wait.PollUntilContextTimeout(ctx, time.Second, recreateTimeout, true, func(ctx context.Context) (bool, error) {
+		_, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return fmt.Errorf("wait for pod %s/%s to be deleted: %w", pod.Namespace, pod.Name, err)
+	}
+
+	replacement := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Namespace:   pod.Namespace,
+			Labels:      mergeStrings(pod.Labels, template.Labels),
+			Annotations: mergeStrings(pod.Annotations, template.Annotations),
+		},
+		Spec: *template.Spec.DeepCopy(),
+	}
+	// Ephemeral containers can only be added to a running pod.
+	replacement.Spec.EphemeralContainers = nil
+	_, err = pods.Create(ctx, replacement, metav1.CreateOptions{})
+	return err
+}
+
+func mergeStrings(base map[string]string, overlay map[string]string) map[string]string {
+	if len(base) == 0 && len(overlay) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(base)+len(overlay))
+	maps.Copy(merged, base)
+	maps.Copy(merged, overlay)
+	return merged
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// meshSidecar describes how a service mesh shows up on a pod: the proxy
+// container it injects and the label or annotation that turns injection
+// on and off.
+type meshSidecar struct {
+	strategy  string
+	container string
+	// injectKey is read from pod and namespace labels and annotations.
+	injectKey string
+	enabled   []string
+	disabled  []string
+	// namespaceLabels enable injection for a namespace when present with
+	// any value, such as Istio's revision label.
+	namespaceLabels []string
+}
+
+var meshSidecars = []meshSidecar{
+	{
+		strategy:        contracts.InterceptStrategyAfterIstioProxy,
+		container:       "istio-proxy",
+		injectKey:       "sidecar.istio.io/inject",
+		enabled:         []string{"true"},
+		disabled:        []string{"false"},
+		namespaceLabels: []string{"istio.io/rev"},
+	},
+	{
+		strategy:  contracts.InterceptStrategyAfterLinkerdProxy,
+		container: "linkerd-proxy",
+		injectKey: "linkerd.io/inject",
+		enabled:   []string{"enabled", "ingress"},
+		disabled:  []string{"disabled"},
+	},
+}
+
+// istioNamespaceLabel is Istio's namespace-wide switch; it does not use
+// the pod-level key.
+const istioNamespaceLabel = "istio-injection"
+
+// InterceptStrategy tells how the traffic-agent can take a session's
+// connections over: inbound, or after the mesh proxy the workload's pods
+// run. The pod template is checked first, then the running pods (a mesh
+// injects its proxy at admission, so it is rarely in the template), then
+// the namespace's injection switch.
+func (i *WorkloadInjector) InterceptStrategy(ctx context.Context, session contracts.DebugSession) (string, error) {
+	namespace, workload, err := resolveTarget(session)
+	if err != nil {
+		return "", err
+	}
+	target, err := i.findWorkloadTarget(ctx, namespace, workload)
+	if err != nil {
+		return "", err
+	}
+	if strategy, ok := podMesh(target.template.ObjectMeta, target.template.Spec); ok {
+		return strategy, nil
+	}
+
+	pods, err := i.selectPods(ctx, target, namespace, workload)
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods {
+		if strategy, ok := podMesh(pod.ObjectMeta, pod.Spec); ok {
+			return strategy, nil
+		}
+	}
+
+	ns, err := i.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("get namespace %s: %w", namespace, err)
+	}
+	return namespaceMesh(ns.ObjectMeta), nil
+}
+
+// podMesh reports the strategy a pod's proxy container or injection
+// switch calls for, if it has either.
+func podMesh(meta metav1.ObjectMeta, spec corev1.PodSpec) (string, bool) {
+	for _, mesh := range meshSidecars {
+		if findContainerIndex(spec.Containers, mesh.container) >= 0 || findContainerIndex(spec.InitContainers, mesh.container) >= 0 {
+			return mesh.strategy, true
+		}
+	}
+	for _, mesh := range meshSidecars {
+		for _, values := range []map[string]string{meta.Annotations, meta.Labels} {
+			value, ok := values[mesh.injectKey]
+			switch {
+			case !ok:
+			case slices.Contains(mesh.enabled, value):
+				return mesh.strategy, true
+			case slices.Contains(mesh.disabled, value):
+				// Opted out of a mesh the namespace may enable.
+				return contracts.InterceptStrategyInbound, true
+			}
+		}
+	}
+	return "", false
+}
+
+func namespaceMesh(meta metav1.ObjectMeta) string {
+	if meta.Labels[istioNamespaceLabel] == "enabled" {
+		return contracts.InterceptStrategyAfterIstioProxy
+	}
+	for _, mesh := range meshSidecars {
+		for _, label := range mesh.namespaceLabels {
+			if _, ok := meta.Labels[label]; ok {
+				return mesh.strategy
+			}
+		}
+		if slices.Contains(mesh.enabled, meta.Annotations[mesh.injectKey]) {
+			return mesh.strategy
+		}
+	}
+	return contracts.InterceptStrategyInbound
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWorkloadInjectorInterceptStrategy(t *testing.T) {
+	session := contracts.DebugSession{Namespace: "default", Workload: "orders-api"}
+
+	meshedPod := newTestPod("default", "orders-api-1", "orders-api", corev1.PodRunning)
+	meshedPod.Spec.Containers = append(meshedPod.Spec.Containers, corev1.Container{Name: "linkerd-proxy"})
+
+	optedOut := newTestDeployment("default", "orders-api")
+	optedOut.Spec.Template.Annotations = map[string]string{"sidecar.istio.io/inject": "false"}
+
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		want    string
+	}{
+		{
+			name:    "no mesh",
+			objects: []runtime.Object{newTestNamespace("default", nil), newTestDeployment("default", "orders-api")},
+			want:    contracts.InterceptStrategyInbound,
+		},
+		{
+			name:    "proxy in a running pod",
+			objects: []runtime.Object{newTestNamespace("default", nil), newTestDeployment("default", "orders-api"), meshedPod},
+			want:    contracts.InterceptStrategyAfterLinkerdProxy,
+		},
+		{
+			name:    "namespace injection",
+			objects: []runtime.Object{newTestNamespace("default", map[string]string{"istio-injection": "enabled"}), newTestDeployment("default", "orders-api")},
+			want:    contracts.InterceptStrategyAfterIstioProxy,
+		},
+		{
+			name:    "namespace revision label",
+			objects: []runtime.Object{newTestNamespace("default", map[string]string{"istio.io/rev": "canary"}), newTestDeployment("default", "orders-api")},
+			want:    contracts.InterceptStrategyAfterIstioProxy,
+		},
+		{
+			name:    "pods opted out of the namespace's mesh",
+			objects: []runtime.Object{newTestNamespace("default", map[string]string{"istio-injection": "enabled"}), optedOut},
+			want:    contracts.InterceptStrategyInbound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			injector := NewWorkloadInjector(fake.NewSimpleClientset(tc.objects...), Options{})
+			strategy, err := injector.InterceptStrategy(context.Background(), session)
+			if err != nil {
+				t.Fatalf("intercept strategy: %v", err)
+			}
+			if strategy != tc.want {
+				t.Fatalf("expected strategy %q, got %q", tc.want, strategy)
+			}
+		})
+	}
+}
+
+func TestWorkloadInjectorPassesInterceptStrategyToAgent(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"))
+	injector := NewWorkloadInjector(client, Options{InitRedirect: true})
+
+	err := injector.Inject(context.Background(), contracts.DebugSession{
+		SessionID:         "sess_1",
+		Namespace:         "default",
+		Workload:          "orders-api",
+		ServicePort:       8080,
+		InterceptStrategy: contracts.InterceptStrategyAfterIstioProxy,
+	})
+	if err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	spec := getDeploymentPodSpec(t, client, "default", "orders-api")
+	if value := envValue(spec.Containers[1].Env, agentStrategyEnv); value != contracts.InterceptStrategyAfterIstioProxy {
+		t.Fatalf("expected the agent told the strategy, got %s=%q", agentStrategyEnv, value)
+	}
+	// The init container may run before the mesh's own; it relies on the
+	// strategy it is given.
+	if value := envValue(spec.InitContainers[0].Env, agentStrategyEnv); value != contracts.InterceptStrategyAfterIstioProxy {
+		t.Fatalf("expected the init container told the strategy, got %s=%q", agentStrategyEnv, value)
+	}
+}
+
+func newTestNamespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// httpAppProtocols are the appProtocol values of Service ports that carry
+// HTTP; any other declared appProtocol does not.
+var httpAppProtocols = []string{"http", "http2", "h2c", "grpc", "grpc-web", "kubernetes.io/h2c", "kubernetes.io/ws"}
+
+// opaquePortNames are the protocol prefixes of Service port names
+// (`<protocol>[-<suffix>]`, the convention service meshes use) that do not
+// carry plain HTTP.
+var opaquePortNames = []string{"https", "tcp", "tls", "mongo", "mysql", "redis", "udp"}
+
+// withOpaquePorts marks the ports of a header route that the session's
+// Service declares as something other than HTTP, so the agent does not
+// wait for a request head there. A Service that cannot be read leaves the
+// route as it is: headers are then read on every port.
+func (i *WorkloadInjector) withOpaquePorts(
+	ctx context.Context,
+	session contracts.DebugSession,
+	spec corev1.PodSpec,
+	route contracts.InterceptRoute,
+) contracts.InterceptRoute {
+	serviceName := strings.TrimSpace(session.ServiceName)
+	if len(route.Headers) == 0 || serviceName == "" {
+		return route
+	}
+	namespace, _, err := resolveTarget(session)
+	if err != nil {
+		return route
+	}
+	service, err := i.client.CoreV1().Services(namespace).Get(ctx, serviceName, metav1.GetOptions{})
+	if err != nil {
+		return route
+	}
+	ports := route.Ports
+	if len(ports) == 0 {
+		ports = []int{session.ServicePort}
+	}
+	route.OpaquePorts = nil
+	for _, servicePort := range service.Spec.Ports {
+		containerPort := serviceTargetPort(servicePort, spec)
+		if slices.Contains(ports, containerPort) && opaqueServicePort(servicePort) {
+			route.OpaquePorts = append(route.OpaquePorts, containerPort)
+		}
+	}
+	slices.Sort(route.OpaquePorts)
+	route.OpaquePorts = slices.Compact(route.OpaquePorts)
+	return route
+}
+
+// serviceTargetPort is the container port a Service port sends to; named
+// target ports are looked up in the pod spec.
+func serviceTargetPort(servicePort corev1.ServicePort, spec corev1.PodSpec) int {
+	switch {
+	case servicePort.TargetPort.Type == intstr.String:
+		for _, container := range spec.Containers {
+			for _, port := range container.Ports {
+				if port.Name == servicePort.TargetPort.StrVal {
+					return int(port.ContainerPort)
+				}
+			}
+		}
+		return 0
+	case servicePort.TargetPort.IntValue() > 0:
+		return servicePort.TargetPort.IntValue()
+	default:
+		return int(servicePort.Port)
+	}
+}
+
+// opaqueServicePort reports whether a Service port declares a protocol
+// other than HTTP, by its appProtocol or else its name. Undeclared ports
+// may carry HTTP.
+func opaqueServicePort(servicePort corev1.ServicePort) bool {
+	if servicePort.Protocol != "" && servicePort.Protocol != corev1.ProtocolTCP {
+		return true
+	}
+	if servicePort.AppProtocol != nil && *servicePort.AppProtocol != "" {
+		return !slices.Contains(httpAppProtocols, strings.ToLower(*servicePort.AppProtocol))
+	}
+	protocol, _, _ := strings.Cut(strings.ToLower(servicePort.Name), "-")
+	return slices.Contains(opaquePortNames, protocol)
+}
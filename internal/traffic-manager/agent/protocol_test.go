@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWithOpaquePortsMarksNonHTTPServicePorts(t *testing.T) {
+	grpc := "grpc"
+	postgres := "postgresql"
+	client := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "orders-api"},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)},
+			{Name: "grpc-api", Port: 9090, AppProtocol: &grpc},
+			{Name: "mysql", Port: 3306, TargetPort: intstr.FromString("db")},
+			{Name: "store", Port: 5432, AppProtocol: &postgres},
+			{Name: "metrics", Port: 9100},
+		}},
+	})
+	injector := NewWorkloadInjector(client, Options{})
+	spec := corev1.PodSpec{Containers: []corev1.Container{{
+		Name:  "app",
+		Ports: []corev1.ContainerPort{{Name: "db", ContainerPort: 13306}},
+	}}}
+	session := contracts.DebugSession{
+		SessionID:   "sess_1",
+		Namespace:   "default",
+		ServiceName: "orders-api",
+		Workload:    "orders-api",
+		ServicePort: 8080,
+	}
+	route := contracts.InterceptRoute{
+		SessionID: "sess_1",
+		Headers:   map[string]string{"X-Dev": "alice"},
+		Ports:     []int{8080, 9090, 13306, 5432, 9100},
+	}
+
+	got := injector.withOpaquePorts(context.Background(), session, spec, route)
+	if !slices.Equal(got.OpaquePorts, []int{5432, 13306}) {
+		t.Fatalf("expected the mysql and postgres ports to be opaque, got %v", got.OpaquePorts)
+	}
+
+	// Headerless routes read nothing anyway.
+	route.Headers = nil
+	if got := injector.withOpaquePorts(context.Background(), session, spec, route); len(got.OpaquePorts) != 0 {
+		t.Fatalf("expected no opaque ports without headers, got %v", got.OpaquePorts)
+	}
+
+	// Without the Service every port may carry HTTP.
+	route.Headers = map[string]string{"X-Dev": "alice"}
+	session.ServiceName = "missing"
+	if got := injector.withOpaquePorts(context.Background(), session, spec, route); len(got.OpaquePorts) != 0 {
+		t.Fatalf("expected no opaque ports without a Service, got %v", got.OpaquePorts)
+	}
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReplicaLabelKey marks the single-replica clone of a Deployment and names
+// the Deployment it was cloned from. Clone pods carry it on top of the
+// original pod labels, so the Service still selects them while the
+// original Deployment's ReplicaSets leave them alone.
+const ReplicaLabelKey = "krun.ftechmax.net/replica-of"
+
+// ReplicaName is the name of the clone single-replica sessions of a
+// workload share.
+func ReplicaName(workload string) string {
+	return workload + "-krun-replica"
+}
+
+// resolveInjectedTarget returns the workload carrying a session's sidecar:
+// the workload itself, or its clone for single-replica sessions.
+func resolveInjectedTarget(session contracts.DebugSession) (string, string, error) {
+	namespace, workload, err := resolveTarget(session)
+	if err != nil || !session.SingleReplica {
+		return namespace, workload, err
+	}
+	return namespace, ReplicaName(workload), nil
+}
+
+func (i *WorkloadInjector) findReplicaTarget(ctx context.Context, namespace string, workload string) (*workloadTarget, error) {
+	return i.findWorkloadTargetByKind(ctx, workloadKindDeployment, namespace, workload)
+}
+
+func isReplica(object metav1.Object) bool {
+	return object.GetLabels()[ReplicaLabelKey] != ""
+}
+
+// ensureReplica creates the single-replica clone of a Deployment unless it
+// exists already, and reports whether it did. The clone is a snapshot of
+// the pod template at the time; it is owned by the original, so deleting
+// that deletes the clone too.
+func (i *WorkloadInjector) ensureReplica(ctx context.Context, namespace string, workload string) (bool, error) {
+	deployments := i.client.AppsV1().Deployments(namespace)
+	_, err := deployments.Get(ctx, ReplicaName(workload), metav1.GetOptions{})
+	if err == nil {
+		return false, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("get %s %s/%s: %w", workloadKindDeployment, namespace, ReplicaName(workload), err)
+	}
+
+	original, err := deployments.Get(ctx, workload, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("%w: %s %s/%s (single-replica sessions need a deployment)", ErrWorkloadNotFound, workloadKindDeployment, namespace, workload)
+	}
+	if err != nil {
+		return false, fmt.Errorf("get %s %s/%s: %w", workloadKindDeployment, namespace, workload, err)
+	}
+
+	_, err = deployments.Create(ctx, i.buildReplica(original), metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("create replica of %s %s/%s: %w", workloadKindDeployment, namespace, workload, err)
+	}
+	return true, nil
+}
+
+// buildReplica clones a Deployment down to one pod. A sidecar that
+// workload-wide sessions injected into the original is not copied.
+func (i *WorkloadInjector) buildReplica(original *appsv1.Deployment) *appsv1.Deployment {
+	selector := original.Spec.Selector.DeepCopy()
+	if selector == nil {
+		selector = &metav1.LabelSelector{}
+	}
+	if selector.MatchLabels == nil {
+		selector.MatchLabels = map[string]string{}
+	}
+	selector.MatchLabels[ReplicaLabelKey] = original.Name
+
+	replica := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ReplicaName(original.Name),
+			Namespace: original.Namespace,
+			Labels:    map[string]string{ReplicaLabelKey: original.Name},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: appsv1.SchemeGroupVersion.String(),
+				Kind:       "Deployment",
+				Name:       original.Name,
+				UID:        original.UID,
+			}},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas:        new(int32(1)),
+			Selector:        selector,
+			Template:        *original.Spec.Template.DeepCopy(),
+			Strategy:        original.Spec.Strategy,
+			MinReadySeconds: original.Spec.MinReadySeconds,
+		},
+	}
+	if replica.Spec.Template.Labels == nil {
+		replica.Spec.Template.Labels = map[string]string{}
+	}
+	replica.Spec.Template.Labels[ReplicaLabelKey] = original.Name
+	// The clone only runs for sessions; with webhook injection its pod is
+	// admitted with the agent from the start.
+	replica.Spec.Template.Labels[TargetLabelKey] = targetLabelValue
+
+	if probes, ok := original.Annotations[OriginalProbesAnnotation]; ok {
+		replica.Annotations = map[string]string{OriginalProbesAnnotation: probes}
+	}
+	i.removeInjectedSidecarAndAnnotation(&workloadTarget{
+		kind:     workloadKindDeployment,
+		object:   replica,
+		template: &replica.Spec.Template,
+	})
+	return replica
+}
+
+// deleteReplica deletes a clone whose last session ended.
+func (i *WorkloadInjector) deleteReplica(ctx context.Context, namespace string, name string) error {
+	err := i.client.AppsV1().Deployments(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete %s %s/%s: %w", workloadKindDeployment, namespace, name, err)
+	}
+	return nil
+}
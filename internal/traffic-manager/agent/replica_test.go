@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWorkloadInjectorInjectsSingleReplicaIntoClone(t *testing.T) {
+	deployment := newTestDeployment("default", "orders-api")
+	deployment.Spec.Replicas = new(int32(3))
+	client := fake.NewSimpleClientset(deployment)
+	injector := NewWorkloadInjector(client, Options{})
+	session := contracts.DebugSession{
+		SessionID:     "sess_1",
+		SessionToken:  "token-1",
+		Namespace:     "default",
+		Workload:      "orders-api",
+		ServicePort:   8080,
+		SingleReplica: true,
+	}
+
+	if err := injector.Inject(context.Background(), session); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+
+	if containers := getWorkloadContainers(t, client, workloadKindDeployment, "default", "orders-api"); len(containers) != 1 {
+		t.Fatalf("expected the original deployment untouched, got %d containers", len(containers))
+	}
+	replica, err := client.AppsV1().Deployments("default").Get(context.Background(), ReplicaName("orders-api"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get replica: %v", err)
+	}
+	if *replica.Spec.Replicas != 1 {
+		t.Fatalf("expected one replica, got %d", *replica.Spec.Replicas)
+	}
+	if replica.Spec.Template.Labels["app"] != "orders-api" || replica.Spec.Template.Labels[ReplicaLabelKey] != "orders-api" {
+		t.Fatalf("expected the clone pods to keep the service labels, got %v", replica.Spec.Template.Labels)
+	}
+	if replica.Spec.Selector.MatchLabels[ReplicaLabelKey] != "orders-api" {
+		t.Fatalf("expected the clone selector to only match clone pods, got %v", replica.Spec.Selector.MatchLabels)
+	}
+	if len(replica.OwnerReferences) != 1 || replica.OwnerReferences[0].Name != "orders-api" {
+		t.Fatalf("expected the clone to be owned by the original, got %+v", replica.OwnerReferences)
+	}
+	containers := replica.Spec.Template.Spec.Containers
+	if len(containers) != 2 || readRoutes(containers[1])[0].SessionID != "sess_1" {
+		t.Fatalf("expected the sidecar in the clone, got %+v", containers)
+	}
+
+	if err := injector.Remove(context.Background(), session); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	_, err = client.AppsV1().Deployments("default").Get(context.Background(), ReplicaName("orders-api"), metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the clone deleted with its last session, got %v", err)
+	}
+}
+
+func TestBuildReplicaLeavesWorkloadSidecarOut(t *testing.T) {
+	deployment := newTestDeployment("default", "orders-api")
+	deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, corev1.Container{
+		Name:  DefaultContainerName,
+		Image: "agent:latest",
+	})
+	injector := NewWorkloadInjector(fake.NewSimpleClientset(), Options{})
+
+	replica := injector.buildReplica(deployment)
+	if containers := replica.Spec.Template.Spec.Containers; len(containers) != 1 || containers[0].Name != "app" {
+		t.Fatalf("expected only the app container in the clone, got %+v", containers)
+	}
+	if len(deployment.Spec.Template.Spec.Containers) != 2 {
+		t.Fatal("expected the original template to stay as it was")
+	}
+}
+
+func TestWorkloadInjectorReconcileDeletesOrphanedReplica(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"))
+	injector := NewWorkloadInjector(client, Options{})
+	kept := contracts.DebugSession{
+		SessionID:     "sess_kept",
+		SessionToken:  "token-kept",
+		Namespace:     "default",
+		Workload:      "orders-api",
+		ServicePort:   8080,
+		SingleReplica: true,
+	}
+	if err := injector.Inject(context.Background(), kept); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+
+	served, err := injector.Reconcile(context.Background(), []contracts.DebugSession{kept})
+	if err != nil || len(served) != 1 {
+		t.Fatalf("expected the clone's session to be kept, got %+v err=%v", served, err)
+	}
+
+	if _, err := injector.Reconcile(context.Background(), nil); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	_, err = client.AppsV1().Deployments("default").Get(context.Background(), ReplicaName("orders-api"), metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the orphaned clone deleted, got %v", err)
+	}
+}
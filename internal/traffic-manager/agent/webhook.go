@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/intercept"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RestartedAtAnnotation is bumped on a workload's pod template to replace
+// its pods, so the admission webhook sees them again.
+const RestartedAtAnnotation = "krun.ftechmax.net/restarted-at"
+
+// TargetLabelKey marks the pod templates of workloads with webhook
+// sessions, and single-replica clones. The webhook configuration only
+// selects pods carrying it, so other pod creations never reach the
+// manager.
+const TargetLabelKey = "krun.ftechmax.net/traffic-agent-target"
+
+const targetLabelValue = "true"
+
+// WebhookInjector injects the traffic-agent sidecar when the pods of a
+// workload with an active session are admitted, instead of patching the
+// pod template. Pods the workload starts later (scale-out, node drain) get
+// the agent too. Inject and Remove still replace the running pods, by
+// bumping an annotation on the template.
+type WebhookInjector struct {
+	workloads *WorkloadInjector
+	now       func() time.Time
+
+	mu       sync.RWMutex
+	sessions map[string]contracts.DebugSession
+}
+
+func NewWebhookInjector(client kubernetes.Interface, options Options) *WebhookInjector {
+	return &WebhookInjector{
+		workloads: NewWorkloadInjector(client, options),
+		now:       time.Now,
+		sessions:  map[string]contracts.DebugSession{},
+	}
+}
+
+func (i *WebhookInjector) Inject(ctx context.Context, session contracts.DebugSession) error {
+	namespace, workload, err := resolveTarget(session)
+	if err != nil {
+		return err
+	}
+	// The session goes in first: pods admitted from here on get the agent.
+	i.mu.Lock()
+	previous, existed := i.sessions[session.SessionID]
+	i.sessions[session.SessionID] = session
+	i.mu.Unlock()
+
+	findTarget := i.workloads.findWorkloadTarget
+	restart := true
+	if session.SingleReplica {
+		created, err := i.workloads.ensureReplica(ctx, namespace, workload)
+		if err != nil {
+			i.forget(session, previous, existed)
+			return err
+		}
+		workload = ReplicaName(workload)
+		findTarget = i.workloads.findReplicaTarget
+		// A new clone's only pod is admitted with the agent already.
+		restart = !created
+	}
+	if !restart {
+		return nil
+	}
+	if err := i.restart(ctx, namespace, workload, findTarget, true); err != nil {
+		i.forget(session, previous, existed)
+		return err
+	}
+	return nil
+}
+
+func (i *WebhookInjector) Remove(ctx context.Context, session contracts.DebugSession) error {
+	namespace, workload, err := resolveInjectedTarget(session)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	delete(i.sessions, session.SessionID)
+	i.mu.Unlock()
+
+	targeted := len(i.sessionsFor(namespace, workload)) > 0
+	if !session.SingleReplica {
+		return i.restart(ctx, namespace, workload, i.workloads.findWorkloadTarget, targeted)
+	}
+	if !targeted {
+		return i.workloads.deleteReplica(ctx, namespace, workload)
+	}
+	return i.restart(ctx, namespace, workload, i.workloads.findReplicaTarget, true)
+}
+
+// Reconcile takes over the restored sessions whose workload still exists.
+// Sidecars a template-mode manager left in pod templates are stripped, and
+// clones no restored session uses are deleted.
+func (i *WebhookInjector) Reconcile(ctx context.Context, sessions []contracts.DebugSession) ([]contracts.DebugSession, error) {
+	_, err := i.workloads.Reconcile(ctx, nil)
+	errs := []error{err}
+
+	kept := make([]contracts.DebugSession, 0, len(sessions))
+	replicas := map[workloadIdentifier]bool{}
+	for _, debugSession := range sessions {
+		namespace, workload, err := resolveInjectedTarget(debugSession)
+		if err != nil {
+			continue
+		}
+		findTarget := i.workloads.findWorkloadTarget
+		if debugSession.SingleReplica {
+			findTarget = i.workloads.findReplicaTarget
+		}
+		if _, err := findTarget(ctx, namespace, workload); err != nil {
+			if !errors.Is(err, ErrWorkloadNotFound) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if debugSession.SingleReplica {
+			replicas[workloadIdentifier{namespace: namespace, workload: workload}] = true
+		}
+		kept = append(kept, debugSession)
+	}
+
+	i.mu.Lock()
+	i.sessions = make(map[string]contracts.DebugSession, len(kept))
+	for _, debugSession := range kept {
+		i.sessions[debugSession.SessionID] = debugSession
+	}
+	i.mu.Unlock()
+
+	list, err := i.workloads.client.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: ReplicaLabelKey})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("list single-replica clones: %w", err))
+	} else {
+		for _, replica := range list.Items {
+			if !replicas[workloadIdentifier{namespace: replica.Namespace, workload: replica.Name}] {
+				errs = append(errs, i.workloads.deleteReplica(ctx, replica.Namespace, replica.Name))
+			}
+		}
+	}
+	return kept, errors.Join(errs...)
+}
+
+// ServeHTTP answers the API server's admission reviews of pods. Pods are
+// always admitted; the ones of a workload with active sessions are patched
+// to carry the agent.
+func (i *WebhookInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionv1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+	patch, err := i.admit(r.Context(), review.Request)
+	if err != nil {
+		log.Printf("admission of pod %s/%s: %v", review.Request.Namespace, review.Request.Name, err)
+	} else if patch != nil {
+		patchType := admissionv1.PatchTypeJSONPatch
+		response.Patch = patch
+		response.PatchType = &patchType
+	}
+	review.Request = nil
+	review.Response = response
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(review)
+}
+
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// admit returns the JSON patch that adds the agent to an admitted pod, or
+// nil when the pod is left alone.
+func (i *WebhookInjector) admit(ctx context.Context, request *admissionv1.AdmissionRequest) ([]byte, error) {
+	if request.Operation != admissionv1.Create || request.Kind.Kind != "Pod" {
+		return nil, nil
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(request.Object.Raw, &pod); err != nil {
+		return nil, fmt.Errorf("decode pod: %w", err)
+	}
+	if findContainerIndex(pod.Spec.Containers, i.workloads.options.ContainerName) >= 0 {
+		return nil, nil
+	}
+	workload, err := i.podWorkload(ctx, request.Namespace, &pod)
+	if err != nil || workload == "" {
+		return nil, err
+	}
+	sessions := i.sessionsFor(request.Namespace, workload)
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+
+	// Later sessions win where routes collide, as if they had been
+	// injected into the template one after the other. Each route keeps
+	// its session's port; the agent's target port is the last session's.
+	var routes []contracts.InterceptRoute
+	var ports []contracts.PortMapping
+	for _, debugSession := range sessions {
+		route := i.workloads.withOpaquePorts(ctx, debugSession, pod.Spec, sessionRoute(debugSession))
+		if len(route.Ports) == 0 {
+			route.Ports = []int{debugSession.ServicePort}
+		}
+		routes = mergeRoute(routes, route)
+		ports = append(ports, intercept.SessionPorts(debugSession)...)
+	}
+
+	template := &corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec}
+	target := &workloadTarget{kind: workloadKindPod, object: &template.ObjectMeta, template: template}
+	i.workloads.rewriteProbes(target, ports)
+	template.Spec.Containers = append(template.Spec.Containers, i.workloads.buildContainer(sessions[len(sessions)-1], routes))
+	operations := []patchOperation{
+		{Op: "replace", Path: "/spec/containers", Value: template.Spec.Containers},
+	}
+	if i.workloads.syncInitContainer(template) {
+		operations = append(operations, patchOperation{Op: "add", Path: "/spec/initContainers", Value: template.Spec.InitContainers})
+	}
+	if len(template.Annotations) > 0 {
+		operations = append(operations, patchOperation{Op: "add", Path: "/metadata/annotations", Value: template.Annotations})
+	}
+	return json.Marshal(operations)
+}
+
+// podWorkload returns the name of the workload a pod belongs to: the
+// topmost controller above it, or the pod itself when it has none.
+func (i *WebhookInjector) podWorkload(ctx context.Context, namespace string, pod *corev1.Pod) (string, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return pod.Name, nil
+	}
+	switch owner.Kind {
+	case "ReplicaSet":
+		replicaSet, err := i.workloads.client.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("get replicaset %s/%s: %w", namespace, owner.Name, err)
+		}
+		// A Deployment or an Argo Rollout.
+		if controller := metav1.GetControllerOf(replicaSet); controller != nil {
+			return controller.Name, nil
+		}
+	case "Job":
+		job, err := i.workloads.client.BatchV1().Jobs(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("get job %s/%s: %w", namespace, owner.Name, err)
+		}
+		if cronJob := metav1.GetControllerOf(job); cronJob != nil && cronJob.Kind == "CronJob" {
+			return cronJob.Name, nil
+		}
+	}
+	return owner.Name, nil
+}
+
+// sessionsFor returns the sessions injected into a workload, oldest first.
+func (i *WebhookInjector) sessionsFor(namespace string, workload string) []contracts.DebugSession {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var sessions []contracts.DebugSession
+	for _, debugSession := range i.sessions {
+		sessionNamespace, sessionWorkload, err := resolveInjectedTarget(debugSession)
+		if err == nil && sessionNamespace == namespace && sessionWorkload == workload {
+			sessions = append(sessions, debugSession)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b contracts.DebugSession) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), cmp.Compare(a.SessionID, b.SessionID))
+	})
+	return sessions
+}
+
+// restart replaces the pods of a workload by bumping an annotation on its
+// pod template. Pods of a targeted workload carry TargetLabelKey, so the
+// webhook sees them; the label goes with the last session.
+func (i *WebhookInjector) restart(ctx context.Context, namespace string, workload string, findTarget workloadFinder, targeted bool) error {
+	restartedAt := i.now().UTC().Format(time.RFC3339Nano)
+	return i.workloads.mutateWorkload(ctx, namespace, workload, findTarget, "restarting pods for the traffic-agent", func(target *workloadTarget) bool {
+		if target.template.Annotations == nil {
+			target.template.Annotations = map[string]string{}
+		}
+		target.template.Annotations[RestartedAtAnnotation] = restartedAt
+		if targeted {
+			if target.template.Labels == nil {
+				target.template.Labels = map[string]string{}
+			}
+			target.template.Labels[TargetLabelKey] = targetLabelValue
+		} else {
+			delete(target.template.Labels, TargetLabelKey)
+		}
+		return true
+	})
+}
+
+// forget undoes the registration of a session whose injection failed.
+func (i *WebhookInjector) forget(session contracts.DebugSession, previous contracts.DebugSession, existed bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if existed {
+		i.sessions[session.SessionID] = previous
+	} else {
+		delete(i.sessions, session.SessionID)
+	}
+}
@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWebhookInjectorInjectsAdmittedPods(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newTestDeployment("default", "orders-api"),
+		newTestOwnedReplicaSet("default", "orders-api-5d8f", "orders-api"),
+	)
+	injector := NewWebhookInjector(client, Options{})
+	injector.now = func() time.Time { return time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC) }
+	session := contracts.DebugSession{
+		SessionID:    "sess_1",
+		SessionToken: "token-1",
+		Namespace:    "default",
+		Workload:     "orders-api",
+		ServicePort:  8080,
+	}
+
+	if err := injector.Inject(context.Background(), session); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	deployment, err := client.AppsV1().Deployments("default").Get(context.Background(), "orders-api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+	if len(deployment.Spec.Template.Spec.Containers) != 1 {
+		t.Fatalf("expected the template to keep its containers, got %d", len(deployment.Spec.Template.Spec.Containers))
+	}
+	if deployment.Spec.Template.Annotations[RestartedAtAnnotation] != "2026-10-17T12:00:00Z" {
+		t.Fatalf("expected the pods to be restarted, got annotations %v", deployment.Spec.Template.Annotations)
+	}
+	if deployment.Spec.Template.Labels[TargetLabelKey] != targetLabelValue {
+		t.Fatalf("expected the pods labelled for the webhook, got labels %v", deployment.Spec.Template.Labels)
+	}
+
+	pod := newTestPod("default", "", "orders-api", corev1.PodPending)
+	pod.OwnerReferences = []metav1.OwnerReference{controllerReference("ReplicaSet", "orders-api-5d8f")}
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 8080}}
+	pod.Spec.Containers[0].ReadinessProbe = &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/ready", Port: intstr.FromInt32(8080)}},
+	}
+	response := admitPod(t, injector, pod)
+	if !response.Allowed || response.PatchType == nil || *response.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Fatalf("expected an allowed JSON patch, got %+v", response)
+	}
+	var operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(response.Patch, &operations); err != nil {
+		t.Fatalf("decode patch: %v", err)
+	}
+	patched := map[string]json.RawMessage{}
+	for _, operation := range operations {
+		patched[operation.Path] = operation.Value
+	}
+	var containers []corev1.Container
+	if err := json.Unmarshal(patched["/spec/containers"], &containers); err != nil {
+		t.Fatalf("decode containers: %v", err)
+	}
+	if len(containers) != 2 || containers[1].Name != DefaultContainerName {
+		t.Fatalf("expected the agent appended to the pod, got %+v", containers)
+	}
+	if routes := readRoutes(containers[1]); len(routes) != 1 || routes[0].SessionID != "sess_1" {
+		t.Fatalf("expected the agent to serve the session, got %+v", routes)
+	}
+	if port := containers[0].ReadinessProbe.HTTPGet.Port.IntValue(); port != DefaultProbePort {
+		t.Fatalf("expected the readiness probe to target the agent, got port %d", port)
+	}
+	var annotations map[string]string
+	if err := json.Unmarshal(patched["/metadata/annotations"], &annotations); err != nil || annotations[OriginalProbesAnnotation] == "" {
+		t.Fatalf("expected the original probes recorded on the pod, got %s", patched["/metadata/annotations"])
+	}
+
+	other := newTestPod("default", "", "billing-api", corev1.PodPending)
+	if response := admitPod(t, injector, other); !response.Allowed || response.Patch != nil {
+		t.Fatalf("expected a pod without sessions admitted untouched, got %+v", response)
+	}
+
+	if err := injector.Remove(context.Background(), session); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if response := admitPod(t, injector, pod); !response.Allowed || response.Patch != nil {
+		t.Fatalf("expected no patch once the session is removed, got %+v", response)
+	}
+	deployment, err = client.AppsV1().Deployments("default").Get(context.Background(), "orders-api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+	if _, ok := deployment.Spec.Template.Labels[TargetLabelKey]; ok {
+		t.Fatalf("expected the webhook label removed with the last session, got labels %v", deployment.Spec.Template.Labels)
+	}
+}
+
+func TestWebhookInjectorReconcileKeepsSessionsOfExistingWorkloads(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestDeployment("default", "orders-api"))
+	injector := NewWebhookInjector(client, Options{})
+
+	kept, err := injector.Reconcile(context.Background(), []contracts.DebugSession{
+		{SessionID: "sess_kept", Namespace: "default", Workload: "orders-api"},
+		{SessionID: "sess_gone", Namespace: "default", Workload: "billing-api"},
+	})
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if len(kept) != 1 || kept[0].SessionID != "sess_kept" {
+		t.Fatalf("expected only the session of the existing workload kept, got %+v", kept)
+	}
+	if sessions := injector.sessionsFor("default", "orders-api"); len(sessions) != 1 {
+		t.Fatalf("expected the kept session to be injected into admitted pods, got %+v", sessions)
+	}
+}
+
+func admitPod(t *testing.T, injector *WebhookInjector, pod *corev1.Pod) *admissionv1.AdmissionResponse {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("encode pod: %v", err)
+	}
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("review-1"),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: pod.Namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("encode review: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	injector.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", recorder.Code)
+	}
+	var answer admissionv1.AdmissionReview
+	if err := json.Unmarshal(recorder.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("decode review: %v", err)
+	}
+	if answer.Response == nil || answer.Response.UID != "review-1" {
+		t.Fatalf("expected a response to the review, got %+v", answer.Response)
+	}
+	return answer.Response
+}
+
+func newTestOwnedReplicaSet(namespace string, name string, deployment string) *appsv1.ReplicaSet {
+	return &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			OwnerReferences: []metav1.OwnerReference{controllerReference("Deployment", deployment)},
+		},
+	}
+}
+
+func controllerReference(kind string, name string) metav1.OwnerReference {
+	return metav1.OwnerReference{APIVersion: "apps/v1", Kind: kind, Name: name, Controller: new(true)}
+}
@@ -0,0 +1,351 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/intercept"
+	"github.com/ftechmax/krun/internal/traffic-manager/agent"
+	"github.com/ftechmax/krun/internal/traffic-manager/session"
+	"github.com/ftechmax/krun/internal/traffic-manager/stream"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Status conditions lag the relay by at most this long.
+const statusSyncInterval = 10 * time.Second
+
+// Controller reconciles DebugSession resources. Resources declared by
+// users become sessions the way POST /v1/sessions creates them; the
+// resources the manager writes for API sessions only get their status
+// kept up to date. Deleting any resource ends its session.
+type Controller struct {
+	client   dynamic.Interface
+	registry *session.DebugSessionRegistry
+	injector agent.Injector
+	relay    *stream.SessionRelayRegistry
+	store    session.Store
+
+	// mu serializes reconciles with delete events, so a resource deleted
+	// mid-reconcile is never adopted again from a stale list.
+	mu sync.Mutex
+	// failures holds the Injected condition of declared sessions the
+	// manager could not set up, keyed by session id.
+	failures map[string]metav1.Condition
+}
+
+func New(client dynamic.Interface, registry *session.DebugSessionRegistry, injector agent.Injector, relay *stream.SessionRelayRegistry, store session.Store) *Controller {
+	return &Controller{
+		client:   client,
+		registry: registry,
+		injector: injector,
+		relay:    relay,
+		store:    store,
+		failures: map[string]metav1.Condition{},
+	}
+}
+
+// Run watches DebugSession resources in all namespaces until ctx ends.
+func (c *Controller) Run(ctx context.Context) {
+	informer := dynamicinformer.NewFilteredDynamicInformer(c.client, session.DebugSessionResource,
+		metav1.NamespaceAll, 0, cache.Indexers{}, nil)
+
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	_, err := informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { notify() },
+		UpdateFunc: func(any, any) { notify() },
+		DeleteFunc: func(obj any) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if deleted, ok := obj.(*unstructured.Unstructured); ok {
+				c.Forget(ctx, deleted)
+			}
+		},
+	})
+	if err != nil {
+		log.Printf("watch DebugSessions: %v", err)
+		return
+	}
+
+	go informer.Informer().Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return
+	}
+	log.Printf("watching DebugSession resources")
+
+	ticker := time.NewTicker(statusSyncInterval)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		listed, err := informer.Lister().List(labels.Everything())
+		if err != nil {
+			log.Printf("list DebugSessions: %v", err)
+		} else {
+			c.reconcileLocked(ctx, unstructuredObjects(listed))
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile brings the sessions and resource statuses in line with the
+// given resources.
+func (c *Controller) Reconcile(ctx context.Context, objects []*unstructured.Unstructured) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconcileLocked(ctx, objects)
+}
+
+// Forget ends the session of a deleted resource.
+func (c *Controller) Forget(ctx context.Context, obj *unstructured.Unstructured) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resource, err := session.DecodeResource(obj)
+	if err != nil {
+		log.Printf("forget DebugSession: %v", err)
+		return
+	}
+	declared := session.SessionFromResource(resource)
+	delete(c.failures, declared.SessionID)
+	current, ok := c.registry.Get(declared.SessionID)
+	if !ok || current.Namespace != declared.Namespace {
+		// Already gone, e.g. the manager deleted the resource itself.
+		return
+	}
+
+	if err := c.injector.Remove(ctx, current); err != nil && !errors.Is(err, agent.ErrWorkloadNotFound) {
+		// The route is stripped by the next startup reconcile at the latest.
+		log.Printf("DebugSession %s/%s deleted: remove traffic-agent sidecar: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+	c.registry.Delete(current.SessionID)
+	c.relay.ForgetLease(current.SessionID)
+	log.Printf("debug session %s ended: DebugSession %s/%s deleted", current.SessionID, obj.GetNamespace(), obj.GetName())
+}
+
+func (c *Controller) reconcileLocked(ctx context.Context, objects []*unstructured.Unstructured) {
+	for _, obj := range objects {
+		resource, err := session.DecodeResource(obj)
+		if err != nil {
+			log.Printf("reconcile DebugSession: %v", err)
+			continue
+		}
+		declared := session.SessionFromResource(resource)
+		if declared.Origin == contracts.SessionOriginResource {
+			current, ok := c.registry.Get(declared.SessionID)
+			if !ok || routeChanged(current, declared) {
+				c.apply(ctx, resource, declared, current, ok)
+			}
+		}
+		c.syncStatus(ctx, obj, resource, declared.SessionID)
+	}
+}
+
+// apply sets up a declared session, replacing the route of the session's
+// previous spec if there was one.
+func (c *Controller) apply(ctx context.Context, resource session.DebugSessionObject, declared contracts.DebugSession, current contracts.DebugSession, known bool) {
+	if known {
+		if err := c.injector.Remove(ctx, current); err != nil && !errors.Is(err, agent.ErrWorkloadNotFound) {
+			c.fail(declared.SessionID, "RemoveFailed", fmt.Errorf("remove previous route: %w", err))
+			return
+		}
+		c.registry.Delete(current.SessionID)
+		// Attached peers keep authenticating with the token they have.
+		declared.SessionToken = current.SessionToken
+	}
+
+	adopted, superseded, err := c.registry.Adopt(declared)
+	if err != nil {
+		reason := "Invalid"
+		if errors.Is(err, session.ErrSessionConflict) {
+			reason = "Conflict"
+		}
+		c.fail(declared.SessionID, reason, err)
+		return
+	}
+	if err := c.injector.Inject(ctx, adopted); err != nil {
+		c.registry.Delete(adopted.SessionID)
+		c.registry.Restore(superseded)
+		reason := "InjectFailed"
+		if errors.Is(err, agent.ErrWorkloadNotFound) {
+			reason = "WorkloadNotFound"
+		}
+		c.fail(declared.SessionID, reason, err)
+		return
+	}
+	delete(c.failures, adopted.SessionID)
+
+	owner := fmt.Sprintf("DebugSession %s/%s", resource.Namespace, resource.Name)
+	for _, previous := range superseded {
+		log.Printf("debug session %s superseded by %s", previous.SessionID, owner)
+		c.relay.ForgetLease(previous.SessionID)
+		c.relay.NotifySuperseded(previous.SessionID, owner)
+		if err := c.store.Delete(ctx, previous); err != nil {
+			log.Printf("forget stored debug session %s: %v", previous.SessionID, err)
+		}
+	}
+	log.Printf("debug session %s set up from %s (%s/%s)", adopted.SessionID, owner, adopted.Namespace, adopted.Workload)
+}
+
+func (c *Controller) fail(sessionID string, reason string, err error) {
+	// Failed sessions are retried on every sync; log each failure once.
+	if previous, ok := c.failures[sessionID]; !ok || previous.Reason != reason || previous.Message != err.Error() {
+		log.Printf("debug session %s: %v", sessionID, err)
+	}
+	c.failures[sessionID] = metav1.Condition{
+		Type:    session.ConditionInjected,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: err.Error(),
+	}
+}
+
+// syncStatus writes the session token and conditions to the resource
+// when they changed.
+func (c *Controller) syncStatus(ctx context.Context, obj *unstructured.Unstructured, resource session.DebugSessionObject, sessionID string) {
+	status := resource.Status
+	status.Conditions = slices.Clone(status.Conditions)
+	changed := false
+
+	registered, ok := c.registry.Get(sessionID)
+	if ok && status.SessionToken != registered.SessionToken {
+		status.SessionToken = registered.SessionToken
+		changed = true
+	}
+
+	injected := metav1.Condition{
+		Type:    session.ConditionInjected,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Injected",
+		Message: "the traffic-agent sidecar routes this session",
+	}
+	if !ok {
+		if failure, failed := c.failures[sessionID]; failed {
+			injected = failure
+		} else {
+			injected = metav1.Condition{
+				Type:    session.ConditionInjected,
+				Status:  metav1.ConditionFalse,
+				Reason:  "Pending",
+				Message: "waiting for the traffic-manager to set up the session",
+			}
+		}
+	}
+	conditions := []metav1.Condition{
+		injected,
+		attachedCondition(session.ConditionAgentAttached, ok && c.relay.AgentConnected(sessionID), "traffic-agent"),
+		attachedCondition(session.ConditionClientAttached, ok && c.relay.ClientConnected(sessionID), "krun-helper"),
+	}
+	for _, condition := range conditions {
+		condition.ObservedGeneration = resource.Generation
+		if meta.SetStatusCondition(&status.Conditions, condition) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		log.Printf("encode DebugSession %s/%s status: %v", obj.GetNamespace(), obj.GetName(), err)
+		return
+	}
+	updated := obj.DeepCopy()
+	updated.Object["status"] = content
+	_, err = c.client.Resource(session.DebugSessionResource).Namespace(obj.GetNamespace()).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if err != nil && !apierrors.IsConflict(err) && !apierrors.IsNotFound(err) {
+		// Conflicts and deletions are picked up by the next sync.
+		log.Printf("update DebugSession %s/%s status: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+}
+
+func attachedCondition(conditionType string, attached bool, peer string) metav1.Condition {
+	if attached {
+		return metav1.Condition{
+			Type:    conditionType,
+			Status:  metav1.ConditionTrue,
+			Reason:  "Connected",
+			Message: peer + " stream attached",
+		}
+	}
+	return metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionFalse,
+		Reason:  "NotConnected",
+		Message: "no " + peer + " stream attached",
+	}
+}
+
+// routeChanged reports whether the spec of a declared session moved away
+// from the session the manager set up for it.
+func routeChanged(current contracts.DebugSession, declared contracts.DebugSession) bool {
+	serviceName := strings.TrimSpace(declared.ServiceName)
+	workload := strings.TrimSpace(declared.Workload)
+	if workload == "" {
+		workload = serviceName
+	}
+	mode, err := intercept.NormalizeMode(declared.Mode)
+	if err != nil {
+		return true
+	}
+	declaredPorts, err := intercept.NormalizePorts(declared.ServicePort, declared.LocalPort, declared.Ports)
+	if err != nil {
+		return true
+	}
+	injection, err := intercept.NormalizeInjection(declared.Injection)
+	if err != nil {
+		return true
+	}
+	udpTargets, err := session.NormalizeUDPTargets(declared.UDPTargets)
+	if err != nil {
+		return true
+	}
+	return current.Namespace != declared.Namespace ||
+		current.ServiceName != serviceName ||
+		current.Workload != workload ||
+		!slices.Equal(intercept.SessionPorts(current), declaredPorts) ||
+		current.Mode != mode ||
+		current.SingleReplica != declared.SingleReplica ||
+		current.Injection != injection ||
+		current.LeaseTTLSeconds != declared.LeaseTTLSeconds ||
+		!slices.Equal(current.UDPTargets, udpTargets) ||
+		!intercept.EqualHeaders(current.InterceptHeaders, intercept.NormalizeHeaders(declared.InterceptHeaders))
+}
+
+func unstructuredObjects(listed []runtime.Object) []*unstructured.Unstructured {
+	objects := make([]*unstructured.Unstructured, 0, len(listed))
+	for _, item := range listed {
+		if obj, ok := item.(*unstructured.Unstructured); ok {
+			objects = append(objects, obj)
+		}
+	}
+	return objects
+}
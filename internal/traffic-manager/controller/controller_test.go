@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/traffic-manager/agent"
+	"github.com/ftechmax/krun/internal/traffic-manager/session"
+	"github.com/ftechmax/krun/internal/traffic-manager/stream"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+type fakeInjector struct {
+	injectErr error
+	injected  []string
+	removed   []string
+}
+
+func (f *fakeInjector) Inject(_ context.Context, debugSession contracts.DebugSession) error {
+	if f.injectErr != nil {
+		return f.injectErr
+	}
+	f.injected = append(f.injected, debugSession.SessionID)
+	return nil
+}
+
+func (f *fakeInjector) Remove(_ context.Context, debugSession contracts.DebugSession) error {
+	f.removed = append(f.removed, debugSession.SessionID)
+	return nil
+}
+
+func (f *fakeInjector) Reconcile(_ context.Context, sessions []contracts.DebugSession) ([]contracts.DebugSession, error) {
+	return sessions, nil
+}
+
+type fakeStore struct {
+	session.NoopStore
+	deletes []string
+}
+
+func (f *fakeStore) Delete(_ context.Context, debugSession contracts.DebugSession) error {
+	f.deletes = append(f.deletes, debugSession.SessionID)
+	return nil
+}
+
+func declaredResource(t *testing.T, localPort int) *unstructured.Unstructured {
+	t.Helper()
+	obj, err := session.EncodeResource(session.DebugSessionObject{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders-debug", Namespace: "shop", Generation: 1},
+		Spec: session.DebugSessionSpec{
+			ServiceName: "orders-api",
+			ServicePort: 8080,
+			LocalPort:   localPort,
+		},
+	})
+	if err != nil {
+		t.Fatalf("encode resource: %v", err)
+	}
+	return obj
+}
+
+func newTestController(objects ...runtime.Object) (*Controller, *dynamicfake.FakeDynamicClient, *fakeInjector, *fakeStore) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		session.DebugSessionResource: session.ResourceKind + "List",
+	}, objects...)
+	injector := &fakeInjector{}
+	store := &fakeStore{}
+	controller := New(client, session.NewDebugSessionRegistry(), injector, stream.NewSessionRelayRegistry(), store)
+	return controller, client, injector, store
+}
+
+func readStatus(t *testing.T, client *dynamicfake.FakeDynamicClient) session.DebugSessionStatus {
+	t.Helper()
+	obj, err := client.Resource(session.DebugSessionResource).Namespace("shop").Get(context.Background(), "orders-debug", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get resource: %v", err)
+	}
+	resource, err := session.DecodeResource(obj)
+	if err != nil {
+		t.Fatalf("decode resource: %v", err)
+	}
+	return resource.Status
+}
+
+func TestReconcileSetsUpDeclaredSession(t *testing.T) {
+	obj := declaredResource(t, 5005)
+	controller, client, injector, store := newTestController(obj)
+
+	apiSession, _, err := controller.registry.Create(contracts.CreateDebugSessionRequest{
+		Namespace:   "shop",
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+	})
+	if err != nil {
+		t.Fatalf("create api session: %v", err)
+	}
+
+	controller.Reconcile(context.Background(), []*unstructured.Unstructured{obj})
+
+	adopted, ok := controller.registry.Get("shop.orders-debug")
+	if !ok || adopted.Origin != contracts.SessionOriginResource {
+		t.Fatalf("expected declared session to be registered, got %+v", adopted)
+	}
+	if len(injector.injected) != 1 || injector.injected[0] != "shop.orders-debug" {
+		t.Fatalf("expected declared session to be injected, got %v", injector.injected)
+	}
+	if _, ok := controller.registry.Get(apiSession.SessionID); ok {
+		t.Fatal("expected the api session for the same route to be superseded")
+	}
+	if len(store.deletes) != 1 || store.deletes[0] != apiSession.SessionID {
+		t.Fatalf("expected superseded session to leave the store, got %v", store.deletes)
+	}
+
+	status := readStatus(t, client)
+	if status.SessionToken != adopted.SessionToken {
+		t.Fatalf("expected status to carry the session token, got %q", status.SessionToken)
+	}
+	if !meta.IsStatusConditionTrue(status.Conditions, session.ConditionInjected) {
+		t.Fatalf("expected Injected condition, got %+v", status.Conditions)
+	}
+	if meta.IsStatusConditionTrue(status.Conditions, session.ConditionClientAttached) ||
+		meta.IsStatusConditionTrue(status.Conditions, session.ConditionAgentAttached) {
+		t.Fatalf("expected no attached peers, got %+v", status.Conditions)
+	}
+
+	// A spec change moves the route.
+	controller.Reconcile(context.Background(), []*unstructured.Unstructured{declaredResource(t, 6006)})
+	moved, _ := controller.registry.Get("shop.orders-debug")
+	if moved.LocalPort != 6006 || moved.SessionToken != adopted.SessionToken {
+		t.Fatalf("expected session to follow the spec and keep its token, got %+v", moved)
+	}
+	if len(injector.removed) != 1 || len(injector.injected) != 2 {
+		t.Fatalf("expected the old route to be replaced, removed=%v injected=%v", injector.removed, injector.injected)
+	}
+}
+
+func TestReconcileReportsInjectFailure(t *testing.T) {
+	obj := declaredResource(t, 5005)
+	controller, client, injector, _ := newTestController(obj)
+	injector.injectErr = agent.ErrWorkloadNotFound
+
+	controller.Reconcile(context.Background(), []*unstructured.Unstructured{obj})
+
+	if _, ok := controller.registry.Get("shop.orders-debug"); ok {
+		t.Fatal("a session that failed to inject must not stay registered")
+	}
+	injected := meta.FindStatusCondition(readStatus(t, client).Conditions, session.ConditionInjected)
+	if injected == nil || injected.Status != metav1.ConditionFalse || injected.Reason != "WorkloadNotFound" {
+		t.Fatalf("expected failed Injected condition, got %+v", injected)
+	}
+}
+
+func TestForgetEndsSession(t *testing.T) {
+	obj := declaredResource(t, 5005)
+	controller, _, injector, _ := newTestController(obj)
+	controller.Reconcile(context.Background(), []*unstructured.Unstructured{obj})
+
+	controller.Forget(context.Background(), obj)
+
+	if _, ok := controller.registry.Get("shop.orders-debug"); ok {
+		t.Fatal("expected deleted resource to end its session")
+	}
+	if len(injector.removed) != 1 || injector.removed[0] != "shop.orders-debug" {
+		t.Fatalf("expected sidecar route to be removed, got %v", injector.removed)
+	}
+
+	// Deleting a resource whose session is already gone is a no-op.
+	controller.Forget(context.Background(), obj)
+	if len(injector.removed) != 1 {
+		t.Fatalf("expected no second removal, got %v", injector.removed)
+	}
+}
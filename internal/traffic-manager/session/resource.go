@@ -0,0 +1,299 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	ResourceGroup   = "krun.ftechmax.net"
+	ResourceVersion = "v1alpha1"
+	ResourceKind    = "DebugSession"
+
+	// managedByLabel marks the resources the manager created for API
+	// sessions; everything else was declared by a user.
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "krun-traffic-manager"
+
+	ConditionInjected       = "Injected"
+	ConditionAgentAttached  = "AgentAttached"
+	ConditionClientAttached = "ClientAttached"
+)
+
+var DebugSessionResource = schema.GroupVersionResource{
+	Group:    ResourceGroup,
+	Version:  ResourceVersion,
+	Resource: "debugsessions",
+}
+
+// DebugSessionObject is the typed form of a DebugSession resource. The
+// resource lives in the namespace of the workload it debugs.
+type DebugSessionObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DebugSessionSpec   `json:"spec"`
+	Status DebugSessionStatus `json:"status,omitempty"`
+}
+
+type DebugSessionSpec struct {
+	// SessionID defaults to "<namespace>.<name>".
+	SessionID        string            `json:"sessionID,omitempty"`
+	ServiceName      string            `json:"serviceName"`
+	Workload         string            `json:"workload,omitempty"`
+	ServicePort      int               `json:"servicePort"`
+	LocalPort        int               `json:"localPort"`
+	ClientID         string            `json:"clientID,omitempty"`
+	KubeUser         string            `json:"kubeUser,omitempty"`
+	Hostname         string            `json:"hostname,omitempty"`
+	InterceptHeaders map[string]string `json:"interceptHeaders,omitempty"`
+	Mode             string            `json:"mode,omitempty"`
+	SingleReplica    bool              `json:"singleReplica,omitempty"`
+	Injection        string            `json:"injection,omitempty"`
+	LeaseTTLSeconds  int               `json:"leaseTTLSeconds,omitempty"`
+	// Ports adds more intercepted ports to servicePort/localPort.
+	Ports []PortSpec `json:"ports,omitempty"`
+	// UDPTargets are the addresses the session's helper may relay UDP to.
+	UDPTargets []UDPTargetSpec `json:"udpTargets,omitempty"`
+}
+
+type PortSpec struct {
+	ServicePort int `json:"servicePort"`
+	LocalPort   int `json:"localPort"`
+}
+
+type UDPTargetSpec struct {
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	Pod       string `json:"pod,omitempty"`
+	Port      int    `json:"port"`
+}
+
+type DebugSessionStatus struct {
+	// SessionToken authenticates the stream peers of the session.
+	SessionToken string             `json:"sessionToken,omitempty"`
+	Conditions   []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ResourceName is the name of the resource the manager creates for an API
+// session; session ids contain underscores, which names may not.
+func ResourceName(sessionID string) string {
+	return strings.ReplaceAll(strings.ToLower(sessionID), "_", "-")
+}
+
+func DecodeResource(obj *unstructured.Unstructured) (DebugSessionObject, error) {
+	var resource DebugSessionObject
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), &resource); err != nil {
+		return DebugSessionObject{}, fmt.Errorf("decode DebugSession %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+	return resource, nil
+}
+
+func EncodeResource(resource DebugSessionObject) (*unstructured.Unstructured, error) {
+	resource.APIVersion = ResourceGroup + "/" + ResourceVersion
+	resource.Kind = ResourceKind
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&resource)
+	if err != nil {
+		return nil, fmt.Errorf("encode DebugSession %s/%s: %w", resource.Namespace, resource.Name, err)
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+// SessionFromResource returns the session a resource declares.
+func SessionFromResource(resource DebugSessionObject) contracts.DebugSession {
+	sessionID := strings.TrimSpace(resource.Spec.SessionID)
+	if sessionID == "" {
+		sessionID = resource.Namespace + "." + resource.Name
+	}
+	origin := contracts.SessionOriginResource
+	if resource.Labels[managedByLabel] == managedByValue {
+		origin = contracts.SessionOriginAPI
+	}
+	createdAt := ""
+	if !resource.CreationTimestamp.IsZero() {
+		createdAt = resource.CreationTimestamp.UTC().Format(time.RFC3339)
+	}
+	return contracts.DebugSession{
+		SessionID:        sessionID,
+		SessionToken:     resource.Status.SessionToken,
+		Namespace:        resource.Namespace,
+		ServiceName:      resource.Spec.ServiceName,
+		Workload:         resource.Spec.Workload,
+		ServicePort:      resource.Spec.ServicePort,
+		LocalPort:        resource.Spec.LocalPort,
+		ClientID:         resource.Spec.ClientID,
+		KubeUser:         resource.Spec.KubeUser,
+		Hostname:         resource.Spec.Hostname,
+		CreatedAt:        createdAt,
+		InterceptHeaders: resource.Spec.InterceptHeaders,
+		Mode:             resource.Spec.Mode,
+		SingleReplica:    resource.Spec.SingleReplica,
+		Injection:        resource.Spec.Injection,
+		LeaseTTLSeconds:  resource.Spec.LeaseTTLSeconds,
+		Ports:            portsFromSpec(resource.Spec.Ports),
+		UDPTargets:       udpTargetsFromSpec(resource.Spec.UDPTargets),
+		Origin:           origin,
+	}
+}
+
+func resourceForSession(session contracts.DebugSession) DebugSessionObject {
+	return DebugSessionObject{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ResourceName(session.SessionID),
+			Namespace: session.Namespace,
+			Labels:    map[string]string{managedByLabel: managedByValue},
+		},
+		Spec: DebugSessionSpec{
+			SessionID:        session.SessionID,
+			ServiceName:      session.ServiceName,
+			Workload:         session.Workload,
+			ServicePort:      session.ServicePort,
+			LocalPort:        session.LocalPort,
+			ClientID:         session.ClientID,
+			KubeUser:         session.KubeUser,
+			Hostname:         session.Hostname,
+			InterceptHeaders: session.InterceptHeaders,
+			Mode:             session.Mode,
+			SingleReplica:    session.SingleReplica,
+			Injection:        session.Injection,
+			LeaseTTLSeconds:  session.LeaseTTLSeconds,
+			Ports:            portsToSpec(session.Ports),
+			UDPTargets:       udpTargetsToSpec(session.UDPTargets),
+		},
+		Status: DebugSessionStatus{SessionToken: session.SessionToken},
+	}
+}
+
+func portsFromSpec(specs []PortSpec) []contracts.PortMapping {
+	if len(specs) == 0 {
+		return nil
+	}
+	ports := make([]contracts.PortMapping, 0, len(specs))
+	for _, spec := range specs {
+		ports = append(ports, contracts.PortMapping{ServicePort: spec.ServicePort, LocalPort: spec.LocalPort})
+	}
+	return ports
+}
+
+func portsToSpec(ports []contracts.PortMapping) []PortSpec {
+	if len(ports) == 0 {
+		return nil
+	}
+	specs := make([]PortSpec, 0, len(ports))
+	for _, port := range ports {
+		specs = append(specs, PortSpec{ServicePort: port.ServicePort, LocalPort: port.LocalPort})
+	}
+	return specs
+}
+
+func udpTargetsFromSpec(specs []UDPTargetSpec) []contracts.UDPTarget {
+	if len(specs) == 0 {
+		return nil
+	}
+	targets := make([]contracts.UDPTarget, 0, len(specs))
+	for _, spec := range specs {
+		targets = append(targets, contracts.UDPTarget(spec))
+	}
+	return targets
+}
+
+func udpTargetsToSpec(targets []contracts.UDPTarget) []UDPTargetSpec {
+	if len(targets) == 0 {
+		return nil
+	}
+	specs := make([]UDPTargetSpec, 0, len(targets))
+	for _, target := range targets {
+		specs = append(specs, UDPTargetSpec(target))
+	}
+	return specs
+}
+
+// CRDStore keeps every session as a DebugSession resource, so sessions
+// show up in kubectl and survive manager restarts. Sessions created through
+// the API get a manager-owned resource; resources declared by users are
+// loaded as-is and never written by the store.
+type CRDStore struct {
+	client dynamic.Interface
+}
+
+func NewCRDStore(client dynamic.Interface) *CRDStore {
+	return &CRDStore{client: client}
+}
+
+func (s *CRDStore) Load(ctx context.Context) ([]contracts.DebugSession, error) {
+	list, err := s.client.Resource(DebugSessionResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list DebugSessions: %w", err)
+	}
+
+	sessions := make([]contracts.DebugSession, 0, len(list.Items))
+	for index := range list.Items {
+		resource, err := DecodeResource(&list.Items[index])
+		if err != nil {
+			log.Printf("skipping unreadable stored session: %v", err)
+			continue
+		}
+		sessions = append(sessions, SessionFromResource(resource))
+	}
+	slices.SortFunc(sessions, func(a, b contracts.DebugSession) int {
+		return strings.Compare(a.SessionID, b.SessionID)
+	})
+	return sessions, nil
+}
+
+func (s *CRDStore) Put(ctx context.Context, session contracts.DebugSession) error {
+	if session.Origin == contracts.SessionOriginResource {
+		return nil
+	}
+	obj, err := EncodeResource(resourceForSession(session))
+	if err != nil {
+		return err
+	}
+
+	resources := s.client.Resource(DebugSessionResource).Namespace(session.Namespace)
+	stored, err := resources.Create(ctx, obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		var existing *unstructured.Unstructured
+		existing, err = resources.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if err == nil {
+			obj.SetResourceVersion(existing.GetResourceVersion())
+			stored, err = resources.Update(ctx, obj, metav1.UpdateOptions{})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("write DebugSession %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	// Status is a subresource: the token only sticks through UpdateStatus.
+	if err := unstructured.SetNestedField(stored.Object, session.SessionToken, "status", "sessionToken"); err != nil {
+		return fmt.Errorf("set DebugSession token: %w", err)
+	}
+	if _, err := resources.UpdateStatus(ctx, stored, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("write DebugSession %s/%s status: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+	return nil
+}
+
+func (s *CRDStore) Delete(ctx context.Context, session contracts.DebugSession) error {
+	if session.Origin == contracts.SessionOriginResource {
+		return nil
+	}
+	name := ResourceName(session.SessionID)
+	err := s.client.Resource(DebugSessionResource).Namespace(session.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete DebugSession %s/%s: %w", session.Namespace, name, err)
+	}
+	return nil
+}
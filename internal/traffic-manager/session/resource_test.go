@@ -0,0 +1,94 @@
+package session
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		DebugSessionResource: ResourceKind + "List",
+	}, objects...)
+}
+
+func TestCRDStoreRoundTrip(t *testing.T) {
+	declared, err := EncodeResource(DebugSessionObject{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders-debug", Namespace: "shop"},
+		Spec: DebugSessionSpec{
+			ServiceName: "orders-api",
+			ServicePort: 8080,
+			LocalPort:   5005,
+		},
+	})
+	if err != nil {
+		t.Fatalf("encode declared resource: %v", err)
+	}
+	client := newFakeDynamicClient(declared)
+	store := NewCRDStore(client)
+
+	apiSession := contracts.DebugSession{
+		SessionID:    "sess_abc",
+		SessionToken: "token-abc",
+		Namespace:    "default",
+		ServiceName:  "billing-api",
+		Workload:     "billing-api",
+		ServicePort:  8080,
+		LocalPort:    5006,
+		Ports:        []contracts.PortMapping{{ServicePort: 8080, LocalPort: 5006}, {ServicePort: 9090, LocalPort: 5007}},
+		KubeUser:     "alice",
+		Mode:         contracts.SessionModeMirror,
+		Origin:       contracts.SessionOriginAPI,
+		UDPTargets:   []contracts.UDPTarget{{Namespace: "monitoring", Service: "statsd", Port: 8125}},
+	}
+	if err := store.Put(context.Background(), apiSession); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	// A second put replaces the resource instead of failing.
+	if err := store.Put(context.Background(), apiSession); err != nil {
+		t.Fatalf("put again: %v", err)
+	}
+
+	loaded, err := store.Load(context.Background())
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("expected two sessions, got %+v", loaded)
+	}
+	if loaded[0].SessionID != "sess_abc" || loaded[0].SessionToken != "token-abc" ||
+		loaded[0].KubeUser != "alice" || loaded[0].Mode != contracts.SessionModeMirror ||
+		loaded[0].Origin != contracts.SessionOriginAPI || len(loaded[0].Ports) != 2 || loaded[0].Ports[1].LocalPort != 5007 ||
+		!slices.Equal(loaded[0].UDPTargets, apiSession.UDPTargets) {
+		t.Fatalf("unexpected api session %+v", loaded[0])
+	}
+	if loaded[1].SessionID != "shop.orders-debug" || loaded[1].Origin != contracts.SessionOriginResource ||
+		loaded[1].Namespace != "shop" || loaded[1].LocalPort != 5005 {
+		t.Fatalf("unexpected declared session %+v", loaded[1])
+	}
+
+	// Declared resources belong to their author, not the store.
+	if err := store.Delete(context.Background(), loaded[1]); err != nil {
+		t.Fatalf("delete declared session: %v", err)
+	}
+	if err := store.Delete(context.Background(), apiSession); err != nil {
+		t.Fatalf("delete api session: %v", err)
+	}
+	if err := store.Delete(context.Background(), apiSession); err != nil {
+		t.Fatalf("delete unknown session: %v", err)
+	}
+
+	loaded, err = store.Load(context.Background())
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].SessionID != "shop.orders-debug" {
+		t.Fatalf("expected only the declared session to remain, got %+v", loaded)
+	}
+}
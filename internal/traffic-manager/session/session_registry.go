@@ -1,6 +1,7 @@
 package session
 
 import (
+	"cmp"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
@@ -11,9 +12,15 @@ import (
 	"time"
 
 	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/intercept"
 	"github.com/ftechmax/krun/internal/sessionkey"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// ErrSessionConflict is returned by Create when another owner holds the
+// session the request would replace and the request does not force it.
+var ErrSessionConflict = errors.New("session conflict")
+
 type DebugSessionRegistry struct {
 	mu       sync.RWMutex
 	sessions map[string]contracts.DebugSession
@@ -25,56 +32,201 @@ func NewDebugSessionRegistry() *DebugSessionRegistry {
 	}
 }
 
-func (s *DebugSessionRegistry) Create(req contracts.CreateDebugSessionRequest) (contracts.DebugSession, error) {
+// Create registers a new session and returns it along with the sessions
+// it superseded.
+func (s *DebugSessionRegistry) Create(req contracts.CreateDebugSessionRequest) (contracts.DebugSession, []contracts.DebugSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, err := normalizeSession(contracts.DebugSession{
+		Namespace:        req.Namespace,
+		ServiceName:      req.ServiceName,
+		Workload:         req.Workload,
+		ServicePort:      req.ServicePort,
+		LocalPort:        req.LocalPort,
+		ClientID:         req.ClientID,
+		KubeUser:         req.KubeUser,
+		Hostname:         req.Hostname,
+		InterceptHeaders: req.InterceptHeaders,
+		Mode:             req.Mode,
+		SingleReplica:    req.SingleReplica,
+		Injection:        req.Injection,
+		LeaseTTLSeconds:  req.LeaseTTLSeconds,
+		Ports:            req.Ports,
+		UDPTargets:       req.UDPTargets,
+	})
+	if err != nil {
+		return contracts.DebugSession{}, nil, err
+	}
+
+	// An earlier session for the same workload, header set and mode is
+	// replaced: the injector swaps its route in place. The same owner
+	// replaces it silently (e.g. after a helper restart skipped the
+	// delete); anyone else has to force the takeover. Sessions declared as
+	// resources are never taken over; their resource has to go first.
+	// Other sessions share the workload side by side.
+	superseded := s.matchingLocked(session)
+	for _, existing := range superseded {
+		if existing.Origin == contracts.SessionOriginResource {
+			return contracts.DebugSession{}, nil, fmt.Errorf("%w: %s/%s is held by DebugSession resource %s",
+				ErrSessionConflict, session.Namespace, session.Workload, existing.SessionID)
+		}
+		if !req.Force && !sameOwner(existing, req) {
+			return contracts.DebugSession{}, nil, fmt.Errorf("%w: %s/%s is already debugged by %s",
+				ErrSessionConflict, session.Namespace, session.Workload, DescribeOwner(existing))
+		}
+	}
+	for _, existing := range superseded {
+		delete(s.sessions, existing.SessionID)
+	}
+
+	session.SessionID = "sess_" + randomHex(8)
+	session.SessionToken = randomHex(16)
+	session.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	session.Origin = contracts.SessionOriginAPI
+
+	s.sessions[session.SessionID] = session
+	return session, superseded, nil
+}
+
+// Adopt registers a session declared outside the API (a DebugSession
+// resource), keeping its id and token; a missing token is generated. It
+// takes over API sessions for the same route the way a forced Create
+// does, but conflicts with another resource holding the route.
+func (s *DebugSessionRegistry) Adopt(session contracts.DebugSession) (contracts.DebugSession, []contracts.DebugSession, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	serviceName := strings.TrimSpace(req.ServiceName)
+	sessionID := sessionkey.Trim(session.SessionID)
+	if sessionID == "" {
+		return contracts.DebugSession{}, nil, errors.New("invalid session: session id is required")
+	}
+	normalized, err := normalizeSession(session)
+	if err != nil {
+		return contracts.DebugSession{}, nil, err
+	}
+	normalized.SessionID = sessionID
+	normalized.SessionToken = strings.TrimSpace(session.SessionToken)
+	if normalized.SessionToken == "" {
+		normalized.SessionToken = randomHex(16)
+	}
+	normalized.CreatedAt = session.CreatedAt
+	if normalized.CreatedAt == "" {
+		normalized.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	normalized.Origin = session.Origin
+
+	var superseded []contracts.DebugSession
+	for _, existing := range s.matchingLocked(normalized) {
+		if existing.SessionID == sessionID {
+			continue
+		}
+		if existing.Origin == contracts.SessionOriginResource {
+			return contracts.DebugSession{}, nil, fmt.Errorf("%w: %s/%s is held by DebugSession resource %s",
+				ErrSessionConflict, normalized.Namespace, normalized.Workload, existing.SessionID)
+		}
+		superseded = append(superseded, existing)
+	}
+	for _, existing := range superseded {
+		delete(s.sessions, existing.SessionID)
+	}
+
+	s.sessions[sessionID] = normalized
+	return normalized, superseded, nil
+}
+
+// matchingLocked returns the sessions serving the same route as session:
+// same workload, header set, mode, replica scope and injection.
+func (s *DebugSessionRegistry) matchingLocked(session contracts.DebugSession) []contracts.DebugSession {
+	var matching []contracts.DebugSession
+	for _, existing := range s.sessions {
+		if existing.Namespace == session.Namespace && existing.Workload == session.Workload &&
+			existing.Mode == session.Mode && existing.SingleReplica == session.SingleReplica &&
+			intercept.IsEphemeral(existing.Injection) == intercept.IsEphemeral(session.Injection) &&
+			intercept.EqualHeaders(existing.InterceptHeaders, session.InterceptHeaders) {
+			matching = append(matching, existing)
+		}
+	}
+	return matching
+}
+
+// normalizeSession validates the routing fields of a session and fills in
+// their defaults. Identity fields (id, token, creation time) are left to
+// the caller.
+func normalizeSession(session contracts.DebugSession) (contracts.DebugSession, error) {
+	serviceName := strings.TrimSpace(session.ServiceName)
 	if serviceName == "" {
 		return contracts.DebugSession{}, errors.New("invalid payload: service_name is required")
 	}
-	if req.ServicePort <= 0 {
+	if session.ServicePort == 0 && session.LocalPort == 0 && len(session.Ports) > 0 {
+		session.ServicePort, session.LocalPort = session.Ports[0].ServicePort, session.Ports[0].LocalPort
+	}
+	if session.ServicePort <= 0 {
 		return contracts.DebugSession{}, errors.New("invalid payload: service_port must be greater than 0")
 	}
-	if req.LocalPort <= 0 {
+	if session.LocalPort <= 0 {
 		return contracts.DebugSession{}, errors.New("invalid payload: local_port must be greater than 0")
 	}
+	if session.LeaseTTLSeconds < 0 {
+		return contracts.DebugSession{}, errors.New("invalid payload: lease_ttl_seconds must not be negative")
+	}
 
-	namespace := strings.TrimSpace(req.Namespace)
+	namespace := strings.TrimSpace(session.Namespace)
 	if namespace == "" {
 		namespace = "default"
 	}
-	workload := strings.TrimSpace(req.Workload)
+	workload := strings.TrimSpace(session.Workload)
 	if workload == "" {
 		workload = serviceName
 	}
 
-	// Supersede any earlier session for the same workload: the new sidecar
-	// injection overwrites the old one in place, so the old registry entry
-	// can only go stale (e.g. after a helper restart skipped the delete).
-	for sessionID, existing := range s.sessions {
-		if existing.Namespace == namespace && existing.Workload == workload {
-			delete(s.sessions, sessionID)
-		}
+	mode, err := intercept.NormalizeMode(session.Mode)
+	if err != nil {
+		return contracts.DebugSession{}, fmt.Errorf("invalid payload: %w", err)
 	}
-
-	session := contracts.DebugSession{
-		SessionID:    "sess_" + randomHex(8),
-		SessionToken: randomHex(16),
-		Namespace:    namespace,
-		ServiceName:  serviceName,
-		Workload:     workload,
-		ServicePort:  req.ServicePort,
-		LocalPort:    req.LocalPort,
-		ClientID:     strings.TrimSpace(req.ClientID),
-		CreatedAt:    time.Now().UTC().Format(time.RFC3339),
+	injection, err := intercept.NormalizeInjection(session.Injection)
+	if err != nil {
+		return contracts.DebugSession{}, fmt.Errorf("invalid payload: %w", err)
+	}
+	if session.SingleReplica && injection == contracts.SessionInjectionEphemeral {
+		// The clone is a new pod anyway; it gets a sidecar.
+		return contracts.DebugSession{}, errors.New("invalid payload: single_replica sessions use sidecar injection")
+	}
+	ports, err := intercept.NormalizePorts(session.ServicePort, session.LocalPort, session.Ports)
+	if err != nil {
+		return contracts.DebugSession{}, fmt.Errorf("invalid payload: %w", err)
+	}
+	udpTargets, err := NormalizeUDPTargets(session.UDPTargets)
+	if err != nil {
+		return contracts.DebugSession{}, fmt.Errorf("invalid payload: %w", err)
 	}
-	if session.ClientID == "" {
-		session.ClientID = "unknown"
+	if len(ports) == 1 {
+		// A single port needs no list.
+		ports = nil
 	}
 
-	s.sessions[session.SessionID] = session
-	return session, nil
+	normalized := contracts.DebugSession{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		Workload:    workload,
+		ServicePort: session.ServicePort,
+		LocalPort:   session.LocalPort,
+		ClientID:    strings.TrimSpace(session.ClientID),
+		KubeUser:    strings.TrimSpace(session.KubeUser),
+		Hostname:    strings.TrimSpace(session.Hostname),
+
+		InterceptHeaders: intercept.NormalizeHeaders(session.InterceptHeaders),
+		Mode:             mode,
+		SingleReplica:    session.SingleReplica,
+		Injection:        injection,
+		LeaseTTLSeconds:  session.LeaseTTLSeconds,
+		Ports:            ports,
+		UDPTargets:       udpTargets,
+	}
+	if normalized.ClientID == "" {
+		normalized.ClientID = "unknown"
+	}
+	return normalized, nil
 }
 
 func (s *DebugSessionRegistry) List() []contracts.DebugSession {
@@ -109,6 +261,21 @@ func (s *DebugSessionRegistry) Get(sessionID string) (contracts.DebugSession, bo
 	return debugSession, true
 }
 
+// Update replaces a registered session with a changed copy of it. It
+// returns false when the session is not registered.
+func (s *DebugSessionRegistry) Update(session contracts.DebugSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sessionkey.Trim(session.SessionID)
+	if _, ok := s.sessions[key]; key == "" || !ok {
+		return false
+	}
+	session.SessionID = key
+	s.sessions[key] = session
+	return true
+}
+
 func (s *DebugSessionRegistry) Delete(sessionID string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -124,12 +291,95 @@ func (s *DebugSessionRegistry) Delete(sessionID string) bool {
 	return true
 }
 
+// Restore adds previously persisted sessions as-is, keeping their ids and
+// tokens so running sidecars and helpers can reattach.
+func (s *DebugSessionRegistry) Restore(sessions []contracts.DebugSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, debugSession := range sessions {
+		key := sessionkey.Trim(debugSession.SessionID)
+		if key == "" {
+			continue
+		}
+		debugSession.SessionID = key
+		s.sessions[key] = debugSession
+	}
+}
+
 func (s *DebugSessionRegistry) Clear() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.sessions = map[string]contracts.DebugSession{}
 }
 
+// DescribeOwner renders who owns a session, e.g. "alice@laptop".
+func DescribeOwner(session contracts.DebugSession) string {
+	owner := session.KubeUser
+	if owner == "" {
+		owner = session.ClientID
+	}
+	if owner == "" {
+		owner = "unknown"
+	}
+	if session.Hostname != "" {
+		owner += "@" + session.Hostname
+	}
+	return owner
+}
+
+// NormalizeUDPTarget lowercases a UDP target, defaults its namespace and
+// checks it names a cluster address: DNS labels and a port in range.
+func NormalizeUDPTarget(target contracts.UDPTarget) (contracts.UDPTarget, error) {
+	normalized := contracts.UDPTarget{
+		Namespace: strings.ToLower(cmp.Or(strings.TrimSpace(target.Namespace), "default")),
+		Service:   strings.ToLower(strings.TrimSpace(target.Service)),
+		Pod:       strings.ToLower(strings.TrimSpace(target.Pod)),
+		Port:      target.Port,
+	}
+	labels := []string{normalized.Service, normalized.Namespace}
+	if normalized.Pod != "" {
+		labels = append(labels, normalized.Pod)
+	}
+	for _, label := range labels {
+		if problems := validation.IsDNS1123Label(label); len(problems) > 0 {
+			return contracts.UDPTarget{}, fmt.Errorf("udp target: invalid name %q: %s", label, strings.Join(problems, "; "))
+		}
+	}
+	if normalized.Port < 1 || normalized.Port > 65535 {
+		return contracts.UDPTarget{}, fmt.Errorf("udp target: invalid port %d", normalized.Port)
+	}
+	return normalized, nil
+}
+
+// NormalizeUDPTargets normalizes every target and drops duplicates.
+func NormalizeUDPTargets(targets []contracts.UDPTarget) ([]contracts.UDPTarget, error) {
+	var normalized []contracts.UDPTarget
+	for _, target := range targets {
+		target, err := NormalizeUDPTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(normalized, target) {
+			normalized = append(normalized, target)
+		}
+	}
+	return normalized, nil
+}
+
+// sameOwner compares the owner a helper claims. None of it is verified;
+// the random client id keeps two helpers with the same user and hostname
+// apart.
+func sameOwner(existing contracts.DebugSession, req contracts.CreateDebugSessionRequest) bool {
+	clientID := strings.TrimSpace(req.ClientID)
+	if clientID == "" {
+		clientID = "unknown"
+	}
+	return existing.ClientID == clientID &&
+		existing.KubeUser == strings.TrimSpace(req.KubeUser) &&
+		existing.Hostname == strings.TrimSpace(req.Hostname)
+}
+
 func randomHex(length int) string {
 	buffer := make([]byte, length)
 	if _, err := rand.Read(buffer); err != nil {
@@ -1,6 +1,9 @@
 package session
 
 import (
+	"errors"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,7 +13,7 @@ import (
 func TestDebugSessionRegistryCreateListDelete(t *testing.T) {
 	registry := NewDebugSessionRegistry()
 
-	created, err := registry.Create(contracts.CreateDebugSessionRequest{
+	created, _, err := registry.Create(contracts.CreateDebugSessionRequest{
 		Namespace:   "default",
 		ServiceName: "svc-a",
 		ServicePort: 8080,
@@ -61,28 +64,28 @@ func TestDebugSessionRegistryCreateListDelete(t *testing.T) {
 func TestDebugSessionRegistryCreateValidationAndDefaults(t *testing.T) {
 	registry := NewDebugSessionRegistry()
 
-	if _, err := registry.Create(contracts.CreateDebugSessionRequest{
+	if _, _, err := registry.Create(contracts.CreateDebugSessionRequest{
 		ServicePort: 8080,
 		LocalPort:   5000,
 	}); err == nil {
 		t.Fatalf("expected validation error for missing service_name")
 	}
 
-	if _, err := registry.Create(contracts.CreateDebugSessionRequest{
+	if _, _, err := registry.Create(contracts.CreateDebugSessionRequest{
 		ServiceName: "svc-a",
 		LocalPort:   5000,
 	}); err == nil {
 		t.Fatalf("expected validation error for missing service_port")
 	}
 
-	if _, err := registry.Create(contracts.CreateDebugSessionRequest{
+	if _, _, err := registry.Create(contracts.CreateDebugSessionRequest{
 		ServiceName: "svc-a",
 		ServicePort: 8080,
 	}); err == nil {
 		t.Fatalf("expected validation error for missing local_port")
 	}
 
-	created, err := registry.Create(contracts.CreateDebugSessionRequest{
+	created, _, err := registry.Create(contracts.CreateDebugSessionRequest{
 		ServiceName: " svc-a ",
 		ServicePort: 8080,
 		LocalPort:   5000,
@@ -101,10 +104,89 @@ func TestDebugSessionRegistryCreateValidationAndDefaults(t *testing.T) {
 	}
 }
 
+func TestCreateKeepsEveryInterceptedPort(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+
+	created, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "svc-a",
+		Ports: []contracts.PortMapping{
+			{ServicePort: 8080, LocalPort: 5000},
+			{ServicePort: 9090, LocalPort: 5001},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected create to succeed, got %v", err)
+	}
+	if created.ServicePort != 8080 || created.LocalPort != 5000 {
+		t.Fatalf("expected the first mapping as primary port, got %d->%d", created.ServicePort, created.LocalPort)
+	}
+	if len(created.Ports) != 2 || created.Ports[1].ServicePort != 9090 {
+		t.Fatalf("expected both ports kept, got %v", created.Ports)
+	}
+
+	single, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "svc-b",
+		ServicePort: 8080,
+		LocalPort:   5000,
+		Ports:       []contracts.PortMapping{{ServicePort: 8080, LocalPort: 5000}},
+	})
+	if err != nil || single.Ports != nil {
+		t.Fatalf("expected a single port without a list, got %v err=%v", single.Ports, err)
+	}
+
+	if _, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "svc-c",
+		ServicePort: 8080,
+		LocalPort:   5000,
+		Ports:       []contracts.PortMapping{{ServicePort: 8080, LocalPort: 5001}},
+	}); err == nil {
+		t.Fatal("expected a container port mapped twice to be rejected")
+	}
+}
+
+func TestCreateNormalizesUDPTargets(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+
+	created, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "svc-a",
+		ServicePort: 8080,
+		LocalPort:   5000,
+		UDPTargets: []contracts.UDPTarget{
+			{Service: "StatsD", Port: 8125},
+			{Namespace: "default", Service: "statsd", Port: 8125},
+			{Namespace: "data", Service: "kafka", Pod: "kafka-0", Port: 9093},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected create to succeed, got %v", err)
+	}
+	want := []contracts.UDPTarget{
+		{Namespace: "default", Service: "statsd", Port: 8125},
+		{Namespace: "data", Service: "kafka", Pod: "kafka-0", Port: 9093},
+	}
+	if !slices.Equal(created.UDPTargets, want) {
+		t.Fatalf("unexpected udp targets %+v", created.UDPTargets)
+	}
+
+	for _, target := range []contracts.UDPTarget{
+		{Service: "statsd.example.com", Port: 8125},
+		{Service: "statsd", Port: 0},
+	} {
+		if _, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+			ServiceName: "svc-b",
+			ServicePort: 8080,
+			LocalPort:   5000,
+			UDPTargets:  []contracts.UDPTarget{target},
+		}); err == nil {
+			t.Fatalf("expected udp target %+v to be rejected", target)
+		}
+	}
+}
+
 func TestCreateSupersedesSessionForSameWorkload(t *testing.T) {
 	registry := NewDebugSessionRegistry()
 
-	first, err := registry.Create(contracts.CreateDebugSessionRequest{
+	first, _, err := registry.Create(contracts.CreateDebugSessionRequest{
 		Namespace:   "shop",
 		ServiceName: "orders-api",
 		ServicePort: 8080,
@@ -114,7 +196,7 @@ func TestCreateSupersedesSessionForSameWorkload(t *testing.T) {
 		t.Fatalf("create first: %v", err)
 	}
 
-	second, err := registry.Create(contracts.CreateDebugSessionRequest{
+	second, _, err := registry.Create(contracts.CreateDebugSessionRequest{
 		Namespace:   "shop",
 		ServiceName: "orders-api",
 		ServicePort: 8080,
@@ -134,7 +216,7 @@ func TestCreateSupersedesSessionForSameWorkload(t *testing.T) {
 		t.Fatalf("expected 1 session, got %d", got)
 	}
 
-	other, err := registry.Create(contracts.CreateDebugSessionRequest{
+	other, _, err := registry.Create(contracts.CreateDebugSessionRequest{
 		Namespace:   "other-ns",
 		ServiceName: "orders-api",
 		ServicePort: 8080,
@@ -150,3 +232,325 @@ func TestCreateSupersedesSessionForSameWorkload(t *testing.T) {
 		t.Fatal("other-namespace session must be active")
 	}
 }
+
+func TestCreateRejectsSessionOwnedBySomeoneElse(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+
+	alice, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		Namespace:   "shop",
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		ClientID:    "krun-helper",
+		KubeUser:    "alice",
+		Hostname:    "alice-laptop",
+	})
+	if err != nil {
+		t.Fatalf("create alice: %v", err)
+	}
+	if alice.KubeUser != "alice" || alice.Hostname != "alice-laptop" {
+		t.Fatalf("expected owner to be recorded, got %+v", alice)
+	}
+
+	bobRequest := contracts.CreateDebugSessionRequest{
+		Namespace:   "shop",
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		ClientID:    "krun-helper",
+		KubeUser:    "bob",
+		Hostname:    "bob-laptop",
+	}
+	_, _, err = registry.Create(bobRequest)
+	if !errors.Is(err, ErrSessionConflict) {
+		t.Fatalf("expected session conflict, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "alice@alice-laptop") {
+		t.Fatalf("expected conflict to name the owner, got %v", err)
+	}
+	if _, ok := registry.Get(alice.SessionID); !ok {
+		t.Fatal("a rejected create must keep the existing session")
+	}
+
+	bobRequest.Force = true
+	bob, superseded, err := registry.Create(bobRequest)
+	if err != nil {
+		t.Fatalf("forced create: %v", err)
+	}
+	if len(superseded) != 1 || superseded[0].SessionID != alice.SessionID {
+		t.Fatalf("expected alice's session to be superseded, got %+v", superseded)
+	}
+	if _, ok := registry.Get(alice.SessionID); ok {
+		t.Fatal("forced create must replace the existing session")
+	}
+	if _, ok := registry.Get(bob.SessionID); !ok {
+		t.Fatal("forced session must be active")
+	}
+}
+
+func TestCreateKeepsSessionsWithDifferentInterceptHeaders(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+
+	alice, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		Namespace:        "shop",
+		ServiceName:      "orders-api",
+		ServicePort:      8080,
+		LocalPort:        5005,
+		InterceptHeaders: map[string]string{"x-krun-intercept": "alice"},
+	})
+	if err != nil {
+		t.Fatalf("create alice: %v", err)
+	}
+	if alice.InterceptHeaders["X-Krun-Intercept"] != "alice" {
+		t.Fatalf("expected canonical intercept header, got %v", alice.InterceptHeaders)
+	}
+
+	bob, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		Namespace:        "shop",
+		ServiceName:      "orders-api",
+		ServicePort:      8080,
+		LocalPort:        5005,
+		InterceptHeaders: map[string]string{"X-Krun-Intercept": "bob"},
+	})
+	if err != nil {
+		t.Fatalf("create bob: %v", err)
+	}
+	if _, ok := registry.Get(alice.SessionID); !ok {
+		t.Fatal("session with different headers must not be superseded")
+	}
+
+	again, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		Namespace:        "shop",
+		ServiceName:      "orders-api",
+		ServicePort:      8080,
+		LocalPort:        5005,
+		InterceptHeaders: map[string]string{" X-KRUN-INTERCEPT ": "alice"},
+	})
+	if err != nil {
+		t.Fatalf("create alice again: %v", err)
+	}
+	if _, ok := registry.Get(alice.SessionID); ok {
+		t.Fatal("session with the same headers must be superseded")
+	}
+	if _, ok := registry.Get(bob.SessionID); !ok {
+		t.Fatal("bob's session must stay active")
+	}
+	if _, ok := registry.Get(again.SessionID); !ok {
+		t.Fatal("new alice session must be active")
+	}
+}
+
+func TestCreateKeepsMirrorAlongsideInterceptSession(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+
+	intercepting, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+	})
+	if err != nil {
+		t.Fatalf("create intercept session: %v", err)
+	}
+	if intercepting.Mode != contracts.SessionModeIntercept {
+		t.Fatalf("expected default intercept mode, got %q", intercepting.Mode)
+	}
+
+	mirroring, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		Mode:        contracts.SessionModeMirror,
+	})
+	if err != nil {
+		t.Fatalf("create mirror session: %v", err)
+	}
+	if _, ok := registry.Get(intercepting.SessionID); !ok {
+		t.Fatal("mirror session must not supersede the intercept session")
+	}
+	if mirroring.Mode != contracts.SessionModeMirror {
+		t.Fatalf("expected mirror mode, got %q", mirroring.Mode)
+	}
+
+	if _, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		Mode:        "tee",
+	}); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+func TestCreateKeepsSingleReplicaAlongsideWorkloadSession(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+
+	workload, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		ClientID:    "alice",
+	})
+	if err != nil {
+		t.Fatalf("create workload session: %v", err)
+	}
+	replica, superseded, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName:   "orders-api",
+		ServicePort:   8080,
+		LocalPort:     5005,
+		ClientID:      "bob",
+		SingleReplica: true,
+	})
+	if err != nil || len(superseded) != 0 {
+		t.Fatalf("expected the single-replica session beside the workload one, got superseded=%+v err=%v", superseded, err)
+	}
+	if !replica.SingleReplica {
+		t.Fatal("expected the session to keep its replica scope")
+	}
+	if _, ok := registry.Get(workload.SessionID); !ok {
+		t.Fatal("single-replica session must not supersede the workload session")
+	}
+}
+
+func TestCreateNormalizesInjection(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+
+	sidecar, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		ClientID:    "alice",
+	})
+	if err != nil {
+		t.Fatalf("create sidecar session: %v", err)
+	}
+	if sidecar.Injection != contracts.SessionInjectionSidecar {
+		t.Fatalf("expected sidecar injection by default, got %q", sidecar.Injection)
+	}
+	ephemeral, superseded, err := registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		ClientID:    "bob",
+		Injection:   "Ephemeral",
+	})
+	if err != nil || len(superseded) != 0 {
+		t.Fatalf("expected the ephemeral session beside the sidecar one, got superseded=%+v err=%v", superseded, err)
+	}
+	if ephemeral.Injection != contracts.SessionInjectionEphemeral {
+		t.Fatalf("expected ephemeral injection, got %q", ephemeral.Injection)
+	}
+
+	_, _, err = registry.Create(contracts.CreateDebugSessionRequest{
+		ServiceName:   "orders-api",
+		ServicePort:   8080,
+		LocalPort:     5005,
+		SingleReplica: true,
+		Injection:     contracts.SessionInjectionEphemeral,
+	})
+	if err == nil {
+		t.Fatal("expected single-replica ephemeral session to be rejected")
+	}
+}
+
+func TestRestoreKeepsSessionIdentity(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+	registry.Restore([]contracts.DebugSession{
+		{SessionID: " sess_a ", SessionToken: "token-a", Namespace: "default", Workload: "orders-api"},
+		{SessionID: "  "},
+	})
+
+	list := registry.List()
+	if len(list) != 1 {
+		t.Fatalf("expected one restored session, got %+v", list)
+	}
+	restored, ok := registry.Get("sess_a")
+	if !ok || restored.SessionToken != "token-a" {
+		t.Fatalf("expected restored session to keep its token, got %+v", restored)
+	}
+}
+
+func TestUpdateReplacesRegisteredSessionsOnly(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+	created, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		Namespace:   "default",
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5000,
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	created.InterceptStrategy = contracts.InterceptStrategyAfterIstioProxy
+	if !registry.Update(created) {
+		t.Fatalf("expected the registered session to be updated")
+	}
+	updated, ok := registry.Get(created.SessionID)
+	if !ok || updated.InterceptStrategy != contracts.InterceptStrategyAfterIstioProxy {
+		t.Fatalf("expected the update to be kept, got %+v", updated)
+	}
+
+	if registry.Update(contracts.DebugSession{SessionID: "sess_missing"}) {
+		t.Fatalf("expected an unknown session not to be updated")
+	}
+	if len(registry.List()) != 1 {
+		t.Fatalf("expected no session added by updates, got %+v", registry.List())
+	}
+}
+
+func TestAdoptTakesOverAPISessionsButNotResources(t *testing.T) {
+	registry := NewDebugSessionRegistry()
+
+	apiSession, _, err := registry.Create(contracts.CreateDebugSessionRequest{
+		Namespace:   "shop",
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		KubeUser:    "alice",
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if apiSession.Origin != contracts.SessionOriginAPI {
+		t.Fatalf("expected api origin, got %q", apiSession.Origin)
+	}
+
+	declared := contracts.DebugSession{
+		SessionID:   "shop.orders-debug",
+		Namespace:   "shop",
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		Origin:      contracts.SessionOriginResource,
+	}
+	adopted, superseded, err := registry.Adopt(declared)
+	if err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+	if adopted.SessionID != "shop.orders-debug" || adopted.SessionToken == "" || adopted.Workload != "orders-api" {
+		t.Fatalf("expected adopted session to keep its id and get a token, got %+v", adopted)
+	}
+	if len(superseded) != 1 || superseded[0].SessionID != apiSession.SessionID {
+		t.Fatalf("expected api session to be superseded, got %+v", superseded)
+	}
+
+	// Adopting the same resource again is not a conflict with itself.
+	if _, superseded, err := registry.Adopt(adopted); err != nil || len(superseded) != 0 {
+		t.Fatalf("re-adopt: superseded=%+v err=%v", superseded, err)
+	}
+
+	declared.SessionID = "shop.other-debug"
+	if _, _, err := registry.Adopt(declared); !errors.Is(err, ErrSessionConflict) {
+		t.Fatalf("expected a second resource for the route to conflict, got %v", err)
+	}
+	_, _, err = registry.Create(contracts.CreateDebugSessionRequest{
+		Namespace:   "shop",
+		ServiceName: "orders-api",
+		ServicePort: 8080,
+		LocalPort:   5005,
+		Force:       true,
+	})
+	if !errors.Is(err, ErrSessionConflict) {
+		t.Fatalf("expected forced create to conflict with a resource session, got %v", err)
+	}
+}
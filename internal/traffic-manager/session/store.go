@@ -0,0 +1,185 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Store keeps debug sessions outside the manager process so they survive a
+// manager restart.
+type Store interface {
+	Load(ctx context.Context) ([]contracts.DebugSession, error)
+	// Put stores or replaces one session.
+	Put(ctx context.Context, session contracts.DebugSession) error
+	// Delete forgets one session; deleting an unknown session is not an
+	// error.
+	Delete(ctx context.Context, session contracts.DebugSession) error
+}
+
+type NoopStore struct{}
+
+func (NoopStore) Load(context.Context) ([]contracts.DebugSession, error) {
+	return nil, nil
+}
+
+func (NoopStore) Put(context.Context, contracts.DebugSession) error {
+	return nil
+}
+
+func (NoopStore) Delete(context.Context, contracts.DebugSession) error {
+	return nil
+}
+
+// SecretStore persists sessions in a single Secret, one JSON-encoded
+// session per key (keyed by session id). A Secret because the sessions
+// carry their tokens: whoever reads one can attach to the session's
+// stream.
+type SecretStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func NewSecretStore(client kubernetes.Interface, namespace string, name string) *SecretStore {
+	return &SecretStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func (s *SecretStore) Load(ctx context.Context) ([]contracts.DebugSession, error) {
+	if err := s.migrateConfigMap(ctx); err != nil {
+		return nil, err
+	}
+
+	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get sessions secret: %w", err)
+	}
+
+	sessions := make([]contracts.DebugSession, 0, len(secret.Data))
+	for key, value := range secret.Data {
+		var debugSession contracts.DebugSession
+		if err := json.Unmarshal(value, &debugSession); err != nil {
+			log.Printf("skipping unreadable stored session %s: %v", key, err)
+			continue
+		}
+		if strings.TrimSpace(debugSession.SessionID) == "" {
+			continue
+		}
+		sessions = append(sessions, debugSession)
+	}
+	slices.SortFunc(sessions, func(a, b contracts.DebugSession) int {
+		return strings.Compare(a.SessionID, b.SessionID)
+	})
+	return sessions, nil
+}
+
+func (s *SecretStore) Put(ctx context.Context, session contracts.DebugSession) error {
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("encode session %s: %w", session.SessionID, err)
+	}
+	return s.update(ctx, func(data map[string][]byte) {
+		data[session.SessionID] = encoded
+	})
+}
+
+func (s *SecretStore) Delete(ctx context.Context, session contracts.DebugSession) error {
+	return s.update(ctx, func(data map[string][]byte) {
+		delete(data, session.SessionID)
+	})
+}
+
+// migrateConfigMap moves the sessions an older manager kept in a
+// ConfigMap of the same name into the Secret, and deletes the ConfigMap
+// with the tokens in it. Sessions already in the Secret win.
+func (s *SecretStore) migrateConfigMap(ctx context.Context) error {
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get legacy sessions configmap: %w", err)
+	}
+
+	if len(configMap.Data) > 0 {
+		err := s.update(ctx, func(data map[string][]byte) {
+			for key, value := range configMap.Data {
+				if _, ok := data[key]; !ok {
+					data[key] = []byte(value)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := configMaps.Delete(ctx, s.name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete legacy sessions configmap: %w", err)
+	}
+	log.Printf("moved %d stored sessions from configmap %s/%s to a secret", len(configMap.Data), s.namespace, s.name)
+	return nil
+}
+
+// update applies mutate to the Secret data, creating the Secret on first
+// use. Each call changes a single key, so concurrent writers only retry on
+// conflict instead of overwriting each other.
+func (s *SecretStore) update(ctx context.Context, mutate func(data map[string][]byte)) error {
+	secrets := s.client.CoreV1().Secrets(s.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := secrets.Get(ctx, s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			data := map[string][]byte{}
+			mutate(data)
+			_, err = secrets.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: data,
+			}, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Surface as a conflict so the retry picks up the new object.
+				return apierrors.NewConflict(corev1.Resource("secrets"), s.name, err)
+			}
+			if err != nil {
+				return fmt.Errorf("create sessions secret: %w", err)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("get sessions secret: %w", err)
+		}
+
+		updated := secret.DeepCopy()
+		if updated.Data == nil {
+			updated.Data = map[string][]byte{}
+		}
+		mutate(updated.Data)
+		if _, err := secrets.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			if apierrors.IsConflict(err) {
+				return err
+			}
+			return fmt.Errorf("update sessions secret: %w", err)
+		}
+		return nil
+	})
+}
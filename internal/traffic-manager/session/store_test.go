@@ -0,0 +1,97 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretStoreRoundTrip(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := NewSecretStore(client, "krun-system", "krun-sessions")
+
+	loaded, err := store.Load(context.Background())
+	if err != nil {
+		t.Fatalf("load without secret: %v", err)
+	}
+	if len(loaded) != 0 {
+		t.Fatalf("expected no sessions, got %+v", loaded)
+	}
+
+	sessions := []contracts.DebugSession{
+		{SessionID: "sess_b", SessionToken: "token-b", Namespace: "default", Workload: "billing-api", ServicePort: 8080},
+		{
+			SessionID:        "sess_a",
+			SessionToken:     "token-a",
+			Namespace:        "default",
+			Workload:         "orders-api",
+			ServicePort:      8080,
+			InterceptHeaders: map[string]string{"X-Krun-Intercept": "alice"},
+			Mode:             contracts.SessionModeMirror,
+		},
+	}
+	for _, debugSession := range sessions {
+		if err := store.Put(context.Background(), debugSession); err != nil {
+			t.Fatalf("put %s: %v", debugSession.SessionID, err)
+		}
+	}
+
+	loaded, err = store.Load(context.Background())
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(loaded) != 2 || loaded[0].SessionID != "sess_a" || loaded[1].SessionID != "sess_b" {
+		t.Fatalf("unexpected loaded sessions: %+v", loaded)
+	}
+	if loaded[0].InterceptHeaders["X-Krun-Intercept"] != "alice" || loaded[0].Mode != contracts.SessionModeMirror {
+		t.Fatalf("expected headers and mode to round-trip, got %+v", loaded[0])
+	}
+
+	if err := store.Delete(context.Background(), sessions[1]); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := store.Delete(context.Background(), contracts.DebugSession{SessionID: "sess_unknown"}); err != nil {
+		t.Fatalf("delete unknown session: %v", err)
+	}
+	secret, err := client.CoreV1().Secrets("krun-system").Get(context.Background(), "krun-sessions", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get secret: %v", err)
+	}
+	if len(secret.Data) != 1 || len(secret.Data["sess_b"]) == 0 {
+		t.Fatalf("expected only sess_b to remain stored, got %v", secret.Data)
+	}
+}
+
+func TestSecretStoreMovesSessionsOutOfConfigMap(t *testing.T) {
+	legacy := contracts.DebugSession{SessionID: "sess_a", SessionToken: "token-a", Namespace: "default", Workload: "orders-api", ServicePort: 8080}
+	stale := contracts.DebugSession{SessionID: "sess_b", SessionToken: "token-old", Namespace: "default", Workload: "billing-api", ServicePort: 8080}
+	encodedLegacy, _ := json.Marshal(legacy)
+	encodedStale, _ := json.Marshal(stale)
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "krun-sessions", Namespace: "krun-system"},
+		Data:       map[string]string{"sess_a": string(encodedLegacy), "sess_b": string(encodedStale)},
+	})
+	store := NewSecretStore(client, "krun-system", "krun-sessions")
+	current := stale
+	current.SessionToken = "token-b"
+	if err := store.Put(context.Background(), current); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	loaded, err := store.Load(context.Background())
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(loaded) != 2 || loaded[0].SessionToken != "token-a" || loaded[1].SessionToken != "token-b" {
+		t.Fatalf("expected the configmap sessions moved over without replacing stored ones, got %+v", loaded)
+	}
+	if _, err := client.CoreV1().ConfigMaps("krun-system").Get(context.Background(), "krun-sessions", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the configmap holding tokens deleted, got %v", err)
+	}
+}
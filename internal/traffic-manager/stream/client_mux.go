@@ -0,0 +1,183 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/sessionkey"
+	"github.com/ftechmax/krun/internal/streamcodec"
+	"github.com/ftechmax/krun/internal/wskeepalive"
+	"github.com/gorilla/websocket"
+)
+
+// AuthorizeFunc checks an attach request of a multiplexed client stream
+// and returns the id of the session to relay.
+type AuthorizeFunc func(sessionID string, sessionToken string) (string, error)
+
+// clientMux is one helper stream carrying the client side of many
+// sessions. Every attached session is a client peer of its own that shares
+// the stream's connection and send queue.
+type clientMux struct {
+	conn   *websocket.Conn
+	sendCh chan contracts.StreamEnvelope
+
+	mu    sync.Mutex
+	peers map[string]*relayPeer
+}
+
+// ServeClientMux relays every session a helper attaches over conn until the
+// stream ends, then detaches them all.
+func (h *SessionRelayRegistry) ServeClientMux(conn *websocket.Conn, authorize AuthorizeFunc) {
+	mux := &clientMux{
+		conn:   conn,
+		sendCh: make(chan contracts.StreamEnvelope, peerSendQueueSize),
+		peers:  map[string]*relayPeer{},
+	}
+	defer func() {
+		for _, peer := range mux.takeAll() {
+			h.unregister(peer)
+		}
+	}()
+	defer conn.Close()
+
+	wskeepalive.Configure(conn)
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go wskeepalive.Ping(conn, pingDone)
+
+	readErrCh := make(chan error, 1)
+	envelopeCh := make(chan contracts.StreamEnvelope, 128)
+	go func() {
+		for {
+			envelope, err := streamcodec.Read(conn)
+			if err != nil {
+				readErrCh <- err
+				return
+			}
+			envelopeCh <- envelope
+		}
+	}()
+
+	for {
+		select {
+		case envelope := <-envelopeCh:
+			h.routeFromMux(mux, envelope, authorize)
+		case outbound := <-mux.sendCh:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := streamcodec.Write(conn, outbound); err != nil {
+				return
+			}
+		case <-readErrCh:
+			return
+		}
+	}
+}
+
+func (h *SessionRelayRegistry) routeFromMux(mux *clientMux, envelope contracts.StreamEnvelope, authorize AuthorizeFunc) {
+	sessionID := sessionkey.Trim(envelope.SessionID)
+	switch envelope.Type {
+	case contracts.StreamTypeAttach:
+		attachedID, err := authorize(sessionID, envelope.SessionToken)
+		if err == nil && sessionkey.Trim(attachedID) == "" {
+			err = errors.New("session id is required")
+		}
+		if err != nil {
+			mux.reply(contracts.StreamEnvelope{
+				Type:      contracts.StreamTypeError,
+				SessionID: sessionID,
+				Message:   err.Error(),
+			})
+			return
+		}
+		attachedID = sessionkey.Trim(attachedID)
+		// Acknowledge first so the helper learns of the attach before any
+		// envelope the session's agents send.
+		mux.reply(contracts.StreamEnvelope{Type: contracts.StreamTypeAttached, SessionID: attachedID})
+		if peer, added := mux.add(attachedID, envelope.Metadata[contracts.StreamMetadataFeatures]); added {
+			h.register(peer)
+		}
+	case contracts.StreamTypeDetach:
+		if peer := mux.remove(sessionID); peer != nil {
+			h.unregister(peer)
+		}
+	default:
+		// Envelopes of sessions this stream does not carry are dropped,
+		// like envelopes sent before a per-session stream attached.
+		if peer := mux.peer(sessionID); peer != nil {
+			h.routeFromPeer(peer, envelope)
+		}
+	}
+}
+
+// reply queues an envelope without waiting: the caller is the loop that
+// drains the queue. A stream that far behind is closed instead.
+func (m *clientMux) reply(envelope contracts.StreamEnvelope) {
+	select {
+	case m.sendCh <- envelope:
+	default:
+		_ = m.conn.Close()
+	}
+}
+
+func (m *clientMux) add(sessionID string, features string) (*relayPeer, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if peer, ok := m.peers[sessionID]; ok {
+		return peer, false
+	}
+	peer := &relayPeer{
+		role:      contracts.StreamRoleClient,
+		sessionID: sessionID,
+		conn:      m.conn,
+		sendCh:    m.sendCh,
+		mux:       m,
+		openAck:   hasFeature(features, contracts.StreamFeatureOpenAck),
+	}
+	m.peers[sessionID] = peer
+	return peer, true
+}
+
+func (m *clientMux) peer(sessionID string) *relayPeer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.peers[sessionID]
+}
+
+func (m *clientMux) remove(sessionID string) *relayPeer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peer, ok := m.peers[sessionID]
+	if !ok {
+		return nil
+	}
+	delete(m.peers, sessionID)
+	return peer
+}
+
+// drop detaches a peer another client displaced, keeping the stream
+// serving the stream's other sessions.
+func (m *clientMux) drop(peer *relayPeer) {
+	m.mu.Lock()
+	if m.peers[peer.sessionID] == peer {
+		delete(m.peers, peer.sessionID)
+	}
+	m.mu.Unlock()
+	m.reply(contracts.StreamEnvelope{
+		Type:      contracts.StreamTypeDetach,
+		SessionID: peer.sessionID,
+		Message:   "another client stream attached to the session",
+	})
+}
+
+func (m *clientMux) takeAll() []*relayPeer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := make([]*relayPeer, 0, len(m.peers))
+	for _, peer := range m.peers {
+		peers = append(peers, peer)
+	}
+	m.peers = map[string]*relayPeer{}
+	return peers
+}
@@ -0,0 +1,170 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/streamcodec"
+	"github.com/gorilla/websocket"
+)
+
+func allowTokens(tokens map[string]string) AuthorizeFunc {
+	return func(sessionID string, sessionToken string) (string, error) {
+		token, ok := tokens[sessionID]
+		if !ok {
+			return "", errors.New("session not found")
+		}
+		if token != sessionToken {
+			return "", errors.New("invalid session token")
+		}
+		return sessionID, nil
+	}
+}
+
+func newTestMux() *clientMux {
+	return &clientMux{
+		sendCh: make(chan contracts.StreamEnvelope, 8),
+		peers:  map[string]*relayPeer{},
+	}
+}
+
+func drainMux(t *testing.T, mux *clientMux) contracts.StreamEnvelope {
+	t.Helper()
+	return drainOne(t, &relayPeer{sendCh: mux.sendCh})
+}
+
+func TestClientMuxAttachRoutesBySession(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	authorize := allowTokens(map[string]string{"sess_a": "ta", "sess_b": "tb"})
+	mux := newTestMux()
+	agentA := newTestPeer(contracts.StreamRoleAgent, "sess_a")
+	agentB := newTestPeer(contracts.StreamRoleAgent, "sess_b")
+	registry.register(agentA)
+	registry.register(agentB)
+
+	registry.routeFromMux(mux, contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeAttach,
+		SessionID:    "sess_a",
+		SessionToken: "ta",
+		Metadata:     map[string]string{contracts.StreamMetadataFeatures: contracts.StreamFeatureOpenAck},
+	}, authorize)
+	registry.routeFromMux(mux, contracts.StreamEnvelope{Type: contracts.StreamTypeAttach, SessionID: "sess_b", SessionToken: "wrong"}, authorize)
+	if envelope := drainMux(t, mux); envelope.Type != contracts.StreamTypeAttached || envelope.SessionID != "sess_a" {
+		t.Fatalf("expected attach ack for sess_a, got %+v", envelope)
+	}
+	if envelope := drainMux(t, mux); envelope.Type != contracts.StreamTypeError || envelope.SessionID != "sess_b" || envelope.ConnectionID != "" {
+		t.Fatalf("expected session-level refusal for sess_b, got %+v", envelope)
+	}
+	if !registry.ClientConnected("sess_a") || registry.ClientConnected("sess_b") {
+		t.Fatal("expected only the authorized session to have a client")
+	}
+
+	registry.routeFromPeer(agentA, contracts.StreamEnvelope{Type: contracts.StreamTypeOpen, ConnectionID: "conn-1"})
+	if envelope := drainMux(t, mux); envelope.Type != contracts.StreamTypeOpen || envelope.SessionID != "sess_a" {
+		t.Fatalf("expected open tagged with its session, got %+v", envelope)
+	}
+	registry.routeFromMux(mux, contracts.StreamEnvelope{Type: contracts.StreamTypeOpenAck, SessionID: "sess_a", ConnectionID: "conn-1"}, authorize)
+	if envelope := drainOne(t, agentA); envelope.Type != contracts.StreamTypeOpenAck {
+		t.Fatalf("expected ack routed to the session's agent, got %+v", envelope)
+	}
+	// Envelopes for a session the stream does not carry go nowhere.
+	registry.routeFromMux(mux, contracts.StreamEnvelope{Type: contracts.StreamTypeData, SessionID: "sess_b", ConnectionID: "conn-1"}, authorize)
+	assertNoEnvelope(t, agentB)
+
+	registry.routeFromMux(mux, contracts.StreamEnvelope{Type: contracts.StreamTypeDetach, SessionID: "sess_a"}, authorize)
+	if registry.ClientConnected("sess_a") {
+		t.Fatal("expected detach to drop the session's client")
+	}
+	if envelope := drainOne(t, agentA); envelope.Type != contracts.StreamTypeError {
+		t.Fatalf("expected the open connection to be torn down, got %+v", envelope)
+	}
+}
+
+func TestClientMuxAcksOpensForSessionsWithoutOpenAck(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	authorize := allowTokens(map[string]string{"sess_a": "ta"})
+	mux := newTestMux()
+	agent := newTestPeer(contracts.StreamRoleAgent, "sess_a")
+	registry.register(agent)
+
+	// An attach without features comes from a helper that never acks.
+	registry.routeFromMux(mux, contracts.StreamEnvelope{Type: contracts.StreamTypeAttach, SessionID: "sess_a", SessionToken: "ta"}, authorize)
+	drainMux(t, mux)
+
+	registry.routeFromPeer(agent, contracts.StreamEnvelope{Type: contracts.StreamTypeOpen, ConnectionID: "conn-1"})
+	if envelope := drainMux(t, mux); envelope.Type != contracts.StreamTypeOpen {
+		t.Fatalf("expected the open relayed to the helper, got %+v", envelope)
+	}
+	if envelope := drainOne(t, agent); envelope.Type != contracts.StreamTypeOpenAck || envelope.ConnectionID != "conn-1" {
+		t.Fatalf("expected the manager to ack the open, got %+v", envelope)
+	}
+}
+
+func TestClientMuxDisplacedSessionKeepsStream(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	authorize := allowTokens(map[string]string{"sess_a": "ta", "sess_b": "tb"})
+	mux := newTestMux()
+	registry.routeFromMux(mux, contracts.StreamEnvelope{Type: contracts.StreamTypeAttach, SessionID: "sess_a", SessionToken: "ta"}, authorize)
+	registry.routeFromMux(mux, contracts.StreamEnvelope{Type: contracts.StreamTypeAttach, SessionID: "sess_b", SessionToken: "tb"}, authorize)
+	drainMux(t, mux)
+	drainMux(t, mux)
+
+	registry.register(newTestPeer(contracts.StreamRoleClient, "sess_a"))
+
+	if envelope := drainMux(t, mux); envelope.Type != contracts.StreamTypeDetach || envelope.SessionID != "sess_a" {
+		t.Fatalf("expected the displaced session to be detached, got %+v", envelope)
+	}
+	if mux.peer("sess_a") != nil || mux.peer("sess_b") == nil {
+		t.Fatal("expected only the displaced session to leave the stream")
+	}
+	if !registry.ClientConnected("sess_b") {
+		t.Fatal("expected the other session to stay attached")
+	}
+}
+
+func TestServeClientMuxDetachesSessionsWhenStreamEnds(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: streamcodec.Subprotocols}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		registry.ServeClientMux(conn, allowTokens(map[string]string{"sess_a": "ta", "sess_b": "tb"}))
+	}))
+	defer server.Close()
+
+	conn, _, err := streamcodec.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	for _, attach := range []contracts.StreamEnvelope{
+		{Type: contracts.StreamTypeAttach, SessionID: "sess_a", SessionToken: "ta"},
+		{Type: contracts.StreamTypeAttach, SessionID: "sess_b", SessionToken: "tb"},
+	} {
+		if err := streamcodec.Write(conn, attach); err != nil {
+			t.Fatalf("write attach: %v", err)
+		}
+		if reply, err := streamcodec.Read(conn); err != nil || reply.Type != contracts.StreamTypeAttached {
+			t.Fatalf("expected attach ack, got %+v err=%v", reply, err)
+		}
+	}
+	if !registry.ClientConnected("sess_a") || !registry.ClientConnected("sess_b") {
+		t.Fatal("expected both sessions attached over one stream")
+	}
+
+	_ = conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for registry.ClientConnected("sess_a") || registry.ClientConnected("sess_b") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the sessions to detach with their stream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -7,6 +7,8 @@ import (
 
 	"github.com/ftechmax/krun/internal/contracts"
 	"github.com/ftechmax/krun/internal/sessionkey"
+	"github.com/ftechmax/krun/internal/streamcodec"
+	"github.com/ftechmax/krun/internal/streamconn"
 	"github.com/ftechmax/krun/internal/wskeepalive"
 	"github.com/gorilla/websocket"
 )
@@ -20,12 +22,32 @@ const (
 type SessionRelayRegistry struct {
 	mu       sync.Mutex
 	sessions map[string]*sessionRelay
+	// leases records when each session's client was last seen: on attach,
+	// on detach and on every envelope it sends (lease renewals included).
+	leases map[string]time.Time
+	// resumeTimeout is how long a resumable connection outlives the stream
+	// of either side.
+	resumeTimeout time.Duration
 }
 
 type sessionRelay struct {
-	client         *relayPeer
-	agents         map[*relayPeer]struct{}
-	connectionPeer map[string]*relayPeer
+	client      *relayPeer
+	agents      map[*relayPeer]struct{}
+	connections map[string]*relayConnection
+}
+
+// relayConnection routes one intercepted connection to the agent that
+// opened it. A connection both sides opened with a receive window can be
+// resumed: it is kept while the stream of either side is away, until the
+// sides exchange resume envelopes or resumeTimeout passes.
+type relayConnection struct {
+	// agent is nil while the agent's stream is away.
+	agent          *relayPeer
+	flowControlled bool
+	resumable      bool
+	suspended      bool
+	// suspensions counts suspensions, so an expiry only ends its own.
+	suspensions uint64
 }
 
 type relayPeer struct {
@@ -33,6 +55,11 @@ type relayPeer struct {
 	sessionID string
 	conn      *websocket.Conn
 	sendCh    chan contracts.StreamEnvelope
+	// mux is set for clients attached over a multiplexed stream, whose
+	// conn and sendCh are shared with the stream's other sessions.
+	mux *clientMux
+	// openAck is set for clients that ack opens themselves.
+	openAck bool
 }
 
 func (p *relayPeer) closeConn() {
@@ -41,18 +68,33 @@ func (p *relayPeer) closeConn() {
 	}
 }
 
+// displace drops a client that a newer one replaced. A multiplexed client
+// only loses this session.
+func (p *relayPeer) displace() {
+	if p.mux != nil {
+		p.mux.drop(p)
+		return
+	}
+	p.closeConn()
+}
+
 func NewSessionRelayRegistry() *SessionRelayRegistry {
 	return &SessionRelayRegistry{
-		sessions: map[string]*sessionRelay{},
+		sessions:      map[string]*sessionRelay{},
+		leases:        map[string]time.Time{},
+		resumeTimeout: streamconn.ResumeTimeout,
 	}
 }
 
-func (h *SessionRelayRegistry) ServePeer(role string, sessionID string, conn *websocket.Conn) {
+// ServePeer relays a per-session stream. features are the stream features
+// a client advertised (contracts.StreamMetadataFeatures).
+func (h *SessionRelayRegistry) ServePeer(role string, sessionID string, features string, conn *websocket.Conn) {
 	peer := &relayPeer{
 		role:      sessionkey.Trim(role),
 		sessionID: sessionkey.Trim(sessionID),
 		conn:      conn,
 		sendCh:    make(chan contracts.StreamEnvelope, peerSendQueueSize),
+		openAck:   hasFeature(features, contracts.StreamFeatureOpenAck),
 	}
 
 	h.register(peer)
@@ -68,8 +110,8 @@ func (h *SessionRelayRegistry) ServePeer(role string, sessionID string, conn *we
 	envelopeCh := make(chan contracts.StreamEnvelope, 128)
 	go func() {
 		for {
-			var envelope contracts.StreamEnvelope
-			if err := peer.conn.ReadJSON(&envelope); err != nil {
+			envelope, err := streamcodec.Read(peer.conn)
+			if err != nil {
 				readErrCh <- err
 				return
 			}
@@ -83,7 +125,7 @@ func (h *SessionRelayRegistry) ServePeer(role string, sessionID string, conn *we
 			h.routeFromPeer(peer, envelope)
 		case outbound := <-peer.sendCh:
 			_ = peer.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			if err := peer.conn.WriteJSON(outbound); err != nil {
+			if err := streamcodec.Write(peer.conn, outbound); err != nil {
 				return
 			}
 		case <-readErrCh:
@@ -100,9 +142,10 @@ func (h *SessionRelayRegistry) register(peer *relayPeer) {
 	switch peer.role {
 	case contracts.StreamRoleClient:
 		if session.client != nil {
-			session.client.closeConn()
+			session.client.displace()
 		}
 		session.client = peer
+		h.leases[peer.sessionID] = time.Now()
 	default:
 		session.agents[peer] = struct{}{}
 	}
@@ -128,59 +171,42 @@ func (h *SessionRelayRegistry) unregister(peer *relayPeer) {
 			break
 		}
 		session.client = nil
-		if len(session.connectionPeer) > 0 {
-			toAgent = map[*relayPeer][]contracts.StreamEnvelope{}
-			for connectionID, owner := range session.connectionPeer {
-				delete(session.connectionPeer, connectionID)
-				if owner == nil {
-					continue
-				}
-				toAgent[owner] = append(toAgent[owner],
-					contracts.StreamEnvelope{
-						Type:         contracts.StreamTypeError,
-						SessionID:    peer.sessionID,
-						ConnectionID: connectionID,
-						Message:      "helper stream disconnected",
-					},
-					contracts.StreamEnvelope{
-						Type:         contracts.StreamTypeClose,
-						SessionID:    peer.sessionID,
-						ConnectionID: connectionID,
-					},
-				)
+		// The idle countdown starts when the client goes away.
+		h.leases[peer.sessionID] = time.Now()
+		for connectionID, connection := range session.connections {
+			if connection.resumable {
+				h.suspendLocked(peer.sessionID, connectionID, connection)
+				continue
 			}
+			delete(session.connections, connectionID)
+			if connection.agent == nil {
+				continue
+			}
+			if toAgent == nil {
+				toAgent = map[*relayPeer][]contracts.StreamEnvelope{}
+			}
+			toAgent[connection.agent] = append(toAgent[connection.agent],
+				closeEnvelopes(peer.sessionID, connectionID, "helper stream disconnected")...)
 		}
 	default:
 		delete(session.agents, peer)
-		if len(session.connectionPeer) > 0 {
-			for connectionID, owner := range session.connectionPeer {
-				if owner != peer {
-					continue
-				}
-				delete(session.connectionPeer, connectionID)
-				if session.client != nil {
-					toClient = append(toClient,
-						contracts.StreamEnvelope{
-							Type:         contracts.StreamTypeError,
-							SessionID:    peer.sessionID,
-							ConnectionID: connectionID,
-							Message:      "agent stream disconnected",
-						},
-						contracts.StreamEnvelope{
-							Type:         contracts.StreamTypeClose,
-							SessionID:    peer.sessionID,
-							ConnectionID: connectionID,
-						},
-					)
-				}
+		for connectionID, connection := range session.connections {
+			if connection.agent != peer {
+				continue
+			}
+			if connection.resumable {
+				connection.agent = nil
+				h.suspendLocked(peer.sessionID, connectionID, connection)
+				continue
+			}
+			delete(session.connections, connectionID)
+			if session.client != nil {
+				toClient = append(toClient, closeEnvelopes(peer.sessionID, connectionID, "agent stream disconnected")...)
 			}
 		}
 	}
 	targetClient = session.client
-
-	if session.client == nil && len(session.agents) == 0 && len(session.connectionPeer) == 0 {
-		delete(h.sessions, peer.sessionID)
-	}
+	h.deleteIdleSessionLocked(peer.sessionID, session)
 	h.mu.Unlock()
 
 	if len(toClient) > 0 && targetClient != nil {
@@ -195,6 +221,41 @@ func (h *SessionRelayRegistry) unregister(peer *relayPeer) {
 	}
 }
 
+// suspendLocked keeps a resumable connection whose agent or client went
+// away, and arms its expiry.
+func (h *SessionRelayRegistry) suspendLocked(sessionID string, connectionID string, connection *relayConnection) {
+	if connection.suspended {
+		return
+	}
+	connection.suspended = true
+	connection.suspensions++
+	suspension := connection.suspensions
+	time.AfterFunc(h.resumeTimeout, func() {
+		h.expire(sessionID, connectionID, connection, suspension)
+	})
+}
+
+// expire drops a connection that was not resumed in time and closes it on
+// whichever side is still there.
+func (h *SessionRelayRegistry) expire(sessionID string, connectionID string, connection *relayConnection, suspension uint64) {
+	h.mu.Lock()
+	session, ok := h.sessions[sessionID]
+	if !ok || session.connections[connectionID] != connection || !connection.suspended || connection.suspensions != suspension {
+		h.mu.Unlock()
+		return
+	}
+	delete(session.connections, connectionID)
+	targets := []*relayPeer{session.client, connection.agent}
+	h.deleteIdleSessionLocked(sessionID, session)
+	h.mu.Unlock()
+
+	for _, target := range targets {
+		for _, envelope := range closeEnvelopes(sessionID, connectionID, "connection was not resumed in time") {
+			sendEnvelope(target, envelope)
+		}
+	}
+}
+
 func (h *SessionRelayRegistry) routeFromPeer(peer *relayPeer, envelope contracts.StreamEnvelope) {
 	envelope.SessionID = peer.sessionID
 	connectionID := strings.TrimSpace(envelope.ConnectionID)
@@ -214,35 +275,42 @@ func (h *SessionRelayRegistry) routeFromAgent(peer *relayPeer, envelope contract
 
 	h.mu.Lock()
 	session := h.ensureSessionLocked(peer.sessionID)
-	if envelope.Type == contracts.StreamTypeOpen && envelope.ConnectionID != "" {
-		session.connectionPeer[envelope.ConnectionID] = peer
-	}
-	if envelope.Type == contracts.StreamTypeClose || envelope.Type == contracts.StreamTypeError {
-		delete(session.connectionPeer, envelope.ConnectionID)
+	if envelope.ConnectionID != "" {
+		switch envelope.Type {
+		case contracts.StreamTypeOpen:
+			session.connections[envelope.ConnectionID] = &relayConnection{
+				agent:          peer,
+				flowControlled: envelope.Window > 0,
+			}
+		case contracts.StreamTypeClose, contracts.StreamTypeError:
+			delete(session.connections, envelope.ConnectionID)
+		case contracts.StreamTypeResume, contracts.StreamTypeResumed:
+			// The agent's stream is back; a connection the manager lost
+			// track of, e.g. across a restart, is picked up again.
+			connection := session.resumeConnectionLocked(envelope.ConnectionID)
+			connection.agent = peer
+			h.resumedLocked(peer.sessionID, envelope.ConnectionID, session, connection)
+		}
 	}
 
 	target = session.client
 	if target == nil && envelope.Type == contracts.StreamTypeOpen && envelope.ConnectionID != "" {
-		delete(session.connectionPeer, envelope.ConnectionID)
-		toAgent = []contracts.StreamEnvelope{
-			{
-				Type:         contracts.StreamTypeError,
-				SessionID:    peer.sessionID,
-				ConnectionID: envelope.ConnectionID,
-				Message:      "no helper client stream attached",
-			},
-			{
-				Type:         contracts.StreamTypeClose,
-				SessionID:    peer.sessionID,
-				ConnectionID: envelope.ConnectionID,
-			},
-		}
+		delete(session.connections, envelope.ConnectionID)
+		toAgent = closeEnvelopes(peer.sessionID, envelope.ConnectionID, "no helper client stream attached")
+	}
+	if target != nil && !target.openAck && envelope.Type == contracts.StreamTypeOpen && envelope.ConnectionID != "" {
+		// A helper from before open-ack never answers; the agent would hold
+		// every caller until it gives up. Ack for it, without flow control.
+		toAgent = append(toAgent, contracts.StreamEnvelope{
+			Type:         contracts.StreamTypeOpenAck,
+			SessionID:    peer.sessionID,
+			ConnectionID: envelope.ConnectionID,
+		})
 	}
 	h.mu.Unlock()
 
 	if target != nil {
 		sendEnvelope(target, envelope)
-		return
 	}
 	for _, response := range toAgent {
 		sendEnvelope(peer, response)
@@ -250,16 +318,31 @@ func (h *SessionRelayRegistry) routeFromAgent(peer *relayPeer, envelope contract
 }
 
 func (h *SessionRelayRegistry) routeFromClient(peer *relayPeer, envelope contracts.StreamEnvelope) {
-	if envelope.ConnectionID == "" {
-		return
-	}
-
 	var target *relayPeer
 	h.mu.Lock()
 	session := h.ensureSessionLocked(peer.sessionID)
-	target = session.connectionPeer[envelope.ConnectionID]
-	if envelope.Type == contracts.StreamTypeClose || envelope.Type == contracts.StreamTypeError {
-		delete(session.connectionPeer, envelope.ConnectionID)
+	if session.client == peer {
+		h.leases[peer.sessionID] = time.Now()
+	}
+	if envelope.ConnectionID == "" {
+		// Lease renewals and pings carry no connection; nothing to route.
+		h.mu.Unlock()
+		return
+	}
+	connection := session.connections[envelope.ConnectionID]
+	switch envelope.Type {
+	case contracts.StreamTypeOpenAck:
+		if connection != nil {
+			connection.resumable = connection.flowControlled && envelope.Window > 0
+		}
+	case contracts.StreamTypeClose, contracts.StreamTypeError:
+		delete(session.connections, envelope.ConnectionID)
+	case contracts.StreamTypeResume, contracts.StreamTypeResumed:
+		connection = session.resumeConnectionLocked(envelope.ConnectionID)
+		h.resumedLocked(peer.sessionID, envelope.ConnectionID, session, connection)
+	}
+	if connection != nil {
+		target = connection.agent
 	}
 	h.mu.Unlock()
 
@@ -269,19 +352,156 @@ func (h *SessionRelayRegistry) routeFromClient(peer *relayPeer, envelope contrac
 	sendEnvelope(target, envelope)
 }
 
+// resumeConnectionLocked returns the connection a resume envelope is for,
+// creating it when the manager no longer knows it.
+func (s *sessionRelay) resumeConnectionLocked(connectionID string) *relayConnection {
+	connection, ok := s.connections[connectionID]
+	if !ok {
+		connection = &relayConnection{flowControlled: true, resumable: true}
+		s.connections[connectionID] = connection
+	}
+	return connection
+}
+
+// resumedLocked ends the suspension of a connection once both its sides
+// are back; until then the resume waits for the missing side to send its
+// own.
+func (h *SessionRelayRegistry) resumedLocked(sessionID string, connectionID string, session *sessionRelay, connection *relayConnection) {
+	if connection.agent != nil && session.client != nil {
+		connection.suspended = false
+		return
+	}
+	h.suspendLocked(sessionID, connectionID, connection)
+}
+
+// RenewLease marks the session's client as seen now, e.g. when the session
+// is created or restored and no client had a chance to attach yet.
+func (h *SessionRelayRegistry) RenewLease(sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leases[sessionkey.Trim(sessionID)] = time.Now()
+}
+
+// LeaseRenewedAt returns when the session's client was last seen.
+func (h *SessionRelayRegistry) LeaseRenewedAt(sessionID string) (time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	renewedAt, ok := h.leases[sessionkey.Trim(sessionID)]
+	return renewedAt, ok
+}
+
+// ForgetLease drops the lease of a deleted session.
+func (h *SessionRelayRegistry) ForgetLease(sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.leases, sessionkey.Trim(sessionID))
+}
+
+// NotifySuperseded tells the session's helper that newOwner took the
+// session over. The helper stops its attachment in response.
+func (h *SessionRelayRegistry) NotifySuperseded(sessionID string, newOwner string) {
+	key := sessionkey.Trim(sessionID)
+	h.mu.Lock()
+	var client *relayPeer
+	if session, ok := h.sessions[key]; ok {
+		client = session.client
+	}
+	h.mu.Unlock()
+
+	sendEnvelope(client, contracts.StreamEnvelope{
+		Type:      contracts.StreamTypeSuperseded,
+		SessionID: key,
+		Message:   newOwner,
+	})
+}
+
+// ReleaseAgents tells the agents serving the session that it ended. Only
+// ephemeral agents are released this way; a sidecar leaves with the pod
+// template instead. An agent that is away learns it when its reconnect is
+// refused.
+func (h *SessionRelayRegistry) ReleaseAgents(sessionID string) {
+	key := sessionkey.Trim(sessionID)
+	h.mu.Lock()
+	var agents []*relayPeer
+	if session, ok := h.sessions[key]; ok {
+		for agent := range session.agents {
+			agents = append(agents, agent)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, agent := range agents {
+		sendEnvelope(agent, contracts.StreamEnvelope{
+			Type:      contracts.StreamTypeRelease,
+			SessionID: key,
+		})
+	}
+}
+
+// ClientConnected reports whether a helper client stream is attached to
+// the session.
+func (h *SessionRelayRegistry) ClientConnected(sessionID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	session, ok := h.sessions[sessionkey.Trim(sessionID)]
+	return ok && session.client != nil
+}
+
+// AgentConnected reports whether at least one traffic-agent stream is
+// attached to the session.
+func (h *SessionRelayRegistry) AgentConnected(sessionID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	session, ok := h.sessions[sessionkey.Trim(sessionID)]
+	return ok && len(session.agents) > 0
+}
+
 func (h *SessionRelayRegistry) ensureSessionLocked(sessionID string) *sessionRelay {
 	session, ok := h.sessions[sessionID]
 	if ok {
 		return session
 	}
 	session = &sessionRelay{
-		agents:         map[*relayPeer]struct{}{},
-		connectionPeer: map[string]*relayPeer{},
+		agents:      map[*relayPeer]struct{}{},
+		connections: map[string]*relayConnection{},
 	}
 	h.sessions[sessionID] = session
 	return session
 }
 
+func (h *SessionRelayRegistry) deleteIdleSessionLocked(sessionID string, session *sessionRelay) {
+	if session.client == nil && len(session.agents) == 0 && len(session.connections) == 0 {
+		delete(h.sessions, sessionID)
+	}
+}
+
+// closeEnvelopes tell one side of a connection that it is gone.
+func closeEnvelopes(sessionID string, connectionID string, message string) []contracts.StreamEnvelope {
+	return []contracts.StreamEnvelope{
+		{
+			Type:         contracts.StreamTypeError,
+			SessionID:    sessionID,
+			ConnectionID: connectionID,
+			Message:      message,
+		},
+		{
+			Type:         contracts.StreamTypeClose,
+			SessionID:    sessionID,
+			ConnectionID: connectionID,
+		},
+	}
+}
+
+// hasFeature reports whether a comma-separated feature list names feature.
+func hasFeature(features string, feature string) bool {
+	for _, candidate := range strings.Split(features, ",") {
+		if strings.TrimSpace(candidate) == feature {
+			return true
+		}
+	}
+	return false
+}
+
 func sendEnvelope(peer *relayPeer, envelope contracts.StreamEnvelope) {
 	if peer == nil {
 		return
@@ -1,10 +1,17 @@
 package stream
 
 import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ftechmax/krun/internal/contracts"
+	"github.com/ftechmax/krun/internal/streamcodec"
+	"github.com/gorilla/websocket"
 )
 
 func newTestPeer(role string, sessionID string) *relayPeer {
@@ -12,6 +19,7 @@ func newTestPeer(role string, sessionID string) *relayPeer {
 		role:      role,
 		sessionID: sessionID,
 		sendCh:    make(chan contracts.StreamEnvelope, 8),
+		openAck:   role == contracts.StreamRoleClient,
 	}
 }
 
@@ -93,6 +101,232 @@ func TestUnregisterActiveClientNotifiesAgents(t *testing.T) {
 	}
 }
 
+func TestRelayAcksOpensForClientsWithoutOpenAck(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	agent := newTestPeer(contracts.StreamRoleAgent, "sess_old")
+	client := newTestPeer(contracts.StreamRoleClient, "sess_old")
+	client.openAck = false
+	registry.register(agent)
+	registry.register(client)
+
+	registry.routeFromPeer(agent, contracts.StreamEnvelope{Type: contracts.StreamTypeOpen, ConnectionID: "conn-1", Window: 1024})
+	if envelope := drainOne(t, client); envelope.Type != contracts.StreamTypeOpen {
+		t.Fatalf("expected the open relayed to the client, got %+v", envelope)
+	}
+	envelope := drainOne(t, agent)
+	if envelope.Type != contracts.StreamTypeOpenAck || envelope.ConnectionID != "conn-1" || envelope.Window != 0 {
+		t.Fatalf("expected an ack without flow control on the client's behalf, got %+v", envelope)
+	}
+
+	// Clients that ack themselves get no help.
+	client.openAck = true
+	registry.routeFromPeer(agent, contracts.StreamEnvelope{Type: contracts.StreamTypeOpen, ConnectionID: "conn-2"})
+	drainOne(t, client)
+	assertNoEnvelope(t, agent)
+}
+
+func TestWindowUpdatesFollowTheirConnection(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	first := newTestPeer(contracts.StreamRoleAgent, "sess_w")
+	second := newTestPeer(contracts.StreamRoleAgent, "sess_w")
+	client := newTestPeer(contracts.StreamRoleClient, "sess_w")
+	registry.register(first)
+	registry.register(second)
+	registry.register(client)
+
+	registry.routeFromPeer(first, contracts.StreamEnvelope{Type: contracts.StreamTypeOpen, ConnectionID: "conn-1", Window: 1024})
+	registry.routeFromPeer(second, contracts.StreamEnvelope{Type: contracts.StreamTypeOpen, ConnectionID: "conn-2", Window: 1024})
+	if envelope := drainOne(t, client); envelope.Window != 1024 {
+		t.Fatalf("expected the advertised window to reach the client, got %+v", envelope)
+	}
+	drainOne(t, client)
+
+	registry.routeFromPeer(client, contracts.StreamEnvelope{Type: contracts.StreamTypeWindow, ConnectionID: "conn-2", Window: 512})
+	if envelope := drainOne(t, second); envelope.Type != contracts.StreamTypeWindow || envelope.Window != 512 {
+		t.Fatalf("expected window update on the owning agent, got %+v", envelope)
+	}
+	assertNoEnvelope(t, first)
+
+	registry.routeFromPeer(first, contracts.StreamEnvelope{Type: contracts.StreamTypeWindow, ConnectionID: "conn-1", Window: 256})
+	if envelope := drainOne(t, client); envelope.Type != contracts.StreamTypeWindow || envelope.Window != 256 {
+		t.Fatalf("expected window update on the client, got %+v", envelope)
+	}
+}
+
+// openResumable opens conn-1 from agent with both sides advertising a
+// receive window.
+func openResumable(t *testing.T, registry *SessionRelayRegistry, agent *relayPeer, client *relayPeer) {
+	t.Helper()
+	registry.routeFromPeer(agent, contracts.StreamEnvelope{Type: contracts.StreamTypeOpen, ConnectionID: "conn-1", Window: 64})
+	drainOne(t, client)
+	registry.routeFromPeer(client, contracts.StreamEnvelope{Type: contracts.StreamTypeOpenAck, ConnectionID: "conn-1", Window: 64})
+	drainOne(t, agent)
+}
+
+func TestResumableConnectionSurvivesAgentReconnect(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	agent := newTestPeer(contracts.StreamRoleAgent, "sess_a")
+	client := newTestPeer(contracts.StreamRoleClient, "sess_a")
+	registry.register(agent)
+	registry.register(client)
+	openResumable(t, registry, agent, client)
+
+	registry.unregister(agent)
+	assertNoEnvelope(t, client)
+	// Nothing reaches the agent while it is away.
+	registry.routeFromPeer(client, contracts.StreamEnvelope{Type: contracts.StreamTypeData, ConnectionID: "conn-1", Seq: 1})
+
+	reconnected := newTestPeer(contracts.StreamRoleAgent, "sess_a")
+	registry.register(reconnected)
+	registry.routeFromPeer(reconnected, contracts.StreamEnvelope{Type: contracts.StreamTypeResume, ConnectionID: "conn-1", Seq: 3})
+	if envelope := drainOne(t, client); envelope.Type != contracts.StreamTypeResume || envelope.Seq != 3 {
+		t.Fatalf("expected the agent's resume forwarded, got %+v", envelope)
+	}
+	registry.routeFromPeer(client, contracts.StreamEnvelope{Type: contracts.StreamTypeResumed, ConnectionID: "conn-1"})
+	if envelope := drainOne(t, reconnected); envelope.Type != contracts.StreamTypeResumed {
+		t.Fatalf("expected the helper's answer routed to the reconnected agent, got %+v", envelope)
+	}
+}
+
+func TestResumableConnectionSurvivesClientReconnect(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	agent := newTestPeer(contracts.StreamRoleAgent, "sess_a")
+	client := newTestPeer(contracts.StreamRoleClient, "sess_a")
+	registry.register(agent)
+	registry.register(client)
+	openResumable(t, registry, agent, client)
+
+	registry.unregister(client)
+	assertNoEnvelope(t, agent)
+
+	reconnected := newTestPeer(contracts.StreamRoleClient, "sess_a")
+	registry.register(reconnected)
+	registry.routeFromPeer(reconnected, contracts.StreamEnvelope{Type: contracts.StreamTypeResume, ConnectionID: "conn-1"})
+	if envelope := drainOne(t, agent); envelope.Type != contracts.StreamTypeResume {
+		t.Fatalf("expected the helper's resume forwarded, got %+v", envelope)
+	}
+	registry.routeFromPeer(agent, contracts.StreamEnvelope{Type: contracts.StreamTypeData, ConnectionID: "conn-1", Seq: 1})
+	if envelope := drainOne(t, reconnected); envelope.Type != contracts.StreamTypeData {
+		t.Fatalf("expected data routed to the reconnected client, got %+v", envelope)
+	}
+}
+
+func TestSuspendedConnectionExpires(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	registry.resumeTimeout = 20 * time.Millisecond
+	agent := newTestPeer(contracts.StreamRoleAgent, "sess_a")
+	client := newTestPeer(contracts.StreamRoleClient, "sess_a")
+	registry.register(agent)
+	registry.register(client)
+	openResumable(t, registry, agent, client)
+
+	registry.unregister(agent)
+	if envelope := drainOne(t, client); envelope.Type != contracts.StreamTypeError || envelope.ConnectionID != "conn-1" {
+		t.Fatalf("expected the connection to give up on its agent, got %+v", envelope)
+	}
+	if envelope := drainOne(t, client); envelope.Type != contracts.StreamTypeClose {
+		t.Fatalf("expected close after the error, got %+v", envelope)
+	}
+}
+
+func TestClientLeaseFollowsClientStream(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	if _, ok := registry.LeaseRenewedAt("sess_c"); ok {
+		t.Fatal("expected no lease before the client attaches")
+	}
+
+	client := newTestPeer(contracts.StreamRoleClient, "sess_c")
+	registry.register(client)
+	if !registry.ClientConnected("sess_c") {
+		t.Fatal("expected client to be reported as connected")
+	}
+	attachedAt, ok := registry.LeaseRenewedAt("sess_c")
+	if !ok {
+		t.Fatal("expected attach to renew the lease")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	registry.routeFromPeer(client, contracts.StreamEnvelope{Type: contracts.StreamTypeLease})
+	renewedAt, _ := registry.LeaseRenewedAt("sess_c")
+	if !renewedAt.After(attachedAt) {
+		t.Fatalf("expected lease envelope to renew the lease, got %v after %v", renewedAt, attachedAt)
+	}
+
+	registry.unregister(client)
+	if registry.ClientConnected("sess_c") {
+		t.Fatal("expected client to be reported as detached")
+	}
+	if _, ok := registry.LeaseRenewedAt("sess_c"); !ok {
+		t.Fatal("expected lease to outlive the client stream")
+	}
+
+	registry.ForgetLease("sess_c")
+	if _, ok := registry.LeaseRenewedAt("sess_c"); ok {
+		t.Fatal("expected lease to be forgotten")
+	}
+}
+
+func TestAgentConnectedFollowsAgentStreams(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	first := newTestPeer(contracts.StreamRoleAgent, "sess_e")
+	second := newTestPeer(contracts.StreamRoleAgent, "sess_e")
+	registry.register(first)
+	registry.register(second)
+	if !registry.AgentConnected("sess_e") {
+		t.Fatal("expected agents to be reported as connected")
+	}
+
+	registry.unregister(first)
+	if !registry.AgentConnected("sess_e") {
+		t.Fatal("expected the remaining agent to keep the session attached")
+	}
+	registry.unregister(second)
+	if registry.AgentConnected("sess_e") {
+		t.Fatal("expected no agent after both detached")
+	}
+}
+
+func TestNotifySupersededReachesClient(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	agent := newTestPeer(contracts.StreamRoleAgent, "sess_d")
+	client := newTestPeer(contracts.StreamRoleClient, "sess_d")
+	registry.register(agent)
+	registry.register(client)
+
+	registry.NotifySuperseded("sess_d", "bob@bob-laptop")
+
+	envelope := drainOne(t, client)
+	if envelope.Type != contracts.StreamTypeSuperseded || envelope.Message != "bob@bob-laptop" {
+		t.Fatalf("expected superseded envelope naming the new owner, got %+v", envelope)
+	}
+	assertNoEnvelope(t, agent)
+
+	// Without an attached client there is nobody to tell.
+	registry.NotifySuperseded("sess_unknown", "bob@bob-laptop")
+}
+
+func TestReleaseAgentsReachesEveryAgent(t *testing.T) {
+	registry := NewSessionRelayRegistry()
+	first := newTestPeer(contracts.StreamRoleAgent, "sess_e")
+	second := newTestPeer(contracts.StreamRoleAgent, "sess_e")
+	client := newTestPeer(contracts.StreamRoleClient, "sess_e")
+	registry.register(first)
+	registry.register(second)
+	registry.register(client)
+
+	registry.ReleaseAgents("sess_e")
+
+	for _, agent := range []*relayPeer{first, second} {
+		if envelope := drainOne(t, agent); envelope.Type != contracts.StreamTypeRelease || envelope.SessionID != "sess_e" {
+			t.Fatalf("expected release envelope, got %+v", envelope)
+		}
+	}
+	assertNoEnvelope(t, client)
+
+	// Agents that are away are refused on reconnect instead.
+	registry.ReleaseAgents("sess_unknown")
+}
+
 func TestSendEnvelopeWaitsForQueueDrain(t *testing.T) {
 	peer := &relayPeer{sendCh: make(chan contracts.StreamEnvelope, 1)}
 	peer.sendCh <- contracts.StreamEnvelope{ConnectionID: "first"}
@@ -117,3 +351,84 @@ func TestSendEnvelopeWaitsForQueueDrain(t *testing.T) {
 		t.Fatalf("expected second envelope, got %+v", envelope)
 	}
 }
+
+// benchmarkRelay pushes 32 KiB data envelopes from an agent through
+// ServePeer to the session's client over real websockets.
+func benchmarkRelay(b *testing.B, binary bool) {
+	registry := NewSessionRelayRegistry()
+	upgrader := websocket.Upgrader{Subprotocols: streamcodec.Subprotocols}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		registry.ServePeer(r.URL.Query().Get("role"), "sess_bench", contracts.StreamFeatureOpenAck, conn)
+	}))
+	defer server.Close()
+
+	dial := func(role string) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "?role=" + role
+		var conn *websocket.Conn
+		var err error
+		if binary {
+			conn, _, err = streamcodec.Dial(context.Background(), url, nil)
+		} else {
+			conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+		}
+		if err != nil {
+			b.Fatalf("dial %s: %v", role, err)
+		}
+		return conn
+	}
+	client := dial(contracts.StreamRoleClient)
+	defer client.Close()
+	for !registry.ClientConnected("sess_bench") {
+		time.Sleep(time.Millisecond)
+	}
+	agent := dial(contracts.StreamRoleAgent)
+	defer agent.Close()
+
+	if err := streamcodec.Write(agent, contracts.StreamEnvelope{Type: contracts.StreamTypeOpen, ConnectionID: "c1"}); err != nil {
+		b.Fatalf("write open: %v", err)
+	}
+	if _, err := streamcodec.Read(client); err != nil {
+		b.Fatalf("read open: %v", err)
+	}
+
+	data := contracts.StreamEnvelope{
+		Type:         contracts.StreamTypeData,
+		SessionID:    "sess_bench",
+		ConnectionID: "c1",
+		Data:         bytes.Repeat([]byte{0xa5}, 32*1024),
+	}
+	b.SetBytes(int64(len(data.Data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	readErr := make(chan error, 1)
+	go func() {
+		for range b.N {
+			if _, err := streamcodec.Read(client); err != nil {
+				readErr <- err
+				return
+			}
+		}
+		readErr <- nil
+	}()
+	for range b.N {
+		if err := streamcodec.Write(agent, data); err != nil {
+			b.Fatalf("write data: %v", err)
+		}
+	}
+	if err := <-readErr; err != nil {
+		b.Fatalf("read data: %v", err)
+	}
+}
+
+func BenchmarkRelayDataJSON(b *testing.B) {
+	benchmarkRelay(b, false)
+}
+
+func BenchmarkRelayDataBinary(b *testing.B) {
+	benchmarkRelay(b, true)
+}
@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ftechmax/krun/internal/wskeepalive"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxDatagramSize = 65535
+	udpWriteTimeout = 10 * time.Second
+)
+
+// RelayUDP carries datagrams between a helper's websocket and target, one
+// binary message per datagram, until either side ends. target is a
+// connected UDP socket, so only its replies come back.
+func RelayUDP(conn *websocket.Conn, target net.Conn) {
+	defer conn.Close()
+	defer target.Close()
+
+	wskeepalive.Configure(conn)
+	conn.SetReadLimit(maxDatagramSize)
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go wskeepalive.Ping(conn, pingDone)
+
+	go func() {
+		// Closing the websocket ends the read loop below once the target
+		// is gone.
+		defer conn.Close()
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, err := target.Read(buffer)
+			if err != nil {
+				// An ICMP port unreachable surfaces on the next read;
+				// the service may start listening later.
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					continue
+				}
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(udpWriteTimeout))
+			if err := conn.WriteMessage(websocket.BinaryMessage, buffer[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		messageType, datagram, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		// Datagrams may be lost; a failed write is not worth ending the
+		// flow over.
+		_, _ = target.Write(datagram)
+	}
+}
@@ -0,0 +1,66 @@
+package stream
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRelayUDPCarriesDatagramsBothWays(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(append([]byte("echo:"), buffer[:n]...), addr)
+		}
+	}()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, err := net.Dial("udp", echo.LocalAddr().String())
+		if err != nil {
+			t.Errorf("dial udp: %v", err)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			target.Close()
+			return
+		}
+		RelayUDP(conn, target)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer conn.Close()
+
+	for _, datagram := range []string{"first", "second"} {
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte(datagram)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		messageType, reply, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if messageType != websocket.BinaryMessage || string(reply) != "echo:"+datagram {
+			t.Fatalf("expected the echoed datagram, got %d %q", messageType, reply)
+		}
+	}
+}
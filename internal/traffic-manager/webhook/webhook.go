@@ -0,0 +1,187 @@
+// Package webhook sets up the traffic-manager's mutating admission webhook:
+// the self-signed certificate it serves with, and the
+// MutatingWebhookConfiguration that sends pod admissions to it.
+package webhook
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	ConfigurationName = "krun-traffic-agent-injector"
+	// Path is where the manager serves pod admission reviews.
+	Path = "/v1/admission/pods"
+
+	webhookName = "traffic-agent.krun.ftechmax.net"
+	// CertificateValidity is how long a generated certificate lasts. A new
+	// one is generated, and registered, on every manager start.
+	CertificateValidity = 365 * 24 * time.Hour
+)
+
+// Config tells the API server where the webhook is served.
+type Config struct {
+	ServiceNamespace string
+	ServiceName      string
+	ServicePort      int32
+	// IgnoredNamespaces are never sent to the webhook: the manager's own,
+	// and the system namespaces.
+	IgnoredNamespaces []string
+	// TargetLabelKey marks the pods the webhook is for; the creation of
+	// any other pod never reaches the manager.
+	TargetLabelKey string
+}
+
+// DNSNames are the names the API server may use to reach a Service.
+func DNSNames(namespace string, service string) []string {
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc.cluster.local",
+	}
+}
+
+// GenerateCertificate creates a self-signed serving certificate for
+// dnsNames. It returns the certificate to serve with and its PEM, which
+// the API server trusts as the webhook's CA bundle.
+func GenerateCertificate(dnsNames []string, now time.Time) (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("generate webhook key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("generate webhook certificate serial: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:              dnsNames,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("create webhook certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("encode webhook key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("load webhook certificate: %w", err)
+	}
+	return certificate, certPEM, nil
+}
+
+// Register creates the MutatingWebhookConfiguration, or points an existing
+// one at the current certificate.
+func Register(ctx context.Context, client kubernetes.Interface, config Config, caBundle []byte) error {
+	desired := buildConfiguration(config, caBundle)
+	configurations := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	existing, err := configurations.Get(ctx, ConfigurationName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := configurations.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("create mutating webhook configuration %s: %w", ConfigurationName, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get mutating webhook configuration %s: %w", ConfigurationName, err)
+	}
+
+	existing.Webhooks = desired.Webhooks
+	if _, err := configurations.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update mutating webhook configuration %s: %w", ConfigurationName, err)
+	}
+	return nil
+}
+
+// Deregister deletes the MutatingWebhookConfiguration, so the API server
+// stops calling a manager that is going away.
+func Deregister(ctx context.Context, client kubernetes.Interface) error {
+	err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(ctx, ConfigurationName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete mutating webhook configuration %s: %w", ConfigurationName, err)
+	}
+	return nil
+}
+
+// buildConfiguration sends the creation of the pods carrying the target
+// label outside the ignored namespaces to the manager. The webhook never
+// blocks a pod: when the manager is down, pods start without the agent.
+func buildConfiguration(config Config, caBundle []byte) *admissionregistrationv1.MutatingWebhookConfiguration {
+	failurePolicy := admissionregistrationv1.Ignore
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	reinvocationPolicy := admissionregistrationv1.IfNeededReinvocationPolicy
+	scope := admissionregistrationv1.NamespacedScope
+	timeoutSeconds := int32(5)
+	path := Path
+	port := config.ServicePort
+
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: ConfigurationName},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: webhookName,
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: config.ServiceNamespace,
+					Name:      config.ServiceName,
+					Path:      &path,
+					Port:      &port,
+				},
+				CABundle: caBundle,
+			},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"pods"},
+					Scope:       &scope,
+				},
+			}},
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      "kubernetes.io/metadata.name",
+					Operator: metav1.LabelSelectorOpNotIn,
+					Values:   config.IgnoredNamespaces,
+				}},
+			},
+			ObjectSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      config.TargetLabelKey,
+					Operator: metav1.LabelSelectorOpExists,
+				}},
+			},
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			ReinvocationPolicy:      &reinvocationPolicy,
+			TimeoutSeconds:          &timeoutSeconds,
+			AdmissionReviewVersions: []string{"v1"},
+		}},
+	}
+}
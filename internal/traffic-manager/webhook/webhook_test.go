@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGenerateCertificateVerifiesForServiceNames(t *testing.T) {
+	now := time.Now()
+	names := DNSNames("krun-system", "krun-traffic-manager")
+	certificate, caBundle, err := GenerateCertificate(names, now)
+	if err != nil {
+		t.Fatalf("generate certificate: %v", err)
+	}
+	if len(certificate.Certificate) != 1 {
+		t.Fatalf("expected one certificate in the chain, got %d", len(certificate.Certificate))
+	}
+
+	block, _ := pem.Decode(caBundle)
+	if block == nil {
+		t.Fatal("expected a PEM CA bundle")
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	for _, name := range names {
+		if _, err := parsed.Verify(x509.VerifyOptions{DNSName: name, Roots: roots, CurrentTime: now}); err != nil {
+			t.Fatalf("verify for %s: %v", name, err)
+		}
+	}
+	if _, err := parsed.Verify(x509.VerifyOptions{DNSName: "other.krun-system.svc", Roots: roots, CurrentTime: now}); err == nil {
+		t.Fatal("expected the certificate to be rejected for another name")
+	}
+}
+
+func TestRegisterCreatesAndUpdatesConfiguration(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	config := Config{
+		ServiceNamespace:  "krun-system",
+		ServiceName:       "krun-traffic-manager",
+		ServicePort:       443,
+		IgnoredNamespaces: []string{"krun-system", "kube-system"},
+		TargetLabelKey:    "krun.ftechmax.net/traffic-agent-target",
+	}
+
+	if err := Register(context.Background(), client, config, []byte("first")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := Register(context.Background(), client, config, []byte("second")); err != nil {
+		t.Fatalf("register again: %v", err)
+	}
+
+	configuration, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), ConfigurationName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get configuration: %v", err)
+	}
+	if len(configuration.Webhooks) != 1 {
+		t.Fatalf("expected one webhook, got %d", len(configuration.Webhooks))
+	}
+	hook := configuration.Webhooks[0]
+	if string(hook.ClientConfig.CABundle) != "second" {
+		t.Fatalf("expected the latest CA bundle, got %q", hook.ClientConfig.CABundle)
+	}
+	service := hook.ClientConfig.Service
+	if service == nil || service.Name != "krun-traffic-manager" || service.Namespace != "krun-system" ||
+		*service.Path != Path || *service.Port != 443 {
+		t.Fatalf("unexpected service reference: %+v", service)
+	}
+	if hook.FailurePolicy == nil || *hook.FailurePolicy != "Ignore" {
+		t.Fatalf("expected pods to be admitted when the manager is down, got %v", hook.FailurePolicy)
+	}
+	if values := hook.NamespaceSelector.MatchExpressions[0].Values; len(values) != 2 {
+		t.Fatalf("expected the ignored namespaces excluded, got %v", values)
+	}
+	if hook.ObjectSelector == nil || len(hook.ObjectSelector.MatchExpressions) != 1 ||
+		hook.ObjectSelector.MatchExpressions[0].Key != config.TargetLabelKey {
+		t.Fatalf("expected only labelled pods sent to the webhook, got %+v", hook.ObjectSelector)
+	}
+
+	if err := Deregister(context.Background(), client); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	if _, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), ConfigurationName, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the configuration deleted")
+	}
+	if err := Deregister(context.Background(), client); err != nil {
+		t.Fatalf("expected deregistering twice to succeed: %v", err)
+	}
+}
@@ -29,7 +29,7 @@ func Configure(conn *websocket.Conn) {
 }
 
 // Ping sends websocket ping control frames until done is closed or a write
-// fails. WriteControl is safe to call concurrently with WriteJSON, so this
+// fails. WriteControl is safe to call concurrently with data writes, so this
 // runs alongside the connection's pump loop.
 func Ping(conn *websocket.Conn, done <-chan struct{}) {
 	ticker := time.NewTicker(pingPeriod)